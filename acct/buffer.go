@@ -0,0 +1,112 @@
+package acct
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const buffer_ext = ".acr"
+
+// buffer keeps the records that could not be delivered in a directory, one
+// file per record named by its order, so they are resent after a restart
+// too. A record that was sent before is stored with the T flag, the others
+// without it until they are resent the first time.
+type buffer struct {
+	dir   string
+	next  uint64
+	files []string
+}
+
+func openBuffer(dir string) (*buffer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c_entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	b := &buffer{dir: dir}
+	for _, v := range c_entries {
+		if v.IsDir() || !strings.HasSuffix(v.Name(), buffer_ext) {
+			continue
+		}
+		c_no, err := strconv.ParseUint(strings.TrimSuffix(v.Name(), buffer_ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		b.files = append(b.files, v.Name())
+		if c_no >= b.next {
+			b.next = c_no + 1
+		}
+	}
+	sort.Strings(b.files)
+	return b, nil
+}
+
+// push stores msg after the others, sent tells it was sent before.
+func (b *buffer) push(msg d.Message, sent bool) error {
+	c_name := fmt.Sprintf("%020d%s", b.next, buffer_ext)
+	msg.Set_retransmit_flag(sent)
+	if err := b.write(c_name, msg); err != nil {
+		return err
+	}
+	b.next++
+	b.files = append(b.files, c_name)
+	return nil
+}
+
+// markSent stores the record file name with the T flag before it is sent
+// the first time.
+func (b *buffer) markSent(name string, msg d.Message) error {
+	msg.Set_retransmit_flag(true)
+	return b.write(name, msg)
+}
+
+func (b *buffer) write(name string, msg d.Message) error {
+	c_tmp := filepath.Join(b.dir, name+".tmp")
+	if err := ioutil.WriteFile(c_tmp, msg.Encode(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(c_tmp, filepath.Join(b.dir, name))
+}
+
+// first reads the oldest record, a file that cannot be decoded is dropped.
+func (b *buffer) first() (d.Message, string, bool) {
+	for len(b.files) != 0 {
+		c_name := b.files[0]
+		c_data, err := ioutil.ReadFile(filepath.Join(b.dir, c_name))
+		if err == nil {
+			var c_msg d.Message
+			if c_msg, err = d.DecodeMessage(c_data); err == nil {
+				return c_msg, c_name, true
+			}
+		}
+		l.Warn.Println("acct: dropped buffered record", c_name, err)
+		b.remove(c_name)
+	}
+	return d.Message{}, "", false
+}
+
+// remove deletes the record file name.
+func (b *buffer) remove(name string) {
+	for i, v := range b.files {
+		if v == name {
+			b.files = append(b.files[:i], b.files[i+1:]...)
+			break
+		}
+	}
+	if err := os.Remove(filepath.Join(b.dir, name)); err != nil && !os.IsNotExist(err) {
+		l.Warn.Println("acct: remove buffered record", name, err)
+	}
+}
+
+func (b *buffer) len() int {
+	return len(b.files)
+}
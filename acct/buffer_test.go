@@ -0,0 +1,184 @@
+package acct
+
+import (
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/internal/apptest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testRecord(id string) d.Message {
+	return d.GenMess(d.CC_ACCOUNTING, true, true, d.APPID_ACCT, 1, 1, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, id, d.MAND, 0),
+	})
+}
+
+func TestMain(m *testing.M) {
+	if err := d.InitWith("../dict", d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestBuffer(t *testing.T) {
+	c_dir := t.TempDir()
+	b, err := openBuffer(c_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.push(testRecord("a"), true); err != nil {
+		t.Fatal(err)
+	}
+	// a record that cannot be decoded and a file left by a failed push
+	if err := ioutil.WriteFile(filepath.Join(c_dir, fmt.Sprintf("%020d%s", 1, buffer_ext)), []byte("xx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(c_dir, fmt.Sprintf("%020d%s.tmp", 5, buffer_ext)), []byte("xx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records are kept over a restart, the new ones go after them
+	if b, err = openBuffer(c_dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.push(testRecord("b"), false); err != nil {
+		t.Fatal(err)
+	}
+	if b.len() != 3 {
+		t.Fatalf("%d records, want 3", b.len())
+	}
+
+	// the record sent before is stored with the T flag
+	for _, want := range []struct {
+		id   string
+		sent bool
+	}{{"a", true}, {"b", false}} {
+		c_msg, c_file, ok := b.first()
+		if !ok {
+			t.Fatalf("no record, want %s", want.id)
+		}
+		if got := app.SessionId(&c_msg); got != want.id {
+			t.Errorf("record %s, want %s", got, want.id)
+		}
+		if got := c_msg.GetCmdFlags()&0b00010000 != 0; got != want.sent {
+			t.Errorf("record %s: T flag %v, want %v", want.id, got, want.sent)
+		}
+		b.remove(c_file)
+	}
+	if _, _, ok := b.first(); ok || b.len() != 0 {
+		t.Errorf("%d records left", b.len())
+	}
+}
+
+func nextRequest(t *testing.T, send_ch chan d.Message) d.Message {
+	t.Helper()
+	select {
+	case ret := <-send_ch:
+		return ret
+	case <-time.After(time.Second):
+		t.Fatal("no record sent")
+	}
+	return d.Message{}
+}
+
+func noRequest(t *testing.T, send_ch chan d.Message) {
+	t.Helper()
+	select {
+	case ret := <-send_ch:
+		t.Fatalf("unexpected record of %s", app.SessionId(&ret))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func answerOf(acr d.Message, c_result uint32) d.Message {
+	return d.GenMess(d.CC_ACCOUNTING, false, true, d.APPID_ACCT, acr.Get_hop_by_hop(), acr.Get_end_to_end(), []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, app.SessionId(&acr), d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Result_Code, c_result, d.MAND, 0),
+	})
+}
+
+// TestReplay stores the records without answer, and resends them in their
+// order after a restart of the client. Only the records sent before have the
+// T flag.
+func TestReplay(t *testing.T) {
+	c_dir := t.TempDir()
+	c_conn := &apptest.Conn{}
+	send_ch := make(chan d.Message, 10)
+	c_conf := ClientConfig{Tx: 200 * time.Millisecond, Dir: c_dir, RetryInterval: time.Hour}
+	cl, err := NewClient(c_conn, send_ch, c_conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first record is refused by an agent, the others go after it
+	// without being sent
+	var c_ids []string
+	for i := 0; i < 3; i++ {
+		s := cl.NewSession()
+		c_ids = append(c_ids, s.Id())
+		if err := s.Event(nil); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			cl.Handle(answerOf(nextRequest(t, send_ch), d.UNABLE_TO_DELIVER))
+		} else {
+			noRequest(t, send_ch)
+		}
+		if got := cl.Buffered(); got != i+1 {
+			t.Fatalf("%d buffered records, want %d", got, i+1)
+		}
+	}
+	cl.Close()
+
+	cl, err = NewClient(c_conn, send_ch, c_conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if got := cl.Buffered(); got != 3 {
+		t.Fatalf("%d buffered records after the restart, want 3", got)
+	}
+	cl.Flush()
+	for i, c_step := range []struct {
+		record int
+		// result is the Result-Code of the answer, no answer if zero
+		result     uint32
+		left       int
+		retransmit bool
+	}{
+		{0, 0, 3, true},
+		{0, d.SUCCESS, 2, true},
+		{1, d.TOO_BUSY, 2, false},
+		{1, d.SUCCESS, 1, true},
+		{2, d.SUCCESS, 0, false},
+	} {
+		c_acr := nextRequest(t, send_ch)
+		if got := app.SessionId(&c_acr); got != c_ids[c_step.record] {
+			t.Errorf("step %d: record of %s, want %s", i, got, c_ids[c_step.record])
+		}
+		if got := c_acr.GetCmdFlags()&0b00010000 != 0; got != c_step.retransmit {
+			t.Errorf("step %d: T flag %v, want %v", i, got, c_step.retransmit)
+		}
+		// one record at a time
+		noRequest(t, send_ch)
+		if c_step.result != 0 {
+			cl.Handle(answerOf(c_acr, c_step.result))
+		} else {
+			time.Sleep(2 * c_conf.Tx)
+		}
+		if got := cl.Buffered(); got != c_step.left {
+			t.Errorf("step %d: %d buffered records, want %d", i, got, c_step.left)
+		}
+		if c_step.result == 0 || c_step.result == d.TOO_BUSY {
+			// the retry timer is not waited for
+			cl.Flush()
+		}
+	}
+	noRequest(t, send_ch)
+}
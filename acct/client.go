@@ -0,0 +1,368 @@
+// Package acct is the client side of Diameter accounting (RFC 6733 9, the
+// base of Rf), the START, INTERIM, STOP and EVENT records of the accounting
+// sessions.
+//
+// A Client sends the ACRs of its sessions on the send channel of a DiamConn
+// and gets the ACAs through Handle (or Run). The records are numbered by
+// Accounting-Record-Number within the session, the interim records follow
+// the Acct-Interim-Interval of the answer to the START record.
+//
+// A record without answer within Tx, or answered with UNABLE_TO_DELIVER or
+// TOO_BUSY, is stored in the buffer directory unless the server asked for
+// GRANT_AND_LOSE. While the buffer is not empty the new records go after
+// the stored ones. The stored records are resent in their order, every
+// RetryInterval or on Flush, also after a restart of the client. The T flag
+// is set on the records sent before.
+//
+// The CER of the DiamConn has to advertise base accounting, "acct_app_ids"
+// set to "3" in its diam_conf.
+//
+//	cl, err := acct.NewClient(&diam_conn, send_ch, acct.ClientConfig{Dir: "acct_buffer"})
+//	go cl.Run(rcv_ch, nil)
+//	s := cl.NewSession()
+//	s.Start(avps)
+//	s.Stop(avps)
+package acct
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+const (
+	default_tx    = 10 * time.Second
+	default_retry = 30 * time.Second
+)
+
+// ErrWrongState is returned for a record the session cannot send now, e.g.
+// an INTERIM before the START.
+var ErrWrongState = errors.New("record not allowed in this state")
+
+// Callbacks report to the application, every field may be nil. They are
+// called without locks held.
+type Callbacks struct {
+	// OnAnswer gets every ACA, s is nil for the records resent from the
+	// buffer.
+	OnAnswer func(s *Session, aca d.Message)
+	// OnBuffered tells a record of the session was stored in the buffer.
+	OnBuffered func(s *Session, acr d.Message)
+	// InterimAVPs gives the AVPs (e.g. the used octets) of the interim
+	// records the session sends by itself.
+	InterimAVPs func(s *Session) []d.AVP
+}
+
+// ClientConfig sets up a Client.
+type ClientConfig struct {
+	// Tx is the answer timeout, 10s if zero.
+	Tx time.Duration
+	// AppId is the Acct-Application-Id, base accounting if zero.
+	AppId uint32
+	// InterimInterval is sent in the START records as
+	// Acct-Interim-Interval and used until an answer gives another one.
+	InterimInterval time.Duration
+	// Dir keeps the undelivered records, they are lost if empty.
+	Dir string
+	// RetryInterval is the period of resending the stored records, 30s if
+	// zero.
+	RetryInterval time.Duration
+	Callbacks     Callbacks
+}
+
+// Client runs the accounting sessions of one connection.
+type Client struct {
+	base     app.Base
+	conf     ClientConfig
+	mtx      sync.Mutex
+	sessions map[string]*Session
+	pending  map[uint32]*record
+	buf      *buffer
+	// resending is the hop-by-hop of the stored record in flight, 0 if none.
+	resending   uint32
+	retry_timer *time.Timer
+}
+
+// record is an ACR waiting for its answer.
+type record struct {
+	s        *Session
+	msg      d.Message
+	timer    *time.Timer
+	realtime int32
+	// file is the buffer file of a resent record.
+	file string
+	// sent tells the record was transmitted.
+	sent bool
+}
+
+// NewClient creates a client sending on send_ch, the send channel of c. The
+// records left in the buffer directory are resent after RetryInterval.
+func NewClient(c app.Conn, send_ch chan d.Message, conf ClientConfig) (*Client, error) {
+	if conf.Tx <= 0 {
+		conf.Tx = default_tx
+	}
+	if conf.RetryInterval <= 0 {
+		conf.RetryInterval = default_retry
+	}
+	if conf.AppId == 0 {
+		conf.AppId = d.APPID_ACCT
+	}
+	cl := &Client{
+		base:     app.NewBase("acct client", c, send_ch),
+		conf:     conf,
+		sessions: make(map[string]*Session),
+		pending:  make(map[uint32]*record),
+	}
+	if conf.Dir != "" {
+		c_buf, err := openBuffer(conf.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("acct buffer: %w", err)
+		}
+		cl.buf = c_buf
+		if c_buf.len() != 0 {
+			l.Info.Println("acct:", c_buf.len(), "buffered records in", conf.Dir)
+			cl.scheduleRetry()
+		}
+	}
+	return cl, nil
+}
+
+// NewSession creates an idle session with a new Session-Id.
+func (cl *Client) NewSession() *Session {
+	return &Session{
+		cl:       cl,
+		id:       cl.base.Conn().Gen_Session_Id(),
+		interim:  cl.conf.InterimInterval,
+		realtime: d.ENUM_ACCOUNTING_REALTIME_GRANT_AND_STORE,
+	}
+}
+
+// Session returns the open session with the Session-Id id.
+func (cl *Client) Session(id string) (*Session, bool) {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	s, ok := cl.sessions[id]
+	return s, ok
+}
+
+// Buffered is the number of records in the buffer.
+func (cl *Client) Buffered() int {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	if cl.buf == nil {
+		return 0
+	}
+	return cl.buf.len()
+}
+
+// Run handles the messages of rcv_ch until it is closed. The messages that
+// are not for the client go to rest, or are dropped if rest is nil.
+func (cl *Client) Run(rcv_ch chan d.Message, rest chan d.Message) {
+	cl.base.Run(rcv_ch, rest, cl.Handle)
+}
+
+// Handle processes a received ACA, it returns false for other messages.
+func (cl *Client) Handle(msg d.Message) bool {
+	if msg.GetCmdCode() != d.CC_ACCOUNTING || !msg.IsAnswer() {
+		return false
+	}
+	var c_todo app.Todo
+	cl.mtx.Lock()
+	cl.answer(msg, &c_todo)
+	cl.mtx.Unlock()
+	c_todo.Run()
+	return true
+}
+
+// Flush resends the stored records now, e.g. when the connection is up
+// again.
+func (cl *Client) Flush() {
+	var c_todo app.Todo
+	cl.mtx.Lock()
+	cl.resendNext(&c_todo)
+	cl.mtx.Unlock()
+	c_todo.Run()
+}
+
+// Close stops the timers of the client and of its sessions, the records
+// waiting for answer are stored.
+func (cl *Client) Close() {
+	var c_todo app.Todo
+	cl.mtx.Lock()
+	if cl.retry_timer != nil {
+		cl.retry_timer.Stop()
+		cl.retry_timer = nil
+	}
+	for _, s := range cl.sessions {
+		s.stopInterim()
+	}
+	for k, v := range cl.pending {
+		v.timer.Stop()
+		delete(cl.pending, k)
+		if v.file == "" {
+			cl.store(v, &c_todo)
+		}
+	}
+	cl.resending = 0
+	cl.mtx.Unlock()
+	c_todo.Run()
+}
+
+// sendRecord sends msg of s, or stores it while the buffer is not empty.
+// It is called with the lock held.
+func (cl *Client) sendRecord(s *Session, msg d.Message, c_todo *app.Todo) {
+	c_rec := &record{s: s, msg: msg, realtime: s.realtime}
+	if cl.buf != nil && cl.buf.len() != 0 {
+		cl.store(c_rec, c_todo)
+		return
+	}
+	cl.transmit(c_rec, c_todo)
+}
+
+func (cl *Client) transmit(rec *record, c_todo *app.Todo) {
+	c_hop_by_hop := rec.msg.Get_hop_by_hop()
+	rec.timer = time.AfterFunc(cl.conf.Tx, func() {
+		cl.txExpired(c_hop_by_hop)
+	})
+	cl.pending[c_hop_by_hop] = rec
+	rec.sent = true
+	c_msg := rec.msg
+	c_todo.Add(func() {
+		cl.base.Send(c_msg)
+	})
+}
+
+// answer handles an ACA with the lock held.
+func (cl *Client) answer(aca d.Message, c_todo *app.Todo) {
+	c_rec, ok := cl.pending[aca.Get_hop_by_hop()]
+	if !ok {
+		l.Warn.Printf("acct client: ACA without request, hop-by-hop 0x%08x session %s", aca.Get_hop_by_hop(), app.SessionId(&aca))
+		return
+	}
+	delete(cl.pending, aca.Get_hop_by_hop())
+	c_rec.timer.Stop()
+
+	if cb := cl.conf.Callbacks.OnAnswer; cb != nil {
+		c_s := c_rec.s
+		if c_rec.file != "" {
+			c_s = nil
+		}
+		c_todo.Add(func() { cb(c_s, aca) })
+	}
+
+	c_result := app.ResultCode(&aca)
+	if c_result == d.UNABLE_TO_DELIVER || c_result == d.TOO_BUSY {
+		l.Warn.Printf("acct client: record of %s not delivered, Result-Code %d", app.SessionId(&c_rec.msg), c_result)
+		cl.undelivered(c_rec, c_todo)
+		return
+	}
+	if c_result < 2000 || c_result >= 3000 {
+		l.Warn.Printf("acct client: record of %s rejected, Result-Code %d", app.SessionId(&c_rec.msg), c_result)
+	}
+	if c_rec.file != "" {
+		cl.buf.remove(c_rec.file)
+		cl.resending = 0
+		cl.resendNext(c_todo)
+		return
+	}
+	if c_rec.s != nil {
+		c_rec.s.answered(c_rec, &aca, c_todo)
+	}
+}
+
+func (cl *Client) txExpired(hop_by_hop uint32) {
+	var c_todo app.Todo
+	cl.mtx.Lock()
+	if c_rec, ok := cl.pending[hop_by_hop]; ok {
+		delete(cl.pending, hop_by_hop)
+		l.Warn.Println("acct client: Tx expired for the record of", app.SessionId(&c_rec.msg))
+		cl.undelivered(c_rec, &c_todo)
+	}
+	cl.mtx.Unlock()
+	c_todo.Run()
+}
+
+// undelivered stores a record without answer, a stored one is tried again
+// later.
+func (cl *Client) undelivered(rec *record, c_todo *app.Todo) {
+	if rec.file != "" {
+		cl.resending = 0
+		cl.scheduleRetry()
+		return
+	}
+	cl.store(rec, c_todo)
+}
+
+func (cl *Client) store(rec *record, c_todo *app.Todo) {
+	if rec.realtime == d.ENUM_ACCOUNTING_REALTIME_GRANT_AND_LOSE {
+		l.Warn.Println("acct client: record of", app.SessionId(&rec.msg), "lost, GRANT_AND_LOSE")
+		return
+	}
+	if cl.buf == nil {
+		l.Warn.Println("acct client: record of", app.SessionId(&rec.msg), "lost, no buffer")
+		return
+	}
+	if err := cl.buf.push(rec.msg, rec.sent); err != nil {
+		l.Error.Println("acct client: record of", app.SessionId(&rec.msg), "lost:", err)
+		return
+	}
+	if cb := cl.conf.Callbacks.OnBuffered; cb != nil && rec.s != nil {
+		c_s, c_msg := rec.s, rec.msg
+		c_todo.Add(func() { cb(c_s, c_msg) })
+	}
+	cl.scheduleRetry()
+}
+
+// resendNext sends the oldest stored record, one at a time so the order is
+// kept. A record stored without being sent goes without the T flag the
+// first time, it is stored with the flag for the next tries.
+func (cl *Client) resendNext(c_todo *app.Todo) {
+	if cl.buf == nil || cl.resending != 0 {
+		return
+	}
+	c_msg, c_file, ok := cl.buf.first()
+	if !ok {
+		return
+	}
+	if c_msg.GetCmdFlags()&0b00010000 == 0 {
+		if err := cl.buf.markSent(c_file, c_msg); err != nil {
+			l.Warn.Println("acct client: record of", app.SessionId(&c_msg), "not marked as sent:", err)
+		}
+	}
+	c_msg.Set_hop_by_hop(cl.base.Conn().NextHopByHop())
+	cl.resending = c_msg.Get_hop_by_hop()
+	cl.transmit(&record{msg: c_msg, file: c_file}, c_todo)
+}
+
+func (cl *Client) scheduleRetry() {
+	if cl.retry_timer != nil {
+		return
+	}
+	cl.retry_timer = time.AfterFunc(cl.conf.RetryInterval, func() {
+		cl.mtx.Lock()
+		cl.retry_timer = nil
+		cl.mtx.Unlock()
+		cl.Flush()
+	})
+}
+
+// request builds an ACR of the session id.
+func (cl *Client) request(id string, record_type int32, record_number uint32, avps []d.AVP) d.Message {
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, id, d.MAND, 0)}
+	c_avps = append(c_avps, cl.base.Origin()...)
+	c_avps = append(c_avps, cl.base.Destination()...)
+	c_avps = append(c_avps,
+		d.AVP_Enumerated(d.AVP_CODE_Accounting_Record_Type, record_type, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Accounting_Record_Number, record_number, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Acct_Application_Id, cl.conf.AppId, d.MAND, 0),
+	)
+	if record_type == d.ENUM_ACCOUNTING_RECORD_START && cl.conf.InterimInterval > 0 {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Acct_Interim_Interval, uint32(cl.conf.InterimInterval/time.Second), d.MAND, 0))
+	}
+	c_avps = append(c_avps, d.AVP_Time(d.AVP_CODE_Event_Timestamp, time.Now(), d.MAND, 0))
+	c_avps = append(c_avps, avps...)
+	return d.GenMess(d.CC_ACCOUNTING, true, true, cl.conf.AppId, cl.base.Conn().NextHopByHop(), cl.base.Conn().NextEndToEnd(), c_avps)
+}
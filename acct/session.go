@@ -0,0 +1,158 @@
+package acct
+
+import (
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"time"
+)
+
+// Session is an accounting session, its records share the Session-Id and
+// are numbered from 0.
+type Session struct {
+	cl            *Client
+	id            string
+	record_number uint32
+	started       bool
+	stopped       bool
+	// interim is the Acct-Interim-Interval in use, no interim records if 0.
+	interim       time.Duration
+	interim_timer *time.Timer
+	// realtime is the Accounting-Realtime-Required of the server.
+	realtime int32
+}
+
+// Id is the Session-Id.
+func (s *Session) Id() string {
+	return s.id
+}
+
+// RecordNumber is the Accounting-Record-Number of the last record.
+func (s *Session) RecordNumber() uint32 {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.record_number
+}
+
+// InterimInterval is the period of the interim records, 0 if none.
+func (s *Session) InterimInterval() time.Duration {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.interim
+}
+
+// Start sends the START record.
+func (s *Session) Start(avps []d.AVP) error {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	if s.started || s.stopped {
+		s.cl.mtx.Unlock()
+		return ErrWrongState
+	}
+	s.started = true
+	s.cl.sessions[s.id] = s
+	s.send(d.ENUM_ACCOUNTING_RECORD_START, avps, &c_todo)
+	s.armInterim()
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+	return nil
+}
+
+// Interim sends an INTERIM record now, the next one is due after the
+// interim interval.
+func (s *Session) Interim(avps []d.AVP) error {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	if !s.started || s.stopped {
+		s.cl.mtx.Unlock()
+		return ErrWrongState
+	}
+	s.record_number++
+	s.send(d.ENUM_ACCOUNTING_RECORD_INTERIM, avps, &c_todo)
+	s.armInterim()
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+	return nil
+}
+
+// Stop sends the STOP record and ends the session.
+func (s *Session) Stop(avps []d.AVP) error {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	if !s.started || s.stopped {
+		s.cl.mtx.Unlock()
+		return ErrWrongState
+	}
+	s.stopped = true
+	s.stopInterim()
+	delete(s.cl.sessions, s.id)
+	s.record_number++
+	s.send(d.ENUM_ACCOUNTING_RECORD_STOP, avps, &c_todo)
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+	return nil
+}
+
+// Event sends an EVENT record, the session is used for nothing else.
+func (s *Session) Event(avps []d.AVP) error {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	if s.started || s.stopped {
+		s.cl.mtx.Unlock()
+		return ErrWrongState
+	}
+	s.stopped = true
+	s.send(d.ENUM_ACCOUNTING_RECORD_EVENT, avps, &c_todo)
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+	return nil
+}
+
+func (s *Session) send(record_type int32, avps []d.AVP, c_todo *app.Todo) {
+	c_msg := s.cl.request(s.id, record_type, s.record_number, avps)
+	s.cl.sendRecord(s, c_msg, c_todo)
+}
+
+// answered takes the Acct-Interim-Interval and Accounting-Realtime-Required
+// of the answer to the START record.
+func (s *Session) answered(rec *record, aca *d.Message, c_todo *app.Todo) {
+	if c_type := aca.FindAVP(0, d.AVP_CODE_Accounting_Record_Type); c_type == nil || int32(c_type.GetIntValue()) != d.ENUM_ACCOUNTING_RECORD_START {
+		return
+	}
+	if c_avp := aca.FindAVP(0, d.AVP_CODE_Accounting_Realtime_Required); c_avp != nil {
+		s.realtime = int32(c_avp.GetIntValue())
+	}
+	c_interim := time.Duration(0)
+	if c_avp := aca.FindAVP(0, d.AVP_CODE_Acct_Interim_Interval); c_avp != nil {
+		c_interim = time.Duration(c_avp.GetIntValue()) * time.Second
+	}
+	if c_interim != s.interim {
+		s.interim = c_interim
+		if !s.stopped {
+			s.armInterim()
+		}
+	}
+}
+
+func (s *Session) armInterim() {
+	s.stopInterim()
+	if s.interim <= 0 {
+		return
+	}
+	s.interim_timer = time.AfterFunc(s.interim, s.interimDue)
+}
+
+func (s *Session) stopInterim() {
+	if s.interim_timer != nil {
+		s.interim_timer.Stop()
+		s.interim_timer = nil
+	}
+}
+
+func (s *Session) interimDue() {
+	var c_avps []d.AVP
+	if cb := s.cl.conf.Callbacks.InterimAVPs; cb != nil {
+		c_avps = cb(s)
+	}
+	// ErrWrongState if the session stopped meanwhile.
+	s.Interim(c_avps)
+}
@@ -0,0 +1,142 @@
+// Package app is what the application clients (cc, gx, rx, sh, s6a, acct,
+// gmb, s9) share: the part of the connection they use, the loop of their
+// received messages and the answers to the requests of the peer.
+//
+// The server applications build their answers with an Answerer.
+//
+// A client keeps a Base and its own messages:
+//
+//	cl.base = app.NewBase("gx client", c, send_ch)
+//	go cl.base.Run(rcv_ch, rest, cl.Handle)
+//	cl.base.Send(cl.base.AnswerTo(req, d.SUCCESS))
+package app
+
+import (
+	"github.com/lehotomi/diam/conn"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+)
+
+// Conn is the part of conn.DiamConn used by the clients.
+type Conn interface {
+	Gen_Session_Id() string
+	ConfValue(key string) (string, bool)
+	NextHopByHop() uint32
+	NextEndToEnd() uint32
+}
+
+// Registry is the request handler registry of conn.DiamConn.
+type Registry interface {
+	Handle(cmd_code uint32, app_id uint32, h conn.RequestHandler)
+}
+
+// Base is the connection of a client and the AVPs common to its messages.
+type Base struct {
+	name    string
+	conn    Conn
+	send_ch chan d.Message
+	// app_avps follow the Session-Id of the answers.
+	app_avps []d.AVP
+}
+
+// NewBase creates the base of the client name, sending on send_ch, the
+// send channel of c. app_avps (e.g. the Vendor-Specific-Application-Id)
+// follow the Session-Id of the answers.
+func NewBase(name string, c Conn, send_ch chan d.Message, app_avps ...d.AVP) Base {
+	return Base{
+		name:     name,
+		conn:     c,
+		send_ch:  send_ch,
+		app_avps: app_avps,
+	}
+}
+
+// Conn is the connection of the client.
+func (b *Base) Conn() Conn {
+	return b.conn
+}
+
+// Run gives the messages of rcv_ch to handle until rcv_ch is closed. The
+// messages handle does not take go to rest, or are dropped if rest is
+// nil.
+func (b *Base) Run(rcv_ch chan d.Message, rest chan d.Message, handle func(msg d.Message) bool) {
+	for msg := range rcv_ch {
+		if handle(msg) {
+			continue
+		}
+		if rest != nil {
+			rest <- msg
+		} else {
+			l.Warn.Println(b.name+": dropped message", msg.GetCmdCode())
+		}
+	}
+}
+
+// Send queues msg on the send channel.
+func (b *Base) Send(msg d.Message) {
+	b.send_ch <- msg
+}
+
+// Origin returns the Origin-Host and Origin-Realm AVPs of the connection.
+func (b *Base) Origin() []d.AVP {
+	c_host, _ := b.conn.ConfValue("origin_host")
+	c_realm, _ := b.conn.ConfValue("origin_realm")
+	return []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, c_host, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, c_realm, d.MAND, 0),
+	}
+}
+
+// Destination returns the Destination-Realm AVP of the connection, and the
+// Destination-Host if it is configured.
+func (b *Base) Destination() []d.AVP {
+	c_realm, _ := b.conn.ConfValue("destination_realm")
+	ret := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Destination_Realm, c_realm, d.MAND, 0)}
+	if c_host, ok := b.conn.ConfValue("destination_host"); ok && c_host != "" {
+		ret = append(ret, d.AVP_UTF8String(d.AVP_CODE_Destination_Host, c_host, d.MAND, 0))
+	}
+	return ret
+}
+
+// AnswerTo creates the answer of req with the Result-Code c_result. A
+// protocol error (3xxx) gets the E flag.
+func (b *Base) AnswerTo(req d.Message, c_result uint32) d.Message {
+	ret := b.AnswerWith(req, d.AVP_Unsigned32(d.AVP_CODE_Result_Code, c_result, d.MAND, 0))
+	if c_result >= 3000 && c_result < 4000 {
+		ret.Set_error_flag(true)
+	}
+	return ret
+}
+
+// ExperimentalTo creates the answer of req with the 3GPP
+// Experimental-Result-Code c_code.
+func (b *Base) ExperimentalTo(req d.Message, c_code uint32) d.Message {
+	return b.AnswerWith(req, d.AVP_Group(d.AVP_CODE_Experimental_Result, []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Vendor_Id, d.VENDOR_3GPP, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Experimental_Result_Code, c_code, d.MAND, 0),
+	}, d.MAND, 0))
+}
+
+// AnswerWith creates the answer of req with result, a Result-Code or an
+// Experimental-Result.
+func (b *Base) AnswerWith(req d.Message, result d.AVP) d.Message {
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, SessionId(&req), d.MAND, 0)}
+	c_avps = append(c_avps, b.app_avps...)
+	c_avps = append(c_avps, b.Origin()...)
+	c_avps = append(c_avps, result)
+	c_proxiable := req.GetCmdFlags()&0b01000000 != 0
+	return d.GenMess(req.GetCmdCode(), false, c_proxiable, req.GetAppId(), req.Get_hop_by_hop(), req.Get_end_to_end(), c_avps)
+}
+
+// Todo collects the callbacks and sends to do after the lock is released.
+type Todo []func()
+
+func (t *Todo) Add(f func()) {
+	*t = append(*t, f)
+}
+
+func (t Todo) Run() {
+	for _, f := range t {
+		f()
+	}
+}
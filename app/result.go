@@ -0,0 +1,42 @@
+package app
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+)
+
+// ResultError is an answer with a not successful Result-Code or
+// Experimental-Result-Code.
+type ResultError struct {
+	ResultCode uint32
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("Result-Code %d", e.ResultCode)
+}
+
+// SessionId is the Session-Id of msg, empty if it has none.
+func SessionId(msg *d.Message) string {
+	return StringValue(msg, d.AVP_CODE_Session_Id)
+}
+
+// StringValue is the value of the AVP c_code of msg, empty if it has none.
+func StringValue(msg *d.Message, c_code uint32) string {
+	if c_avp := msg.FindAVP(0, c_code); c_avp != nil {
+		return c_avp.GetStringValue()
+	}
+	return ""
+}
+
+// ResultCode is the Result-Code or the Experimental-Result-Code of msg.
+func ResultCode(msg *d.Message) uint32 {
+	if c_avp := msg.FindAVP(0, d.AVP_CODE_Result_Code); c_avp != nil {
+		return uint32(c_avp.GetIntValue())
+	}
+	if c_avp := msg.FindAVP(0, d.AVP_CODE_Experimental_Result); c_avp != nil {
+		if c_code := c_avp.FindAVP(0, d.AVP_CODE_Experimental_Result_Code); c_code != nil {
+			return uint32(c_code.GetIntValue())
+		}
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	d "github.com/lehotomi/diam/diam"
+)
+
+// Answerer builds the answers of a server application like Base does for
+// the clients.
+type Answerer struct {
+	OriginHost  string
+	OriginRealm string
+	// AppAVPs are the AVPs following the Session-Id for the application of
+	// the request, the Auth-Application-Id of it if nil.
+	AppAVPs func(app_id uint32) []d.AVP
+	// Echo are the codes of the AVPs copied from the request, e.g.
+	// CC-Request-Type and CC-Request-Number.
+	Echo []uint32
+}
+
+// AnswerTo creates the answer of req with the Result-Code c_result and
+// avps. A protocol error (3xxx) gets the E flag.
+func (a *Answerer) AnswerTo(req d.Message, c_result uint32, avps ...d.AVP) d.Message {
+	ret := a.AnswerWith(req, d.AVP_Unsigned32(d.AVP_CODE_Result_Code, c_result, d.MAND, 0), avps...)
+	if c_result >= 3000 && c_result < 4000 {
+		ret.Set_error_flag(true)
+	}
+	return ret
+}
+
+// ExperimentalTo creates the answer of req with the 3GPP
+// Experimental-Result-Code c_code.
+func (a *Answerer) ExperimentalTo(req d.Message, c_code uint32, avps ...d.AVP) d.Message {
+	return a.AnswerWith(req, d.AVP_Group(d.AVP_CODE_Experimental_Result, []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Vendor_Id, d.VENDOR_3GPP, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Experimental_Result_Code, c_code, d.MAND, 0),
+	}, d.MAND, 0), avps...)
+}
+
+// AnswerWith creates the answer of req with result, a Result-Code or an
+// Experimental-Result, and avps.
+func (a *Answerer) AnswerWith(req d.Message, result d.AVP, avps ...d.AVP) d.Message {
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, SessionId(&req), d.MAND, 0)}
+	if a.AppAVPs != nil {
+		c_avps = append(c_avps, a.AppAVPs(req.GetAppId())...)
+	} else {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, req.GetAppId(), d.MAND, 0))
+	}
+	c_avps = append(c_avps,
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, a.OriginHost, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, a.OriginRealm, d.MAND, 0),
+		result,
+	)
+	for _, c_code := range a.Echo {
+		if c_avp := req.FindAVP(0, c_code); c_avp != nil {
+			c_avps = append(c_avps, *c_avp)
+		}
+	}
+	c_avps = append(c_avps, avps...)
+	c_proxiable := req.GetCmdFlags()&0b01000000 != 0
+	return d.GenMess(req.GetCmdCode(), false, c_proxiable, req.GetAppId(), req.Get_hop_by_hop(), req.Get_end_to_end(), c_avps)
+}
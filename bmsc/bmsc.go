@@ -0,0 +1,401 @@
+// Package bmsc is a BM-SC stub, the server side of Gmb (3GPP TS 29.061 17)
+// for testing the MBMS setup of GGSNs without a BM-SC.
+//
+// The GGSNs register for the multicast services of the configuration and
+// activate the MBMS UE contexts of their users with AARs, the AAA gives
+// the TMGI and the Required-MBMS-Bearer-Capabilities of the service.
+// Start, Update and Stop send the MBMS session of a service in RARs to the
+// registered GGSNs, for a broadcast service to its configured GGSNs on new
+// sessions. Deregister ends the registrations of a service with ASRs.
+//
+//	b := bmsc.New(conf)
+//	srv := conn.NewServer(conn.ServerConfig{Listen: ":3868", AuthAppIds: []uint32{d.APPID_GMB}, Handler: b.Handle})
+//	b.SetSender(srv)
+//	b.Start("news", nil)
+package bmsc
+
+import (
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/gmb"
+	l "github.com/lehotomi/diam/mlog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer is a GGSN of a broadcast service.
+type Peer struct {
+	Host  string `json:"host"`
+	Realm string `json:"realm"`
+}
+
+// Service is an MBMS bearer service of the BM-SC.
+type Service struct {
+	Name string `json:"name"`
+	gmb.Service
+	TMGI gmb.TMGI `json:"tmgi"`
+	// Broadcast services are started on the GGSNs without registration.
+	Broadcast bool   `json:"broadcast,omitempty"`
+	GGSNs     []Peer `json:"ggsns,omitempty"`
+	// BearerCapabilities is the Required-MBMS-Bearer-Capabilities of the
+	// AAAs.
+	BearerCapabilities string `json:"bearer_capabilities,omitempty"`
+	// Session is the MBMS session started by default, its TMGI and
+	// MBMS-Service-Type are the ones of the service.
+	Session gmb.MBMSSession `json:"session"`
+	// IMSIs may activate their UE context, everyone if empty.
+	IMSIs []string `json:"imsis,omitempty"`
+}
+
+// Config sets up a BM-SC.
+type Config struct {
+	OriginHost  string    `json:"origin_host"`
+	OriginRealm string    `json:"origin_realm"`
+	Services    []Service `json:"services"`
+}
+
+// Sender sends a request to a connected GGSN, conn.Server implements it.
+type Sender interface {
+	SendTo(host string, msg d.Message) error
+}
+
+// BMSC keeps the services and the Gmb sessions of the GGSNs.
+type BMSC struct {
+	conf       Config
+	ans        app.Answerer
+	mtx        sync.Mutex
+	services   []*service
+	sessions   map[string]*session
+	sender     Sender
+	start      int64
+	session_no uint32
+}
+
+type service struct {
+	Service
+	// mbms is the started MBMS session, nil if none.
+	mbms *gmb.MBMSSession
+}
+
+// session is a registration, an MBMS UE context or a broadcast session.
+type session struct {
+	// host and realm are the GGSN, the destination of RARs and ASRs.
+	host    string
+	realm   string
+	service *service
+	ue      *gmb.UE
+}
+
+// note is a request to send after the lock is released.
+type note struct {
+	host string
+	msg  d.Message
+}
+
+func New(conf Config) *BMSC {
+	b := &BMSC{
+		conf:     conf,
+		ans:      app.Answerer{OriginHost: conf.OriginHost, OriginRealm: conf.OriginRealm},
+		sessions: make(map[string]*session),
+		start:    time.Now().Unix(),
+	}
+	for _, v := range conf.Services {
+		b.services = append(b.services, &service{Service: v})
+	}
+	return b
+}
+
+// SetSender sets where the RARs and ASRs are sent.
+func (b *BMSC) SetSender(sender Sender) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.sender = sender
+}
+
+// Sessions returns the Session-Ids of the Gmb sessions of the service
+// name.
+func (b *BMSC) Sessions(name string) []string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var ret []string
+	for k, v := range b.sessions {
+		if v.service.Name == name {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Handle answers the AARs and STRs of Gmb, it is a conn.RequestHandler.
+// Other requests get 3001 with the E flag.
+func (b *BMSC) Handle(req d.Message) (d.Message, bool) {
+	if req.GetAppId() != d.APPID_GMB {
+		l.Warn.Println("bmsc: unsupported command", req.GetCmdCode(), "app", req.GetAppId())
+		return b.ans.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+	}
+	c_session_id := app.SessionId(&req)
+	if c_session_id == "" {
+		return b.ans.AnswerTo(req, d.MISSING_AVP), true
+	}
+	switch req.GetCmdCode() {
+	case d.CC_AA:
+		return b.authorize(c_session_id, &req), true
+	case d.CC_SESSION_TERMINATION:
+		return b.terminate(c_session_id, &req), true
+	}
+	l.Warn.Println("bmsc: unsupported Gmb command", req.GetCmdCode())
+	return b.ans.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+}
+
+// HandleAnswer logs the failed RAAs and ASAs, e.g. as the AnswerHandler of
+// conn.Server.
+func (b *BMSC) HandleAnswer(ans d.Message) {
+	if ans.GetAppId() != d.APPID_GMB {
+		return
+	}
+	if c_result := app.ResultCode(&ans); c_result < 2000 || c_result >= 3000 {
+		l.Warn.Println("bmsc: answer", ans.GetCmdCode(), "of", app.SessionId(&ans), "Result-Code", c_result)
+	}
+}
+
+// authorize answers the AAR of a registration, or of an MBMS UE context
+// activation if it has a 3GPP-IMSI.
+func (b *BMSC) authorize(session_id string, req *d.Message) d.Message {
+	c_service := gmb.ServiceOf(req)
+	c_ue, c_activation := gmb.UEOf(req)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	sv := b.find(c_service)
+	if sv == nil || (sv.Broadcast && !c_activation) {
+		l.Warn.Println("bmsc: unknown bearer service", c_service.Multicast, c_service.APN, "of", session_id)
+		return b.ans.ExperimentalTo(*req, d.ERROR_UNKNOWN_MBMS_BEARER_SERVICE)
+	}
+	if c_activation && !sv.allows(c_ue.IMSI) {
+		l.Warn.Println("bmsc: UE", c_ue.IMSI, "not authorized for", sv.Name)
+		return b.ans.AnswerTo(*req, d.AUTHORIZATION_REJECTED)
+	}
+	c_tmgi, err := sv.TMGI.AVP()
+	if err != nil {
+		l.Error.Println("bmsc: service", sv.Name, err)
+		return b.ans.AnswerTo(*req, d.UNABLE_TO_COMPLY)
+	}
+	s := &session{
+		host:    app.StringValue(req, d.AVP_CODE_Origin_Host),
+		realm:   app.StringValue(req, d.AVP_CODE_Origin_Realm),
+		service: sv,
+	}
+	if c_activation {
+		s.ue = &c_ue
+		l.Info.Println("bmsc: UE context", c_ue.IMSI, "of", sv.Name, "activated by", s.host)
+	} else {
+		l.Info.Println("bmsc:", s.host, "registered for", sv.Name)
+	}
+	b.sessions[session_id] = s
+
+	c_avps := []d.AVP{c_tmgi}
+	if sv.BearerCapabilities != "" {
+		c_avps = append(c_avps, d.AVP_UTF8String(d.AVP_CODE_Required_MBMS_Bearer_Capabilities, sv.BearerCapabilities, d.MAND, d.VENDOR_3GPP))
+	}
+	return b.ans.AnswerTo(*req, d.SUCCESS, c_avps...)
+}
+
+// terminate answers the STR of a de-registration, an MBMS UE context
+// deactivation or the end of a broadcast session.
+func (b *BMSC) terminate(session_id string, req *d.Message) d.Message {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	s, ok := b.sessions[session_id]
+	if !ok {
+		return b.ans.AnswerTo(*req, d.UNKNOWN_SESSION_ID)
+	}
+	delete(b.sessions, session_id)
+	l.Info.Println("bmsc: session", session_id, "of", s.service.Name, "terminated by", s.host)
+	return b.ans.AnswerTo(*req, d.SUCCESS)
+}
+
+// Start sends the MBMS session of the service name, the default one of the
+// service if m is nil.
+func (b *BMSC) Start(name string, m *gmb.MBMSSession) error {
+	return b.mbmsSession(name, d.ENUM_MBMS_START, m)
+}
+
+// Update sends the changed MBMS session of the started service name.
+func (b *BMSC) Update(name string, m gmb.MBMSSession) error {
+	return b.mbmsSession(name, d.ENUM_MBMS_UPDATE, &m)
+}
+
+// Stop stops the MBMS session of the service name.
+func (b *BMSC) Stop(name string) error {
+	return b.mbmsSession(name, d.ENUM_MBMS_STOP, nil)
+}
+
+func (b *BMSC) mbmsSession(name string, indication int32, m *gmb.MBMSSession) error {
+	b.mtx.Lock()
+	sv := b.findName(name)
+	if sv == nil {
+		b.mtx.Unlock()
+		return fmt.Errorf("bmsc: unknown service %s", name)
+	}
+	switch {
+	case indication == d.ENUM_MBMS_START && sv.mbms != nil:
+		b.mtx.Unlock()
+		return fmt.Errorf("bmsc: service %s already started", name)
+	case indication != d.ENUM_MBMS_START && sv.mbms == nil:
+		b.mtx.Unlock()
+		return fmt.Errorf("bmsc: service %s not started", name)
+	}
+	var c_mbms gmb.MBMSSession
+	switch {
+	case indication == d.ENUM_MBMS_STOP:
+		c_mbms = *sv.mbms
+	case m != nil:
+		c_mbms = *m
+	default:
+		c_mbms = sv.Session
+	}
+	c_mbms.TMGI = sv.TMGI
+	c_mbms.ServiceType = d.ENUM_MBMS_SERVICE_TYPE_MULTICAST
+	if sv.Broadcast {
+		c_mbms.ServiceType = d.ENUM_MBMS_SERVICE_TYPE_BROADCAST
+	}
+	c_session_avps, err := c_mbms.AVPs()
+	if err != nil {
+		b.mtx.Unlock()
+		return fmt.Errorf("bmsc: service %s: %w", name, err)
+	}
+	c_service_avps, err := sv.Service.Service.AVPs()
+	if err != nil {
+		b.mtx.Unlock()
+		return fmt.Errorf("bmsc: service %s: %w", name, err)
+	}
+	c_avps := []d.AVP{
+		d.AVP_Enumerated(d.AVP_CODE_Re_Auth_Request_Type, d.ENUM_RE_AUTH_AUTHORIZE_ONLY, d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_MBMS_StartStop_Indication, indication, d.MAND, d.VENDOR_3GPP),
+	}
+	c_avps = append(c_avps, c_service_avps...)
+	c_avps = append(c_avps, c_session_avps...)
+
+	var c_notes []note
+	if sv.Broadcast && indication == d.ENUM_MBMS_START {
+		for _, v := range sv.GGSNs {
+			c_id := b.newSessionId()
+			b.sessions[c_id] = &session{host: v.Host, realm: v.Realm, service: sv}
+			c_notes = append(c_notes, b.request(c_id, v.Host, v.Realm, d.CC_RE_AUTH, c_avps))
+		}
+	} else {
+		for _, c_id := range b.sessionsOf(sv) {
+			s := b.sessions[c_id]
+			if s.ue != nil {
+				continue
+			}
+			c_notes = append(c_notes, b.request(c_id, s.host, s.realm, d.CC_RE_AUTH, c_avps))
+		}
+	}
+	if indication == d.ENUM_MBMS_STOP {
+		sv.mbms = nil
+	} else {
+		sv.mbms = &c_mbms
+	}
+	b.mtx.Unlock()
+	l.Info.Println("bmsc: MBMS session of", name, "indication", indication, "sent to", len(c_notes), "GGSNs")
+	b.send(c_notes)
+	return nil
+}
+
+// Deregister asks the GGSNs with ASRs to end the registrations and the
+// MBMS UE contexts of the service name.
+func (b *BMSC) Deregister(name string) error {
+	b.mtx.Lock()
+	sv := b.findName(name)
+	if sv == nil {
+		b.mtx.Unlock()
+		return fmt.Errorf("bmsc: unknown service %s", name)
+	}
+	var c_notes []note
+	for _, c_id := range b.sessionsOf(sv) {
+		s := b.sessions[c_id]
+		c_notes = append(c_notes, b.request(c_id, s.host, s.realm, d.CC_ABORT_SESSION, nil))
+	}
+	b.mtx.Unlock()
+	b.send(c_notes)
+	return nil
+}
+
+func (b *BMSC) find(service gmb.Service) *service {
+	for _, v := range b.services {
+		if v.Multicast == service.Multicast && v.APN == service.APN {
+			return v
+		}
+	}
+	return nil
+}
+
+func (b *BMSC) findName(name string) *service {
+	for _, v := range b.services {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// sessionsOf returns the Session-Ids of sv in order.
+func (b *BMSC) sessionsOf(sv *service) []string {
+	var ret []string
+	for k, v := range b.sessions {
+		if v.service == sv {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (sv *service) allows(imsi string) bool {
+	if len(sv.IMSIs) == 0 {
+		return true
+	}
+	for _, v := range sv.IMSIs {
+		if v == imsi {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BMSC) newSessionId() string {
+	b.session_no++
+	return fmt.Sprintf("%s;%d;%d", b.conf.OriginHost, b.start, b.session_no)
+}
+
+func (b *BMSC) request(session_id string, host string, realm string, cmd_code uint32, avps []d.AVP) note {
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, session_id, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_GMB, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, b.conf.OriginHost, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, b.conf.OriginRealm, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Destination_Realm, realm, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Destination_Host, host, d.MAND, 0),
+	}
+	c_avps = append(c_avps, avps...)
+	return note{host: host, msg: d.GenMess(cmd_code, true, true, d.APPID_GMB, 0, 0, c_avps)}
+}
+
+func (b *BMSC) send(msgs []note) {
+	b.mtx.Lock()
+	c_sender := b.sender
+	b.mtx.Unlock()
+	for _, v := range msgs {
+		if c_sender == nil {
+			l.Warn.Println("bmsc: no sender for the request to", v.host)
+			return
+		}
+		if err := c_sender.SendTo(v.host, v.msg); err != nil {
+			l.Warn.Println("bmsc: request", v.msg.GetCmdCode(), "to", v.host, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package cc is the client side of Diameter Credit Control (RFC 4006), the
+// Gy/Ro sessions of a charging client.
+//
+// A Client sends the CCRs of its sessions on the send channel of a DiamConn
+// and gets the received messages through Handle (or Run). The answers are
+// matched to the requests by Hop-by-Hop Identifier, a RAR is answered and
+// triggers a CCR-U of the session, an ASR triggers a CCR-T. With Register
+// the RARs and ASRs are answered by the handlers of the connection.
+//
+//	cl := cc.NewClient(&diam_conn, send_ch, cc.ClientConfig{Callbacks: cbs})
+//	cl.Register(&diam_conn)
+//	go cl.Run(rcv_ch, nil)
+//	s := cl.NewSession()
+//	s.Start(avps)
+package cc
+
+import (
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+const (
+	// default_tx is the answer timeout recommended by RFC 4006.
+	default_tx = 10 * time.Second
+)
+
+// Callbacks report the life of the sessions to the application, every field
+// may be nil. They are called without locks held, so they may call the
+// methods of the session.
+type Callbacks struct {
+	// OnStateChange reports every state transition.
+	OnStateChange func(s *Session, from State, to State)
+	// OnAnswer gets every CCA of the session.
+	OnAnswer func(s *Session, cca d.Message)
+	// OnGrant tells the service can be given. cca is nil if the failure
+	// handling granted it without answer.
+	OnGrant func(s *Session, cca *d.Message)
+	// OnTerminate tells the service of the user must be stopped.
+	OnTerminate func(s *Session, err error)
+	// OnFinalUnit reports the Final-Unit-Indication of an answer, the
+	// granted units are the last ones.
+	OnFinalUnit func(s *Session, fui FinalUnit)
+	// UpdateAVPs gives the AVPs (e.g. Used-Service-Unit) of a CCR-U the
+	// client sends by itself.
+	UpdateAVPs func(s *Session, reason UpdateReason) []d.AVP
+}
+
+// ClientConfig sets up a Client.
+type ClientConfig struct {
+	// Tx is the answer timeout, 10s if zero.
+	Tx time.Duration
+	// ServiceContextId is added to every CCR if not empty.
+	ServiceContextId string
+	// CCFH and DDFH are the Credit-Control-Failure-Handling and the
+	// Direct-Debiting-Failure-Handling used until an answer sets them.
+	CCFH      int32
+	DDFH      int32
+	Callbacks Callbacks
+}
+
+// Client runs the credit control sessions of one connection.
+type Client struct {
+	base     app.Base
+	conf     ClientConfig
+	mtx      sync.Mutex
+	sessions map[string]*Session
+	pending  map[uint32]*Session
+}
+
+// NewClient creates a client sending on send_ch, the send channel of c.
+func NewClient(c app.Conn, send_ch chan d.Message, conf ClientConfig) *Client {
+	if conf.Tx <= 0 {
+		conf.Tx = default_tx
+	}
+	return &Client{
+		base:     app.NewBase("cc client", c, send_ch),
+		conf:     conf,
+		sessions: make(map[string]*Session),
+		pending:  make(map[uint32]*Session),
+	}
+}
+
+// NewSession creates an idle session with a new Session-Id.
+func (cl *Client) NewSession() *Session {
+	s := &Session{
+		cl:   cl,
+		id:   cl.base.Conn().Gen_Session_Id(),
+		ccfh: cl.conf.CCFH,
+		ddfh: cl.conf.DDFH,
+	}
+	cl.mtx.Lock()
+	cl.sessions[s.id] = s
+	cl.mtx.Unlock()
+	return s
+}
+
+// Session returns the active session with the Session-Id id.
+func (cl *Client) Session(id string) (*Session, bool) {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	s, ok := cl.sessions[id]
+	return s, ok
+}
+
+// Run handles the messages of rcv_ch until it is closed. The messages that
+// are not for the client go to rest, or are dropped if rest is nil.
+func (cl *Client) Run(rcv_ch chan d.Message, rest chan d.Message) {
+	cl.base.Run(rcv_ch, rest, cl.Handle)
+}
+
+// Handle processes a received message: the CCAs of the sessions and the
+// RARs and ASRs of the credit control application. It returns false for
+// other messages.
+func (cl *Client) Handle(msg d.Message) bool {
+	if msg.GetAppId() != d.APPID_CC {
+		return false
+	}
+	switch {
+	case msg.GetCmdCode() == d.CC_CREDIT_CONTROL && msg.IsAnswer():
+		cl.mtx.Lock()
+		s, ok := cl.pending[msg.Get_hop_by_hop()]
+		cl.mtx.Unlock()
+		if !ok {
+			l.Warn.Printf("cc client: CCA without request, hop-by-hop 0x%08x session %s", msg.Get_hop_by_hop(), app.SessionId(&msg))
+			return true
+		}
+		s.answer(msg)
+		return true
+	case (msg.GetCmdCode() == d.CC_RE_AUTH || msg.GetCmdCode() == d.CC_ABORT_SESSION) && msg.IsRequest():
+		if c_ans, ok := cl.HandleRequest(msg); ok {
+			cl.base.Send(c_ans)
+		}
+		return true
+	}
+	return false
+}
+
+// Register makes r answer the RARs and ASRs of the credit control
+// application with the client, instead of forwarding them to Handle.
+func (cl *Client) Register(r app.Registry) {
+	r.Handle(d.CC_RE_AUTH, d.APPID_CC, cl.HandleRequest)
+	r.Handle(d.CC_ABORT_SESSION, d.APPID_CC, cl.HandleRequest)
+}
+
+// HandleRequest answers a RAR or an ASR, it is a conn.RequestHandler. After
+// a RAR the session sends a CCR-U, after an ASR a CCR-T.
+func (cl *Client) HandleRequest(req d.Message) (d.Message, bool) {
+	c_id := app.SessionId(&req)
+	cl.mtx.Lock()
+	s, ok := cl.sessions[c_id]
+	cl.mtx.Unlock()
+
+	var c_result uint32 = d.SUCCESS
+	if !ok {
+		l.Warn.Println("cc client: request", req.GetCmdCode(), "for unknown session", c_id)
+		c_result = d.UNKNOWN_SESSION_ID
+	}
+	if ok {
+		// the answer is sent before the CCR, the session sends on the send
+		// channel which may block
+		switch req.GetCmdCode() {
+		case d.CC_RE_AUTH:
+			go s.reAuth()
+		case d.CC_ABORT_SESSION:
+			go s.abort()
+		}
+	}
+	return cl.base.AnswerTo(req, c_result), true
+}
@@ -0,0 +1,469 @@
+package cc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"time"
+)
+
+// State is the state of the client session state machine of RFC 4006 8.
+type State int
+
+const (
+	STATE_IDLE State = iota
+	STATE_PENDING_I
+	STATE_PENDING_U
+	STATE_PENDING_T
+	STATE_PENDING_E
+	STATE_OPEN
+)
+
+var state_names map[State]string = map[State]string{
+	STATE_IDLE:      "Idle",
+	STATE_PENDING_I: "PendingI",
+	STATE_PENDING_U: "PendingU",
+	STATE_PENDING_T: "PendingT",
+	STATE_PENDING_E: "PendingE",
+	STATE_OPEN:      "Open",
+}
+
+func (st State) String() string {
+	if c_name, ok := state_names[st]; ok {
+		return c_name
+	}
+	return fmt.Sprintf("State(%d)", int(st))
+}
+
+// UpdateReason tells why the client sends a CCR-U by itself.
+type UpdateReason int
+
+const (
+	// REASON_VALIDITY_TIME the Validity-Time of the granted units expired.
+	REASON_VALIDITY_TIME UpdateReason = iota
+	// REASON_REAUTH the server asked for it with a RAR.
+	REASON_REAUTH
+)
+
+// FinalUnit is a received Final-Unit-Indication.
+type FinalUnit struct {
+	// Action is the Final-Unit-Action, d.ENUM_FUA_*.
+	Action int32
+	// AVP is the whole Final-Unit-Indication AVP.
+	AVP d.AVP
+}
+
+var (
+	ErrTxExpired   = errors.New("no answer within Tx")
+	ErrWrongState  = errors.New("request not allowed in this state")
+	ErrServiceDeny = errors.New("service denied")
+)
+
+// Session is one credit control session of a Client.
+type Session struct {
+	cl             *Client
+	id             string
+	state          State
+	req_number     uint32
+	ccfh           int32
+	ddfh           int32
+	last_req       d.Message
+	hop_by_hop     uint32
+	retried        bool
+	tx_expired     bool
+	tx_timer       *time.Timer
+	validity_timer *time.Timer
+	fui            *FinalUnit
+}
+
+func (s *Session) Id() string {
+	return s.id
+}
+
+func (s *Session) State() State {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.state
+}
+
+// RequestNumber is the CC-Request-Number of the last request.
+func (s *Session) RequestNumber() uint32 {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.req_number
+}
+
+// FinalUnit returns the Final-Unit-Indication of the last answer, nil if
+// there was none.
+func (s *Session) FinalUnit() *FinalUnit {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.fui
+}
+
+// Start sends the CCR-I of an idle session. The Session-Id, the origin and
+// destination, the Auth-Application-Id and the request type and number are
+// added to avps.
+func (s *Session) Start(avps []d.AVP) error {
+	return s.do(func(c_todo *app.Todo) error {
+		return s.sendRequest(d.ENUM_CC_REQUEST_INITIAL, avps, []State{STATE_IDLE}, STATE_PENDING_I, c_todo)
+	})
+}
+
+// Update sends a CCR-U of an open session.
+func (s *Session) Update(avps []d.AVP) error {
+	return s.do(func(c_todo *app.Todo) error {
+		return s.sendRequest(d.ENUM_CC_REQUEST_UPDATE, avps, []State{STATE_OPEN}, STATE_PENDING_U, c_todo)
+	})
+}
+
+// Terminate sends the CCR-T of an open session, or of a pending one whose
+// request timed out. A Termination-Cause DIAMETER_LOGOUT is added if avps
+// has none.
+func (s *Session) Terminate(avps []d.AVP) error {
+	if !hasAVP(avps, d.AVP_CODE_Termination_Cause) {
+		avps = append(avps, d.AVP_Enumerated(d.AVP_CODE_Termination_Cause, d.ENUM_TERMINATION_CAUSE_LOGOUT, d.MAND, 0))
+	}
+	return s.do(func(c_todo *app.Todo) error {
+		c_from := []State{STATE_OPEN}
+		if s.tx_expired {
+			c_from = append(c_from, STATE_PENDING_I, STATE_PENDING_U)
+		}
+		return s.sendRequest(d.ENUM_CC_REQUEST_TERMINATION, avps, c_from, STATE_PENDING_T, c_todo)
+	})
+}
+
+// Event sends the CCR of a one time event (e.g. direct debiting with
+// Requested-Action) from an idle session.
+func (s *Session) Event(avps []d.AVP) error {
+	return s.do(func(c_todo *app.Todo) error {
+		return s.sendRequest(d.ENUM_CC_REQUEST_EVENT, avps, []State{STATE_IDLE}, STATE_PENDING_E, c_todo)
+	})
+}
+
+// UnitsExhausted reports that the granted units are used up. After a
+// Final-Unit-Indication with TERMINATE action the session is terminated,
+// otherwise a CCR-U is sent with avps.
+func (s *Session) UnitsExhausted(avps []d.AVP) error {
+	c_fui := s.FinalUnit()
+	if c_fui != nil && c_fui.Action == d.ENUM_FUA_TERMINATE {
+		return s.Terminate(avps)
+	}
+	return s.Update(avps)
+}
+
+func (s *Session) do(f func(c_todo *app.Todo) error) error {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	err := f(&c_todo)
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+	return err
+}
+
+// sendRequest sends a CCR if the session is in one of the from states.
+func (s *Session) sendRequest(c_type int32, avps []d.AVP, from []State, to State, c_todo *app.Todo) error {
+	c_allowed := false
+	for _, v := range from {
+		if s.state == v {
+			c_allowed = true
+		}
+	}
+	if !c_allowed {
+		return fmt.Errorf("%s: CC-Request-Type %d in state %s: %w", s.id, c_type, s.state, ErrWrongState)
+	}
+
+	if c_type == d.ENUM_CC_REQUEST_INITIAL || c_type == d.ENUM_CC_REQUEST_EVENT {
+		s.req_number = 0
+	} else {
+		s.req_number++
+	}
+	s.stopTx()
+	if c_type == d.ENUM_CC_REQUEST_TERMINATION {
+		s.stopValidity()
+	}
+	s.retried = false
+	s.tx_expired = false
+	s.last_req = s.request(c_type, avps)
+	s.hop_by_hop = s.last_req.Get_hop_by_hop()
+	s.cl.pending[s.hop_by_hop] = s
+	s.cl.sessions[s.id] = s
+	s.startTx()
+	s.setState(to, c_todo)
+
+	c_req := s.last_req
+	c_todo.Add(func() {
+		s.cl.base.Send(c_req)
+	})
+	return nil
+}
+
+func (s *Session) request(c_type int32, avps []d.AVP) d.Message {
+	cl := s.cl
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, s.id, d.MAND, 0)}
+	c_avps = append(c_avps, cl.base.Origin()...)
+	c_avps = append(c_avps, cl.base.Destination()...)
+	c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_CC, d.MAND, 0))
+	if cl.conf.ServiceContextId != "" {
+		c_avps = append(c_avps, d.AVP_UTF8String(d.AVP_CODE_Service_Context_Id, cl.conf.ServiceContextId, d.MAND, 0))
+	}
+	c_avps = append(c_avps,
+		d.AVP_Enumerated(d.AVP_CODE_CC_Request_Type, c_type, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_CC_Request_Number, s.req_number, d.MAND, 0),
+	)
+	c_avps = append(c_avps, avps...)
+	return d.GenMess(d.CC_CREDIT_CONTROL, true, true, d.APPID_CC, cl.base.Conn().NextHopByHop(), 0, c_avps)
+}
+
+func (s *Session) setState(to State, c_todo *app.Todo) {
+	c_from := s.state
+	s.state = to
+	if to == STATE_IDLE {
+		s.stopTx()
+		s.stopValidity()
+		delete(s.cl.sessions, s.id)
+	}
+	if c_from == to {
+		return
+	}
+	l.Trace.Printf("cc session %s: %s -> %s", s.id, c_from, to)
+	if cb := s.cl.conf.Callbacks.OnStateChange; cb != nil {
+		c_todo.Add(func() { cb(s, c_from, to) })
+	}
+}
+
+func (s *Session) grant(cca *d.Message, c_todo *app.Todo) {
+	if cb := s.cl.conf.Callbacks.OnGrant; cb != nil {
+		c_todo.Add(func() { cb(s, cca) })
+	}
+}
+
+func (s *Session) deny(err error, c_todo *app.Todo) {
+	if cb := s.cl.conf.Callbacks.OnTerminate; cb != nil {
+		c_todo.Add(func() { cb(s, err) })
+	}
+}
+
+// answer runs the state machine for a received CCA.
+func (s *Session) answer(cca d.Message) {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	s.answerLocked(cca, &c_todo)
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+}
+
+func (s *Session) answerLocked(cca d.Message, c_todo *app.Todo) {
+	if cca.Get_hop_by_hop() != s.hop_by_hop {
+		l.Warn.Printf("cc session %s: late answer, hop-by-hop 0x%08x", s.id, cca.Get_hop_by_hop())
+		delete(s.cl.pending, cca.Get_hop_by_hop())
+		return
+	}
+	delete(s.cl.pending, s.hop_by_hop)
+	s.stopTx()
+
+	if c_avp := cca.FindAVP(0, d.AVP_CODE_Credit_Control_Failure_Handling); c_avp != nil {
+		s.ccfh = int32(c_avp.GetIntValue())
+	}
+	if c_avp := cca.FindAVP(0, d.AVP_CODE_Direct_Debiting_Failure_Handling); c_avp != nil {
+		s.ddfh = int32(c_avp.GetIntValue())
+	}
+	if cb := s.cl.conf.Callbacks.OnAnswer; cb != nil {
+		c_todo.Add(func() { cb(s, cca) })
+	}
+
+	c_result := app.ResultCode(&cca)
+	c_success := c_result >= 2000 && c_result < 3000
+	var c_err error = &app.ResultError{ResultCode: c_result}
+
+	switch s.state {
+	case STATE_PENDING_I, STATE_PENDING_U:
+		switch {
+		case c_success:
+			s.setState(STATE_OPEN, c_todo)
+			s.grant(&cca, c_todo)
+			s.granted(&cca, c_todo)
+		case c_result == d.CREDIT_CONTROL_NOT_APPLICABLE:
+			s.setState(STATE_IDLE, c_todo)
+			s.grant(&cca, c_todo)
+		case c_result == d.END_USER_SERVICE_DENIED || c_result == d.USER_UNKNOWN || c_result == d.CREDIT_LIMIT_REACHED:
+			s.setState(STATE_IDLE, c_todo)
+			s.deny(fmt.Errorf("%w: %v", ErrServiceDeny, c_err), c_todo)
+		case s.ccfh == d.ENUM_CCFH_CONTINUE:
+			s.setState(STATE_IDLE, c_todo)
+			// granted already when Tx expired
+			if !s.tx_expired {
+				s.grant(nil, c_todo)
+			}
+		default:
+			s.setState(STATE_IDLE, c_todo)
+			s.deny(c_err, c_todo)
+		}
+	case STATE_PENDING_T:
+		s.setState(STATE_IDLE, c_todo)
+	case STATE_PENDING_E:
+		s.setState(STATE_IDLE, c_todo)
+		if c_success {
+			s.grant(&cca, c_todo)
+		} else {
+			s.deny(c_err, c_todo)
+		}
+	default:
+		l.Warn.Printf("cc session %s: unexpected answer in state %s", s.id, s.state)
+	}
+}
+
+// granted arms the Validity-Time and reports the Final-Unit-Indication of
+// a successful answer. Both are looked for at command level and in the
+// Multiple-Services-Credit-Control AVPs.
+func (s *Session) granted(cca *d.Message, c_todo *app.Todo) {
+	var c_validity int = -1
+	s.fui = nil
+
+	check := func(c_avp *d.AVP) {
+		if c_avp == nil {
+			return
+		}
+		switch c_avp.GetAVPCode() {
+		case d.AVP_CODE_Validity_Time:
+			if c_val := c_avp.GetIntValue(); c_validity < 0 || c_val < c_validity {
+				c_validity = c_val
+			}
+		case d.AVP_CODE_Final_Unit_Indication:
+			c_fui := FinalUnit{Action: d.ENUM_FUA_TERMINATE, AVP: *c_avp}
+			if c_action := c_avp.FindAVP(0, d.AVP_CODE_Final_Unit_Action); c_action != nil {
+				c_fui.Action = int32(c_action.GetIntValue())
+			}
+			s.fui = &c_fui
+		}
+	}
+	check(cca.FindAVP(0, d.AVP_CODE_Validity_Time))
+	check(cca.FindAVP(0, d.AVP_CODE_Final_Unit_Indication))
+	for _, c_mscc := range cca.FindAVPs(0, d.AVP_CODE_Multiple_Services_Credit_Control) {
+		check(c_mscc.FindAVP(0, d.AVP_CODE_Validity_Time))
+		check(c_mscc.FindAVP(0, d.AVP_CODE_Final_Unit_Indication))
+	}
+
+	s.stopValidity()
+	if c_validity >= 0 {
+		s.validity_timer = time.AfterFunc(time.Duration(c_validity)*time.Second, s.validityExpired)
+	}
+	if s.fui != nil {
+		if cb := s.cl.conf.Callbacks.OnFinalUnit; cb != nil {
+			c_fui := *s.fui
+			c_todo.Add(func() { cb(s, c_fui) })
+		}
+	}
+}
+
+func (s *Session) startTx() {
+	c_hop_by_hop := s.hop_by_hop
+	s.tx_timer = time.AfterFunc(s.cl.conf.Tx, func() {
+		s.txExpired(c_hop_by_hop)
+	})
+}
+
+func (s *Session) stopTx() {
+	if s.tx_timer != nil {
+		s.tx_timer.Stop()
+		s.tx_timer = nil
+	}
+}
+
+func (s *Session) stopValidity() {
+	if s.validity_timer != nil {
+		s.validity_timer.Stop()
+		s.validity_timer = nil
+	}
+}
+
+// txExpired applies the failure handling when the answer of the request
+// with c_hop_by_hop did not arrive in time.
+func (s *Session) txExpired(c_hop_by_hop uint32) {
+	s.do(func(c_todo *app.Todo) error {
+		if s.hop_by_hop != c_hop_by_hop || s.tx_timer == nil {
+			return nil
+		}
+		s.tx_timer = nil
+		l.Warn.Printf("cc session %s: Tx expired in state %s", s.id, s.state)
+
+		switch s.state {
+		case STATE_PENDING_I, STATE_PENDING_U:
+			switch {
+			case s.ccfh == d.ENUM_CCFH_RETRY_AND_TERMINATE && !s.retried:
+				// sent again with T flag, the answer of either is accepted;
+				// the service is given meanwhile (RFC 4006 7)
+				s.retried = true
+				s.tx_expired = true
+				s.grant(nil, c_todo)
+				c_req := s.last_req
+				c_req.Set_retransmit_flag(true)
+				s.startTx()
+				c_todo.Add(func() { s.cl.base.Send(c_req) })
+			case s.ccfh == d.ENUM_CCFH_CONTINUE:
+				// the service goes on and the session stays pending, a
+				// late answer is still processed (RFC 4006 7)
+				s.tx_expired = true
+				s.grant(nil, c_todo)
+			default:
+				delete(s.cl.pending, s.hop_by_hop)
+				s.setState(STATE_IDLE, c_todo)
+				s.deny(ErrTxExpired, c_todo)
+			}
+		case STATE_PENDING_T:
+			delete(s.cl.pending, s.hop_by_hop)
+			s.setState(STATE_IDLE, c_todo)
+		case STATE_PENDING_E:
+			delete(s.cl.pending, s.hop_by_hop)
+			s.setState(STATE_IDLE, c_todo)
+			if s.ddfh == d.ENUM_DDFH_CONTINUE {
+				s.grant(nil, c_todo)
+			} else {
+				s.deny(ErrTxExpired, c_todo)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Session) validityExpired() {
+	s.autoUpdate(REASON_VALIDITY_TIME)
+}
+
+func (s *Session) reAuth() {
+	s.autoUpdate(REASON_REAUTH)
+}
+
+// abort terminates the session the server aborted with an ASR.
+func (s *Session) abort() {
+	c_cause := d.AVP_Enumerated(d.AVP_CODE_Termination_Cause, d.ENUM_TERMINATION_CAUSE_ADMINISTRATIVE, d.MAND, 0)
+	if err := s.Terminate([]d.AVP{c_cause}); err != nil {
+		l.Warn.Println("cc session", s.id, "cannot terminate after ASR:", err)
+	}
+}
+
+// autoUpdate sends a CCR-U in Open state, in the pending states the
+// expected answer brings the new authorization.
+func (s *Session) autoUpdate(reason UpdateReason) {
+	if s.State() != STATE_OPEN {
+		return
+	}
+	var avps []d.AVP
+	if cb := s.cl.conf.Callbacks.UpdateAVPs; cb != nil {
+		avps = cb(s, reason)
+	}
+	if err := s.Update(avps); err != nil {
+		l.Trace.Println("cc session", s.id, "no update:", err)
+	}
+}
+
+func hasAVP(avps []d.AVP, avp_code uint32) bool {
+	for _, v := range avps {
+		if v.GetAVPCode() == avp_code && v.GetVendorId() == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+package cc
+
+import (
+	"errors"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/internal/apptest"
+	"testing"
+	"time"
+)
+
+const test_tx = 30 * time.Millisecond
+
+// event is a callback of a session: "grant", "grant without answer" or
+// "terminate".
+type event struct {
+	name string
+	err  error
+}
+
+func newTestClient(ccfh int32) (*Client, chan d.Message, chan event) {
+	send_ch := make(chan d.Message, 10)
+	ev_ch := make(chan event, 10)
+	cl := NewClient(&apptest.Conn{}, send_ch, ClientConfig{
+		Tx:   test_tx,
+		CCFH: ccfh,
+		Callbacks: Callbacks{
+			OnGrant: func(s *Session, cca *d.Message) {
+				if cca == nil {
+					ev_ch <- event{name: "grant without answer"}
+				} else {
+					ev_ch <- event{name: "grant"}
+				}
+			},
+			OnTerminate: func(s *Session, err error) {
+				ev_ch <- event{name: "terminate", err: err}
+			},
+		},
+	})
+	return cl, send_ch, ev_ch
+}
+
+func nextRequest(t *testing.T, send_ch chan d.Message) d.Message {
+	t.Helper()
+	select {
+	case ret := <-send_ch:
+		return ret
+	case <-time.After(time.Second):
+		t.Fatal("no request sent")
+	}
+	return d.Message{}
+}
+
+func nextEvent(t *testing.T, ev_ch chan event) event {
+	t.Helper()
+	select {
+	case ret := <-ev_ch:
+		return ret
+	case <-time.After(time.Second):
+		t.Fatal("no callback")
+	}
+	return event{}
+}
+
+func noEvent(t *testing.T, ev_ch chan event) {
+	t.Helper()
+	select {
+	case ret := <-ev_ch:
+		t.Fatalf("unexpected callback %s %v", ret.name, ret.err)
+	case <-time.After(3 * test_tx):
+	}
+}
+
+func answerOf(req d.Message, c_result uint32) d.Message {
+	c_id := app.SessionId(&req)
+	return d.GenMess(d.CC_CREDIT_CONTROL, false, true, d.APPID_CC, req.Get_hop_by_hop(), req.Get_end_to_end(), []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, c_id, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Result_Code, c_result, d.MAND, 0),
+	})
+}
+
+// openSession starts a session and answers its CCR-I with success.
+func openSession(t *testing.T, cl *Client, send_ch chan d.Message, ev_ch chan event) *Session {
+	t.Helper()
+	s := cl.NewSession()
+	if err := s.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	cl.Handle(answerOf(nextRequest(t, send_ch), d.SUCCESS))
+	if c_ev := nextEvent(t, ev_ch); c_ev.name != "grant" {
+		t.Fatalf("CCA-I: %s", c_ev.name)
+	}
+	return s
+}
+
+// TestTxExpired checks the failure handling of a request without answer.
+// With CONTINUE the service is given, the session stays pending and the late
+// answer is still processed.
+func TestTxExpired(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		ccfh   int32
+		update bool
+		want   string
+	}{
+		{"CCR-I TERMINATE", d.ENUM_CCFH_TERMINATE, false, "terminate"},
+		{"CCR-U TERMINATE", d.ENUM_CCFH_TERMINATE, true, "terminate"},
+		{"CCR-I CONTINUE", d.ENUM_CCFH_CONTINUE, false, "grant without answer"},
+		{"CCR-U CONTINUE", d.ENUM_CCFH_CONTINUE, true, "grant without answer"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cl, send_ch, ev_ch := newTestClient(c.ccfh)
+			var s *Session
+			c_pending := STATE_PENDING_I
+			if c.update {
+				s = openSession(t, cl, send_ch, ev_ch)
+				if err := s.Update(nil); err != nil {
+					t.Fatal(err)
+				}
+				c_pending = STATE_PENDING_U
+			} else {
+				s = cl.NewSession()
+				if err := s.Start(nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c_req := nextRequest(t, send_ch)
+
+			c_ev := nextEvent(t, ev_ch)
+			if c_ev.name != c.want {
+				t.Fatalf("callback %s, want %s", c_ev.name, c.want)
+			}
+
+			if c_ev.name == "terminate" {
+				if !errors.Is(c_ev.err, ErrTxExpired) {
+					t.Errorf("terminate with %v", c_ev.err)
+				}
+				if st := s.State(); st != STATE_IDLE {
+					t.Errorf("state %s, want Idle", st)
+				}
+				if _, ok := cl.Session(s.Id()); ok {
+					t.Error("idle session kept by the client")
+				}
+				// the late answer is dropped
+				cl.Handle(answerOf(c_req, d.SUCCESS))
+				noEvent(t, ev_ch)
+				return
+			}
+
+			if st := s.State(); st != c_pending {
+				t.Errorf("state %s, want %s", st, c_pending)
+			}
+			cl.Handle(answerOf(c_req, d.SUCCESS))
+			if c_ev := nextEvent(t, ev_ch); c_ev.name != "grant" {
+				t.Fatalf("callback %s for the late answer, want grant", c_ev.name)
+			}
+			if st := s.State(); st != STATE_OPEN {
+				t.Errorf("state %s after the late answer, want Open", st)
+			}
+		})
+	}
+}
+
+// TestTxExpiredTerminate ends a session whose request is still pending
+// after Tx.
+func TestTxExpiredTerminate(t *testing.T) {
+	cl, send_ch, ev_ch := newTestClient(d.ENUM_CCFH_CONTINUE)
+	s := cl.NewSession()
+	if err := s.Terminate(nil); !errors.Is(err, ErrWrongState) {
+		t.Errorf("Terminate of an idle session: %v", err)
+	}
+	if err := s.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	nextRequest(t, send_ch)
+	if c_ev := nextEvent(t, ev_ch); c_ev.name != "grant without answer" {
+		t.Fatalf("callback %s", c_ev.name)
+	}
+	if err := s.Terminate(nil); err != nil {
+		t.Fatal(err)
+	}
+	c_req := nextRequest(t, send_ch)
+	if c_type := c_req.FindAVP(0, d.AVP_CODE_CC_Request_Type); c_type == nil || int32(c_type.GetIntValue()) != d.ENUM_CC_REQUEST_TERMINATION {
+		t.Errorf("CC-Request-Type %v, want TERMINATION_REQUEST", c_type)
+	}
+	cl.Handle(answerOf(c_req, d.SUCCESS))
+	if st := s.State(); st != STATE_IDLE {
+		t.Errorf("state %s, want Idle", st)
+	}
+}
+
+func TestTxExpiredRetry(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		update bool
+		// answered is true if the resent request gets its answer
+		answered bool
+	}{
+		{"CCR-I", false, false},
+		{"CCR-U", true, false},
+		{"CCR-I answered", false, true},
+		{"CCR-U answered", true, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cl, send_ch, ev_ch := newTestClient(d.ENUM_CCFH_RETRY_AND_TERMINATE)
+			var s *Session
+			if c.update {
+				s = openSession(t, cl, send_ch, ev_ch)
+				if err := s.Update(nil); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				s = cl.NewSession()
+				if err := s.Start(nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c_req := nextRequest(t, send_ch)
+
+			c_resent := nextRequest(t, send_ch)
+			if c_resent.GetCmdFlags()&0b00010000 == 0 {
+				t.Error("resent request without T flag")
+			}
+			if c_resent.Get_hop_by_hop() != c_req.Get_hop_by_hop() {
+				t.Errorf("resent with hop-by-hop 0x%08x, want 0x%08x", c_resent.Get_hop_by_hop(), c_req.Get_hop_by_hop())
+			}
+			// the service is given while the request is retried
+			if c_ev := nextEvent(t, ev_ch); c_ev.name != "grant without answer" {
+				t.Fatalf("callback %s at the retry", c_ev.name)
+			}
+
+			if c.answered {
+				cl.Handle(answerOf(c_resent, d.SUCCESS))
+				if c_ev := nextEvent(t, ev_ch); c_ev.name != "grant" {
+					t.Fatalf("callback %s, want grant", c_ev.name)
+				}
+				if st := s.State(); st != STATE_OPEN {
+					t.Errorf("state %s, want Open", st)
+				}
+				return
+			}
+			c_ev := nextEvent(t, ev_ch)
+			if c_ev.name != "terminate" || !errors.Is(c_ev.err, ErrTxExpired) {
+				t.Fatalf("callback %s %v, want terminate", c_ev.name, c_ev.err)
+			}
+			if st := s.State(); st != STATE_IDLE {
+				t.Errorf("state %s, want Idle", st)
+			}
+		})
+	}
+}
+
+func TestFailedAnswer(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		ccfh   int32
+		result uint32
+		want   string
+	}{
+		{"UNABLE_TO_DELIVER TERMINATE", d.ENUM_CCFH_TERMINATE, d.UNABLE_TO_DELIVER, "terminate"},
+		{"UNABLE_TO_DELIVER CONTINUE", d.ENUM_CCFH_CONTINUE, d.UNABLE_TO_DELIVER, "grant without answer"},
+		{"END_USER_SERVICE_DENIED CONTINUE", d.ENUM_CCFH_CONTINUE, d.END_USER_SERVICE_DENIED, "terminate"},
+		{"CREDIT_CONTROL_NOT_APPLICABLE", d.ENUM_CCFH_TERMINATE, d.CREDIT_CONTROL_NOT_APPLICABLE, "grant"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cl, send_ch, ev_ch := newTestClient(c.ccfh)
+			s := cl.NewSession()
+			if err := s.Start(nil); err != nil {
+				t.Fatal(err)
+			}
+			cl.Handle(answerOf(nextRequest(t, send_ch), c.result))
+			if c_ev := nextEvent(t, ev_ch); c_ev.name != c.want {
+				t.Fatalf("callback %s, want %s", c_ev.name, c.want)
+			}
+			if st := s.State(); st != STATE_IDLE {
+				t.Errorf("state %s, want Idle", st)
+			}
+		})
+	}
+}
+
+func TestTerminateTxExpired(t *testing.T) {
+	cl, send_ch, ev_ch := newTestClient(d.ENUM_CCFH_RETRY_AND_TERMINATE)
+	s := openSession(t, cl, send_ch, ev_ch)
+	if err := s.Terminate(nil); err != nil {
+		t.Fatal(err)
+	}
+	nextRequest(t, send_ch)
+	time.Sleep(3 * test_tx)
+	if st := s.State(); st != STATE_IDLE {
+		t.Errorf("state %s, want Idle", st)
+	}
+	select {
+	case <-send_ch:
+		t.Error("CCR-T sent again")
+	default:
+	}
+	if err := s.Update(nil); !errors.Is(err, ErrWrongState) {
+		t.Errorf("Update after the CCR-T: %v", err)
+	}
+}
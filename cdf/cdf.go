@@ -0,0 +1,174 @@
+// Package cdf is a charging data function stub, the server side of
+// Diameter accounting (RFC 6733 9, the base of Rf) for testing accounting
+// clients.
+//
+// Every received ACR is answered with success and written as a JSON line
+// to the file of the day in the records directory. The resent records are
+// marked as retransmitted, and as duplicate if the same Session-Id and
+// Accounting-Record-Number was received before.
+//
+//	c := cdf.New(conf)
+//	srv := conn.NewServer(conn.ServerConfig{Listen: ":3868", AcctAppIds: []uint32{d.APPID_ACCT}, Handler: c.Handle})
+package cdf
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Config sets up a CDF.
+type Config struct {
+	OriginHost  string `json:"origin_host"`
+	OriginRealm string `json:"origin_realm"`
+	// Dir is the records directory, the records are only logged if empty.
+	Dir string `json:"dir"`
+	// InterimInterval is the Acct-Interim-Interval in seconds of the
+	// answers to the START records, not sent if zero.
+	InterimInterval uint32 `json:"interim_interval,omitempty"`
+	// RealtimeRequired is the Accounting-Realtime-Required of the answers
+	// to the START records, a d.ENUM_ACCOUNTING_REALTIME value, not sent
+	// if zero.
+	RealtimeRequired int32 `json:"realtime_required,omitempty"`
+}
+
+// Record is a line of the records file.
+type Record struct {
+	Time         time.Time `json:"time"`
+	OriginHost   string    `json:"origin_host"`
+	SessionId    string    `json:"session_id"`
+	RecordType   int32     `json:"record_type"`
+	RecordNumber uint32    `json:"record_number"`
+	// Retransmitted is the T flag of the ACR.
+	Retransmitted bool `json:"retransmitted,omitempty"`
+	// Duplicate tells the record was received before.
+	Duplicate bool      `json:"duplicate,omitempty"`
+	ACR       d.Message `json:"acr"`
+}
+
+type record_key struct {
+	session_id    string
+	record_number uint32
+}
+
+// CDF answers the ACRs and writes their records.
+type CDF struct {
+	conf Config
+	ans  app.Answerer
+	mtx  sync.Mutex
+	// day is the date of the open file, seen has the records of the day.
+	day  string
+	file *os.File
+	seen map[record_key]bool
+}
+
+func New(conf Config) *CDF {
+	return &CDF{
+		conf: conf,
+		ans: app.Answerer{
+			OriginHost:  conf.OriginHost,
+			OriginRealm: conf.OriginRealm,
+			// the Acct-Application-Id of the ACR is echoed instead of an
+			// Auth-Application-Id
+			AppAVPs: func(app_id uint32) []d.AVP { return nil },
+			Echo:    []uint32{d.AVP_CODE_Accounting_Record_Type, d.AVP_CODE_Accounting_Record_Number, d.AVP_CODE_Acct_Application_Id},
+		},
+		seen: make(map[record_key]bool),
+	}
+}
+
+// Handle answers the ACRs, it is a conn.RequestHandler. Other requests get
+// 3001 with the E flag.
+func (c *CDF) Handle(req d.Message) (d.Message, bool) {
+	if req.GetCmdCode() != d.CC_ACCOUNTING {
+		l.Warn.Println("cdf: unsupported command", req.GetCmdCode(), "app", req.GetAppId())
+		return c.ans.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+	}
+	c_type := req.FindAVP(0, d.AVP_CODE_Accounting_Record_Type)
+	c_number := req.FindAVP(0, d.AVP_CODE_Accounting_Record_Number)
+	if c_type == nil || c_number == nil {
+		return c.ans.AnswerTo(req, d.MISSING_AVP), true
+	}
+	c_rec := Record{
+		Time:          time.Now(),
+		OriginHost:    app.StringValue(&req, d.AVP_CODE_Origin_Host),
+		SessionId:     app.SessionId(&req),
+		RecordType:    int32(c_type.GetIntValue()),
+		RecordNumber:  uint32(c_number.GetIntValue()),
+		Retransmitted: req.GetCmdFlags()&0b00010000 != 0,
+		ACR:           req,
+	}
+	if err := c.write(&c_rec); err != nil {
+		l.Error.Println("cdf: record of", c_rec.SessionId, err)
+		return c.ans.AnswerTo(req, d.UNABLE_TO_COMPLY), true
+	}
+	l.Info.Printf("cdf: %s record %d type %d from %s retransmitted %t duplicate %t", c_rec.SessionId, c_rec.RecordNumber, c_rec.RecordType, c_rec.OriginHost, c_rec.Retransmitted, c_rec.Duplicate)
+
+	var c_avps []d.AVP
+	if c_rec.RecordType == d.ENUM_ACCOUNTING_RECORD_START {
+		if c.conf.InterimInterval != 0 {
+			c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Acct_Interim_Interval, c.conf.InterimInterval, d.MAND, 0))
+		}
+		if c.conf.RealtimeRequired != 0 {
+			c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Accounting_Realtime_Required, c.conf.RealtimeRequired, d.MAND, 0))
+		}
+	}
+	return c.ans.AnswerTo(req, d.SUCCESS, c_avps...), true
+}
+
+// Close closes the records file.
+func (c *CDF) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	c.day = ""
+	return err
+}
+
+// write sets the Duplicate of rec and appends it to the file of the day.
+// The duplicates are looked for within the day.
+func (c *CDF) write(rec *Record) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c_day := rec.Time.Format("20060102")
+	if c_day != c.day {
+		c.seen = make(map[record_key]bool)
+		if c.file != nil {
+			c.file.Close()
+			c.file = nil
+		}
+		c.day = c_day
+	}
+	c_key := record_key{rec.SessionId, rec.RecordNumber}
+	rec.Duplicate = c.seen[c_key]
+	c.seen[c_key] = true
+	if c.conf.Dir == "" {
+		return nil
+	}
+	if c.file == nil {
+		if err := os.MkdirAll(c.conf.Dir, 0755); err != nil {
+			return err
+		}
+		c_file, err := os.OpenFile(filepath.Join(c.conf.Dir, "acr-"+c_day+".json"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		c.file = c_file
+	}
+	c_line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	_, err = c.file.Write(append(c_line, '\n'))
+	return err
+}
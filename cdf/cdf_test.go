@@ -0,0 +1,137 @@
+package cdf
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if err := d.InitWith("../dict", d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func acr(session_id string, record_type int32, record_number uint32) d.Message {
+	return d.GenMess(d.CC_ACCOUNTING, true, true, d.APPID_ACCT, 7, 8, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, session_id, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, "client.test", d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, "test", d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_Accounting_Record_Type, record_type, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Accounting_Record_Number, record_number, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Acct_Application_Id, d.APPID_ACCT, d.MAND, 0),
+	})
+}
+
+func handle(t *testing.T, c *CDF, req d.Message) d.Message {
+	t.Helper()
+	ans, ok := c.Handle(req)
+	if !ok {
+		t.Fatal("no answer")
+	}
+	if ans.IsRequest() || ans.Get_hop_by_hop() != req.Get_hop_by_hop() {
+		t.Error("not the answer of the request")
+	}
+	return ans
+}
+
+func TestACA(t *testing.T) {
+	c := New(Config{OriginHost: "cdf.test", OriginRealm: "test", InterimInterval: 60})
+	for _, c_type := range []int32{d.ENUM_ACCOUNTING_RECORD_START, d.ENUM_ACCOUNTING_RECORD_INTERIM} {
+		ans := handle(t, c, acr("s1", c_type, 1))
+		if c_result := app.ResultCode(&ans); c_result != d.SUCCESS {
+			t.Fatalf("record type %d: Result-Code %d", c_type, c_result)
+		}
+		if app.SessionId(&ans) != "s1" || app.StringValue(&ans, d.AVP_CODE_Origin_Host) != "cdf.test" {
+			t.Errorf("record type %d: %s", c_type, ans.ToString())
+		}
+		if c_avp := ans.FindAVP(0, d.AVP_CODE_Accounting_Record_Type); c_avp == nil || int32(c_avp.GetIntValue()) != c_type {
+			t.Errorf("record type %d: Accounting-Record-Type %v", c_type, c_avp)
+		}
+		if c_avp := ans.FindAVP(0, d.AVP_CODE_Accounting_Record_Number); c_avp == nil || c_avp.GetIntValue() != 1 {
+			t.Errorf("record type %d: Accounting-Record-Number %v", c_type, c_avp)
+		}
+		if c_avp := ans.FindAVP(0, d.AVP_CODE_Acct_Application_Id); c_avp == nil || uint32(c_avp.GetIntValue()) != d.APPID_ACCT {
+			t.Errorf("record type %d: Acct-Application-Id %v", c_type, c_avp)
+		}
+		if ans.FindAVP(0, d.AVP_CODE_Auth_Application_Id) != nil {
+			t.Errorf("record type %d: Auth-Application-Id in the answer", c_type)
+		}
+		// only the answer to the START has the interim interval
+		c_interval := ans.FindAVP(0, d.AVP_CODE_Acct_Interim_Interval)
+		if c_type == d.ENUM_ACCOUNTING_RECORD_START && (c_interval == nil || c_interval.GetIntValue() != 60) {
+			t.Errorf("Acct-Interim-Interval %v", c_interval)
+		}
+		if c_type != d.ENUM_ACCOUNTING_RECORD_START && c_interval != nil {
+			t.Errorf("record type %d: Acct-Interim-Interval in the answer", c_type)
+		}
+	}
+}
+
+// TestRecords writes the records to the file of the day, the resent ones
+// are retransmitted and duplicate if received before.
+func TestRecords(t *testing.T) {
+	c_dir := t.TempDir()
+	c := New(Config{OriginHost: "cdf.test", OriginRealm: "test", Dir: c_dir})
+	handle(t, c, acr("s1", d.ENUM_ACCOUNTING_RECORD_START, 0))
+	c_resent := acr("s1", d.ENUM_ACCOUNTING_RECORD_START, 0)
+	c_resent.Set_retransmit_flag(true)
+	handle(t, c, c_resent)
+	// a record sent the first time from the buffer of the client
+	c_buffered := acr("s1", d.ENUM_ACCOUNTING_RECORD_STOP, 1)
+	c_buffered.Set_retransmit_flag(true)
+	handle(t, c, c_buffered)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c_file, err := os.Open(filepath.Join(c_dir, "acr-"+time.Now().Format("20060102")+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c_file.Close()
+	var c_recs []Record
+	c_scanner := bufio.NewScanner(c_file)
+	for c_scanner.Scan() {
+		var c_rec Record
+		if err := json.Unmarshal(c_scanner.Bytes(), &c_rec); err != nil {
+			t.Fatal(err)
+		}
+		c_recs = append(c_recs, c_rec)
+	}
+	if err := c_scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct {
+		record_number uint32
+		retransmitted bool
+		duplicate     bool
+	}{{0, false, false}, {0, true, true}, {1, true, false}} {
+		if i >= len(c_recs) {
+			t.Fatalf("%d records, want 3", len(c_recs))
+		}
+		got := c_recs[i]
+		if got.SessionId != "s1" || got.OriginHost != "client.test" || got.RecordNumber != want.record_number ||
+			got.Retransmitted != want.retransmitted || got.Duplicate != want.duplicate {
+			t.Errorf("record %d: %+v", i, got)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	c := New(Config{OriginHost: "cdf.test", OriginRealm: "test"})
+	ans := handle(t, c, d.GenMess(d.CC_RE_AUTH, true, true, d.APPID_ACCT, 7, 8, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "s1", d.MAND, 0),
+	}))
+	if c_result := app.ResultCode(&ans); c_result != d.COMMAND_UNSUPPORTED || ans.GetCmdFlags()&0b00100000 == 0 {
+		t.Errorf("Result-Code %d flags 0x%x, want 3001 with the E flag", c_result, ans.GetCmdFlags())
+	}
+}
@@ -0,0 +1,120 @@
+// bmscsim is a BM-SC stub: it accepts the GGSNs as diameter peers and
+// answers their Gmb registrations and MBMS UE context activations for the
+// services of a JSON file in the format of bmsc.Config. The MBMS sessions
+// are driven by the commands read from the standard input:
+//
+//	start <service>
+//	stop <service>
+//	deregister <service>
+//	sessions <service>
+//
+//	bmscsim -listen :3868 -config bmsc.json
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/lehotomi/diam/bmsc"
+	"github.com/lehotomi/diam/conn"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	listen := flag.String("listen", ":3868", "address to accept the peers on")
+	conf_file := flag.String("config", "", "BM-SC configuration (JSON)")
+	dict_dir := flag.String("dict", "dict", "dictionary directory")
+	origin_host := flag.String("origin_host", "bmsc.sim", "Origin-Host, unless set by the configuration")
+	origin_realm := flag.String("origin_realm", "sim", "Origin-Realm, unless set by the configuration")
+	flag.Parse()
+
+	l.Init(os.Stdout, os.Stdout, os.Stderr, os.Stderr, log.Lshortfile|log.Ltime)
+
+	if err := d.InitWith(*dict_dir, d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var c_conf bmsc.Config
+	if *conf_file != "" {
+		c_data, err := ioutil.ReadFile(*conf_file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err := json.Unmarshal(c_data, &c_conf); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *conf_file, err)
+			os.Exit(2)
+		}
+	}
+	if c_conf.OriginHost == "" {
+		c_conf.OriginHost = *origin_host
+	}
+	if c_conf.OriginRealm == "" {
+		c_conf.OriginRealm = *origin_realm
+	}
+
+	c_bmsc := bmsc.New(c_conf)
+	c_srv := conn.NewServer(conn.ServerConfig{
+		Name:          "bmscsim",
+		Listen:        *listen,
+		OriginHost:    c_conf.OriginHost,
+		OriginRealm:   c_conf.OriginRealm,
+		ProductName:   "bmscsim",
+		AuthAppIds:    []uint32{d.APPID_GMB},
+		Handler:       c_bmsc.Handle,
+		AnswerHandler: c_bmsc.HandleAnswer,
+	})
+	c_bmsc.SetSender(c_srv)
+	if err := c_srv.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	go commands(c_bmsc)
+
+	sig_ch := make(chan os.Signal, 1)
+	signal.Notify(sig_ch, os.Interrupt, syscall.SIGTERM)
+	<-sig_ch
+	c_srv.Stop()
+}
+
+// commands runs the commands of the standard input until it is closed.
+func commands(b *bmsc.BMSC) {
+	c_scanner := bufio.NewScanner(os.Stdin)
+	for c_scanner.Scan() {
+		c_fields := strings.Fields(c_scanner.Text())
+		if len(c_fields) == 0 {
+			continue
+		}
+		if len(c_fields) != 2 {
+			fmt.Println("usage: start|stop|deregister|sessions <service>")
+			continue
+		}
+		var err error
+		switch c_fields[0] {
+		case "start":
+			err = b.Start(c_fields[1], nil)
+		case "stop":
+			err = b.Stop(c_fields[1])
+		case "deregister":
+			err = b.Deregister(c_fields[1])
+		case "sessions":
+			for _, v := range b.Sessions(c_fields[1]) {
+				fmt.Println(v)
+			}
+		default:
+			err = fmt.Errorf("unknown command %s", c_fields[0])
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
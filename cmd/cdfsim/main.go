@@ -0,0 +1,85 @@
+// cdfsim is a charging data function stub: it accepts diameter peers,
+// answers their accounting requests and writes the records to a JSON
+// lines file per day.
+//
+//	cdfsim -listen :3868 -dir records -interim 300
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/lehotomi/diam/cdf"
+	"github.com/lehotomi/diam/conn"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	listen := flag.String("listen", ":3868", "address to accept the peers on")
+	conf_file := flag.String("config", "", "CDF configuration (JSON)")
+	dict_dir := flag.String("dict", "dict", "dictionary directory")
+	origin_host := flag.String("origin_host", "cdf.sim", "Origin-Host, unless set by the configuration")
+	origin_realm := flag.String("origin_realm", "sim", "Origin-Realm, unless set by the configuration")
+	dir := flag.String("dir", "records", "records directory, unless set by the configuration")
+	interim := flag.Uint("interim", 0, "Acct-Interim-Interval (s) of the START answers, unless set by the configuration")
+	flag.Parse()
+
+	l.Init(os.Stdout, os.Stdout, os.Stderr, os.Stderr, log.Lshortfile|log.Ltime)
+
+	if err := d.InitWith(*dict_dir, d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var c_conf cdf.Config
+	if *conf_file != "" {
+		c_data, err := ioutil.ReadFile(*conf_file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err := json.Unmarshal(c_data, &c_conf); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *conf_file, err)
+			os.Exit(2)
+		}
+	}
+	if c_conf.OriginHost == "" {
+		c_conf.OriginHost = *origin_host
+	}
+	if c_conf.OriginRealm == "" {
+		c_conf.OriginRealm = *origin_realm
+	}
+	if c_conf.Dir == "" {
+		c_conf.Dir = *dir
+	}
+	if c_conf.InterimInterval == 0 {
+		c_conf.InterimInterval = uint32(*interim)
+	}
+
+	c_cdf := cdf.New(c_conf)
+	c_srv := conn.NewServer(conn.ServerConfig{
+		Name:        "cdfsim",
+		Listen:      *listen,
+		OriginHost:  c_conf.OriginHost,
+		OriginRealm: c_conf.OriginRealm,
+		ProductName: "cdfsim",
+		AcctAppIds:  []uint32{d.APPID_ACCT},
+		Handler:     c_cdf.Handle,
+	})
+	if err := c_srv.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	sig_ch := make(chan os.Signal, 1)
+	signal.Notify(sig_ch, os.Interrupt, syscall.SIGTERM)
+	<-sig_ch
+	c_srv.Stop()
+	c_cdf.Close()
+}
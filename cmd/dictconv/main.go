@@ -0,0 +1,60 @@
+// dictconv reads dictionaries in any format known by the diam package (json,
+// wireshark/freeDiameter xml, go-diameter xml) and writes them out as one json
+// dictionary.
+//
+//	dictconv -o dict/dict_base.json dict/other/dictionary.xml
+package main
+
+import (
+	"flag"
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"io"
+	"os"
+)
+
+func main() {
+	out := flag.String("o", "", "output file (default stdout)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dictconv [-o out.json] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var defs []d.DictDef
+	for _, c_file := range flag.Args() {
+		c_def, err := d.LoadDictFile(c_file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defs = append(defs, c_def)
+	}
+	// the dictionary resolves the vendor symbols of the xml files
+	dc := d.NewDictionary()
+	if err := dc.AddDefs(defs, d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		c_file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer c_file.Close()
+		w = c_file
+	}
+
+	if err := d.WriteJSONDef(w, dc.Def()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,139 @@
+// hpcrfsim is an H-PCRF simulator: it accepts the V-PCRFs as diameter
+// peers and answers the subsessions of their S9 CCRs with the rule sets of
+// a JSON file in the format of pcrf.Config, as pcrfsim answers Gx. The
+// standard input takes the commands:
+//
+//	sessions
+//	push <session> <subsession> <rule set>
+//	release <session> <subsession>
+//	close <session>
+//
+//	hpcrfsim -listen :3868 -config pcrf.json
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/lehotomi/diam/conn"
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/hpcrf"
+	l "github.com/lehotomi/diam/mlog"
+	"github.com/lehotomi/diam/pcrf"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	listen := flag.String("listen", ":3868", "address to accept the peers on")
+	conf_file := flag.String("config", "", "PCRF configuration (JSON)")
+	dict_dir := flag.String("dict", "dict", "dictionary directory")
+	origin_host := flag.String("origin_host", "hpcrf.sim", "Origin-Host, unless set by the configuration")
+	origin_realm := flag.String("origin_realm", "home", "Origin-Realm, unless set by the configuration")
+	flag.Parse()
+
+	l.Init(os.Stdout, os.Stdout, os.Stderr, os.Stderr, log.Lshortfile|log.Ltime)
+
+	if err := d.InitWith(*dict_dir, d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var c_conf pcrf.Config
+	if *conf_file != "" {
+		c_data, err := ioutil.ReadFile(*conf_file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err := json.Unmarshal(c_data, &c_conf); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *conf_file, err)
+			os.Exit(2)
+		}
+	}
+	if c_conf.OriginHost == "" {
+		c_conf.OriginHost = *origin_host
+	}
+	if c_conf.OriginRealm == "" {
+		c_conf.OriginRealm = *origin_realm
+	}
+
+	c_hpcrf := hpcrf.New(c_conf)
+	c_srv := conn.NewServer(conn.ServerConfig{
+		Name:        "hpcrfsim",
+		Listen:      *listen,
+		OriginHost:  c_conf.OriginHost,
+		OriginRealm: c_conf.OriginRealm,
+		ProductName: "hpcrfsim",
+		AuthAppIds:  []uint32{d.APPID_S9, d.APPID_RX},
+		Handler:     c_hpcrf.Handle,
+		AnswerHandler: func(ans d.Message) {
+			l.Info.Println("hpcrfsim: answer", ans.Format(d.FormatOptions{Mode: d.FORMAT_COMPACT}))
+			c_hpcrf.HandleAnswer(ans)
+		},
+	})
+	c_hpcrf.SetSender(c_srv)
+	if err := c_srv.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	go commands(c_hpcrf)
+
+	sig_ch := make(chan os.Signal, 1)
+	signal.Notify(sig_ch, os.Interrupt, syscall.SIGTERM)
+	<-sig_ch
+	c_srv.Stop()
+}
+
+// commands runs the commands of the standard input until it is closed.
+func commands(h *hpcrf.HPCRF) {
+	c_scanner := bufio.NewScanner(os.Stdin)
+	for c_scanner.Scan() {
+		c_fields := strings.Fields(c_scanner.Text())
+		if len(c_fields) == 0 {
+			continue
+		}
+		var err error
+		switch {
+		case c_fields[0] == "sessions" && len(c_fields) == 1:
+			for _, v := range h.Sessions() {
+				fmt.Println(v)
+				for _, c_sub := range h.Subsessions(v) {
+					c_set, _ := h.RuleSet(v, c_sub)
+					fmt.Printf("  subsession %d rule set %s\n", c_sub, c_set)
+				}
+			}
+		case c_fields[0] == "push" && len(c_fields) == 4:
+			var c_sub uint32
+			if c_sub, err = subsessionId(c_fields[2]); err == nil {
+				err = h.PushRuleSet(c_fields[1], c_sub, c_fields[3])
+			}
+		case c_fields[0] == "release" && len(c_fields) == 3:
+			var c_sub uint32
+			if c_sub, err = subsessionId(c_fields[2]); err == nil {
+				err = h.Release(c_fields[1], c_sub, d.ENUM_SESSION_RELEASE_UNSPECIFIED)
+			}
+		case c_fields[0] == "close" && len(c_fields) == 2:
+			err = h.ReleaseSession(c_fields[1], d.ENUM_SESSION_RELEASE_UNSPECIFIED)
+		default:
+			fmt.Println("usage: sessions | push <session> <subsession> <rule set> | release <session> <subsession> | close <session>")
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func subsessionId(s string) (uint32, error) {
+	c_val, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid subsession %q", s)
+	}
+	return uint32(c_val), nil
+}
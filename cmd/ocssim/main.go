@@ -0,0 +1,80 @@
+// ocssim is an online charging server simulator: it accepts diameter peers
+// and answers their CCRs from the balances and rules of a JSON file in the
+// format of ocs.Config.
+//
+//	ocssim -listen :3868 -config ocs.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/lehotomi/diam/conn"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"github.com/lehotomi/diam/ocs"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	listen := flag.String("listen", ":3868", "address to accept the peers on")
+	conf_file := flag.String("config", "", "OCS configuration (JSON)")
+	dict_dir := flag.String("dict", "dict", "dictionary directory")
+	origin_host := flag.String("origin_host", "ocs.sim", "Origin-Host, unless set by the configuration")
+	origin_realm := flag.String("origin_realm", "sim", "Origin-Realm, unless set by the configuration")
+	flag.Parse()
+
+	l.Init(os.Stdout, os.Stdout, os.Stderr, os.Stderr, log.Lshortfile|log.Ltime)
+
+	if err := d.InitWith(*dict_dir, d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var c_conf ocs.Config
+	if *conf_file != "" {
+		c_data, err := ioutil.ReadFile(*conf_file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err := json.Unmarshal(c_data, &c_conf); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *conf_file, err)
+			os.Exit(2)
+		}
+		if err := c_conf.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *conf_file, err)
+			os.Exit(2)
+		}
+	}
+	if c_conf.OriginHost == "" {
+		c_conf.OriginHost = *origin_host
+	}
+	if c_conf.OriginRealm == "" {
+		c_conf.OriginRealm = *origin_realm
+	}
+
+	c_ocs := ocs.New(c_conf)
+	c_srv := conn.NewServer(conn.ServerConfig{
+		Name:        "ocssim",
+		Listen:      *listen,
+		OriginHost:  c_conf.OriginHost,
+		OriginRealm: c_conf.OriginRealm,
+		ProductName: "ocssim",
+		AuthAppIds:  []uint32{d.APPID_CC},
+		Handler:     c_ocs.Handle,
+	})
+	if err := c_srv.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	sig_ch := make(chan os.Signal, 1)
+	signal.Notify(sig_ch, os.Interrupt, syscall.SIGTERM)
+	<-sig_ch
+	c_srv.Stop()
+}
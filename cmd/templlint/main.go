@@ -0,0 +1,46 @@
+// templlint checks the templates of the given directories and prints one
+// line per problem found. The rows are checked against the dictionaries of
+// the -dict directory.
+//
+//	templlint -dict dict templates
+package main
+
+import (
+	"flag"
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	templates "github.com/lehotomi/diam/templ"
+	"os"
+)
+
+func main() {
+	dict_dir := flag.String("dict", "dict", "dictionary directory")
+	strict := flag.Bool("strict", false, "conflicting dictionary definitions are errors")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: templlint [-dict dir] [-strict] template_dir...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c_dict := d.NewDictionary()
+	if err := c_dict.Load(*dict_dir, d.LoadOptions{Strict: *strict}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	c_problems := 0
+	for _, c_dir := range flag.Args() {
+		for _, err := range templates.Lint(c_dir, c_dict) {
+			fmt.Println(err)
+			c_problems++
+		}
+	}
+	if c_problems > 0 {
+		os.Exit(1)
+	}
+}
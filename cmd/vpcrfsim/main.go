@@ -0,0 +1,204 @@
+// vpcrfsim is a V-PCRF simulator: it connects to an H-PCRF and runs the S9
+// sessions of roaming UEs, every PDN connection of a UE is a subsession.
+// The decisions of the H-PCRF are printed, the sessions are driven by the
+// commands read from the standard input:
+//
+//	open <imsi> <ue ip> <apn>
+//	add <session> <ue ip> <apn>
+//	report <session> <subsession> <event trigger>
+//	drop <session> <subsession>
+//	close <session>
+//	sessions
+//
+//	vpcrfsim -peer hpcrf:3868 -destination_realm home
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/lehotomi/diam/conn"
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/gx"
+	l "github.com/lehotomi/diam/mlog"
+	"github.com/lehotomi/diam/rx"
+	"github.com/lehotomi/diam/s9"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	peer := flag.String("peer", "127.0.0.1:3868", "address of the H-PCRF")
+	dict_dir := flag.String("dict", "dict", "dictionary directory")
+	origin_host := flag.String("origin_host", "vpcrf.sim", "Origin-Host")
+	origin_realm := flag.String("origin_realm", "visited", "Origin-Realm")
+	destination_realm := flag.String("destination_realm", "home", "Destination-Realm, the realm of the H-PCRF")
+	host_ip := flag.String("host_ip", "127.0.0.1", "Host-IP-Address of the CER")
+	flag.Parse()
+
+	l.Init(os.Stdout, os.Stdout, os.Stderr, os.Stderr, log.Lshortfile|log.Ltime)
+
+	if err := d.InitWith(*dict_dir, d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	send_ch := make(chan d.Message, 100)
+	rcv_ch := make(chan d.Message, 100)
+	mgmt_ch := make(chan conn.Event, 10)
+	c_conn := conn.NewDiamConn(send_ch, rcv_ch, mgmt_ch, map[string]interface{}{
+		"name":     "vpcrfsim",
+		"tcp_conf": map[string]string{"peer": *peer},
+		"diam_conf": map[string]string{
+			"origin_host":       *origin_host,
+			"origin_realm":      *origin_realm,
+			"destination_realm": *destination_realm,
+			"host_ip":           *host_ip,
+			"auth_app_ids":      strconv.Itoa(d.APPID_S9),
+		},
+	})
+	c_cl := s9.NewClient(&c_conn, send_ch, s9.ClientConfig{Callbacks: s9.Callbacks{
+		OnDecision: func(s *s9.Session, dec s9.Subsession, installed []gx.Rule, removed []gx.Rule) {
+			fmt.Printf("%s subsession %d: installed %s removed %s\n", s.Id(), dec.Id, names(installed), names(removed))
+		},
+		OnTerminate: func(s *s9.Session, err error) {
+			if err != nil {
+				fmt.Println(s.Id(), "terminated:", err)
+			} else {
+				fmt.Println(s.Id(), "terminated")
+			}
+		},
+	}})
+	c_cl.Register(&c_conn)
+	c_conn.Start()
+	go func() {
+		for v := range mgmt_ch {
+			l.Info.Println("vpcrfsim: connection event", v.Eid)
+		}
+	}()
+	go c_cl.Run(rcv_ch, nil)
+	go commands(c_cl)
+
+	sig_ch := make(chan os.Signal, 1)
+	signal.Notify(sig_ch, os.Interrupt, syscall.SIGTERM)
+	<-sig_ch
+}
+
+// commands runs the commands of the standard input until it is closed.
+func commands(cl *s9.Client) {
+	c_scanner := bufio.NewScanner(os.Stdin)
+	for c_scanner.Scan() {
+		c_fields := strings.Fields(c_scanner.Text())
+		if len(c_fields) == 0 {
+			continue
+		}
+		var err error
+		switch {
+		case c_fields[0] == "open" && len(c_fields) == 4:
+			err = open(cl, c_fields[1], c_fields[2], c_fields[3])
+		case c_fields[0] == "add" && len(c_fields) == 4:
+			err = withSession(cl, c_fields[1], func(s *s9.Session) error {
+				c_info, err := establishment(s.NextSubsession(), c_fields[2], c_fields[3])
+				if err != nil {
+					return err
+				}
+				return s.Update(nil, c_info)
+			})
+		case c_fields[0] == "report" && len(c_fields) == 4:
+			c_trigger, err_trigger := strconv.ParseInt(c_fields[3], 10, 32)
+			if err_trigger != nil {
+				err = fmt.Errorf("invalid event trigger %q", c_fields[3])
+				break
+			}
+			err = withSubsession(cl, c_fields[1], c_fields[2], func(s *s9.Session, sub uint32) error {
+				return s.Update(nil, s9.EnforcementInfo(sub, d.ENUM_SUBSESSION_OPERATION_MODIFICATION, []d.AVP{
+					d.AVP_Enumerated(d.AVP_CODE_Event_Trigger, int32(c_trigger), d.MAND, d.VENDOR_3GPP),
+				}))
+			})
+		case c_fields[0] == "drop" && len(c_fields) == 3:
+			err = withSubsession(cl, c_fields[1], c_fields[2], func(s *s9.Session, sub uint32) error {
+				return s.Update(nil, s9.EnforcementInfo(sub, d.ENUM_SUBSESSION_OPERATION_TERMINATION, nil))
+			})
+		case c_fields[0] == "close" && len(c_fields) == 2:
+			err = withSession(cl, c_fields[1], func(s *s9.Session) error {
+				return s.Terminate(nil)
+			})
+		case c_fields[0] == "sessions" && len(c_fields) == 1:
+			for _, s := range cl.Sessions() {
+				fmt.Println(s.Id(), s.State())
+				for _, c_sub := range s.Subsessions() {
+					fmt.Printf("  subsession %d rules %s triggers %v\n", c_sub, names(s.Rules(c_sub)), s.Triggers(c_sub))
+				}
+			}
+		default:
+			fmt.Println("usage: open <imsi> <ue ip> <apn> | add <session> <ue ip> <apn> | report <session> <subsession> <event trigger> | drop <session> <subsession> | close <session> | sessions")
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// open starts the S9 session of a UE with its first subsession.
+func open(cl *s9.Client, imsi string, ip string, apn string) error {
+	s := cl.NewSession()
+	c_info, err := establishment(s.NextSubsession(), ip, apn)
+	if err != nil {
+		return err
+	}
+	if err := s.Start([]d.AVP{
+		d.AVP_Group(d.AVP_CODE_Subscription_Id, []d.AVP{
+			d.AVP_Enumerated(d.AVP_CODE_Subscription_Id_Type, d.ENUM_SUBSCRIPTION_ID_IMSI, d.MAND, 0),
+			d.AVP_UTF8String(d.AVP_CODE_Subscription_Id_Data, imsi, d.MAND, 0),
+		}, d.MAND, 0),
+	}, c_info); err != nil {
+		return err
+	}
+	fmt.Println(s.Id())
+	return nil
+}
+
+// establishment is the Subsession-Enforcement-Info of a new PDN connection
+// over E-UTRAN.
+func establishment(sub uint32, ip string, apn string) (d.AVP, error) {
+	c_ip, err := rx.UEAddress(ip)
+	if err != nil {
+		return d.AVP{}, err
+	}
+	return s9.EnforcementInfo(sub, d.ENUM_SUBSESSION_OPERATION_ESTABLISHMENT, []d.AVP{
+		c_ip,
+		d.AVP_UTF8String(d.AVP_CODE_Called_Station_Id, apn, d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_IP_CAN_Type, d.ENUM_IP_CAN_TYPE_3GPP_EPS, d.MAND, d.VENDOR_3GPP),
+		d.AVP_Enumerated(d.AVP_CODE_RAT_Type, d.ENUM_RAT_TYPE_EUTRAN, false, d.VENDOR_3GPP),
+	}), nil
+}
+
+func withSession(cl *s9.Client, id string, f func(s *s9.Session) error) error {
+	s, ok := cl.Session(id)
+	if !ok {
+		return fmt.Errorf("unknown session %s", id)
+	}
+	return f(s)
+}
+
+func withSubsession(cl *s9.Client, id string, sub string, f func(s *s9.Session, sub uint32) error) error {
+	c_sub, err := strconv.ParseUint(sub, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid subsession %q", sub)
+	}
+	return withSession(cl, id, func(s *s9.Session) error {
+		return f(s, uint32(c_sub))
+	})
+}
+
+func names(rules []gx.Rule) []string {
+	ret := []string{}
+	for _, v := range rules {
+		ret = append(ret, v.Name)
+	}
+	return ret
+}
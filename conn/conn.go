@@ -3,8 +3,10 @@ package conn
 import (
 	"bytes"
 	bin "encoding/binary"
+	d "github.com/lehotomi/diam/diam"
 	l "github.com/lehotomi/diam/mlog"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +23,9 @@ type ConnParam struct {
 	rcvd_ch  chan []byte
 	write_ch chan []byte
 	state    int
+	// reconnect_wait is the wait before connecting again after a DPR, -1
+	// stops reconnecting. It is accessed with sync/atomic.
+	reconnect_wait int64
 }
 
 func CreateNewConn(conf map[string]interface{}, mgmt_ch chan Event, send_ch chan []byte, write_ch chan []byte) ConnParam {
@@ -54,40 +59,49 @@ func (c *ConnParam) readLoop() {
 
 		i := 0
 		for {
-			if len(collect) == 0 {
-				break
-			}
-			if len(collect) < 20 {
-				l.Trace.Println("buffer contains less than 20:", collect)
-				break
-			}
-			length_b := make([]byte, 4)
-			copy(length_b, collect[0:4])
-			c_version := collect[0]
-			if c_version != 1 {
-				l.Trace.Println("invalid diameter message header:", collect)
+			c_part, c_rest, bad := nextMessage(collect)
+			if bad {
+				l.Warn.Printf("invalid diameter message header:\n%s", d.HexDump(collect))
 				collect = collect[0:0]
 				break
 			}
-			length_b[0] = 0
-			c_length := int(byteArrayToInt(length_b))
-
-			if len(collect) < c_length {
-				l.Trace.Println("c_length:", i, len(collect), c_length)
+			if c_part == nil {
 				l.Trace.Println("diam message not complete", collect)
 				break
 			}
-			l.Trace.Println("message complete:", collect)
-			l.Trace.Println("c_length:", i, c_length)
+			l.Trace.Println("message complete:", c_part)
+			l.Trace.Println("c_length:", i, len(c_part))
 
-			c_part := collect[0:c_length]
-			collect = collect[c_length:]
+			collect = c_rest
 			c.rcvd_ch <- c_part
 			i = i + 1
 		}
 	}
 }
 
+// nextMessage cuts the first complete message from collect, msg is nil if
+// it is not complete yet. bad means collect does not start with a diameter
+// header.
+func nextMessage(collect []byte) (msg []byte, rest []byte, bad bool) {
+	if len(collect) < 20 {
+		return nil, collect, false
+	}
+	if collect[0] != 1 {
+		return nil, collect, true
+	}
+	length_b := make([]byte, 4)
+	copy(length_b, collect[0:4])
+	length_b[0] = 0
+	c_length := int(byteArrayToInt(length_b))
+	if c_length < 20 {
+		return nil, collect, true
+	}
+	if len(collect) < c_length {
+		return nil, collect, false
+	}
+	return collect[0:c_length], collect[c_length:], false
+}
+
 func (c *ConnParam) Start() {
 	for i := 0; i < 10; i++ {
 		go c.Writer(i) //??MORE
@@ -96,6 +110,12 @@ func (c *ConnParam) Start() {
 	for {
 		c.init()
 		c.readLoop()
+		c_wait := time.Duration(atomic.SwapInt64(&c.reconnect_wait, 0))
+		if c_wait < 0 {
+			l.Info.Println(c.name, "not reconnecting to", c.peer)
+			return
+		}
+		time.Sleep(c_wait)
 	}
 
 }
@@ -120,6 +140,21 @@ func (c *ConnParam) Writer(cli int) {
 
 }
 
+// writeAndClose writes b, then closes the connection. It is set up again
+// after wait, a negative wait leaves it closed.
+func (c *ConnParam) writeAndClose(b []byte, wait time.Duration) {
+	if c.state == DOWN || c.Conn == nil {
+		l.Warn.Println(c.name, "trying to write, but tcp connection is down:", b)
+		return
+	}
+	if wait < 0 {
+		wait = -1
+	}
+	atomic.StoreInt64(&c.reconnect_wait, int64(wait))
+	c.Conn.Write(b)
+	c.Conn.Close()
+}
+
 func (c *ConnParam) init() {
 	c_dial := net.Dialer{
 		Timeout: 2 * time.Second,
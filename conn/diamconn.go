@@ -6,6 +6,7 @@ import (
 	l "github.com/lehotomi/diam/mlog"
 	"math/rand"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -29,7 +30,7 @@ type DiamConn struct {
 	name              string
 	diam_conf         map[string]string
 	tcp_conf          map[string]string
-	tcp_conn          ConnParam
+	tcp_conn          *ConnParam
 	mgmt_tcp_ch       chan Event
 	rcvd_tcp_ch       chan []byte
 	write_tcp_ch      chan []byte
@@ -41,6 +42,8 @@ type DiamConn struct {
 	end_to_end        uint32
 	start_time        string
 	run_ind           uint32
+	dict              *d.Dictionary
+	handlers          *handlers
 }
 
 var mtx sync.RWMutex
@@ -66,7 +69,11 @@ func NewDiamConn(c_send_mess_ch chan d.Message, c_rcv_mess_ch chan d.Message, c_
 		send_mess_ch:   c_send_mess_ch,
 		rcv_mess_ch:    c_rcv_mess_ch,
 		mgmt_diam_conn: c_mgmt_diam_conn,
-		tcp_conn:       tcp_conn,
+		tcp_conn:       &tcp_conn,
+	}
+	// optional, the default dictionary is used without it
+	if c_dict, ok := conf["dictionary"].(*d.Dictionary); ok {
+		c_diam.dict = c_dict
 	}
 	c_diam.init()
 	return c_diam
@@ -84,25 +91,59 @@ func (c *DiamConn) Gen_Session_Id() string {
 	return ret
 }
 
+// ConfValue returns a value of the diameter config of the connection, e.g.
+// origin_host or destination_realm.
+func (c *DiamConn) ConfValue(key string) (string, bool) {
+	c_val, ok := c.diam_conf[key]
+	return c_val, ok
+}
+
+// Dictionary returns the dictionary used to decode the messages of the
+// connection.
+func (c *DiamConn) Dictionary() *d.Dictionary {
+	if c.dict != nil {
+		return c.dict
+	}
+	return d.Default()
+}
+
 func (c *DiamConn) init() {
 	rand.Seed(time.Now().UnixNano())
 	c.hop_by_hop = rand.Uint32()
 	c.end_to_end = rand.Uint32()
 	c.start_time = fmt.Sprintf("%d", Abs(time.Now().Unix()-int64(rand.Uint32()>>3)))
 	c.run_ind = 0 //rand.Uint32()
+	c.initHandlers()
 	//l.Trace.Println(c.name,"RAND",c.hop_by_hop,c.end_to_end)
 }
 
 func (c *DiamConn) next_h_by_h() uint32 {
+	mtx.Lock()
 	c.hop_by_hop = c.hop_by_hop + 1
-	l.Trace.Println(c.name, "NEXT", c.hop_by_hop)
-	return c.hop_by_hop
+	ret := c.hop_by_hop
+	mtx.Unlock()
+	l.Trace.Println(c.name, "NEXT", ret)
+	return ret
 }
 
 func (c *DiamConn) next_e_to_e() uint32 {
+	mtx.Lock()
 	c.end_to_end = c.end_to_end + 1
-	l.Trace.Println(c.name, "NEXT", c.end_to_end)
-	return c.end_to_end
+	ret := c.end_to_end
+	mtx.Unlock()
+	l.Trace.Println(c.name, "NEXT", ret)
+	return ret
+}
+
+// NextHopByHop reserves a Hop-by-Hop Identifier. Messages sent with it set
+// keep it, so the answer can be matched to the request.
+func (c *DiamConn) NextHopByHop() uint32 {
+	return c.next_h_by_h()
+}
+
+// NextEndToEnd reserves an End-to-End Identifier.
+func (c *DiamConn) NextEndToEnd() uint32 {
+	return c.next_e_to_e()
 }
 
 func (c *DiamConn) Start() {
@@ -122,7 +163,7 @@ func (c *DiamConn) Start() {
 					c_prot_len := c_rcv.GetMessageLength()
 					//fmt.Println("GetMessageLength:", c_prot_len, c_whole_len)
 					if c_prot_len != c_whole_len {
-						l.Error.Println(c.name, "INVALID message")
+						l.Error.Printf("%s INVALID message\n%s", c.name, c.Dictionary().HexDump(mess))
 						mess = mess[0:c_prot_len]
 					}
 					if c_rcv.IsAnswer() && (c_rcv.GetCmdCode() == d.CC_CAP_EXCH) {
@@ -140,7 +181,14 @@ func (c *DiamConn) Start() {
 						continue
 					}
 
-					c_rvc_full_decoded := d.Decode(mess)
+					c_rvc_full_decoded, err := c.Dictionary().DecodeMessage(mess)
+					if err != nil {
+						l.Error.Printf("%s cannot decode message: %v\n%s", c.name, err, c.Dictionary().HexDump(mess))
+						continue
+					}
+					if c_rvc_full_decoded.IsRequest() && c.handleRequest(c_rvc_full_decoded) {
+						continue
+					}
 					c.rcv_mess_ch <- c_rvc_full_decoded
 					//l.Warn.Println(c.name,"Got message:")
 
@@ -212,13 +260,46 @@ func (c *DiamConn) createCER() d.Message {
 		d.AVP_Address(d.AVP_CODE_Host_IP_Address, d.NewAddress(d.ENUM_ADDR_FAMILY, d.IPv4ToByte(c.diam_conf["host_ip"])), d.MAND, 0),
 		d.AVP_UTF8String(d.AVP_CODE_Product_Name, "golang cli", d.MAND, 0),
 		d.AVP_Unsigned32(d.AVP_CODE_Vendor_Id, 666, d.MAND, 0),
-		d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_CC, d.MAND, 0),
 	}
+	cer_avp = append(cer_avp, c.authAppIds()...)
+	cer_avp = append(cer_avp, c.acctAppIds()...)
 
 	cer := d.GenMess(d.CC_CAP_EXCH, true, false, d.APPID_COMMON, c.next_h_by_h(), c.next_e_to_e(), cer_avp)
 	return cer
 }
 
+// authAppIds are the Auth-Application-Ids of the CER: the comma separated
+// "auth_app_ids" of the diam_conf, or credit control without it.
+func (c *DiamConn) authAppIds() []d.AVP {
+	if c.diam_conf["auth_app_ids"] == "" {
+		return []d.AVP{d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_CC, d.MAND, 0)}
+	}
+	return c.appIds("auth_app_ids", d.AVP_CODE_Auth_Application_Id)
+}
+
+// acctAppIds are the Acct-Application-Ids of the CER, the comma separated
+// "acct_app_ids" of the diam_conf, e.g. 3 for base accounting.
+func (c *DiamConn) acctAppIds() []d.AVP {
+	return c.appIds("acct_app_ids", d.AVP_CODE_Acct_Application_Id)
+}
+
+func (c *DiamConn) appIds(key string, avp_code uint32) []d.AVP {
+	c_ids := c.diam_conf[key]
+	if c_ids == "" {
+		return nil
+	}
+	var ret []d.AVP
+	for _, v := range strings.Split(c_ids, ",") {
+		c_id, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+		if err != nil {
+			l.Warn.Println(c.name, "invalid", key+":", c_ids)
+			continue
+		}
+		ret = append(ret, d.AVP_Unsigned32(avp_code, uint32(c_id), d.MAND, 0))
+	}
+	return ret
+}
+
 func (c *DiamConn) createDWR() d.Message {
 	dwh_avp := []d.AVP{
 		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, c.diam_conf["origin_host"], d.MAND, 0),
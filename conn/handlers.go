@@ -0,0 +1,141 @@
+package conn
+
+import (
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+// RequestHandler answers a received request. The Hop-by-Hop and End-to-End
+// Identifiers of the answer are set from the request. No answer is sent if
+// ok is false.
+type RequestHandler func(req d.Message) (ans d.Message, ok bool)
+
+type handlerKey struct {
+	cmd_code uint32
+	app_id   uint32
+}
+
+// handlers is the request handler registry, shared by the copies of a
+// DiamConn.
+type handlers struct {
+	mtx    sync.RWMutex
+	by_key map[handlerKey]RequestHandler
+	// fallback answers the requests without handler, nil forwards them to
+	// the receive channel.
+	fallback RequestHandler
+}
+
+// dpr_waits are the waits before connecting again after a DPR by its
+// Disconnect-Cause. A peer that does not want to talk is not connected
+// again.
+var dpr_waits = map[int32]time.Duration{
+	d.ENUM_DISCONNECT_CAUSE_REBOOTING:                  10 * time.Second,
+	d.ENUM_DISCONNECT_CAUSE_BUSY:                       5 * time.Minute,
+	d.ENUM_DISCONNECT_CAUSE_DO_NOT_WANT_TO_TALK_TO_YOU: -1,
+}
+
+// dprWait is the wait before connecting again after dpr, negative if the
+// connection is not set up again.
+func dprWait(dpr *d.Message) time.Duration {
+	c_cause := int32(d.ENUM_DISCONNECT_CAUSE_REBOOTING)
+	if c_avp := dpr.FindAVP(0, d.AVP_CODE_Disconnect_Cause); c_avp != nil {
+		c_cause = int32(c_avp.GetIntValue())
+	}
+	c_wait, ok := dpr_waits[c_cause]
+	if !ok {
+		c_wait = dpr_waits[d.ENUM_DISCONNECT_CAUSE_BUSY]
+	}
+	return c_wait
+}
+
+// initHandlers answers DPR and closes the connection after the DPA, it is
+// set up again after the wait for the Disconnect-Cause. The other requests
+// go to the receive channel, or get 3001 if "unhandled_requests" is
+// "reject" in the diam_conf.
+func (c *DiamConn) initHandlers() {
+	c.handlers = &handlers{by_key: make(map[handlerKey]RequestHandler)}
+	c.Handle(d.CC_DISC_PEER, d.APPID_COMMON, func(req d.Message) (d.Message, bool) {
+		c_wait := dprWait(&req)
+		if c_wait < 0 {
+			l.Info.Println(c.name, "got DPR, disconnecting for good")
+		} else {
+			l.Info.Println(c.name, "got DPR, disconnecting for", c_wait)
+		}
+		dpa := c.AnswerTo(&req, d.SUCCESS)
+		dpa.Set_hop_by_hop(req.Get_hop_by_hop())
+		dpa.Set_end_to_end(req.Get_end_to_end())
+		c.tcp_conn.writeAndClose(dpa.Encode(), c_wait)
+		return d.Message{}, false
+	})
+	if c.diam_conf["unhandled_requests"] == "reject" {
+		c.SetDefaultHandler(c.RejectUnsupported)
+	}
+}
+
+// Handle registers h for the requests with cmd_code and app_id, replacing
+// the previous one. h runs on a receiving worker of the connection, so it
+// must not wait for messages of the connection.
+func (c *DiamConn) Handle(cmd_code uint32, app_id uint32, h RequestHandler) {
+	c.handlers.mtx.Lock()
+	defer c.handlers.mtx.Unlock()
+	if h == nil {
+		delete(c.handlers.by_key, handlerKey{cmd_code, app_id})
+		return
+	}
+	c.handlers.by_key[handlerKey{cmd_code, app_id}] = h
+}
+
+// SetDefaultHandler sets the handler of the requests without a registered
+// one, nil forwards them to the receive channel.
+func (c *DiamConn) SetDefaultHandler(h RequestHandler) {
+	c.handlers.mtx.Lock()
+	defer c.handlers.mtx.Unlock()
+	c.handlers.fallback = h
+}
+
+// RejectUnsupported answers req with 3001 DIAMETER_COMMAND_UNSUPPORTED, it
+// is the default handler if "unhandled_requests" is "reject".
+func (c *DiamConn) RejectUnsupported(req d.Message) (d.Message, bool) {
+	l.Warn.Println(c.name, "unsupported request", req.GetCmdCode(), "app", req.GetAppId())
+	ans := c.AnswerTo(&req, d.COMMAND_UNSUPPORTED)
+	ans.Set_error_flag(true)
+	return ans, true
+}
+
+// AnswerTo creates the answer of req with the Session-Id of req, the origin
+// of the connection and c_result.
+func (c *DiamConn) AnswerTo(req *d.Message, c_result uint32) d.Message {
+	var c_avps []d.AVP
+	if c_session := req.FindAVP(0, d.AVP_CODE_Session_Id); c_session != nil {
+		c_avps = append(c_avps, *c_session)
+	}
+	c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Result_Code, c_result, d.MAND, 0))
+	c_avps = append(c_avps, c.GetOurHostAndRealm()...)
+	c_proxiable := req.GetCmdFlags()&0b01000000 != 0
+	return d.GenMess(req.GetCmdCode(), false, c_proxiable, req.GetAppId(), req.Get_hop_by_hop(), req.Get_end_to_end(), c_avps)
+}
+
+// handleRequest runs the handler of req and sends its answer, it returns
+// false if req has to be forwarded to the receive channel.
+func (c *DiamConn) handleRequest(req d.Message) bool {
+	c.handlers.mtx.RLock()
+	h, ok := c.handlers.by_key[handlerKey{req.GetCmdCode(), req.GetAppId()}]
+	if !ok {
+		h = c.handlers.fallback
+	}
+	c.handlers.mtx.RUnlock()
+	if h == nil {
+		return false
+	}
+
+	c_ans, ok := h(req)
+	if !ok {
+		return true
+	}
+	c_ans.Set_hop_by_hop(req.Get_hop_by_hop())
+	c_ans.Set_end_to_end(req.Get_end_to_end())
+	c.write_tcp_ch <- c_ans.Encode()
+	return true
+}
@@ -0,0 +1,181 @@
+package conn
+
+import (
+	d "github.com/lehotomi/diam/diam"
+	"net"
+	"testing"
+	"time"
+)
+
+func testDiamConn(unhandled string) DiamConn {
+	return NewDiamConn(nil, nil, nil, map[string]interface{}{
+		"name":     "test",
+		"tcp_conf": map[string]string{"peer": "127.0.0.1:0"},
+		"diam_conf": map[string]string{
+			"origin_host":        "client.test",
+			"origin_realm":       "test",
+			"unhandled_requests": unhandled,
+		},
+	})
+}
+
+// written returns the message written to the connection by a handler.
+func written(t *testing.T, c *DiamConn) d.Message {
+	t.Helper()
+	select {
+	case b := <-c.write_tcp_ch:
+		ret, err := d.DecodeMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	default:
+		t.Fatal("nothing written")
+	}
+	return d.Message{}
+}
+
+func TestHandleRequest(t *testing.T) {
+	c := testDiamConn("")
+	c_called := 0
+	c.Handle(d.CC_RE_AUTH, d.APPID_CC, func(req d.Message) (d.Message, bool) {
+		c_called++
+		return c.AnswerTo(&req, d.SUCCESS), true
+	})
+	c.Handle(d.CC_ABORT_SESSION, d.APPID_CC, func(req d.Message) (d.Message, bool) {
+		return d.Message{}, false
+	})
+
+	if !c.handleRequest(peerRequest(d.CC_RE_AUTH, d.APPID_CC, 5)) {
+		t.Fatal("RAR not handled")
+	}
+	c_raa := written(t, &c)
+	if c_called != 1 || c_raa.IsRequest() || c_raa.Get_hop_by_hop() != 5 || c_raa.Get_end_to_end() != 105 || resultCode(c_raa) != d.SUCCESS {
+		t.Errorf("RAA: %s", c_raa.ToString())
+	}
+	// the same command of an other application has no handler
+	if c.handleRequest(peerRequest(d.CC_RE_AUTH, d.APPID_GX, 6)) {
+		t.Error("RAR of Gx handled")
+	}
+	// handled without answer
+	if !c.handleRequest(peerRequest(d.CC_ABORT_SESSION, d.APPID_CC, 7)) || len(c.write_tcp_ch) != 0 {
+		t.Error("ASR answered")
+	}
+
+	c.Handle(d.CC_RE_AUTH, d.APPID_CC, nil)
+	if c.handleRequest(peerRequest(d.CC_RE_AUTH, d.APPID_CC, 8)) || c_called != 1 {
+		t.Error("removed handler called")
+	}
+	c.SetDefaultHandler(c.RejectUnsupported)
+	if !c.handleRequest(peerRequest(d.CC_RE_AUTH, d.APPID_CC, 9)) {
+		t.Fatal("default handler not called")
+	}
+	if c_raa := written(t, &c); resultCode(c_raa) != d.COMMAND_UNSUPPORTED {
+		t.Errorf("RAA: %s", c_raa.ToString())
+	}
+}
+
+// TestRejectUnsupported answers the requests without handler with 3001 and
+// the E flag if "unhandled_requests" is "reject".
+func TestRejectUnsupported(t *testing.T) {
+	if c := testDiamConn(""); c.handleRequest(peerRequest(d.CC_RE_AUTH, d.APPID_CC, 1)) {
+		t.Error("request not forwarded to the receive channel")
+	}
+
+	c := testDiamConn("reject")
+	c_req := peerRequest(d.CC_RE_AUTH, d.APPID_CC, 1)
+	c_req.AddAVPs_Tail([]d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, "s1", d.MAND, 0)})
+	if !c.handleRequest(c_req) {
+		t.Fatal("request not rejected")
+	}
+	c_ans := written(t, &c)
+	if resultCode(c_ans) != d.COMMAND_UNSUPPORTED || c_ans.GetCmdFlags()&0b00100000 == 0 {
+		t.Errorf("Result-Code %d flags 0x%x, want 3001 with the E flag", resultCode(c_ans), c_ans.GetCmdFlags())
+	}
+	if c_session := c_ans.FindAVP(0, d.AVP_CODE_Session_Id); c_session == nil || c_session.GetStringValue() != "s1" {
+		t.Error("Session-Id not in the answer")
+	}
+	if c_host := c_ans.FindAVP(0, d.AVP_CODE_Origin_Host); c_host == nil || c_host.GetStringValue() != "client.test" {
+		t.Error("Origin-Host not in the answer")
+	}
+}
+
+func TestDprWait(t *testing.T) {
+	c_dpr := func(c_cause ...int32) d.Message {
+		c_mess := peerRequest(d.CC_DISC_PEER, d.APPID_COMMON, 1)
+		for _, v := range c_cause {
+			c_mess.AddAVPs_Tail([]d.AVP{d.AVP_Enumerated(d.AVP_CODE_Disconnect_Cause, v, d.MAND, 0)})
+		}
+		return c_mess
+	}
+	for _, c := range []struct {
+		name string
+		dpr  d.Message
+		want time.Duration
+	}{
+		{"no cause", c_dpr(), dpr_waits[d.ENUM_DISCONNECT_CAUSE_REBOOTING]},
+		{"rebooting", c_dpr(d.ENUM_DISCONNECT_CAUSE_REBOOTING), dpr_waits[d.ENUM_DISCONNECT_CAUSE_REBOOTING]},
+		{"busy", c_dpr(d.ENUM_DISCONNECT_CAUSE_BUSY), dpr_waits[d.ENUM_DISCONNECT_CAUSE_BUSY]},
+		{"do not want to talk", c_dpr(d.ENUM_DISCONNECT_CAUSE_DO_NOT_WANT_TO_TALK_TO_YOU), -1},
+		{"unknown", c_dpr(7), dpr_waits[d.ENUM_DISCONNECT_CAUSE_BUSY]},
+	} {
+		if got := dprWait(&c.dpr); got != c.want {
+			t.Errorf("%s: %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// TestReconnectWait closes the connection like after a DPR, it is set up
+// again after a wait only.
+func TestReconnectWait(t *testing.T) {
+	c_ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c_ln.Close()
+	c_accept := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := c_ln.Accept()
+			if err != nil {
+				return
+			}
+			c_accept <- c
+		}
+	}()
+
+	c_mgmt := make(chan Event, 2)
+	c_tcp := CreateNewConn(map[string]interface{}{"name": "test", "peer": c_ln.Addr().String()},
+		c_mgmt, make(chan []byte, 1), make(chan []byte, 1))
+	c_done := make(chan struct{})
+	go func() {
+		c_tcp.Start()
+		close(c_done)
+	}()
+
+	for _, c_wait := range []time.Duration{10 * time.Millisecond, -1} {
+		<-c_mgmt
+		var c_peer net.Conn
+		select {
+		case c_peer = <-c_accept:
+		case <-time.After(time.Second):
+			t.Fatal("not connected")
+		}
+		c_tcp.writeAndClose([]byte("dpa"), c_wait)
+		c_read := make([]byte, 3)
+		c_peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c_peer.Read(c_read); err != nil || string(c_read) != "dpa" {
+			t.Errorf("read %q %v", c_read, err)
+		}
+		c_peer.Close()
+	}
+
+	select {
+	case <-c_done:
+	case <-time.After(time.Second):
+		t.Fatal("connecting again after a negative wait")
+	}
+	if len(c_accept) != 0 {
+		t.Error("connected again after a negative wait")
+	}
+}
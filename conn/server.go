@@ -0,0 +1,295 @@
+package conn
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// ServerConfig sets up a Server.
+type ServerConfig struct {
+	Name string
+	// Listen is the host:port to accept the peers on.
+	Listen      string
+	OriginHost  string
+	OriginRealm string
+	// HostIP is the IPv4 Host-IP-Address of the CEA, the listen address if
+	// empty.
+	HostIP      string
+	ProductName string
+	// AuthAppIds and AcctAppIds are advertised in the CEA.
+	AuthAppIds []uint32
+	AcctAppIds []uint32
+	// Dictionary decodes the requests, the default dictionary if nil.
+	Dictionary *d.Dictionary
+	Handler    RequestHandler
+	// AnswerHandler gets the answers to the requests sent with SendTo.
+	AnswerHandler func(ans d.Message)
+}
+
+// Server is the diameter server side: it accepts peers, answers their
+// CER, DWR and DPR and gives the other requests to the handler.
+type Server struct {
+	conf       ServerConfig
+	listener   net.Listener
+	mtx        sync.Mutex
+	peers      map[*serverPeer]bool
+	done_ch    chan struct{}
+	hop_by_hop uint32
+	end_to_end uint32
+}
+
+type serverPeer struct {
+	srv     *Server
+	conn    net.Conn
+	write_m sync.Mutex
+	// origin_host is the Origin-Host of the CER of the peer.
+	origin_host string
+}
+
+func NewServer(conf ServerConfig) *Server {
+	if conf.ProductName == "" {
+		conf.ProductName = "golang srv"
+	}
+	if conf.Name == "" {
+		conf.Name = conf.Listen
+	}
+	return &Server{
+		conf:       conf,
+		peers:      make(map[*serverPeer]bool),
+		hop_by_hop: rand.Uint32(),
+		end_to_end: rand.Uint32(),
+	}
+}
+
+// Start listens and accepts the peers in the background.
+func (s *Server) Start() error {
+	c_listener, err := net.Listen("tcp", s.conf.Listen)
+	if err != nil {
+		return err
+	}
+	c_done_ch := make(chan struct{})
+	s.mtx.Lock()
+	s.listener = c_listener
+	s.done_ch = c_done_ch
+	s.mtx.Unlock()
+	l.Info.Println(s.conf.Name, "listening on", c_listener.Addr())
+	go s.acceptLoop(c_listener, c_done_ch)
+	return nil
+}
+
+// Addr is the address the server listens on, nil if it is not started.
+func (s *Server) Addr() net.Addr {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stop closes the listener and the connections of the peers. It does
+// nothing if the server is not started.
+func (s *Server) Stop() {
+	s.mtx.Lock()
+	c_listener, c_done_ch := s.listener, s.done_ch
+	s.listener, s.done_ch = nil, nil
+	s.mtx.Unlock()
+	if c_listener == nil {
+		return
+	}
+	c_listener.Close()
+	<-c_done_ch
+	s.mtx.Lock()
+	for c_peer := range s.peers {
+		c_peer.conn.Close()
+	}
+	s.mtx.Unlock()
+}
+
+func (s *Server) dictionary() *d.Dictionary {
+	if s.conf.Dictionary != nil {
+		return s.conf.Dictionary
+	}
+	return d.Default()
+}
+
+func (s *Server) acceptLoop(c_listener net.Listener, c_done_ch chan struct{}) {
+	defer close(c_done_ch)
+	for {
+		c_conn, err := c_listener.Accept()
+		if err != nil {
+			l.Info.Println(s.conf.Name, "stopped accepting:", err)
+			return
+		}
+		l.Info.Println(s.conf.Name, "peer connected:", c_conn.RemoteAddr())
+		c_peer := &serverPeer{srv: s, conn: c_conn}
+		s.mtx.Lock()
+		s.peers[c_peer] = true
+		s.mtx.Unlock()
+		go c_peer.readLoop()
+	}
+}
+
+func (p *serverPeer) readLoop() {
+	defer func() {
+		p.conn.Close()
+		p.srv.mtx.Lock()
+		delete(p.srv.peers, p)
+		p.srv.mtx.Unlock()
+	}()
+
+	bufferb := make([]byte, 65536)
+	var collect []byte
+	for {
+		nr, err := p.conn.Read(bufferb)
+		if err != nil {
+			l.Info.Println(p.srv.conf.Name, "peer", p.conn.RemoteAddr(), "disconnected:", err)
+			return
+		}
+		collect = append(collect, bufferb[0:nr]...)
+		for {
+			c_part, c_rest, bad := nextMessage(collect)
+			if bad {
+				l.Warn.Printf("%s invalid diameter message header from %s:\n%s", p.srv.conf.Name, p.conn.RemoteAddr(), d.HexDump(collect))
+				return
+			}
+			if c_part == nil {
+				break
+			}
+			collect = c_rest
+			if !p.received(append([]byte{}, c_part...)) {
+				return
+			}
+		}
+	}
+}
+
+// received handles one message, false closes the connection.
+func (p *serverPeer) received(mess []byte) bool {
+	c_rcv := d.DecodeHeader(mess)
+	if !c_rcv.IsRequest() {
+		l.Trace.Println(p.srv.conf.Name, "answer received:", c_rcv.GetCmdCode())
+		if p.srv.conf.AnswerHandler != nil {
+			if c_ans, err := p.srv.dictionary().DecodeMessage(mess); err == nil {
+				p.srv.conf.AnswerHandler(c_ans)
+			}
+		}
+		return true
+	}
+	switch c_rcv.GetCmdCode() {
+	case d.CC_CAP_EXCH:
+		if c_cer, err := p.srv.dictionary().DecodeMessage(mess); err == nil {
+			if c_host := c_cer.FindAVP(0, d.AVP_CODE_Origin_Host); c_host != nil {
+				p.srv.mtx.Lock()
+				p.origin_host = c_host.GetStringValue()
+				p.srv.mtx.Unlock()
+			}
+		}
+		p.write(p.srv.createCEA(&c_rcv))
+		return true
+	case d.CC_DEVICE_WATCHDOG:
+		p.write(p.srv.baseAnswer(&c_rcv, d.SUCCESS))
+		return true
+	case d.CC_DISC_PEER:
+		p.write(p.srv.baseAnswer(&c_rcv, d.SUCCESS))
+		return false
+	}
+
+	c_req, err := p.srv.dictionary().DecodeMessage(mess)
+	if err != nil {
+		l.Error.Printf("%s cannot decode message: %v\n%s", p.srv.conf.Name, err, p.srv.dictionary().HexDump(mess))
+		return true
+	}
+	if p.srv.conf.Handler == nil {
+		return true
+	}
+	go func() {
+		c_ans, ok := p.srv.conf.Handler(c_req)
+		if !ok {
+			return
+		}
+		c_ans.Set_hop_by_hop(c_req.Get_hop_by_hop())
+		c_ans.Set_end_to_end(c_req.Get_end_to_end())
+		p.write(c_ans)
+	}()
+	return true
+}
+
+func (p *serverPeer) write(msg d.Message) {
+	p.write_m.Lock()
+	defer p.write_m.Unlock()
+	if _, err := p.conn.Write(msg.Encode()); err != nil {
+		l.Warn.Println(p.srv.conf.Name, "write to", p.conn.RemoteAddr(), "failed:", err)
+	}
+}
+
+// SendTo sends a request to the peer with the Origin-Host host. The
+// Hop-by-Hop and End-to-End Identifiers are set if they are zero.
+func (s *Server) SendTo(host string, msg d.Message) error {
+	var c_peer *serverPeer
+	s.mtx.Lock()
+	for v := range s.peers {
+		if v.origin_host == host {
+			c_peer = v
+			break
+		}
+	}
+	if msg.Get_hop_by_hop() == 0 {
+		s.hop_by_hop++
+		msg.Set_hop_by_hop(s.hop_by_hop)
+	}
+	if msg.Get_end_to_end() == 0 {
+		s.end_to_end++
+		msg.Set_end_to_end(s.end_to_end)
+	}
+	s.mtx.Unlock()
+	if c_peer == nil {
+		return fmt.Errorf("%s: no peer %s", s.conf.Name, host)
+	}
+	c_peer.write(msg)
+	return nil
+}
+
+// Origin returns the Origin-Host and Origin-Realm AVPs of the server.
+func (s *Server) Origin() []d.AVP {
+	return []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, s.conf.OriginHost, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, s.conf.OriginRealm, d.MAND, 0),
+	}
+}
+
+func (s *Server) baseAnswer(req *d.Message, c_result uint32) d.Message {
+	c_avps := []d.AVP{d.AVP_Unsigned32(d.AVP_CODE_Result_Code, c_result, d.MAND, 0)}
+	c_avps = append(c_avps, s.Origin()...)
+	return d.GenMess(req.GetCmdCode(), false, false, req.GetAppId(), req.Get_hop_by_hop(), req.Get_end_to_end(), c_avps)
+}
+
+func (s *Server) createCEA(cer *d.Message) d.Message {
+	c_ip := net.ParseIP(s.conf.HostIP).To4()
+	if c_ip == nil {
+		if c_addr, ok := s.Addr().(*net.TCPAddr); ok && !c_addr.IP.IsUnspecified() {
+			c_ip = c_addr.IP.To4()
+		}
+	}
+	if c_ip == nil {
+		c_ip = net.IPv4(127, 0, 0, 1).To4()
+	}
+	cea := s.baseAnswer(cer, d.SUCCESS)
+	c_avps := []d.AVP{
+		d.AVP_Address(d.AVP_CODE_Host_IP_Address, d.NewAddress(d.ENUM_ADDR_FAMILY, c_ip), d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Vendor_Id, 666, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Product_Name, s.conf.ProductName, d.MAND, 0),
+	}
+	for _, v := range s.conf.AuthAppIds {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, v, d.MAND, 0))
+	}
+	for _, v := range s.conf.AcctAppIds {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Acct_Application_Id, v, d.MAND, 0))
+	}
+	cea.AddAVPs_Tail(c_avps)
+	return cea
+}
@@ -0,0 +1,177 @@
+package conn
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if err := d.InitWith("../dict", d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// readMessage reads one message from c.
+func readMessage(t *testing.T, c net.Conn) d.Message {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	c_header := make([]byte, 20)
+	if _, err := io.ReadFull(c, c_header); err != nil {
+		t.Fatal(err)
+	}
+	c_length := int(c_header[1])<<16 | int(c_header[2])<<8 | int(c_header[3])
+	c_mess := append(c_header, make([]byte, c_length-20)...)
+	if _, err := io.ReadFull(c, c_mess[20:]); err != nil {
+		t.Fatal(err)
+	}
+	ret, err := d.DecodeMessage(c_mess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func writeMessage(t *testing.T, c net.Conn, msg d.Message) {
+	t.Helper()
+	if _, err := c.Write(msg.Encode()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func resultCode(msg d.Message) int {
+	if c_avp := msg.FindAVP(0, d.AVP_CODE_Result_Code); c_avp != nil {
+		return c_avp.GetIntValue()
+	}
+	return -1
+}
+
+func peerRequest(cmd_code uint32, app_id uint32, hop_by_hop uint32) d.Message {
+	return d.GenMess(cmd_code, true, false, app_id, hop_by_hop, hop_by_hop+100, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, "peer.test", d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, "test", d.MAND, 0),
+	})
+}
+
+// TestServer connects to the server like a client, exchanges capabilities
+// and watchdogs, sends a request to the handler and gets a request of the
+// server before the disconnection.
+func TestServer(t *testing.T) {
+	c_ans_ch := make(chan d.Message, 1)
+	srv := NewServer(ServerConfig{
+		Listen:      "127.0.0.1:0",
+		OriginHost:  "server.test",
+		OriginRealm: "test",
+		AuthAppIds:  []uint32{d.APPID_CC},
+		Handler: func(req d.Message) (d.Message, bool) {
+			if req.GetCmdCode() != d.CC_CREDIT_CONTROL {
+				return d.Message{}, false
+			}
+			return d.GenMess(req.GetCmdCode(), false, false, req.GetAppId(), 0, 0, []d.AVP{
+				d.AVP_Unsigned32(d.AVP_CODE_Result_Code, d.SUCCESS, d.MAND, 0),
+			}), true
+		},
+		AnswerHandler: func(ans d.Message) { c_ans_ch <- ans },
+	})
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	c, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	writeMessage(t, c, peerRequest(d.CC_CAP_EXCH, 0, 1))
+	c_cea := readMessage(t, c)
+	if c_cea.GetCmdCode() != d.CC_CAP_EXCH || c_cea.IsRequest() || resultCode(c_cea) != d.SUCCESS || c_cea.Get_hop_by_hop() != 1 {
+		t.Fatalf("CEA: %s", c_cea.ToString())
+	}
+	if c_app := c_cea.FindAVP(0, d.AVP_CODE_Auth_Application_Id); c_app == nil || c_app.GetIntValue() != d.APPID_CC {
+		t.Error("Auth-Application-Id not in the CEA")
+	}
+	if c_host := c_cea.FindAVP(0, d.AVP_CODE_Origin_Host); c_host == nil || c_host.GetStringValue() != "server.test" {
+		t.Error("Origin-Host not in the CEA")
+	}
+
+	writeMessage(t, c, peerRequest(d.CC_DEVICE_WATCHDOG, 0, 2))
+	if c_dwa := readMessage(t, c); c_dwa.GetCmdCode() != d.CC_DEVICE_WATCHDOG || resultCode(c_dwa) != d.SUCCESS {
+		t.Fatalf("DWA: %s", c_dwa.ToString())
+	}
+
+	// the handler answers, the identifiers are taken from the request
+	writeMessage(t, c, peerRequest(d.CC_CREDIT_CONTROL, d.APPID_CC, 3))
+	c_cca := readMessage(t, c)
+	if c_cca.GetCmdCode() != d.CC_CREDIT_CONTROL || c_cca.Get_hop_by_hop() != 3 || c_cca.Get_end_to_end() != 103 {
+		t.Fatalf("CCA: %s", c_cca.ToString())
+	}
+
+	// a request to the peer known by the Origin-Host of its CER
+	if err := srv.SendTo("other.test", peerRequest(d.CC_RE_AUTH, d.APPID_CC, 0)); err == nil {
+		t.Error("request sent to an unknown peer")
+	}
+	if err := srv.SendTo("peer.test", peerRequest(d.CC_RE_AUTH, d.APPID_CC, 0)); err != nil {
+		t.Fatal(err)
+	}
+	c_rar := readMessage(t, c)
+	if c_rar.GetCmdCode() != d.CC_RE_AUTH || !c_rar.IsRequest() || c_rar.Get_hop_by_hop() == 0 {
+		t.Fatalf("RAR: %s", c_rar.ToString())
+	}
+	writeMessage(t, c, d.GenMess(d.CC_RE_AUTH, false, false, d.APPID_CC, c_rar.Get_hop_by_hop(), c_rar.Get_end_to_end(), []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Result_Code, d.SUCCESS, d.MAND, 0),
+	}))
+	select {
+	case c_raa := <-c_ans_ch:
+		if c_raa.Get_hop_by_hop() != c_rar.Get_hop_by_hop() {
+			t.Errorf("RAA hop-by-hop 0x%08x", c_raa.Get_hop_by_hop())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RAA not given to the answer handler")
+	}
+
+	// the server closes the connection after the DPA
+	writeMessage(t, c, peerRequest(d.CC_DISC_PEER, 0, 4))
+	if c_dpa := readMessage(t, c); c_dpa.GetCmdCode() != d.CC_DISC_PEER || resultCode(c_dpa) != d.SUCCESS {
+		t.Fatalf("DPA: %s", c_dpa.ToString())
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after the DPA: %v, want EOF", err)
+	}
+}
+
+func TestServerStop(t *testing.T) {
+	srv := NewServer(ServerConfig{Listen: "127.0.0.1:0"})
+	srv.Stop()
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c_addr := srv.Addr().String()
+	c, err := net.Dial("tcp", c_addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writeMessage(t, c, peerRequest(d.CC_DEVICE_WATCHDOG, 0, 1))
+	readMessage(t, c)
+	srv.Stop()
+	if srv.Addr() != nil {
+		t.Error("stopped server has an address")
+	}
+	// the connection of the peer is closed
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after Stop: %v, want EOF", err)
+	}
+	if _, err := net.Dial("tcp", c_addr); err == nil {
+		t.Error("stopped server accepts")
+	}
+}
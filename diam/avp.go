@@ -59,6 +59,15 @@ func (a *AVP) set_vendor_flag(f bool) {
 	a.vendor_flag = f
 }
 
+func (a *AVP) IsMandatory() bool {
+	return a.mandatory_flag
+}
+
+// GetFormat returns the Avp_* constant the value is encoded with.
+func (a *AVP) GetFormat() int {
+	return a.format
+}
+
 func (a *AVP) GetValue() interface{} {
 	return a.data
 }
@@ -363,15 +372,29 @@ func (a *AVP) Encode_group() []byte {
 }
 
 func Decode_AVPs(in []byte) []AVP {
+	return Default().Decode_AVPs(in)
+}
+
+// Decode_AVPs decodes in with the types defined in dc. A malformed AVP is
+// logged, the AVPs before it are returned.
+func (dc *Dictionary) Decode_AVPs(in []byte) []AVP {
+	ret, err := dc.decodeAVPs(in, 0)
+	if err != nil {
+		l.Warn.Printf("avp decode error: %v: content % x", err, in)
+	}
+	return ret
+}
+
+// decodeAVPs decodes the AVPs of in, offset is the position of in in the
+// message for the errors. It returns the AVPs decoded before an error.
+func (dc *Dictionary) decodeAVPs(in []byte, offset int) ([]AVP, error) {
 	var ret []AVP
 
-	all_len := uint32(len(in))
 	avps := in
-	i := 1
 	for len(avps) > 0 {
+		c_pos := offset + len(in) - len(avps)
 		if len(avps) < 8 {
-			l.Warn.Printf("avp length error, length less than 8: content % x", avps)
-			return ret
+			return ret, fmt.Errorf("offset 0x%04x: AVP header needs 8 bytes, %d left", c_pos, len(avps))
 		}
 		c_avp_code := byteArrayToUint32(avps[0:4])
 
@@ -390,20 +413,25 @@ func Decode_AVPs(in []byte) []AVP {
 			c_mandatory_flag = true
 		}
 
-		var vendor_id uint32 = 0
+		c_length_b[0] = 0
+		c_length := byteArrayToUint32(c_length_b)
 
+		c_head_size := uint32(8)
 		if c_vendor_flag {
-			if len(avps) < 12 {
-				l.Warn.Printf("avp length error, less than 12: content % x", avps)
-				return ret
-			}
-			vendor_id = byteArrayToUint32(avps[8:12])
+			c_head_size = 12
+		}
+		if c_length < c_head_size {
+			return ret, fmt.Errorf("offset 0x%04x: avp %d length %d is less than the %d byte header", c_pos, c_avp_code, c_length, c_head_size)
+		}
+		if c_length > uint32(len(avps)) {
+			return ret, fmt.Errorf("offset 0x%04x: avp %d length %d exceeds the %d bytes left", c_pos, c_avp_code, c_length, len(avps))
 		}
 
-		c_length_b[0] = 0
-		c_length := byteArrayToUint32(c_length_b)
+		var vendor_id uint32 = 0
+		if c_vendor_flag {
+			vendor_id = byteArrayToUint32(avps[8:12])
+		}
 
-		all_len = all_len - c_length
 		c_avp := avps[0:c_length]
 
 		padded_len := c_length
@@ -411,66 +439,87 @@ func Decode_AVPs(in []byte) []AVP {
 		if c_mod != 0 {
 			padded_len = padded_len + (4 - c_mod)
 		}
+		if padded_len > uint32(len(avps)) {
+			return ret, fmt.Errorf("offset 0x%04x: avp %d padding missing", c_pos+int(c_length), c_avp_code)
+		}
 		avps = avps[padded_len:]
 
-		i = i + 1
-		c_dec_avp := Decode_AVP(c_avp_code, c_vendor_flag, c_mandatory_flag, vendor_id, c_avp)
+		c_dec_avp, err := dc.decodeAVP(c_avp_code, c_vendor_flag, c_mandatory_flag, vendor_id, c_avp, c_pos)
+		if err != nil {
+			return ret, err
+		}
 		ret = append(ret, c_dec_avp)
 	}
-	return ret
+	return ret, nil
 }
 
 func Decode_AVP(code uint32, vendor_flag bool, mandatory_flag bool, vendor_id uint32, all_avp_b []byte) AVP {
-	var avp AVP
-	var data_curr interface{}
+	return Default().Decode_AVP(code, vendor_flag, mandatory_flag, vendor_id, all_avp_b)
+}
+
+// Decode_AVP decodes the AVP all_avp_b, header included. A value that does
+// not fit the type is logged and kept as raw bytes of an unknown AVP.
+func (dc *Dictionary) Decode_AVP(code uint32, vendor_flag bool, mandatory_flag bool, vendor_id uint32, all_avp_b []byte) AVP {
+	avp, err := dc.decodeAVP(code, vendor_flag, mandatory_flag, vendor_id, all_avp_b, 0)
+	if err != nil {
+		l.Warn.Printf("avp decode error: %v: content % x", err, all_avp_b)
+		c_head_size := 8
+		if vendor_flag {
+			c_head_size = 12
+		}
+		c_data := []byte{}
+		if len(all_avp_b) > c_head_size {
+			c_data = all_avp_b[c_head_size:]
+		}
+		avp = AVP{
+			avp_code:       code,
+			format:         Avp_code_unknown,
+			vendor_id:      vendor_id,
+			vendor_flag:    vendor_flag,
+			mandatory_flag: mandatory_flag,
+			data:           c_data,
+		}
+	}
+	return avp
+}
 
-	c_avp_format_by_code := Avp_code_unknown
-	//TODO figure out format
-	dict_entry := LookUpAvp(code, vendor_id)
+// decodeAVP decodes the AVP all_avp_b, the length of the value must match
+// its type. offset is the position of the AVP for the errors.
+func (dc *Dictionary) decodeAVP(code uint32, vendor_flag bool, mandatory_flag bool, vendor_id uint32, all_avp_b []byte, offset int) (AVP, error) {
+	var data_curr interface{}
 
-	c_avp_format_by_code = dict_entry.avptype
+	dict_entry := dc.LookUpAvp(code, vendor_id)
+	c_avp_format_by_code := dict_entry.avptype
 
-	var data_part []byte
+	c_head_size := 8
 	if vendor_flag {
-		data_part = all_avp_b[12:]
-	} else {
-		data_part = all_avp_b[8:]
+		c_head_size = 12
+	}
+	if len(all_avp_b) < c_head_size {
+		return AVP{}, fmt.Errorf("offset 0x%04x: avp %d is %d bytes, shorter than its %d byte header", offset, code, len(all_avp_b), c_head_size)
+	}
+	data_part := all_avp_b[c_head_size:]
+
+	if c_size, ok := avp_fixed_sizes[c_avp_format_by_code]; ok && len(data_part) != c_size {
+		return AVP{}, fmt.Errorf("offset 0x%04x: avp %d %s needs %d bytes, got %d", offset, code, avp_format_names[c_avp_format_by_code], c_size, len(data_part))
 	}
 	switch c_avp_format_by_code {
 	case Avp_Integer32, Avp_Enumerated:
-		if len(data_part) != 4 {
-			l.Warn.Printf("avp length mismatch: type %d avp_code %d content % x", c_avp_format_by_code, code, data_part)
-		}
 		data_curr = byteArrayToInt32(data_part)
 
 	case Avp_Integer64:
-		if len(data_part) != 8 {
-			l.Warn.Printf("avp length mismatch: type %d avp_code %d content % x", c_avp_format_by_code, code, data_part)
-		}
 		data_curr = byteArrayToInt64(data_part)
 
 	case Avp_Unsigned32:
-		if len(data_part) != 4 {
-			l.Warn.Printf("avp length mismatch: type %d avp_code %d content % x", c_avp_format_by_code, code, data_part)
-		}
 		data_curr = byteArrayToUint32(data_part)
 
 	case Avp_Unsigned64:
-		if len(data_part) != 8 {
-			l.Warn.Printf("avp length mismatch: type %d avp_code %d content % x", c_avp_format_by_code, code, data_part)
-		}
 		data_curr = byteArrayToUint64(data_part)
 
 	case Avp_Float32:
-		if len(data_part) != 4 {
-			l.Warn.Printf("avp length mismatch: type %d avp_code %d content % x", c_avp_format_by_code, code, data_part)
-		}
 		data_curr = byteArrayToFloat32(data_part)
 
 	case Avp_Float64:
-		if len(data_part) != 8 {
-			l.Warn.Printf("avp length mismatch: type %d avp_code %d content % x", c_avp_format_by_code, code, data_part)
-		}
 		data_curr = byteArrayToFloat64(data_part)
 
 	case Avp_OctetString, Avp_IPAddress:
@@ -480,21 +529,22 @@ func Decode_AVP(code uint32, vendor_flag bool, mandatory_flag bool, vendor_id ui
 		data_curr = string(data_part)
 
 	case Avp_Address:
-		if len(data_part) != 6 {
-			l.Warn.Printf("avp length mismatch: type %d avp_code %d content % x", c_avp_format_by_code, code, data_part)
+		if len(data_part) < 2 {
+			return AVP{}, fmt.Errorf("offset 0x%04x: avp %d Address needs the 2 byte family, got %d bytes", offset, code, len(data_part))
 		}
 		c_add_fam := byteArrayToUint16(data_part[0:2])
 		data_curr = Address{family: c_add_fam, addr: data_part[2:]}
 
 	case Avp_Time:
-		if len(data_part) != 4 {
-			l.Warn.Printf("avp length mismatch: type %d avp_code %d content % x", c_avp_format_by_code, code, data_part)
-		}
 		c_unix_time := byteArrayToUint32(data_part) - uint32(2208988800)
 		data_curr = time.Unix(int64(c_unix_time), 0)
 
 	case Avp_Grouped:
-		data_curr = Decode_AVPs(data_part)
+		c_avps, err := dc.decodeAVPs(data_part, offset+c_head_size)
+		if err != nil {
+			return AVP{}, err
+		}
+		data_curr = c_avps
 
 	case Avp_code_unknown:
 		l.Warn.Printf("unknown avp: avp_code %d content % x", code, data_part)
@@ -505,15 +555,14 @@ func Decode_AVP(code uint32, vendor_flag bool, mandatory_flag bool, vendor_id ui
 		data_curr = data_part
 	}
 	//
-	avp = AVP{
+	return AVP{
 		avp_code:       code,
 		format:         c_avp_format_by_code,
 		vendor_id:      vendor_id,
 		vendor_flag:    vendor_flag,
 		mandatory_flag: mandatory_flag,
 		data:           data_curr,
-	}
-	return avp
+	}, nil
 }
 
 func AvpStringToConst(in string) int {
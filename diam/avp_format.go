@@ -19,6 +19,14 @@ func NewAddress(family uint16, address []byte) Address {
 	}
 }
 
+func (a Address) GetFamily() uint16 {
+	return a.family
+}
+
+func (a Address) GetAddr() []byte {
+	return a.addr
+}
+
 //TODO error check
 func IPv4ToByte(ipv4 string) []byte {
 	parts := strings.Split(ipv4, ".")
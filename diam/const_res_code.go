@@ -12,4 +12,47 @@ const (
 	AUTHORIZATION_REJECTED        = 5003
 	AUTHENTICATION_REJECTED       = 4001
 	UNABLE_TO_DELIVER             = 3002
+	COMMAND_UNSUPPORTED           = 3001
+	TOO_BUSY                      = 3004
+	APPLICATION_UNSUPPORTED       = 3007
+	INVALID_AVP_VALUE             = 5004
+	MISSING_AVP                   = 5005
+	UNABLE_TO_COMPLY              = 5012
+	IP_CAN_SESSION_NOT_AVAILABLE  = 5065
+)
+
+// Experimental-Result-Codes of Sh (3GPP TS 29.329)
+const (
+	USER_DATA_NOT_AVAILABLE            = 4100
+	PRIOR_UPDATE_IN_PROGRESS           = 4101
+	ERROR_USER_UNKNOWN                 = 5001
+	ERROR_IDENTITIES_DONT_MATCH        = 5002
+	ERROR_USER_DATA_NOT_RECOGNIZED     = 5100
+	ERROR_OPERATION_NOT_ALLOWED        = 5101
+	ERROR_USER_DATA_CANNOT_BE_READ     = 5102
+	ERROR_USER_DATA_CANNOT_BE_MODIFIED = 5103
+	ERROR_USER_DATA_CANNOT_BE_NOTIFIED = 5104
+	ERROR_TRANSPARENT_DATA_OUT_OF_SYNC = 5105
+	ERROR_SUBS_DATA_ABSENT             = 5106
+	ERROR_NO_SUBSCRIPTION_TO_DATA      = 5107
+)
+
+// Experimental-Result-Codes of S6a/S6d (3GPP TS 29.272), ERROR_USER_UNKNOWN
+// is shared with Sh
+const (
+	AUTHENTICATION_DATA_UNAVAILABLE  = 4181
+	ERROR_CAMEL_SUBSCRIPTION_PRESENT = 4182
+	ERROR_ROAMING_NOT_ALLOWED        = 5004
+	ERROR_UNKNOWN_EPS_SUBSCRIPTION   = 5420
+	ERROR_RAT_NOT_ALLOWED            = 5421
+	ERROR_EQUIPMENT_UNKNOWN          = 5422
+	ERROR_UNKNOWN_SERVING_NODE       = 5423
+)
+
+// Experimental-Result-Codes of Gmb (3GPP TS 29.061)
+const (
+	ERROR_START_INDICATION            = 5120
+	ERROR_STOP_INDICATION             = 5121
+	ERROR_UNKNOWN_MBMS_BEARER_SERVICE = 5122
+	ERROR_SERVICE_AREA                = 5123
 )
@@ -1,16 +1,89 @@
 package diam
 
 const (
-	CC_CAP_EXCH        = 257
-	CC_DISC_PEER       = 282
-	CC_DEVICE_WATCHDOG = 280
-	CC_CREDIT_CONTROL  = 272
-	CC_RE_AUTH         = 258
+	CC_CAP_EXCH                   = 257
+	CC_DISC_PEER                  = 282
+	CC_DEVICE_WATCHDOG            = 280
+	CC_CREDIT_CONTROL             = 272
+	CC_RE_AUTH                    = 258
+	CC_ABORT_SESSION              = 274
+	CC_AA                         = 265
+	CC_ACCOUNTING                 = 271
+	CC_SESSION_TERMINATION        = 275
+	CC_USER_DATA                  = 306
+	CC_PROFILE_UPDATE             = 307
+	CC_SUBSCRIBE_NOTIFICATIONS    = 308
+	CC_PUSH_NOTIFICATION          = 309
+	CC_UPDATE_LOCATION            = 316
+	CC_CANCEL_LOCATION            = 317
+	CC_AUTHENTICATION_INFORMATION = 318
+	CC_INSERT_SUBSCRIBER_DATA     = 319
+	CC_DELETE_SUBSCRIBER_DATA     = 320
+	CC_PURGE_UE                   = 321
+	CC_RESET                      = 322
+	CC_NOTIFY                     = 323
 )
 
 const (
 	ENUM_ADDR_FAMILY = 1
 )
+
+// CC-Request-Type
+const (
+	ENUM_CC_REQUEST_INITIAL     = 1
+	ENUM_CC_REQUEST_UPDATE      = 2
+	ENUM_CC_REQUEST_TERMINATION = 3
+	ENUM_CC_REQUEST_EVENT       = 4
+)
+
+// Credit-Control-Failure-Handling
+const (
+	ENUM_CCFH_TERMINATE           = 0
+	ENUM_CCFH_CONTINUE            = 1
+	ENUM_CCFH_RETRY_AND_TERMINATE = 2
+)
+
+// Direct-Debiting-Failure-Handling
+const (
+	ENUM_DDFH_TERMINATE_OR_BUFFER = 0
+	ENUM_DDFH_CONTINUE            = 1
+)
+
+// Final-Unit-Action
+const (
+	ENUM_FUA_TERMINATE       = 0
+	ENUM_FUA_REDIRECT        = 1
+	ENUM_FUA_RESTRICT_ACCESS = 2
+)
+
+// Disconnect-Cause
+const (
+	ENUM_DISCONNECT_CAUSE_REBOOTING                  = 0
+	ENUM_DISCONNECT_CAUSE_BUSY                       = 1
+	ENUM_DISCONNECT_CAUSE_DO_NOT_WANT_TO_TALK_TO_YOU = 2
+)
+
+// Termination-Cause
+const (
+	ENUM_TERMINATION_CAUSE_LOGOUT               = 1
+	ENUM_TERMINATION_CAUSE_SERVICE_NOT_PROVIDED = 2
+	ENUM_TERMINATION_CAUSE_BAD_ANSWER           = 3
+	ENUM_TERMINATION_CAUSE_ADMINISTRATIVE       = 4
+)
+
+// Requested-Action
+const (
+	ENUM_REQUESTED_ACTION_DIRECT_DEBITING = 0
+	ENUM_REQUESTED_ACTION_REFUND_ACCOUNT  = 1
+	ENUM_REQUESTED_ACTION_CHECK_BALANCE   = 2
+	ENUM_REQUESTED_ACTION_PRICE_ENQUIRY   = 3
+)
+
+// Check-Balance-Result
+const (
+	ENUM_CHECK_BALANCE_ENOUGH_CREDIT = 0
+	ENUM_CHECK_BALANCE_NO_CREDIT     = 1
+)
 const (
 	VENDOR_3GPP     = 10415
 	VENDOR_NO       = 0
@@ -19,10 +92,320 @@ const (
 
 const (
 	APPID_COMMON = 0
+	APPID_ACCT   = 3
 	APPID_CC     = 4
+	APPID_GX     = 16777238
+	APPID_RX     = 16777236
+	APPID_SH     = 16777217
+	APPID_S6A    = 16777251
+	APPID_GMB    = 16777223
+	APPID_S9     = 16777267
 )
 
 const (
 	MAND     = true
 	NOT_MAND = false
 )
+
+// Re-Auth-Request-Type
+const (
+	ENUM_RE_AUTH_AUTHORIZE_ONLY         = 0
+	ENUM_RE_AUTH_AUTHORIZE_AUTHENTICATE = 1
+)
+
+// Event-Trigger of Gx, the ones the PCEF reports most
+const (
+	ENUM_EVENT_TRIGGER_SGSN_CHANGE          = 0
+	ENUM_EVENT_TRIGGER_QOS_CHANGE           = 1
+	ENUM_EVENT_TRIGGER_RAT_CHANGE           = 2
+	ENUM_EVENT_TRIGGER_TFT_CHANGE           = 3
+	ENUM_EVENT_TRIGGER_PLMN_CHANGE          = 4
+	ENUM_EVENT_TRIGGER_LOSS_OF_BEARER       = 5
+	ENUM_EVENT_TRIGGER_RECOVERY_OF_BEARER   = 6
+	ENUM_EVENT_TRIGGER_IP_CAN_CHANGE        = 7
+	ENUM_EVENT_TRIGGER_USER_LOCATION_CHANGE = 13
+	ENUM_EVENT_TRIGGER_NO_EVENT_TRIGGERS    = 14
+	ENUM_EVENT_TRIGGER_REVALIDATION_TIMEOUT = 17
+	ENUM_EVENT_TRIGGER_UE_IP_ADDRESS_ALLOC  = 18
+	ENUM_EVENT_TRIGGER_UE_IP_ADDRESS_FREE   = 19
+	ENUM_EVENT_TRIGGER_AN_GW_CHANGE         = 21
+	ENUM_EVENT_TRIGGER_SUCCESSFUL_RES_ALLOC = 22
+	ENUM_EVENT_TRIGGER_UE_TIME_ZONE_CHANGE  = 25
+	ENUM_EVENT_TRIGGER_TAI_CHANGE           = 26
+	ENUM_EVENT_TRIGGER_ECGI_CHANGE          = 27
+	ENUM_EVENT_TRIGGER_USAGE_REPORT         = 33
+)
+
+// PCC-Rule-Status
+const (
+	ENUM_PCC_RULE_ACTIVE             = 0
+	ENUM_PCC_RULE_INACTIVE           = 1
+	ENUM_PCC_RULE_TEMPORARY_INACTIVE = 2
+)
+
+// Session-Release-Cause
+const (
+	ENUM_SESSION_RELEASE_UNSPECIFIED            = 0
+	ENUM_SESSION_RELEASE_UE_SUBSCRIPTION        = 1
+	ENUM_SESSION_RELEASE_INSUFFICIENT_RESOURCES = 2
+)
+
+// Specific-Action of Rx
+const (
+	ENUM_SPECIFIC_ACTION_CHARGING_CORRELATION_EXCHANGE = 1
+	ENUM_SPECIFIC_ACTION_LOSS_OF_BEARER                = 2
+	ENUM_SPECIFIC_ACTION_RECOVERY_OF_BEARER            = 3
+	ENUM_SPECIFIC_ACTION_RELEASE_OF_BEARER             = 4
+	ENUM_SPECIFIC_ACTION_IP_CAN_CHANGE                 = 6
+	ENUM_SPECIFIC_ACTION_OUT_OF_CREDIT                 = 7
+	ENUM_SPECIFIC_ACTION_SUCCESSFUL_RESOURCES_ALLOC    = 8
+	ENUM_SPECIFIC_ACTION_FAILED_RESOURCES_ALLOC        = 9
+	ENUM_SPECIFIC_ACTION_LIMITED_PCC_DEPLOYMENT        = 10
+	ENUM_SPECIFIC_ACTION_USAGE_REPORT                  = 11
+	ENUM_SPECIFIC_ACTION_ACCESS_NETWORK_INFO_REPORT    = 12
+)
+
+// Media-Type
+const (
+	ENUM_MEDIA_TYPE_AUDIO       = 0
+	ENUM_MEDIA_TYPE_VIDEO       = 1
+	ENUM_MEDIA_TYPE_DATA        = 2
+	ENUM_MEDIA_TYPE_APPLICATION = 3
+	ENUM_MEDIA_TYPE_CONTROL     = 4
+	ENUM_MEDIA_TYPE_TEXT        = 5
+	ENUM_MEDIA_TYPE_MESSAGE     = 6
+)
+
+// Flow-Status
+const (
+	ENUM_FLOW_STATUS_ENABLED_UPLINK   = 0
+	ENUM_FLOW_STATUS_ENABLED_DOWNLINK = 1
+	ENUM_FLOW_STATUS_ENABLED          = 2
+	ENUM_FLOW_STATUS_DISABLED         = 3
+	ENUM_FLOW_STATUS_REMOVED          = 4
+)
+
+// Flow-Usage
+const (
+	ENUM_FLOW_USAGE_NO_INFORMATION = 0
+	ENUM_FLOW_USAGE_RTCP           = 1
+	ENUM_FLOW_USAGE_AF_SIGNALLING  = 2
+)
+
+// Abort-Cause
+const (
+	ENUM_ABORT_CAUSE_BEARER_RELEASED               = 0
+	ENUM_ABORT_CAUSE_INSUFFICIENT_SERVER_RESOURCES = 1
+	ENUM_ABORT_CAUSE_INSUFFICIENT_BEARER_RESOURCES = 2
+	ENUM_ABORT_CAUSE_PS_TO_CS_HANDOVER             = 3
+)
+
+// Auth-Session-State
+const (
+	ENUM_AUTH_SESSION_STATE_MAINTAINED    = 0
+	ENUM_AUTH_SESSION_NO_STATE_MAINTAINED = 1
+)
+
+// Data-Reference of Sh
+const (
+	ENUM_DATA_REFERENCE_REPOSITORY_DATA         = 0
+	ENUM_DATA_REFERENCE_IMS_PUBLIC_IDENTITY     = 10
+	ENUM_DATA_REFERENCE_IMS_USER_STATE          = 11
+	ENUM_DATA_REFERENCE_S_CSCF_NAME             = 12
+	ENUM_DATA_REFERENCE_INITIAL_FILTER_CRITERIA = 13
+	ENUM_DATA_REFERENCE_LOCATION_INFORMATION    = 14
+	ENUM_DATA_REFERENCE_USER_STATE              = 15
+	ENUM_DATA_REFERENCE_CHARGING_INFORMATION    = 16
+	ENUM_DATA_REFERENCE_MSISDN                  = 17
+)
+
+// Subs-Req-Type
+const (
+	ENUM_SUBS_REQ_TYPE_SUBSCRIBE   = 0
+	ENUM_SUBS_REQ_TYPE_UNSUBSCRIBE = 1
+)
+
+// Send-Data-Indication
+const (
+	ENUM_SEND_DATA_INDICATION_NOT_REQUESTED = 0
+	ENUM_SEND_DATA_INDICATION_REQUESTED     = 1
+)
+
+// RAT-Type
+const (
+	ENUM_RAT_TYPE_WLAN   = 0
+	ENUM_RAT_TYPE_UTRAN  = 1000
+	ENUM_RAT_TYPE_GERAN  = 1001
+	ENUM_RAT_TYPE_EUTRAN = 1004
+)
+
+// Subscription-Id-Type
+const (
+	ENUM_SUBSCRIPTION_ID_E164 = 0
+	ENUM_SUBSCRIPTION_ID_IMSI = 1
+)
+
+// IP-CAN-Type
+const (
+	ENUM_IP_CAN_TYPE_3GPP_GPRS = 0
+	ENUM_IP_CAN_TYPE_3GPP_EPS  = 5
+)
+
+// Cancellation-Type of S6a
+const (
+	ENUM_CANCELLATION_TYPE_MME_UPDATE_PROCEDURE     = 0
+	ENUM_CANCELLATION_TYPE_SGSN_UPDATE_PROCEDURE    = 1
+	ENUM_CANCELLATION_TYPE_SUBSCRIPTION_WITHDRAWAL  = 2
+	ENUM_CANCELLATION_TYPE_UPDATE_PROCEDURE_IWF     = 3
+	ENUM_CANCELLATION_TYPE_INITIAL_ATTACH_PROCEDURE = 4
+)
+
+// Subscriber-Status
+const (
+	ENUM_SUBSCRIBER_STATUS_SERVICE_GRANTED             = 0
+	ENUM_SUBSCRIBER_STATUS_OPERATOR_DETERMINED_BARRING = 1
+)
+
+// Network-Access-Mode
+const (
+	ENUM_NETWORK_ACCESS_MODE_PACKET_AND_CIRCUIT = 0
+	ENUM_NETWORK_ACCESS_MODE_ONLY_PACKET        = 2
+)
+
+// PDN-Type
+const (
+	ENUM_PDN_TYPE_IPV4         = 0
+	ENUM_PDN_TYPE_IPV6         = 1
+	ENUM_PDN_TYPE_IPV4V6       = 2
+	ENUM_PDN_TYPE_IPV4_OR_IPV6 = 3
+)
+
+// All-APN-Configurations-Included-Indicator
+const (
+	ENUM_ALL_APN_CONFIGURATIONS_INCLUDED            = 0
+	ENUM_MODIFIED_ADDED_APN_CONFIGURATIONS_INCLUDED = 1
+)
+
+// Pre-emption-Capability and Pre-emption-Vulnerability
+const (
+	ENUM_PRE_EMPTION_ENABLED  = 0
+	ENUM_PRE_EMPTION_DISABLED = 1
+)
+
+// Bits of the S6a flag AVPs (3GPP TS 29.272 clause 7.3)
+const (
+	ULR_FLAG_SINGLE_REGISTRATION_INDICATION   = 1 << 0
+	ULR_FLAG_S6A_S6D_INDICATOR                = 1 << 1
+	ULR_FLAG_SKIP_SUBSCRIBER_DATA             = 1 << 2
+	ULR_FLAG_GPRS_SUBSCRIPTION_DATA_INDICATOR = 1 << 3
+	ULR_FLAG_NODE_TYPE_INDICATOR              = 1 << 4
+	ULR_FLAG_INITIAL_ATTACH_INDICATOR         = 1 << 5
+	ULR_FLAG_PS_LCS_NOT_SUPPORTED_BY_UE       = 1 << 6
+	ULR_FLAG_SMS_ONLY_INDICATION              = 1 << 7
+
+	ULA_FLAG_SEPARATION_INDICATION  = 1 << 0
+	ULA_FLAG_MME_REGISTERED_FOR_SMS = 1 << 1
+
+	CLR_FLAG_S6A_S6D_INDICATOR = 1 << 0
+	CLR_FLAG_REATTACH_REQUIRED = 1 << 1
+
+	IDR_FLAG_UE_REACHABILITY_REQUEST          = 1 << 0
+	IDR_FLAG_T_ADS_DATA_REQUEST               = 1 << 1
+	IDR_FLAG_EPS_USER_STATE_REQUEST           = 1 << 2
+	IDR_FLAG_EPS_LOCATION_INFORMATION_REQUEST = 1 << 3
+	IDR_FLAG_CURRENT_LOCATION_REQUEST         = 1 << 4
+
+	PUR_FLAG_UE_PURGED_IN_MME  = 1 << 0
+	PUR_FLAG_UE_PURGED_IN_SGSN = 1 << 1
+
+	PUA_FLAG_FREEZE_M_TMSI = 1 << 0
+	PUA_FLAG_FREEZE_P_TMSI = 1 << 1
+
+	NOR_FLAG_SINGLE_REGISTRATION_INDICATION      = 1 << 0
+	NOR_FLAG_SGSN_AREA_RESTRICTED                = 1 << 1
+	NOR_FLAG_READY_FOR_SM_FROM_SGSN              = 1 << 2
+	NOR_FLAG_UE_REACHABLE_FROM_MME               = 1 << 3
+	NOR_FLAG_UE_REACHABLE_FROM_SGSN              = 1 << 5
+	NOR_FLAG_READY_FOR_SM_FROM_MME               = 1 << 6
+	NOR_FLAG_S6A_S6D_INDICATOR                   = 1 << 8
+	NOR_FLAG_REMOVAL_OF_MME_REGISTRATION_FOR_SMS = 1 << 9
+)
+
+// Accounting-Record-Type
+const (
+	ENUM_ACCOUNTING_RECORD_EVENT   = 1
+	ENUM_ACCOUNTING_RECORD_START   = 2
+	ENUM_ACCOUNTING_RECORD_INTERIM = 3
+	ENUM_ACCOUNTING_RECORD_STOP    = 4
+)
+
+// Accounting-Realtime-Required
+const (
+	ENUM_ACCOUNTING_REALTIME_DELIVER_AND_GRANT = 1
+	ENUM_ACCOUNTING_REALTIME_GRANT_AND_STORE   = 2
+	ENUM_ACCOUNTING_REALTIME_GRANT_AND_LOSE    = 3
+)
+
+// MBMS-StartStop-Indication
+const (
+	ENUM_MBMS_START  = 0
+	ENUM_MBMS_STOP   = 1
+	ENUM_MBMS_UPDATE = 2
+)
+
+// MBMS-Service-Type
+const (
+	ENUM_MBMS_SERVICE_TYPE_MULTICAST = 0
+	ENUM_MBMS_SERVICE_TYPE_BROADCAST = 1
+)
+
+// MBMS-User-Service-Type
+const (
+	ENUM_MBMS_USER_SERVICE_TYPE_DOWNLOAD  = 1
+	ENUM_MBMS_USER_SERVICE_TYPE_STREAMING = 2
+)
+
+// MBMS-2G-3G-Indicator
+const (
+	ENUM_MBMS_2G        = 0
+	ENUM_MBMS_3G        = 1
+	ENUM_MBMS_2G_AND_3G = 2
+)
+
+// MBMS-Counting-Information
+const (
+	ENUM_MBMS_COUNTING_NOT_APPLICABLE = 0
+	ENUM_MBMS_COUNTING_APPLICABLE     = 1
+)
+
+// MBMS-User-Data-Mode-Indication
+const (
+	ENUM_MBMS_USER_DATA_MODE_UNICAST               = 0
+	ENUM_MBMS_USER_DATA_MODE_MULTICAST_AND_UNICAST = 1
+)
+
+// MBMS-Access-Indicator
+const (
+	ENUM_MBMS_ACCESS_UTRAN         = 0
+	ENUM_MBMS_ACCESS_E_UTRAN       = 1
+	ENUM_MBMS_ACCESS_UTRAN_E_UTRAN = 2
+)
+
+// CN-IP-Multicast-Distribution
+const (
+	ENUM_CN_NO_IP_MULTICAST = 0
+	ENUM_CN_IP_MULTICAST    = 1
+)
+
+// Subsession-Operation of S9
+const (
+	ENUM_SUBSESSION_OPERATION_TERMINATION   = 0
+	ENUM_SUBSESSION_OPERATION_ESTABLISHMENT = 1
+	ENUM_SUBSESSION_OPERATION_MODIFICATION  = 2
+)
+
+// Multiple-BBERF-Action of S9
+const (
+	ENUM_MULTIPLE_BBERF_ESTABLISHMENT = 0
+	ENUM_MULTIPLE_BBERF_TERMINATION   = 1
+)
@@ -263,7 +263,7 @@ const (
 	AVP_CODE_Redirect_Realm                  = 620
 	AVP_CODE_OC_Supported_Features           = 621
 	AVP_CODE_OC_OLR                          = 623
-	AVP_CODE_OC_Feature_Vector               = 624
+	AVP_CODE_OC_Feature_Vector               = 622 // RFC 7683; was 624, the code of OC-Sequence-Number
 	AVP_CODE_OC_Sequence_Number              = 624
 	AVP_CODE_OC_Validity_Duration            = 625
 	AVP_CODE_OC_Report_Type                  = 626
@@ -324,7 +324,7 @@ const (
 	AVP_CODE_Service_Parameter_Value          = 442
 )
 
-//TGPP
+// TGPP
 const (
 	AVP_CODE_Service_Information = 873
 
@@ -339,7 +339,7 @@ const (
 	AVP_CODE_Class_Identifier   = 1214
 )
 
-//vodafone
+// vodafone
 const (
 	AVP_CODE_SMS_Information          = 600
 	AVP_CODE_SMS_Node                 = 618
@@ -353,7 +353,7 @@ const (
 	AVP_CODE_Originating_SCCP_Address = 607
 )
 
-//voda
+// voda
 const (
 	AVP_ENUM_SMS_Router_and_IP_SM_GW = 2
 	AVP_ENUM_SUBMISSION              = 0
@@ -361,16 +361,207 @@ const (
 	AVP_ENUM_MOBILE_TERMINATING      = 2
 )
 
-//3gpp
+// 3gpp
 const (
 	AVP_ENUM_MSISDN   = 1
 	AVP_ENUM_Personal = 0
 )
 
-//base
+// base
 const (
 	AVP_ENUM_Event_Request   = 4
 	AVP_ENUM_Direct_Debiting = 0
 	AVP_EMUM_END_USER_E164   = 0
 	AVP_ENUM_END_USER_IMSI   = 1
 )
+
+// Gx
+const (
+	AVP_CODE_Supported_Features            = 628
+	AVP_CODE_Feature_List_ID               = 629
+	AVP_CODE_Feature_List                  = 630
+	AVP_CODE_Flow_Description              = 507
+	AVP_CODE_Flow_Status                   = 511
+	AVP_CODE_Max_Requested_Bandwidth_DL    = 515
+	AVP_CODE_Max_Requested_Bandwidth_UL    = 516
+	AVP_CODE_Charging_Rule_Install         = 1001
+	AVP_CODE_Charging_Rule_Remove          = 1002
+	AVP_CODE_Charging_Rule_Definition      = 1003
+	AVP_CODE_Charging_Rule_Base_Name       = 1004
+	AVP_CODE_Charging_Rule_Name            = 1005
+	AVP_CODE_Event_Trigger                 = 1006
+	AVP_CODE_Offline                       = 1008
+	AVP_CODE_Online                        = 1009
+	AVP_CODE_Precedence                    = 1010
+	AVP_CODE_QoS_Information               = 1016
+	AVP_CODE_Charging_Rule_Report          = 1018
+	AVP_CODE_PCC_Rule_Status               = 1019
+	AVP_CODE_IP_CAN_Type                   = 1027
+	AVP_CODE_QoS_Class_Identifier          = 1028
+	AVP_CODE_Rule_Failure_Code             = 1031
+	AVP_CODE_RAT_Type                      = 1032
+	AVP_CODE_Allocation_Retention_Priority = 1034
+	AVP_CODE_APN_Aggregate_Max_Bitrate_DL  = 1040
+	AVP_CODE_APN_Aggregate_Max_Bitrate_UL  = 1041
+	AVP_CODE_Session_Release_Cause         = 1045
+	AVP_CODE_Priority_Level                = 1046
+	AVP_CODE_Default_EPS_Bearer_QoS        = 1049
+	AVP_CODE_Flow_Information              = 1058
+	AVP_CODE_Monitoring_Key                = 1066
+)
+
+// Rx
+const (
+	AVP_CODE_Abort_Cause                 = 500
+	AVP_CODE_AF_Application_Identifier   = 504
+	AVP_CODE_AF_Charging_Identifier      = 505
+	AVP_CODE_Flow_Number                 = 509
+	AVP_CODE_Flows                       = 510
+	AVP_CODE_Flow_Usage                  = 512
+	AVP_CODE_Specific_Action             = 513
+	AVP_CODE_Media_Component_Description = 517
+	AVP_CODE_Media_Component_Number      = 518
+	AVP_CODE_Media_Sub_Component         = 519
+	AVP_CODE_Media_Type                  = 520
+	AVP_CODE_RR_Bandwidth                = 521
+	AVP_CODE_RS_Bandwidth                = 522
+	AVP_CODE_Codec_Data                  = 524
+	AVP_CODE_Rx_Request_Type             = 533
+	AVP_CODE_Guaranteed_Bitrate_DL       = 1025
+	AVP_CODE_Guaranteed_Bitrate_UL       = 1026
+)
+
+// Sh
+const (
+	AVP_CODE_Public_Identity      = 601
+	AVP_CODE_Server_Name          = 602
+	AVP_CODE_User_Identity        = 700
+	AVP_CODE_MSISDN               = 701
+	AVP_CODE_User_Data            = 702
+	AVP_CODE_Data_Reference       = 703
+	AVP_CODE_Service_Indication   = 704
+	AVP_CODE_Subs_Req_Type        = 705
+	AVP_CODE_Identity_Set         = 708
+	AVP_CODE_Expiry_Time          = 709
+	AVP_CODE_Send_Data_Indication = 710
+	AVP_CODE_Sequence_Number      = 716
+)
+
+// S6a
+const (
+	AVP_CODE_MIP_Home_Agent_Address                    = 334
+	AVP_CODE_MIP6_Agent_Info                           = 486
+	AVP_CODE_Service_Selection                         = 493
+	AVP_CODE_Confidentiality_Key                       = 625
+	AVP_CODE_Integrity_Key                             = 626
+	AVP_CODE_Subscription_Data                         = 1400
+	AVP_CODE_Terminal_Information                      = 1401
+	AVP_CODE_IMEI                                      = 1402
+	AVP_CODE_Software_Version                          = 1403
+	AVP_CODE_ULR_Flags                                 = 1405
+	AVP_CODE_ULA_Flags                                 = 1406
+	AVP_CODE_Visited_PLMN_Id                           = 1407
+	AVP_CODE_Requested_EUTRAN_Authentication_Info      = 1408
+	AVP_CODE_Requested_UTRAN_GERAN_Authentication_Info = 1409
+	AVP_CODE_Number_Of_Requested_Vectors               = 1410
+	AVP_CODE_Re_Synchronization_Info                   = 1411
+	AVP_CODE_Immediate_Response_Preferred              = 1412
+	AVP_CODE_Authentication_Info                       = 1413
+	AVP_CODE_E_UTRAN_Vector                            = 1414
+	AVP_CODE_UTRAN_Vector                              = 1415
+	AVP_CODE_Network_Access_Mode                       = 1417
+	AVP_CODE_Item_Number                               = 1419
+	AVP_CODE_Cancellation_Type                         = 1420
+	AVP_CODE_Context_Identifier                        = 1423
+	AVP_CODE_Subscriber_Status                         = 1424
+	AVP_CODE_Access_Restriction_Data                   = 1426
+	AVP_CODE_APN_OI_Replacement                        = 1427
+	AVP_CODE_All_APN_Configurations_Included_Indicator = 1428
+	AVP_CODE_APN_Configuration_Profile                 = 1429
+	AVP_CODE_APN_Configuration                         = 1430
+	AVP_CODE_EPS_Subscribed_QoS_Profile                = 1431
+	AVP_CODE_Alert_Reason                              = 1434
+	AVP_CODE_AMBR                                      = 1435
+	AVP_CODE_IDA_Flags                                 = 1441
+	AVP_CODE_PUA_Flags                                 = 1442
+	AVP_CODE_NOR_Flags                                 = 1443
+	AVP_CODE_RAND                                      = 1447
+	AVP_CODE_XRES                                      = 1448
+	AVP_CODE_AUTN                                      = 1449
+	AVP_CODE_KASME                                     = 1450
+	AVP_CODE_PDN_Type                                  = 1456
+	AVP_CODE_IDR_Flags                                 = 1490
+	AVP_CODE_Pre_emption_Capability                    = 1047
+	AVP_CODE_Pre_emption_Vulnerability                 = 1048
+	AVP_CODE_Subscribed_Periodic_RAU_TAU_Timer         = 1619
+	AVP_CODE_PUR_Flags                                 = 1635
+	AVP_CODE_CLR_Flags                                 = 1638
+)
+
+// Gmb
+const (
+	AVP_CODE_TGPP_IMSI                         = 1
+	AVP_CODE_TGPP_SGSN_Address                 = 6
+	AVP_CODE_TGPP_SGSN_IPv6_Address            = 15
+	AVP_CODE_TGPP_IMEISV                       = 20
+	AVP_CODE_TGPP_RAT_Type                     = 21
+	AVP_CODE_TGPP_User_Location_Info           = 22
+	AVP_CODE_TGPP_MS_TimeZone                  = 23
+	AVP_CODE_TMGI                              = 900
+	AVP_CODE_Required_MBMS_Bearer_Capabilities = 901
+	AVP_CODE_MBMS_StartStop_Indication         = 902
+	AVP_CODE_MBMS_Service_Area                 = 903
+	AVP_CODE_MBMS_Session_Duration             = 904
+	AVP_CODE_Alternative_APN                   = 905
+	AVP_CODE_MBMS_Service_Type                 = 906
+	AVP_CODE_MBMS_2G_3G_Indicator              = 907
+	AVP_CODE_MBMS_Session_Identity             = 908
+	AVP_CODE_RAI                               = 909
+	AVP_CODE_Additional_MBMS_Trace_Info        = 910
+	AVP_CODE_MBMS_Time_To_Data_Transfer        = 911
+	AVP_CODE_MBMS_Session_Repetition_Number    = 912
+	AVP_CODE_MBMS_Required_QoS                 = 913
+	AVP_CODE_MBMS_Counting_Information         = 914
+	AVP_CODE_MBMS_User_Data_Mode_Indication    = 915
+	AVP_CODE_MBMS_GGSN_Address                 = 916
+	AVP_CODE_MBMS_GGSN_IPv6_Address            = 917
+	AVP_CODE_MBMS_BMSC_SSM_IP_Address          = 918
+	AVP_CODE_MBMS_BMSC_SSM_IPv6_Address        = 919
+	AVP_CODE_MBMS_Flow_Identifier              = 920
+	AVP_CODE_CN_IP_Multicast_Distribution      = 921
+	AVP_CODE_MBMS_HC_Indicator                 = 922
+	AVP_CODE_MBMS_Access_Indicator             = 923
+	AVP_CODE_MBMS_GW_SSM_IP_Address            = 924
+	AVP_CODE_MBMS_GW_SSM_IPv6_Address          = 925
+	AVP_CODE_MBMS_BMSC_SSM_UDP_Port            = 926
+	AVP_CODE_MBMS_GW_UDP_Port                  = 927
+	AVP_CODE_MBMS_GW_UDP_Port_Indicator        = 928
+	AVP_CODE_MBMS_Data_Transfer_Start          = 929
+	AVP_CODE_MBMS_Data_Transfer_Stop           = 930
+	AVP_CODE_MBMS_User_Service_Type            = 1225
+)
+
+// S9
+const (
+	AVP_CODE_Subsession_Decision_Info              = 2200
+	AVP_CODE_Subsession_Enforcement_Info           = 2201
+	AVP_CODE_Subsession_Id                         = 2202
+	AVP_CODE_Subsession_Operation                  = 2203
+	AVP_CODE_Multiple_BBERF_Action                 = 2204
+	AVP_CODE_Bearer_Usage                          = 1000
+	AVP_CODE_Bearer_Identifier                     = 1020
+	AVP_CODE_Bearer_Operation                      = 1021
+	AVP_CODE_Access_Network_Charging_Identifier_Gx = 1022
+	AVP_CODE_Bearer_Control_Mode                   = 1023
+	AVP_CODE_Event_Report_Indication               = 1033
+	AVP_CODE_CoA_Information                       = 1039
+	AVP_CODE_Revalidation_Time                     = 1042
+	AVP_CODE_AN_GW_Address                         = 1050
+	AVP_CODE_Packet_Filter_Information             = 1061
+	AVP_CODE_Packet_Filter_Operation               = 1062
+	AVP_CODE_PDN_Connection_ID                     = 1065
+	AVP_CODE_Usage_Monitoring_Information          = 1067
+	AVP_CODE_TFT_Packet_Filter_Information         = 1013
+	AVP_CODE_Access_Network_Charging_Address       = 501
+	AVP_CODE_TGPP_SGSN_MCC_MNC                     = 18
+)
@@ -1,11 +1,10 @@
 package diam
 
 import (
-	"encoding/json"
 	"fmt"
-	l "github.com/lehotomi/diam/mlog"
-	"io/ioutil"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -19,120 +18,181 @@ type AVPDictEntry struct {
 	name      string
 	vendor_id uint32
 	avptype   int
+	type_name string
+	source    string
 }
 
-var dict map[string]AVPDictEntry = make(map[string]AVPDictEntry)
-var avp_enums map[string]map[int32]string = make(map[string]map[int32]string)
-var cmd_codes map[uint32]string = make(map[uint32]string)
-var app_ids map[uint32]string = make(map[uint32]string)
+// DictDef is the format independent content of one dictionary source, as
+// produced by a DictLoader.
+type DictDef struct {
+	Source       string
+	Vendors      []VendorDef
+	Commands     []CommandDef
+	Applications []ApplicationDef
+	Avps         []AvpDef
+}
 
-func Init(dir string) {
-	var files []string
-	var file_cont [][]byte
-	fileInfo, err := ioutil.ReadDir(dir) //TODO
-	if err != nil {
-		fmt.Println("cannot find dict dir:", dir)
-		os.Exit(1)
+// VendorDef names a vendor. Sym is the short name the wireshark xml
+// dictionaries refer to the vendor by, e.g. TGPP for 3GPP.
+type VendorDef struct {
+	Id   uint32
+	Name string
+	Sym  string
+}
+
+type CommandDef struct {
+	Code uint32
+	Name string
+}
+
+type ApplicationDef struct {
+	Id   uint32
+	Name string
+}
+
+// AvpDef describes one AVP. Type is the type name used by the json
+// dictionaries (OctetString, Unsigned32, grouped, ...). A loader that knows
+// the vendor only by name or symbol sets Vendor instead of VendorId, the
+// dictionary resolves it with the vendors of every loaded source.
+type AvpDef struct {
+	Code     uint32
+	VendorId uint32
+	Vendor   string
+	Name     string
+	Type     string
+	Enum     map[int32]string
+}
+
+// DictLoader reads a dictionary source of one particular format.
+type DictLoader interface {
+	Load(r io.Reader) (DictDef, error)
+}
+
+var dict_loaders map[string]DictLoader = map[string]DictLoader{
+	".json": JSONDictLoader{},
+	".xml":  XMLDictLoader{},
+}
+
+// RegisterDictLoader sets the loader used by Init for files with the given
+// extension (e.g. ".xml"). A nil loader removes the extension.
+func RegisterDictLoader(ext string, loader DictLoader) {
+	if loader == nil {
+		delete(dict_loaders, ext)
 		return
 	}
+	dict_loaders[ext] = loader
+}
 
-	for _, file := range fileInfo {
-		c_file := file.Name()
-		if strings.HasSuffix(c_file, ".json") {
-			files = append(files, c_file)
-		}
-	}
-	for _, c_file := range files {
+// DictLoaderFor returns the loader registered for the extension of file.
+func DictLoaderFor(file string) (DictLoader, bool) {
+	loader, ok := dict_loaders[filepath.Ext(file)]
+	return loader, ok
+}
 
-		c_jsonfile, err := os.Open(dir + "/" + c_file)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		defer c_jsonfile.Close()
-		byte_json, _ := ioutil.ReadAll(c_jsonfile)
-		file_cont = append(file_cont, byte_json)
+// DictError describes a problem in a dictionary source. Section, Index and
+// Field locate the entry (e.g. avps[12].type) if known, Line is set for
+// syntax errors.
+type DictError struct {
+	File    string
+	Section string
+	Index   int
+	Field   string
+	Line    int
+	Err     error
+}
 
+func (e *DictError) Error() string {
+	var c_loc []string
+	if e.File != "" {
+		c_file := e.File
+		if e.Line > 0 {
+			c_file += ":" + strconv.Itoa(e.Line)
+		}
+		c_loc = append(c_loc, c_file)
 	}
-
-	for c_index, c_file_cont := range file_cont {
-		var result map[string]interface{}
-		json.Unmarshal(c_file_cont, &result)
-
-		_, ok := result["avps"]
-		if ok {
-			avps := result["avps"].([]interface{})
-			//if avps != nil
-			for _, v := range avps {
-				v_map := v.(map[string]interface{})
-				c_vendor_id := v_map["vendor-id"].(float64)
-				c_code := v_map["code"].(float64)
-				c_key := fmt.Sprint(c_vendor_id) + "." + fmt.Sprint(c_code)
-				c_avp_dict := make_AVPDict(v_map)
-
-				if c_avp_dict.avptype == Avp_Enumerated {
-					if v_map["enumarated"] != nil {
-						c_avp_enum := v_map["enumarated"].(map[string]interface{})
-						for c_enum_key, c_enum_val := range c_avp_enum {
-							if c_enum_key == "" {
-								continue
-							}
-							c_enum_key_int, err := strconv.Atoi(c_enum_key)
-							if err != nil {
-								l.Error.Printf("Dictionary: %s(%s) cannot convert %s to integer", files[c_index], c_key, c_enum_key)
-							}
-
-							c_enum_val_str, ok := c_enum_val.(string)
-							if !ok {
-								l.Error.Printf("Dictionary: cannot convert %v to string, %s", c_enum_key, c_key)
-								continue
-							}
-							//fmt.Printf("%s %s -> %s\n", c_key, c_enum_key, c_enum_val)
-							_, ok = avp_enums[c_key]
-							if !ok {
-								avp_enums[c_key] = make(map[int32]string)
-							}
-							avp_enums[c_key][int32(c_enum_key_int)] = c_enum_val_str
-						}
-					}
-
-				}
-				dict[c_key] = c_avp_dict
-			}
+	if e.Section != "" {
+		c_entry := e.Section
+		if e.Index >= 0 {
+			c_entry += "[" + strconv.Itoa(e.Index) + "]"
 		}
-		_, ok = result["commands"]
-		if ok {
-			commands := result["commands"].([]interface{})
-			for _, v := range commands {
-				v_map := v.(map[string]interface{})
-				c_code := uint32(v_map["code"].(float64))
-				c_name := v_map["name"].(string)
-				cmd_codes[c_code] = c_name
-			}
+		if e.Field != "" {
+			c_entry += "." + e.Field
 		}
-		_, ok = result["application"]
-		if ok {
-			commands := result["application"].([]interface{})
-			for _, v := range commands {
-				v_map := v.(map[string]interface{})
-				c_id := uint32(v_map["id"].(float64))
-				c_name := v_map["name"].(string)
-				app_ids[c_id] = c_name
-			}
+		c_loc = append(c_loc, c_entry)
+	}
+	if len(c_loc) == 0 {
+		return e.Err.Error()
+	}
+	return strings.Join(c_loc, ": ") + ": " + e.Err.Error()
+}
+
+func (e *DictError) Unwrap() error {
+	return e.Err
+}
+
+func newDictError(section string, index int, field string, format string, a ...interface{}) *DictError {
+	return &DictError{Section: section, Index: index, Field: field, Err: fmt.Errorf(format, a...)}
+}
+
+// LoadDictFile reads a single dictionary file with the loader registered for
+// its extension. Errors are *DictError.
+func LoadDictFile(file string) (DictDef, error) {
+	loader, ok := DictLoaderFor(file)
+	if !ok {
+		return DictDef{}, &DictError{File: file, Index: -1, Err: fmt.Errorf("no dictionary loader for extension %q", filepath.Ext(file))}
+	}
+	c_file, err := os.Open(file)
+	if err != nil {
+		return DictDef{}, &DictError{File: file, Index: -1, Err: err}
+	}
+	defer c_file.Close()
+	def, err := loader.Load(c_file)
+	if err != nil {
+		c_err, ok := err.(*DictError)
+		if !ok {
+			c_err = &DictError{Index: -1, Err: err}
 		}
+		c_err.File = file
+		return DictDef{}, c_err
+	}
+	def.Source = file
+	return def, nil
+}
+
+// LoadOptions control how dictionary files are merged.
+type LoadOptions struct {
+	// Strict makes conflicting definitions of the same AVP, enum value,
+	// command or application an error instead of the later one winning.
+	Strict bool
+}
 
+// Init loads the dictionary files of dir into the default dictionary, it
+// exits the program if they cannot be loaded. InitWith returns the error
+// instead.
+func Init(dir string) {
+	if err := InitWith(dir, LoadOptions{}); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
 
-func make_AVPDict(c_row map[string]interface{}) AVPDictEntry {
-	c_vendor_id := c_row["vendor-id"].(float64)
-	c_code := c_row["code"].(float64)
-	c_type := c_row["type"].(string)
-	c_name := c_row["name"].(string)
+// InitWith loads the dictionary files of dir into the default dictionary
+// with options, either all of them or, on error, none.
+func InitWith(dir string, opts LoadOptions) error {
+	return Default().Load(dir, opts)
+}
+
+// AddDef adds the content of def to the default dictionary.
+func AddDef(def DictDef) error {
+	return Default().AddDef(def)
+}
+
+func make_AVPDict(c_row AvpDef) (AVPDictEntry, error) {
+	c_type := c_row.Type
 
 	c_type_to_const := Avp_code_unknown
 	switch c_type {
-	case "OctetString", "IPFilterRule":
+	case "OctetString", "IPFilterRule", "QoSFilterRule":
 		c_type_to_const = Avp_OctetString
 	case "Unsigned32", "AppId", "VendorId":
 		c_type_to_const = Avp_Unsigned32
@@ -150,7 +210,7 @@ func make_AVPDict(c_row map[string]interface{}) AVPDictEntry {
 		c_type_to_const = Avp_UTF8String
 	case "Enumerated":
 		c_type_to_const = Avp_Enumerated
-	case "grouped":
+	case "grouped", "Grouped":
 		c_type_to_const = Avp_Grouped
 	case "Time":
 		c_type_to_const = Avp_Time
@@ -160,66 +220,72 @@ func make_AVPDict(c_row map[string]interface{}) AVPDictEntry {
 		c_type_to_const = Avp_OctetString //Avp_IPAddress
 
 	default:
-		fmt.Fprintln(os.Stderr, "unknown avp type in dictionary: "+c_type)
-		os.Exit(1)
-
+		return AVPDictEntry{}, fmt.Errorf("unknown avp type %q", c_type)
 	}
 
 	return AVPDictEntry{
-		code:      uint32(c_code),
-		vendor_id: uint32(c_vendor_id),
-		name:      c_name,
+		code:      c_row.Code,
+		vendor_id: c_row.VendorId,
+		name:      c_row.Name,
 		avptype:   c_type_to_const,
-	}
+		type_name: c_type,
+	}, nil
 }
 
 func LookUpAvp(avp_code uint32, vendor_id uint32) AVPDictEntry {
-	c_key := fmt.Sprint(vendor_id) + "." + fmt.Sprint(avp_code)
-	//l.Trace.Printf("lookup key: %s", c_key)
-	c_val, c_ok := dict[c_key]
-	if c_ok {
-		l.Trace.Println("lookup success:", c_key, c_val)
-		return c_val
-	}
-	l.Trace.Println("lookup failed:", c_key)
-	return AVPDictEntry{
-		avptype:   Avp_code_unknown,
-		code:      avp_code,
-		name:      "Unknown",
-		vendor_id: vendor_id,
-	}
+	return Default().LookUpAvp(avp_code, vendor_id)
 }
 
 func LookUpAvp_Enum(avp_code uint32, vendor_id uint32, c_value int32) (string, bool) {
-	c_key := fmt.Sprint(vendor_id) + "." + fmt.Sprint(avp_code)
+	return Default().LookUpAvp_Enum(avp_code, vendor_id, c_value)
+}
 
-	c_values, ok := avp_enums[c_key]
-	if !ok {
-		return "", false
-	}
+func LookUpAvp_command(cmd_code uint32) (string, bool) {
+	return Default().LookUpAvp_command(cmd_code)
+}
 
-	c_string, ok := c_values[c_value]
-	if !ok {
-		return "", false
-	}
+func LookUpAvp_appid(app_id uint32) (string, bool) {
+	return Default().LookUpAvp_appid(app_id)
+}
 
-	return c_string, true
+func LookUpAvpByName(name string) (AVPDictEntry, bool) {
+	return Default().LookUpAvpByName(name)
 }
 
-func LookUpAvp_command(cmd_code uint32) (string, bool) {
-	c_value, ok := cmd_codes[cmd_code]
-	if !ok {
-		return "", false
-	}
+func LookUpAvp_EnumValue(avp_code uint32, vendor_id uint32, name string) (int32, bool) {
+	return Default().LookUpAvp_EnumValue(avp_code, vendor_id, name)
+}
 
-	return c_value, true
+func LookUpCommandByName(name string) (uint32, bool) {
+	return Default().LookUpCommandByName(name)
 }
 
-func LookUpAvp_appid(app_id uint32) (string, bool) {
-	c_value, ok := app_ids[app_id]
-	if !ok {
-		return "", false
-	}
+func LookUpAppByName(name string) (uint32, bool) {
+	return Default().LookUpAppByName(name)
+}
+
+func LookUpVendorByName(name string) (uint32, bool) {
+	return Default().LookUpVendorByName(name)
+}
+
+func (e AVPDictEntry) GetCode() uint32 {
+	return e.code
+}
+
+func (e AVPDictEntry) GetVendorId() uint32 {
+	return e.vendor_id
+}
+
+func (e AVPDictEntry) GetName() string {
+	return e.name
+}
+
+// GetType returns the Avp_* constant of the AVP type.
+func (e AVPDictEntry) GetType() int {
+	return e.avptype
+}
 
-	return c_value, true
+// GetTypeName returns the type as written in the dictionary.
+func (e AVPDictEntry) GetTypeName() string {
+	return e.type_name
 }
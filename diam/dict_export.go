@@ -0,0 +1,98 @@
+package diam
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Def returns the default dictionary as a DictDef.
+func Def() DictDef {
+	return Default().Def()
+}
+
+// ExportJSON writes the default dictionary in the json dictionary format.
+func ExportJSON(w io.Writer) error {
+	return Default().ExportJSON(w)
+}
+
+// ExportJSON writes the dictionary in the json dictionary format.
+func (dc *Dictionary) ExportJSON(w io.Writer) error {
+	return WriteJSONDef(w, dc.Def())
+}
+
+// WriteJSONDef writes def in the json dictionary format, one entry per line.
+// Entries are sorted, so the same input always gives the same output.
+func WriteJSONDef(w io.Writer, def DictDef) error {
+	sort.Slice(def.Vendors, func(i, j int) bool { return def.Vendors[i].Id < def.Vendors[j].Id })
+	sort.Slice(def.Commands, func(i, j int) bool { return def.Commands[i].Code < def.Commands[j].Code })
+	sort.Slice(def.Applications, func(i, j int) bool { return def.Applications[i].Id < def.Applications[j].Id })
+	sort.Slice(def.Avps, func(i, j int) bool {
+		if def.Avps[i].VendorId != def.Avps[j].VendorId {
+			return def.Avps[i].VendorId < def.Avps[j].VendorId
+		}
+		return def.Avps[i].Code < def.Avps[j].Code
+	})
+
+	var sections []string
+
+	if len(def.Vendors) > 0 {
+		var rows []string
+		for _, v := range def.Vendors {
+			rows = append(rows, fmt.Sprintf(`{"id":%d,"name":%s}`, v.Id, jsonString(v.Name)))
+		}
+		sections = append(sections, jsonSection("vendors", rows))
+	}
+
+	var rows []string
+	for _, v := range def.Commands {
+		rows = append(rows, fmt.Sprintf(`{"code":%d,"name":%s}`, v.Code, jsonString(v.Name)))
+	}
+	sections = append(sections, jsonSection("commands", rows))
+
+	if len(def.Applications) > 0 {
+		var rows []string
+		for _, v := range def.Applications {
+			rows = append(rows, fmt.Sprintf(`{"id":%d,"name":%s}`, v.Id, jsonString(v.Name)))
+		}
+		sections = append(sections, jsonSection("application", rows))
+	}
+
+	rows = nil
+	for _, v := range def.Avps {
+		c_row := fmt.Sprintf(`{"code":%d,"name":%s,"vendor-id":%d,"type":%s`, v.Code, jsonString(v.Name), v.VendorId, jsonString(v.Type))
+		if len(v.Enum) > 0 {
+			var c_vals []int
+			for c_val := range v.Enum {
+				c_vals = append(c_vals, int(c_val))
+			}
+			sort.Ints(c_vals)
+			var c_enums []string
+			for _, c_val := range c_vals {
+				c_enums = append(c_enums, fmt.Sprintf(`"%d":%s`, c_val, jsonString(v.Enum[int32(c_val)])))
+			}
+			c_row += `,"enumarated": {` + strings.Join(c_enums, ",") + "}"
+		}
+		rows = append(rows, c_row+"}")
+	}
+	sections = append(sections, jsonSection("avps", rows))
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "{\n%s\n}\n", strings.Join(sections, ",\n    \n"))
+	return bw.Flush()
+}
+
+func jsonSection(name string, rows []string) string {
+	if len(rows) == 0 {
+		return fmt.Sprintf("    %q: [\n\n    ]", name)
+	}
+	return fmt.Sprintf("    %q: [\n      %s\n    ]", name, strings.Join(rows, ",\n      "))
+}
+
+func jsonString(in string) string {
+	res, _ := json.Marshal(in)
+	return string(res)
+}
@@ -0,0 +1,194 @@
+package diam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// JSONDict is the schema of the json dictionaries in the dict directory.
+type JSONDict struct {
+	Vendors     []JSONVendor      `json:"vendors,omitempty"`
+	Commands    []JSONCommand     `json:"commands"`
+	Application []JSONApplication `json:"application,omitempty"`
+	Avps        []JSONAvp         `json:"avps"`
+}
+
+type JSONVendor struct {
+	Id   *uint32 `json:"id"`
+	Name string  `json:"name"`
+}
+
+type JSONCommand struct {
+	Code *uint32 `json:"code"`
+	Name string  `json:"name"`
+}
+
+type JSONApplication struct {
+	Id   *uint32 `json:"id"`
+	Name string  `json:"name"`
+}
+
+// JSONAvp is one AVP definition. The enum values are keyed by their integer
+// value; both the historical "enumarated" and "enumerated" keys are read.
+type JSONAvp struct {
+	Code       *uint32           `json:"code"`
+	Name       string            `json:"name"`
+	VendorId   *uint32           `json:"vendor-id"`
+	Type       string            `json:"type"`
+	Enumarated map[string]string `json:"enumarated,omitempty"`
+	Enumerated map[string]string `json:"enumerated,omitempty"`
+}
+
+// jsonDictRaw keeps the entries undecoded, so errors can be reported with the
+// index of the bad entry.
+type jsonDictRaw struct {
+	Vendors     []json.RawMessage `json:"vendors"`
+	Commands    []json.RawMessage `json:"commands"`
+	Application []json.RawMessage `json:"application"`
+	Avps        []json.RawMessage `json:"avps"`
+}
+
+// JSONDictLoader reads the json dictionaries found in the dict directory.
+type JSONDictLoader struct{}
+
+func (JSONDictLoader) Load(r io.Reader) (DictDef, error) {
+	var def DictDef
+	var raw jsonDictRaw
+
+	byte_json, err := ioutil.ReadAll(r)
+	if err != nil {
+		return def, err
+	}
+	if err := json.Unmarshal(byte_json, &raw); err != nil {
+		return def, jsonDictError(byte_json, "", -1, err)
+	}
+
+	for i, v := range raw.Vendors {
+		var c_vendor JSONVendor
+		if err := json.Unmarshal(v, &c_vendor); err != nil {
+			return def, jsonDictError(byte_json, "vendors", i, err)
+		}
+		if c_vendor.Id == nil {
+			return def, newDictError("vendors", i, "id", "missing")
+		}
+		if c_vendor.Name == "" {
+			return def, newDictError("vendors", i, "name", "missing")
+		}
+		def.Vendors = append(def.Vendors, VendorDef{Id: *c_vendor.Id, Name: c_vendor.Name})
+	}
+
+	for i, v := range raw.Commands {
+		var c_cmd JSONCommand
+		if err := json.Unmarshal(v, &c_cmd); err != nil {
+			return def, jsonDictError(byte_json, "commands", i, err)
+		}
+		if c_cmd.Code == nil {
+			return def, newDictError("commands", i, "code", "missing")
+		}
+		if c_cmd.Name == "" {
+			return def, newDictError("commands", i, "name", "missing")
+		}
+		def.Commands = append(def.Commands, CommandDef{Code: *c_cmd.Code, Name: c_cmd.Name})
+	}
+
+	for i, v := range raw.Application {
+		var c_app JSONApplication
+		if err := json.Unmarshal(v, &c_app); err != nil {
+			return def, jsonDictError(byte_json, "application", i, err)
+		}
+		if c_app.Id == nil {
+			return def, newDictError("application", i, "id", "missing")
+		}
+		if c_app.Name == "" {
+			return def, newDictError("application", i, "name", "missing")
+		}
+		def.Applications = append(def.Applications, ApplicationDef{Id: *c_app.Id, Name: c_app.Name})
+	}
+
+	for i, v := range raw.Avps {
+		var c_json_avp JSONAvp
+		if err := json.Unmarshal(v, &c_json_avp); err != nil {
+			return def, jsonDictError(byte_json, "avps", i, err)
+		}
+		c_avp, err := c_json_avp.toAvpDef()
+		if err != nil {
+			c_err := err.(*DictError)
+			c_err.Section = "avps"
+			c_err.Index = i
+			return def, c_err
+		}
+		def.Avps = append(def.Avps, c_avp)
+	}
+	return def, nil
+}
+
+func (v JSONAvp) toAvpDef() (AvpDef, error) {
+	if v.Code == nil {
+		return AvpDef{}, newDictError("", -1, "code", "missing")
+	}
+	if v.VendorId == nil {
+		return AvpDef{}, newDictError("", -1, "vendor-id", "missing")
+	}
+	if v.Name == "" {
+		return AvpDef{}, newDictError("", -1, "name", "missing")
+	}
+	c_avp := AvpDef{
+		Code:     *v.Code,
+		VendorId: *v.VendorId,
+		Name:     v.Name,
+		Type:     v.Type,
+	}
+	if _, err := make_AVPDict(c_avp); err != nil {
+		return AvpDef{}, newDictError("", -1, "type", "%v", err)
+	}
+
+	c_field := "enumarated"
+	c_enums := v.Enumarated
+	if c_enums == nil {
+		c_field = "enumerated"
+		c_enums = v.Enumerated
+	}
+	for c_enum_key, c_enum_val := range c_enums {
+		// placeholder rows of the generated dict_base.json
+		if c_enum_key == "" {
+			continue
+		}
+		c_enum_key_int, err := strconv.ParseInt(c_enum_key, 10, 32)
+		if err != nil {
+			return AvpDef{}, newDictError("", -1, c_field, "cannot convert %q to integer", c_enum_key)
+		}
+		if c_avp.Enum == nil {
+			c_avp.Enum = make(map[int32]string)
+		}
+		c_avp.Enum[int32(c_enum_key_int)] = c_enum_val
+	}
+	return c_avp, nil
+}
+
+func jsonDictError(cont []byte, section string, index int, err error) *DictError {
+	c_err := &DictError{Section: section, Index: index, Err: err}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		if section == "" {
+			c_err.Line = lineOfOffset(cont, e.Offset)
+		}
+	case *json.UnmarshalTypeError:
+		c_err.Field = e.Field
+		c_err.Err = fmt.Errorf("cannot use %s as %s", e.Value, e.Type)
+		if section == "" {
+			c_err.Line = lineOfOffset(cont, e.Offset)
+		}
+	}
+	return c_err
+}
+
+func lineOfOffset(cont []byte, offset int64) int {
+	if offset > int64(len(cont)) {
+		offset = int64(len(cont))
+	}
+	return bytes.Count(cont[:offset], []byte("\n")) + 1
+}
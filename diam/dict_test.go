@@ -0,0 +1,150 @@
+package diam
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONDictLoaderErrors(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		json    string
+		section string
+		index   int
+		field   string
+	}{
+		{"syntax", "{\n\"avps\": [,]\n}", "", -1, ""},
+		{"vendor without id", `{"vendors":[{"name":"3GPP"}]}`, "vendors", 0, "id"},
+		{"command without name", `{"commands":[{"code":272,"name":"Credit-Control"},{"code":258}]}`, "commands", 1, "name"},
+		{"avp type", `{"avps":[{"code":1,"name":"User-Name","vendor-id":0,"type":"Text"}]}`, "avps", 0, "type"},
+		{"avp vendor", `{"avps":[{"code":1,"name":"User-Name","type":"UTF8String"}]}`, "avps", 0, "vendor-id"},
+		{"enum value", `{"avps":[{"code":416,"name":"CC-Request-Type","vendor-id":0,"type":"Enumerated","enumarated":{"x":"INITIAL_REQUEST"}}]}`, "avps", 0, "enumarated"},
+	} {
+		_, err := JSONDictLoader{}.Load(strings.NewReader(c.json))
+		var c_err *DictError
+		if !errors.As(err, &c_err) {
+			t.Errorf("%s: %v, want a DictError", c.name, err)
+			continue
+		}
+		if c_err.Section != c.section || c_err.Index != c.index || c_err.Field != c.field {
+			t.Errorf("%s: error at %s[%d].%s, want %s[%d].%s", c.name, c_err.Section, c_err.Index, c_err.Field, c.section, c.index, c.field)
+		}
+	}
+}
+
+func TestLoadDictFileError(t *testing.T) {
+	_, err := LoadDictFile("dict.txt")
+	var c_err *DictError
+	if !errors.As(err, &c_err) || c_err.File != "dict.txt" {
+		t.Errorf("%v, want a DictError of dict.txt", err)
+	}
+}
+
+// TestExportJSON loads the exported dictionary again, the second export
+// must be the same.
+func TestExportJSON(t *testing.T) {
+	dc := NewDictionary()
+	if err := dc.LoadDir("../dict"); err != nil {
+		t.Fatal(err)
+	}
+	var c_first bytes.Buffer
+	if err := dc.ExportJSON(&c_first); err != nil {
+		t.Fatal(err)
+	}
+
+	c_def, err := JSONDictLoader{}.Load(bytes.NewReader(c_first.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c_dc := NewDictionary()
+	if err := c_dc.AddDef(c_def); err != nil {
+		t.Fatal(err)
+	}
+	var c_second bytes.Buffer
+	if err := c_dc.ExportJSON(&c_second); err != nil {
+		t.Fatal(err)
+	}
+	if c_first.String() != c_second.String() {
+		t.Error("the export of the exported dictionary differs")
+	}
+	if _, ok := c_dc.LookUpAvp_Enum(AVP_CODE_CC_Request_Type, 0, 1); !ok {
+		t.Error("enum of CC-Request-Type lost")
+	}
+}
+
+func TestLegacyXMLLoader(t *testing.T) {
+	const c_xml = `<dictionary>
+<vendor vendor-id="TGPP" code="10415" name="3GPP"/>
+<application id="4" name="Credit Control">
+<command name="Credit-Control" code="272" vendor-id="None"/>
+<typedefn type-name="MyTime" type-parent="Time"/>
+<avp name="CC-Request-Type" code="416" mandatory="must" vendor-id="None">
+	<type type-name="Enumerated"/>
+	<enum name="INITIAL_REQUEST" code="1"/>
+</avp>
+<avp name="3GPP-Charging-Id" code="2" vendor-id="TGPP"><type type-name="Unsigned32"/></avp>
+<avp name="Event-Time" code="1000" vendor-id="10415"><type type-name="MyTime"/></avp>
+<avp name="Service-Info" code="873" vendor-id="TGPP"><grouped/></avp>
+</application>
+</dictionary>`
+	def, err := LegacyXMLLoader{}.Load(strings.NewReader(c_xml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(def.Vendors) != 1 || def.Vendors[0] != (VendorDef{Id: 10415, Name: "3GPP", Sym: "TGPP"}) {
+		t.Errorf("vendors %v", def.Vendors)
+	}
+	if len(def.Commands) != 1 || def.Commands[0] != (CommandDef{Code: 272, Name: "Credit-Control"}) {
+		t.Errorf("commands %v", def.Commands)
+	}
+	want := []AvpDef{
+		{Code: 416, Name: "CC-Request-Type", Type: "Enumerated"},
+		{Code: 2, Vendor: "TGPP", Name: "3GPP-Charging-Id", Type: "Unsigned32"},
+		{Code: 1000, VendorId: 10415, Name: "Event-Time", Type: "Time"},
+		{Code: 873, Vendor: "TGPP", Name: "Service-Info", Type: "grouped"},
+	}
+	if len(def.Avps) != len(want) {
+		t.Fatalf("%d avps, want %d", len(def.Avps), len(want))
+	}
+	for i, v := range want {
+		c_avp := def.Avps[i]
+		c_avp.Enum = nil
+		if !reflect.DeepEqual(c_avp, v) {
+			t.Errorf("avp %d: %+v, want %+v", i, def.Avps[i], v)
+		}
+	}
+	if def.Avps[0].Enum[1] != "INITIAL_REQUEST" {
+		t.Errorf("enum %v", def.Avps[0].Enum)
+	}
+
+	_, err = LegacyXMLLoader{}.Load(strings.NewReader(`<dictionary><avp name="A" code="1"/></dictionary>`))
+	var c_err *DictError
+	if !errors.As(err, &c_err) || c_err.Field != "type" {
+		t.Errorf("avp without type: %v", err)
+	}
+}
+
+func TestXMLDictLoader(t *testing.T) {
+	const c_xml = `<diameter>
+<application id="4" name="Charging Control">
+<vendor id="10415" name="3GPP"/>
+<avp name="CC-Request-Type" code="416" must="M" vendor-id="0">
+	<data type="Enumerated"><item code="1" name="INITIAL_REQUEST"/></data>
+</avp>
+<avp name="Framed-IP-Address" code="8" vendor-id="0"><data type="IPv4"/></avp>
+</application>
+</diameter>`
+	def, err := XMLDictLoader{}.Load(strings.NewReader(c_xml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(def.Applications) != 1 || len(def.Vendors) != 1 || len(def.Avps) != 2 {
+		t.Fatalf("%+v", def)
+	}
+	if def.Avps[0].Enum[1] != "INITIAL_REQUEST" || def.Avps[1].Type != "OctetString" {
+		t.Errorf("avps %+v", def.Avps)
+	}
+}
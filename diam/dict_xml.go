@@ -0,0 +1,337 @@
+package diam
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// XMLDictLoader detects the layout of an xml dictionary and hands it to
+// GoDiameterXMLLoader (<diameter> root element) or LegacyXMLLoader (anything
+// else).
+type XMLDictLoader struct{}
+
+func (XMLDictLoader) Load(r io.Reader) (DictDef, error) {
+	cont, err := ioutil.ReadAll(r)
+	if err != nil {
+		return DictDef{}, err
+	}
+	if xmlRootElement(cont) == "diameter" {
+		return GoDiameterXMLLoader{}.Load(bytes.NewReader(cont))
+	}
+	return LegacyXMLLoader{}.Load(bytes.NewReader(cont))
+}
+
+func xmlRootElement(cont []byte) string {
+	decoder := newXMLDecoder(bytes.NewReader(cont))
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if c_start, ok := tok.(xml.StartElement); ok {
+			return c_start.Name.Local
+		}
+	}
+}
+
+func newXMLDecoder(r io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(r)
+	// wireshark dictionary.xml pulls its parts in with external entities
+	decoder.Strict = false
+	return decoder
+}
+
+func xmlAttr(elem xml.StartElement, name string) string {
+	for _, a := range elem.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func xmlAttrUint32(elem xml.StartElement, name string, index int) (uint32, error) {
+	c_val := xmlAttr(elem, name)
+	res, err := strconv.ParseUint(c_val, 0, 32)
+	if err != nil {
+		return 0, newDictError(elem.Name.Local, index, name, "cannot convert %q to integer", c_val)
+	}
+	return uint32(res), nil
+}
+
+// LegacyXMLLoader reads the wireshark dictionary layout (dict/other/*.xml),
+// which is also used by the freeDiameter dict_legacy_xml extension:
+//
+//	<vendor vendor-id="TGPP" code="10415" name="3GPP"/>
+//	<application id="4" name="...">
+//	<command name="Credit-Control" code="272" vendor-id="None"/>
+//	<avp name="CC-Request-Type" code="416" mandatory="must" vendor-id="TGPP">
+//	    <type type-name="Enumerated"/>
+//	    <enum name="INITIAL_REQUEST" code="1"/>
+//	</avp>
+//
+// vendor-id may be numeric or a vendor symbol. The AVPs keep the symbols in
+// AvpDef.Vendor, the dictionary resolves them with the <vendor> entries of
+// every loaded file, wireshark declares them in dictionary.xml.
+type LegacyXMLLoader struct{}
+
+func (LegacyXMLLoader) Load(r io.Reader) (DictDef, error) {
+	var def DictDef
+	type_parents := make(map[string]string)
+	var c_avp *AvpDef
+	var c_avp_vendor string
+	counts := make(map[string]int)
+
+	decoder := newXMLDecoder(r)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return def, err
+		}
+
+		switch elem := tok.(type) {
+		case xml.StartElement:
+			c_index := counts[elem.Name.Local]
+			counts[elem.Name.Local]++
+
+			switch elem.Name.Local {
+			case "vendor":
+				c_code, err := xmlAttrUint32(elem, "code", c_index)
+				if err != nil {
+					return def, err
+				}
+				// the vendor-id is the symbol of the file, e.g. TGPP for 3GPP
+				c_sym := xmlAttr(elem, "vendor-id")
+				c_name := xmlAttr(elem, "name")
+				if c_name == "" {
+					c_name = c_sym
+				}
+				def.Vendors = append(def.Vendors, VendorDef{Id: c_code, Name: c_name, Sym: c_sym})
+			case "typedefn":
+				type_parents[xmlAttr(elem, "type-name")] = xmlAttr(elem, "type-parent")
+			case "application":
+				c_id, err := xmlAttrUint32(elem, "id", c_index)
+				if err != nil {
+					return def, err
+				}
+				def.Applications = append(def.Applications, ApplicationDef{Id: c_id, Name: xmlAttr(elem, "name")})
+			case "command":
+				c_code, err := xmlAttrUint32(elem, "code", c_index)
+				if err != nil {
+					return def, err
+				}
+				def.Commands = append(def.Commands, CommandDef{Code: c_code, Name: xmlAttr(elem, "name")})
+			case "avp":
+				if c_avp != nil {
+					return def, newDictError("avp", c_index, "", "nested <avp> in %s", c_avp.Name)
+				}
+				c_code, err := xmlAttrUint32(elem, "code", c_index)
+				if err != nil {
+					return def, err
+				}
+				c_avp = &AvpDef{Code: c_code, Name: xmlAttr(elem, "name")}
+				c_avp_vendor = xmlAttr(elem, "vendor-id")
+			case "type":
+				if c_avp != nil {
+					c_avp.Type = xmlAttr(elem, "type-name")
+				}
+			case "grouped":
+				if c_avp != nil {
+					c_avp.Type = "grouped"
+				}
+			case "enum":
+				if c_avp == nil {
+					continue
+				}
+				c_code, err := strconv.ParseInt(xmlAttr(elem, "code"), 0, 32)
+				if err != nil {
+					return def, newDictError("avp", counts["avp"]-1, "enum", "%s: invalid enum code %q", c_avp.Name, xmlAttr(elem, "code"))
+				}
+				if c_avp.Enum == nil {
+					c_avp.Enum = make(map[int32]string)
+				}
+				c_avp.Enum[int32(c_code)] = xmlAttr(elem, "name")
+			}
+		case xml.EndElement:
+			if elem.Name.Local != "avp" || c_avp == nil {
+				continue
+			}
+			c_avp.VendorId, c_avp.Vendor = legacyVendor(c_avp_vendor)
+			if c_avp.Type == "" {
+				return def, newDictError("avp", counts["avp"]-1, "type", "%s: type is missing", c_avp.Name)
+			}
+			c_avp.Type = resolveTypeName(c_avp.Type, type_parents)
+			def.Avps = append(def.Avps, *c_avp)
+			c_avp = nil
+		}
+	}
+	return def, nil
+}
+
+// legacyVendor is the numeric vendor-id of an AVP, or its vendor symbol if
+// it is not numeric.
+func legacyVendor(sym string) (uint32, string) {
+	if sym == "" || sym == "None" {
+		return 0, ""
+	}
+	if res, err := strconv.ParseUint(sym, 10, 32); err == nil {
+		return uint32(res), ""
+	}
+	return 0, sym
+}
+
+// resolveTypeName follows typedefn parents until a type known by the json
+// dictionaries is found. Unknown types are derived from OctetString.
+func resolveTypeName(type_name string, type_parents map[string]string) string {
+	for i := 0; i < 16; i++ {
+		if isKnownTypeName(type_name) {
+			if type_name == "Grouped" {
+				return "grouped"
+			}
+			return type_name
+		}
+		c_parent, ok := type_parents[type_name]
+		if !ok || c_parent == "" {
+			break
+		}
+		type_name = c_parent
+	}
+	return "OctetString"
+}
+
+func isKnownTypeName(type_name string) bool {
+	switch type_name {
+	case "OctetString", "IPFilterRule", "QoSFilterRule", "Unsigned32", "AppId", "VendorId",
+		"Unsigned64", "Integer32", "Integer64", "Float32", "Float64", "UTF8String",
+		"DiameterURI", "DiameterIdentity", "Enumerated", "grouped", "Grouped", "Time",
+		"Address", "IPAddress":
+		return true
+	}
+	return false
+}
+
+// GoDiameterXMLLoader reads the layout used by the go-diameter project:
+//
+//	<diameter>
+//	  <application id="4" type="auth" name="Charging Control">
+//	    <vendor id="10415" name="3GPP"/>
+//	    <command code="272" short="CC" name="Credit-Control">...</command>
+//	    <avp name="CC-Request-Type" code="416" must="M" vendor-id="0">
+//	      <data type="Enumerated">
+//	        <item code="1" name="INITIAL_REQUEST"/>
+//	      </data>
+//	    </avp>
+//	  </application>
+//	</diameter>
+type GoDiameterXMLLoader struct{}
+
+type goDiameterFile struct {
+	Applications []struct {
+		Id      string `xml:"id,attr"`
+		Name    string `xml:"name,attr"`
+		Vendors []struct {
+			Id   string `xml:"id,attr"`
+			Name string `xml:"name,attr"`
+		} `xml:"vendor"`
+		Commands []struct {
+			Code string `xml:"code,attr"`
+			Name string `xml:"name,attr"`
+		} `xml:"command"`
+		Avps []struct {
+			Name     string `xml:"name,attr"`
+			Code     string `xml:"code,attr"`
+			VendorId string `xml:"vendor-id,attr"`
+			Data     struct {
+				Type  string `xml:"type,attr"`
+				Items []struct {
+					Code string `xml:"code,attr"`
+					Name string `xml:"name,attr"`
+				} `xml:"item"`
+			} `xml:"data"`
+		} `xml:"avp"`
+	} `xml:"application"`
+}
+
+func (GoDiameterXMLLoader) Load(r io.Reader) (DictDef, error) {
+	var def DictDef
+	var file goDiameterFile
+
+	if err := newXMLDecoder(r).Decode(&file); err != nil {
+		return def, err
+	}
+
+	for c_app_index, app := range file.Applications {
+		c_app_id, err := strconv.ParseUint(app.Id, 10, 32)
+		if err != nil {
+			return def, newDictError("application", c_app_index, "id", "cannot convert %q to integer", app.Id)
+		}
+		if c_app_id != 0 || app.Name != "" {
+			def.Applications = append(def.Applications, ApplicationDef{Id: uint32(c_app_id), Name: app.Name})
+		}
+		for i, v := range app.Vendors {
+			c_id, err := strconv.ParseUint(v.Id, 10, 32)
+			if err != nil {
+				return def, newDictError("vendor", i, "id", "cannot convert %q to integer", v.Id)
+			}
+			def.Vendors = append(def.Vendors, VendorDef{Id: uint32(c_id), Name: v.Name})
+		}
+		for i, v := range app.Commands {
+			c_code, err := strconv.ParseUint(v.Code, 10, 32)
+			if err != nil {
+				return def, newDictError("command", i, "code", "cannot convert %q to integer", v.Code)
+			}
+			def.Commands = append(def.Commands, CommandDef{Code: uint32(c_code), Name: v.Name})
+		}
+		for i, v := range app.Avps {
+			c_code, err := strconv.ParseUint(v.Code, 10, 32)
+			if err != nil {
+				return def, newDictError("avp", i, "code", "cannot convert %q to integer", v.Code)
+			}
+			var c_vendor_id uint64
+			if v.VendorId != "" {
+				c_vendor_id, err = strconv.ParseUint(v.VendorId, 10, 32)
+				if err != nil {
+					return def, newDictError("avp", i, "vendor-id", "cannot convert %q to integer", v.VendorId)
+				}
+			}
+			c_avp := AvpDef{
+				Code:     uint32(c_code),
+				VendorId: uint32(c_vendor_id),
+				Name:     v.Name,
+				Type:     goDiameterTypeName(v.Data.Type),
+			}
+			for _, item := range v.Data.Items {
+				c_item_code, err := strconv.ParseInt(item.Code, 10, 32)
+				if err != nil {
+					return def, newDictError("avp", i, "item", "%s: cannot convert %q to integer", v.Name, item.Code)
+				}
+				if c_avp.Enum == nil {
+					c_avp.Enum = make(map[int32]string)
+				}
+				c_avp.Enum[int32(c_item_code)] = item.Name
+			}
+			def.Avps = append(def.Avps, c_avp)
+		}
+	}
+	return def, nil
+}
+
+func goDiameterTypeName(type_name string) string {
+	switch {
+	case type_name == "Grouped":
+		return "grouped"
+	case strings.HasPrefix(type_name, "IPv"):
+		// IPv4/IPv6 are plain addresses without the family
+		return "OctetString"
+	case isKnownTypeName(type_name):
+		return type_name
+	}
+	return "OctetString"
+}
@@ -0,0 +1,479 @@
+package diam
+
+import (
+	"fmt"
+	l "github.com/lehotomi/diam/mlog"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Dictionary holds AVP, enum, command, application and vendor definitions.
+// It is safe for concurrent use. The package level lookup functions use the
+// default dictionary, see Default and SetDefault.
+type Dictionary struct {
+	mtx     sync.RWMutex
+	avps    map[AvpKey]AVPDictEntry
+	enums   map[AvpKey]map[int32]string
+	cmds    map[uint32]string
+	apps    map[uint32]string
+	vendors map[uint32]string
+	// vendor symbols of the wireshark xml dictionaries, by vendor id
+	vendor_syms map[uint32]string
+	names       nameIndex
+}
+
+// AvpKey identifies an AVP by vendor and code.
+type AvpKey struct {
+	VendorId uint32
+	Code     uint32
+}
+
+func (k AvpKey) String() string {
+	return fmt.Sprintf("%d.%d", k.VendorId, k.Code)
+}
+
+// nameIndex holds the reverse (name to code) lookups, keys are lower case.
+type nameIndex struct {
+	avps    map[string][]AvpKey
+	enums   map[AvpKey]map[string]int32
+	cmds    map[string]uint32
+	apps    map[string]uint32
+	vendors map[string]uint32
+}
+
+var default_dict_mtx sync.RWMutex
+var default_dict *Dictionary = NewDictionary()
+
+// NewDictionary returns an empty dictionary. The vendor names come from the
+// "vendors" of the loaded files.
+func NewDictionary() *Dictionary {
+	dc := &Dictionary{
+		avps:        make(map[AvpKey]AVPDictEntry),
+		enums:       make(map[AvpKey]map[int32]string),
+		cmds:        make(map[uint32]string),
+		apps:        make(map[uint32]string),
+		vendors:     make(map[uint32]string),
+		vendor_syms: make(map[uint32]string),
+	}
+	dc.reindex()
+	return dc
+}
+
+// Default returns the dictionary used by Init, Decode, ToString and the
+// package level lookup functions.
+func Default() *Dictionary {
+	default_dict_mtx.RLock()
+	defer default_dict_mtx.RUnlock()
+	return default_dict
+}
+
+// SetDefault replaces the default dictionary.
+func SetDefault(dc *Dictionary) {
+	default_dict_mtx.Lock()
+	default_dict = dc
+	default_dict_mtx.Unlock()
+}
+
+func avpKey(avp_code uint32, vendor_id uint32) AvpKey {
+	return AvpKey{VendorId: vendor_id, Code: avp_code}
+}
+
+// LoadDir adds every file of dir that has a registered DictLoader.
+func (dc *Dictionary) LoadDir(dir string) error {
+	return dc.Load(dir, LoadOptions{})
+}
+
+// Load adds every file of dir that has a registered DictLoader. Either all
+// files are added or, on error, none of them.
+func (dc *Dictionary) Load(dir string, opts LoadOptions) error {
+	fileInfo, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return &DictError{File: dir, Index: -1, Err: fmt.Errorf("cannot read dict dir: %v", err)}
+	}
+
+	var defs []DictDef
+	for _, file := range fileInfo {
+		c_file := file.Name()
+		if _, ok := DictLoaderFor(c_file); !ok || file.IsDir() {
+			continue
+		}
+		def, err := LoadDictFile(filepath.Join(dir, c_file))
+		if err != nil {
+			return err
+		}
+		defs = append(defs, def)
+	}
+	return dc.AddDefs(defs, opts)
+}
+
+// AddDef adds the content of def to the dictionary. Entries already present
+// are overwritten.
+func (dc *Dictionary) AddDef(def DictDef) error {
+	return dc.AddDefs([]DictDef{def}, LoadOptions{})
+}
+
+// AddDefs adds defs in order. Nothing is added if one of them is invalid or,
+// in strict mode, conflicts with an earlier definition.
+func (dc *Dictionary) AddDefs(defs []DictDef, opts LoadOptions) error {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+
+	staged := dc.cloneLocked()
+	// the AVPs may refer to vendors declared by a later source
+	for _, def := range defs {
+		staged.addVendors(def)
+	}
+	staged.reindex()
+	for _, def := range defs {
+		if err := staged.addDef(def, opts.Strict); err != nil {
+			return err
+		}
+	}
+	dc.avps = staged.avps
+	dc.enums = staged.enums
+	dc.cmds = staged.cmds
+	dc.apps = staged.apps
+	dc.vendors = staged.vendors
+	dc.vendor_syms = staged.vendor_syms
+	dc.reindex()
+	return nil
+}
+
+func (dc *Dictionary) addVendors(def DictDef) {
+	for _, v := range def.Vendors {
+		dc.vendors[v.Id] = v.Name
+		if v.Sym != "" {
+			dc.vendor_syms[v.Id] = v.Sym
+		}
+	}
+}
+
+// addDef adds def, the vendors of the AVPs set by name are looked up in the
+// name index, so the vendors are added and indexed before.
+func (dc *Dictionary) addDef(def DictDef, strict bool) error {
+	dc.addVendors(def)
+	for i, v := range def.Commands {
+		if c_name, ok := dc.cmds[v.Code]; strict && ok && c_name != v.Name {
+			return &DictError{File: def.Source, Section: "commands", Index: i, Err: fmt.Errorf("command %d defined as %s and %s", v.Code, c_name, v.Name)}
+		}
+		dc.cmds[v.Code] = v.Name
+	}
+	for i, v := range def.Applications {
+		if c_name, ok := dc.apps[v.Id]; strict && ok && c_name != v.Name {
+			return &DictError{File: def.Source, Section: "application", Index: i, Err: fmt.Errorf("application %d defined as %s and %s", v.Id, c_name, v.Name)}
+		}
+		dc.apps[v.Id] = v.Name
+	}
+	for i, v := range def.Avps {
+		if v.Vendor != "" {
+			c_id, ok := dc.names.vendors[strings.ToLower(v.Vendor)]
+			if !ok {
+				return &DictError{File: def.Source, Section: "avps", Index: i, Field: "vendor-id", Err: fmt.Errorf("%s: unknown vendor %q", v.Name, v.Vendor)}
+			}
+			v.VendorId = c_id
+		}
+		c_key := avpKey(v.Code, v.VendorId)
+		c_avp_dict, err := make_AVPDict(v)
+		if err != nil {
+			return &DictError{File: def.Source, Section: "avps", Index: i, Field: "type", Err: err}
+		}
+		c_avp_dict.source = def.Source
+
+		if c_prev, ok := dc.avps[c_key]; strict && ok {
+			if c_prev.name != c_avp_dict.name || c_prev.avptype != c_avp_dict.avptype {
+				return &DictError{File: def.Source, Section: "avps", Index: i,
+					Err: fmt.Errorf("avp %s defined as %s(%s) and %s(%s) in %s", c_key, v.Name, v.Type, c_prev.name, c_prev.type_name, c_prev.source)}
+			}
+			for c_enum_val, c_enum_name := range v.Enum {
+				if c_prev_name, ok := dc.enums[c_key][c_enum_val]; ok && c_prev_name != c_enum_name {
+					return &DictError{File: def.Source, Section: "avps", Index: i, Field: "enumarated",
+						Err: fmt.Errorf("avp %s value %d defined as %s and %s in %s", c_key, c_enum_val, c_enum_name, c_prev_name, c_prev.source)}
+				}
+			}
+		}
+
+		if c_avp_dict.avptype == Avp_Enumerated && len(v.Enum) > 0 {
+			_, ok := dc.enums[c_key]
+			if !ok {
+				dc.enums[c_key] = make(map[int32]string)
+			}
+			for c_enum_val, c_enum_name := range v.Enum {
+				dc.enums[c_key][c_enum_val] = c_enum_name
+			}
+		}
+		dc.avps[c_key] = c_avp_dict
+	}
+	return nil
+}
+
+func (dc *Dictionary) cloneLocked() *Dictionary {
+	ret := &Dictionary{
+		avps:        make(map[AvpKey]AVPDictEntry, len(dc.avps)),
+		enums:       make(map[AvpKey]map[int32]string, len(dc.enums)),
+		cmds:        make(map[uint32]string, len(dc.cmds)),
+		apps:        make(map[uint32]string, len(dc.apps)),
+		vendors:     make(map[uint32]string, len(dc.vendors)),
+		vendor_syms: make(map[uint32]string, len(dc.vendor_syms)),
+	}
+	for k, v := range dc.avps {
+		ret.avps[k] = v
+	}
+	for k, v := range dc.enums {
+		ret.enums[k] = make(map[int32]string, len(v))
+		for c_val, c_name := range v {
+			ret.enums[k][c_val] = c_name
+		}
+	}
+	for k, v := range dc.cmds {
+		ret.cmds[k] = v
+	}
+	for k, v := range dc.apps {
+		ret.apps[k] = v
+	}
+	for k, v := range dc.vendors {
+		ret.vendors[k] = v
+	}
+	for k, v := range dc.vendor_syms {
+		ret.vendor_syms[k] = v
+	}
+	ret.reindex()
+	return ret
+}
+
+// reindex rebuilds the name lookups, the caller holds the write lock.
+// AVP names are not unique across vendors, their keys are kept sorted so the
+// vendor independent lookup prefers the lowest vendor id.
+func (dc *Dictionary) reindex() {
+	dc.names = nameIndex{
+		avps:    make(map[string][]AvpKey, len(dc.avps)),
+		enums:   make(map[AvpKey]map[string]int32, len(dc.enums)),
+		cmds:    make(map[string]uint32, len(dc.cmds)),
+		apps:    make(map[string]uint32, len(dc.apps)),
+		vendors: make(map[string]uint32, len(dc.vendors)),
+	}
+	for k, v := range dc.avps {
+		c_name := strings.ToLower(v.name)
+		dc.names.avps[c_name] = append(dc.names.avps[c_name], k)
+	}
+	for _, v := range dc.names.avps {
+		sort.Slice(v, func(i, j int) bool {
+			if v[i].VendorId != v[j].VendorId {
+				return v[i].VendorId < v[j].VendorId
+			}
+			return v[i].Code < v[j].Code
+		})
+	}
+	for k, v := range dc.enums {
+		dc.names.enums[k] = make(map[string]int32, len(v))
+		for c_val, c_name := range v {
+			dc.names.enums[k][strings.ToLower(c_name)] = c_val
+		}
+	}
+	for k, v := range dc.cmds {
+		dc.names.cmds[strings.ToLower(v)] = k
+	}
+	for k, v := range dc.apps {
+		dc.names.apps[strings.ToLower(v)] = k
+	}
+	for k, v := range dc.vendor_syms {
+		dc.names.vendors[strings.ToLower(v)] = k
+	}
+	for k, v := range dc.vendors {
+		dc.names.vendors[strings.ToLower(v)] = k
+	}
+}
+
+// Def returns the content of the dictionary as a DictDef.
+func (dc *Dictionary) Def() DictDef {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+
+	var def DictDef
+	for c_id, c_name := range dc.vendors {
+		def.Vendors = append(def.Vendors, VendorDef{Id: c_id, Name: c_name, Sym: dc.vendor_syms[c_id]})
+	}
+	for c_code, c_name := range dc.cmds {
+		def.Commands = append(def.Commands, CommandDef{Code: c_code, Name: c_name})
+	}
+	for c_id, c_name := range dc.apps {
+		def.Applications = append(def.Applications, ApplicationDef{Id: c_id, Name: c_name})
+	}
+	for c_key, c_entry := range dc.avps {
+		c_avp := AvpDef{
+			Code:     c_entry.code,
+			VendorId: c_entry.vendor_id,
+			Name:     c_entry.name,
+			Type:     c_entry.type_name,
+		}
+		if c_enums, ok := dc.enums[c_key]; ok {
+			c_avp.Enum = make(map[int32]string)
+			for c_val, c_name := range c_enums {
+				c_avp.Enum[c_val] = c_name
+			}
+		}
+		def.Avps = append(def.Avps, c_avp)
+	}
+	return def
+}
+
+// Merge adds every definition of other to dc, overwriting the ones dc
+// already has.
+func (dc *Dictionary) Merge(other *Dictionary) {
+	if dc == other {
+		return
+	}
+	c_other := other.Clone()
+
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	for k, v := range c_other.avps {
+		dc.avps[k] = v
+	}
+	for k, v := range c_other.enums {
+		if _, ok := dc.enums[k]; !ok {
+			dc.enums[k] = make(map[int32]string)
+		}
+		for c_val, c_name := range v {
+			dc.enums[k][c_val] = c_name
+		}
+	}
+	for k, v := range c_other.cmds {
+		dc.cmds[k] = v
+	}
+	for k, v := range c_other.apps {
+		dc.apps[k] = v
+	}
+	for k, v := range c_other.vendors {
+		dc.vendors[k] = v
+	}
+	for k, v := range c_other.vendor_syms {
+		dc.vendor_syms[k] = v
+	}
+	dc.reindex()
+}
+
+// Clone returns an independent copy of the dictionary.
+func (dc *Dictionary) Clone() *Dictionary {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	return dc.cloneLocked()
+}
+
+func (dc *Dictionary) LookUpAvp(avp_code uint32, vendor_id uint32) AVPDictEntry {
+	c_key := avpKey(avp_code, vendor_id)
+	dc.mtx.RLock()
+	c_val, c_ok := dc.avps[c_key]
+	dc.mtx.RUnlock()
+	if c_ok {
+		l.Trace.Println("lookup success:", c_key, c_val)
+		return c_val
+	}
+	l.Trace.Println("lookup failed:", c_key)
+	return AVPDictEntry{
+		avptype:   Avp_code_unknown,
+		code:      avp_code,
+		name:      "Unknown",
+		vendor_id: vendor_id,
+	}
+}
+
+func (dc *Dictionary) LookUpAvp_Enum(avp_code uint32, vendor_id uint32, c_value int32) (string, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+
+	c_values, ok := dc.enums[avpKey(avp_code, vendor_id)]
+	if !ok {
+		return "", false
+	}
+
+	c_string, ok := c_values[c_value]
+	return c_string, ok
+}
+
+// HasEnum tells if the dictionary has enum values for the AVP.
+func (dc *Dictionary) HasEnum(avp_code uint32, vendor_id uint32) bool {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	return len(dc.enums[avpKey(avp_code, vendor_id)]) > 0
+}
+
+func (dc *Dictionary) LookUpAvp_command(cmd_code uint32) (string, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	c_value, ok := dc.cmds[cmd_code]
+	return c_value, ok
+}
+
+func (dc *Dictionary) LookUpAvp_appid(app_id uint32) (string, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	c_value, ok := dc.apps[app_id]
+	return c_value, ok
+}
+
+func (dc *Dictionary) LookUpVendor(vendor_id uint32) (string, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	c_value, ok := dc.vendors[vendor_id]
+	return c_value, ok
+}
+
+// LookUpAvpByName finds an AVP by its name, case insensitively. If vendors
+// share the name the one with the lowest vendor id is returned.
+func (dc *Dictionary) LookUpAvpByName(name string) (AVPDictEntry, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	c_keys := dc.names.avps[strings.ToLower(name)]
+	if len(c_keys) == 0 {
+		return AVPDictEntry{}, false
+	}
+	return dc.avps[c_keys[0]], true
+}
+
+// LookUpAvpByVendorName finds the AVP of vendor_id by its name, case
+// insensitively.
+func (dc *Dictionary) LookUpAvpByVendorName(vendor_id uint32, name string) (AVPDictEntry, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	for _, c_key := range dc.names.avps[strings.ToLower(name)] {
+		if c_key.VendorId == vendor_id {
+			return dc.avps[c_key], true
+		}
+	}
+	return AVPDictEntry{}, false
+}
+
+// LookUpAvp_EnumValue returns the value of the enum name of an Enumerated
+// AVP, case insensitively.
+func (dc *Dictionary) LookUpAvp_EnumValue(avp_code uint32, vendor_id uint32, name string) (int32, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	c_val, ok := dc.names.enums[avpKey(avp_code, vendor_id)][strings.ToLower(name)]
+	return c_val, ok
+}
+
+func (dc *Dictionary) LookUpCommandByName(name string) (uint32, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	c_val, ok := dc.names.cmds[strings.ToLower(name)]
+	return c_val, ok
+}
+
+func (dc *Dictionary) LookUpAppByName(name string) (uint32, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	c_val, ok := dc.names.apps[strings.ToLower(name)]
+	return c_val, ok
+}
+
+// LookUpVendorByName finds a vendor by its name or wireshark symbol (e.g.
+// TGPP), case insensitively.
+func (dc *Dictionary) LookUpVendorByName(name string) (uint32, bool) {
+	dc.mtx.RLock()
+	defer dc.mtx.RUnlock()
+	c_val, ok := dc.names.vendors[strings.ToLower(name)]
+	return c_val, ok
+}
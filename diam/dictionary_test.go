@@ -0,0 +1,100 @@
+package diam
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAddDefsConflicts(t *testing.T) {
+	c_base := DictDef{
+		Source:       "base.json",
+		Commands:     []CommandDef{{Code: 272, Name: "Credit-Control"}},
+		Applications: []ApplicationDef{{Id: 4, Name: "Credit Control"}},
+		Avps: []AvpDef{
+			{Code: 416, Name: "CC-Request-Type", Type: "Enumerated", Enum: map[int32]string{1: "INITIAL_REQUEST"}},
+		},
+	}
+	for _, c := range []struct {
+		name    string
+		def     DictDef
+		section string
+	}{
+		{"command", DictDef{Commands: []CommandDef{{Code: 272, Name: "CC"}}}, "commands"},
+		{"application", DictDef{Applications: []ApplicationDef{{Id: 4, Name: "DCCA"}}}, "application"},
+		{"avp name", DictDef{Avps: []AvpDef{{Code: 416, Name: "Request-Type", Type: "Enumerated"}}}, "avps"},
+		{"avp type", DictDef{Avps: []AvpDef{{Code: 416, Name: "CC-Request-Type", Type: "Unsigned32"}}}, "avps"},
+		{"enum value", DictDef{Avps: []AvpDef{{Code: 416, Name: "CC-Request-Type", Type: "Enumerated", Enum: map[int32]string{1: "INITIAL"}}}}, "avps"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// the first source is valid, nothing of it may be added
+			c_first := DictDef{Commands: []CommandDef{{Code: 257, Name: "Capabilities-Exchange"}}}
+			dc := NewDictionary()
+			if err := dc.AddDef(c_base); err != nil {
+				t.Fatal(err)
+			}
+			err := dc.AddDefs([]DictDef{c_first, c.def}, LoadOptions{Strict: true})
+			var c_err *DictError
+			if !errors.As(err, &c_err) || c_err.Section != c.section || c_err.Index != 0 {
+				t.Fatalf("strict: %v, want a conflict in %s[0]", err, c.section)
+			}
+			if _, ok := dc.LookUpAvp_command(257); ok {
+				t.Error("strict: the sources before the conflict are added")
+			}
+			if c_name, _ := dc.LookUpAvp_command(272); c_name != "Credit-Control" {
+				t.Errorf("strict: command 272 is %s", c_name)
+			}
+
+			// without strict the later definition wins
+			if err := dc.AddDefs([]DictDef{c_first, c.def}, LoadOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := dc.LookUpAvp_command(257); !ok {
+				t.Error("the sources are not added")
+			}
+		})
+	}
+
+	// the same definition again is no conflict
+	dc := NewDictionary()
+	if err := dc.AddDefs([]DictDef{c_base, c_base}, LoadOptions{Strict: true}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddDefsInvalid(t *testing.T) {
+	dc := NewDictionary()
+	err := dc.AddDefs([]DictDef{
+		{Commands: []CommandDef{{Code: 257, Name: "Capabilities-Exchange"}}},
+		{Source: "bad.json", Avps: []AvpDef{{Code: 1, Name: "User-Name", Type: "UTF8String"}, {Code: 2, Name: "X", Type: "Text"}}},
+	}, LoadOptions{})
+	var c_err *DictError
+	if !errors.As(err, &c_err) || c_err.File != "bad.json" || c_err.Section != "avps" || c_err.Index != 1 || c_err.Field != "type" {
+		t.Fatalf("%v, want an error at bad.json avps[1].type", err)
+	}
+	if _, ok := dc.LookUpAvp_command(257); ok {
+		t.Error("the valid source is added")
+	}
+}
+
+// TestAddDefsVendorSymbols resolves the vendor symbols of the AVPs with the
+// vendors of every source, the declaring one may come later.
+func TestAddDefsVendorSymbols(t *testing.T) {
+	c_avps := DictDef{Source: "TGPPGx.xml", Avps: []AvpDef{{Code: 1016, Vendor: "TGPP", Name: "QoS-Information", Type: "grouped"}}}
+	c_vendors := DictDef{Source: "dictionary.xml", Vendors: []VendorDef{{Id: 10415, Name: "3GPP", Sym: "TGPP"}}}
+
+	dc := NewDictionary()
+	if err := dc.AddDefs([]DictDef{c_avps}, LoadOptions{}); err == nil {
+		t.Error("unknown vendor symbol accepted")
+	}
+	if err := dc.AddDefs([]DictDef{c_avps, c_vendors}, LoadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if c_avp := dc.LookUpAvp(1016, 10415); c_avp.GetName() != "QoS-Information" {
+		t.Errorf("avp 10415.1016 is %s", c_avp.GetName())
+	}
+	for _, v := range []string{"TGPP", "3gpp"} {
+		if c_id, ok := dc.LookUpVendorByName(v); !ok || c_id != 10415 {
+			t.Errorf("vendor %s: %d", v, c_id)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package diam
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type FormatMode int
+
+const (
+	// FORMAT_NORMAL is the ToString layout, one AVP per line.
+	FORMAT_NORMAL FormatMode = iota
+	// FORMAT_COMPACT puts the whole message on one line.
+	FORMAT_COMPACT
+	// FORMAT_VERBOSE adds the offsets (hex, as in HexDump), lengths, padding
+	// and types.
+	FORMAT_VERBOSE
+)
+
+// FormatOptions selects the layout of Message.Format.
+type FormatOptions struct {
+	Mode FormatMode
+	// Color adds ANSI colors for terminals.
+	Color bool
+	// Raw shows codes only, no names are looked up.
+	Raw bool
+	// Dict gives the names, Default() if nil.
+	Dict *Dictionary
+}
+
+const (
+	const_pre = "    "
+)
+
+const (
+	ansi_reset   = "\x1b[0m"
+	ansi_bold    = "\x1b[1m"
+	ansi_dim     = "\x1b[2m"
+	ansi_green   = "\x1b[32m"
+	ansi_yellow  = "\x1b[33m"
+	ansi_cyan    = "\x1b[36m"
+	ansi_magenta = "\x1b[35m"
+)
+
+type formatter struct {
+	opts FormatOptions
+	dc   *Dictionary
+}
+
+// Format writes the message in the layout of opts.
+func (d *Message) Format(opts FormatOptions) string {
+	f := newFormatter(opts)
+	if opts.Mode == FORMAT_COMPACT {
+		return f.compactMessage(d)
+	}
+	return f.message(d)
+}
+
+// Format writes the AVP (and its children) in the layout of opts.
+func (a *AVP) Format(opts FormatOptions) string {
+	f := newFormatter(opts)
+	if opts.Mode == FORMAT_COMPACT {
+		return f.compactAvp(*a)
+	}
+	return strings.Join(f.avps([]AVP{*a}, 0, 0), "\n")
+}
+
+func newFormatter(opts FormatOptions) *formatter {
+	dc := opts.Dict
+	if dc == nil {
+		dc = Default()
+	}
+	return &formatter{opts: opts, dc: dc}
+}
+
+func (f *formatter) paint(color string, in string) string {
+	if !f.opts.Color {
+		return in
+	}
+	return color + in + ansi_reset
+}
+
+func (f *formatter) message(d *Message) string {
+	var res []string
+
+	c_key := func(key string) string {
+		return f.paint(ansi_bold, fmt.Sprintf("%-11s", key))
+	}
+
+	if f.opts.Mode == FORMAT_VERBOSE {
+		res = append(res, fmt.Sprintf("%s 1", c_key("version:")))
+		res = append(res, fmt.Sprintf("%s %d", c_key("length:"), 20+avpsSize(d.avps)))
+	}
+	res = append(res, fmt.Sprintf("%s %s", c_key("cmd_code:"), f.command(d.header.cmd_code)))
+
+	flag_str := ""
+	if d.IsRequest() {
+		flag_str += "Request"
+	} else {
+		flag_str += "Answer"
+	}
+	if d.header.cmd_flags&msg_flag_proxiable != 0 {
+		flag_str += ",Proxiable"
+	}
+	if d.header.cmd_flags&msg_flag_error != 0 {
+		flag_str += ",Error"
+	}
+	if d.header.cmd_flags&msg_flag_retransmit != 0 {
+		flag_str += ",Retransmit"
+	}
+	res = append(res, fmt.Sprintf("%s 0x%x %s", c_key("flags:"), d.header.cmd_flags, flag_str))
+
+	res = append(res, fmt.Sprintf("%s %s", c_key("app_id:"), f.application(d.header.app_id)))
+	res = append(res, fmt.Sprintf("%s 0x%08x", c_key("hop_by_hop:"), d.header.hop_by_hop))
+	res = append(res, fmt.Sprintf("%s 0x%08x", c_key("end_by_end:"), d.header.end_to_end))
+	res = append(res, "----")
+	res = append(res, strings.Join(f.avps(d.avps, 0, 20), "\n"))
+	return strings.Join(res, "\n")
+}
+
+// avps returns one line per AVP, offset is the position of the first AVP in
+// the message, used by FORMAT_VERBOSE.
+func (f *formatter) avps(avps []AVP, level int, offset int) []string {
+	var res []string
+	pref := strings.Repeat(const_pre, level)
+
+	for _, v := range avps {
+		c_avp_code := v.avp_code
+		c_vendor_id := v.vendor_id
+		dict_entry := f.entry(v)
+
+		cflags := "-"
+		if c_vendor_id != 0 {
+			cflags = "V"
+		}
+		if v.mandatory_flag {
+			cflags += "M"
+		} else {
+			cflags += "-"
+		}
+
+		cline := pref + "AVP: " + f.avpName(dict_entry, c_avp_code) + " f=" + f.paint(ansi_dim, cflags)
+		if c_vendor_id != 0 {
+			cline += fmt.Sprintf(" vnd=%s", f.vendor(c_vendor_id))
+		}
+
+		c_len, c_pad := avpSize(v)
+		if f.opts.Mode == FORMAT_VERBOSE {
+			cline = f.paint(ansi_dim, fmt.Sprintf("%04x ", offset)) + cline
+			cline += fmt.Sprintf(" len=%d pad=%d type=%s", c_len, c_pad, avp_format_names[v.format])
+		}
+
+		child_avps, is_group := v.data.([]AVP)
+		if !is_group {
+			cline += " val=" + f.value(dict_entry, v)
+		}
+		res = append(res, cline)
+
+		if is_group && len(child_avps) != 0 {
+			res = append(res, f.avps(child_avps, level+1, offset+avpHeaderSize(v))...)
+		}
+		offset += c_len + c_pad
+	}
+	return res
+}
+
+func (f *formatter) compactMessage(d *Message) string {
+	c_kind := "Answer"
+	if d.IsRequest() {
+		c_kind = "Request"
+	}
+	c_head := fmt.Sprintf("%s %s app=%s hbh=0x%08x e2e=0x%08x", f.command(d.header.cmd_code), c_kind,
+		f.application(d.header.app_id), d.header.hop_by_hop, d.header.end_to_end)
+
+	var c_avps []string
+	for _, v := range d.avps {
+		c_avps = append(c_avps, f.compactAvp(v))
+	}
+	return c_head + " " + strings.Join(c_avps, " ")
+}
+
+func (f *formatter) compactAvp(avp AVP) string {
+	dict_entry := f.entry(avp)
+	c_name := f.paint(ansi_cyan, dict_entry.name)
+	if f.opts.Raw || dict_entry.avptype == Avp_code_unknown {
+		c_name = f.paint(ansi_yellow, fmt.Sprintf("%d.%d", avp.vendor_id, avp.avp_code))
+	}
+
+	if child_avps, ok := avp.data.([]AVP); ok {
+		var c_children []string
+		for _, v := range child_avps {
+			c_children = append(c_children, f.compactAvp(v))
+		}
+		return c_name + "={" + strings.Join(c_children, " ") + "}"
+	}
+	return c_name + "=" + f.value(dict_entry, avp)
+}
+
+func (f *formatter) entry(avp AVP) AVPDictEntry {
+	if f.opts.Raw {
+		return AVPDictEntry{avptype: Avp_code_unknown, code: avp.avp_code, vendor_id: avp.vendor_id}
+	}
+	return f.dc.LookUpAvp(avp.avp_code, avp.vendor_id)
+}
+
+func (f *formatter) avpName(dict_entry AVPDictEntry, avp_code uint32) string {
+	if f.opts.Raw {
+		return fmt.Sprintf("%d", avp_code)
+	}
+	if dict_entry.avptype == Avp_code_unknown {
+		return f.paint(ansi_yellow, dict_entry.name) + fmt.Sprintf("(%d)", avp_code)
+	}
+	return f.paint(ansi_cyan, dict_entry.name) + fmt.Sprintf("(%d)", avp_code)
+}
+
+func (f *formatter) vendor(vendor_id uint32) string {
+	if f.opts.Raw {
+		return fmt.Sprintf("%d", vendor_id)
+	}
+	return fmt.Sprintf("%s(%d)", vendorToString(f.dc, vendor_id), vendor_id)
+}
+
+func (f *formatter) command(cmd_code uint32) string {
+	if f.opts.Raw {
+		return fmt.Sprintf("%d", cmd_code)
+	}
+	return f.paint(ansi_magenta, cmdCodeToString(f.dc, cmd_code))
+}
+
+func (f *formatter) application(app_id uint32) string {
+	if f.opts.Raw {
+		return fmt.Sprintf("%d", app_id)
+	}
+	return cmdAppidToString(f.dc, app_id)
+}
+
+func (f *formatter) value(dict_entry AVPDictEntry, avp AVP) string {
+	if dict_entry.avptype == Avp_code_unknown || f.opts.Raw {
+		return f.paint(ansi_green, rawValue(avp))
+	}
+	return f.paint(ansi_green, avpToValue(f.dc, avp))
+}
+
+// rawValue shows the value without the dictionary, byte values are hex with
+// the text added if it is printable.
+func rawValue(avp AVP) string {
+	switch c_val := avp.data.(type) {
+	case []byte:
+		if len(c_val) > 0 && isPrintableASCII(c_val) {
+			return fmt.Sprintf("0x%x %q", c_val, c_val)
+		}
+		return fmt.Sprintf("0x%x", c_val)
+	case time.Time:
+		return c_val.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%v", avp.data)
+}
+
+func isPrintableASCII(in []byte) bool {
+	for _, c := range in {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// avpHeaderSize is 12 with vendor id, 8 otherwise.
+func avpHeaderSize(avp AVP) int {
+	if avp.vendor_id > 0 {
+		return 12
+	}
+	return 8
+}
+
+// avpSize returns the AVP Length (header and data) and the padding after it.
+func avpSize(avp AVP) (int, int) {
+	c_len := avpHeaderSize(avp)
+	switch c_val := avp.data.(type) {
+	case int32, uint32, float32, time.Time:
+		c_len += 4
+	case int64, uint64, float64:
+		c_len += 8
+	case []byte:
+		c_len += len(c_val)
+	case string:
+		c_len += len(c_val)
+	case Address:
+		c_len += 2 + len(c_val.addr)
+	case []AVP:
+		c_len += avpsSize(c_val)
+	}
+	return c_len, (4 - c_len%4) % 4
+}
+
+func avpsSize(avps []AVP) int {
+	ret := 0
+	for _, v := range avps {
+		c_len, c_pad := avpSize(v)
+		ret += c_len + c_pad
+	}
+	return ret
+}
+
+func vendorToString(dc *Dictionary, vendor_id uint32) string {
+	c_val, ok := dc.LookUpVendor(vendor_id)
+	if ok {
+		return c_val
+	}
+	return "Unknown"
+}
+
+func cmdCodeToString(dc *Dictionary, cmd_code uint32) string {
+	cmd_str, ok := dc.LookUpAvp_command(cmd_code)
+	if !ok {
+		return fmt.Sprintf("%d", cmd_code)
+	}
+	return fmt.Sprintf("%s(%d)", cmd_str, cmd_code)
+}
+
+func cmdAppidToString(dc *Dictionary, app_id uint32) string {
+	cmd_str, ok := dc.LookUpAvp_appid(app_id)
+	if !ok {
+		return fmt.Sprintf("%d", app_id)
+	}
+	return fmt.Sprintf("%s(%d)", cmd_str, app_id)
+}
+
+func avpToValue(dc *Dictionary, avp AVP) string {
+	if avp.format == Avp_OctetString {
+		return fmt.Sprintf("0x%x", avp.data)
+	}
+
+	// messages built by hand may use Integer32/Unsigned32 for an Enumerated
+	// AVP, so the names are looked up for those too
+	var enum_int_val int32
+	switch c_val := avp.data.(type) {
+	case int32:
+		enum_int_val = c_val
+	case uint32:
+		enum_int_val = int32(c_val)
+	default:
+		return fmt.Sprintf("%v", avp.data)
+	}
+	mapped_str, ok := dc.LookUpAvp_Enum(avp.avp_code, avp.vendor_id, enum_int_val)
+	if !ok {
+		return fmt.Sprintf("%v", avp.data)
+	}
+	return fmt.Sprintf("%s(%v)", mapped_str, avp.data)
+}
@@ -0,0 +1,41 @@
+package diam
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestFormatVerboseOffsets finds the offset of every AVP line of the verbose
+// format in the hexdump of the message.
+func TestFormatVerboseOffsets(t *testing.T) {
+	dc := NewDictionary()
+	if err := dc.LoadDir("../dict"); err != nil {
+		t.Fatal(err)
+	}
+	c_mess := GenMess(272, true, true, 4, 1, 2, []AVP{
+		AVP_UTF8String(AVP_CODE_Session_Id, "host;1;2", true, 0),
+		AVP_Enumerated(AVP_CODE_CC_Request_Type, 1, true, 0),
+		AVP_Group(AVP_CODE_Subscription_Id, []AVP{
+			AVP_Enumerated(AVP_CODE_Subscription_Id_Type, 0, true, 0),
+			AVP_UTF8String(AVP_CODE_Subscription_Id_Data, "36201234567", true, 0),
+		}, true, 0),
+		AVP_Unsigned32(AVP_CODE_CC_Request_Number, 0, true, 0),
+	})
+	c_dump := "\n" + dc.HexDump(c_mess.Encode())
+
+	var c_offsets []string
+	for _, v := range strings.Split(c_mess.Format(FormatOptions{Mode: FORMAT_VERBOSE, Dict: dc}), "\n") {
+		if c_fields := strings.Fields(v); len(c_fields) > 1 && c_fields[1] == "AVP:" {
+			c_offsets = append(c_offsets, c_fields[0])
+		}
+	}
+	want := []string{"0014", "0024", "0030", "0038", "0044", "0058"}
+	if strings.Join(c_offsets, " ") != strings.Join(want, " ") {
+		t.Fatalf("offsets %v, want %v", c_offsets, want)
+	}
+	for _, v := range c_offsets {
+		if !strings.Contains(c_dump, "\n"+v+"  ") {
+			t.Errorf("offset %s is not in the hexdump\n%s", v, c_dump)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package diam
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	hexdump_bytes_per_line = 16
+	hexdump_note_col       = 6 + 3*hexdump_bytes_per_line
+)
+
+// avp_fixed_sizes are the value sizes of the fixed length formats.
+var avp_fixed_sizes map[int]int = map[int]int{
+	Avp_Integer32:  4,
+	Avp_Integer64:  8,
+	Avp_Unsigned32: 4,
+	Avp_Unsigned64: 8,
+	Avp_Float32:    4,
+	Avp_Float64:    8,
+	Avp_Enumerated: 4,
+	Avp_Time:       4,
+}
+
+type hexDumper struct {
+	dc    *Dictionary
+	in    []byte
+	lines []string
+}
+
+// HexDump annotates a raw message, it does not need to be decodable. Every
+// header field, AVP header, value and padding is marked; the problems are
+// marked with "!!" where they are found. The bytes that cannot be parsed
+// after a problem are dumped as such.
+func HexDump(in []byte) string {
+	return Default().HexDump(in)
+}
+
+// HexDump is HexDump with the types and names taken from dc.
+func (dc *Dictionary) HexDump(in []byte) string {
+	h := &hexDumper{dc: dc, in: in}
+	h.message()
+	return strings.Join(h.lines, "\n")
+}
+
+func (h *hexDumper) message() {
+	in := h.in
+	if len(in) < 20 {
+		h.problem(0, 0, "message is %d bytes, shorter than the 20 byte header", len(in))
+		h.unparsed(0, len(in), 0)
+		return
+	}
+
+	c_version := in[0]
+	c_note := fmt.Sprintf("version %d", c_version)
+	if c_version != 1 {
+		c_note += " !! should be 1"
+	}
+	h.field(0, 1, 0, c_note)
+
+	c_length := int(byteArrayToUint32(append([]byte{0}, in[1:4]...)))
+	c_note = fmt.Sprintf("length %d", c_length)
+	if c_length != len(in) {
+		c_note += fmt.Sprintf(" !! got %d bytes", len(in))
+	}
+	h.field(1, 4, 0, c_note)
+
+	c_flags := in[4]
+	c_note = fmt.Sprintf("flags 0x%02x %s", c_flags, msgFlagString(c_flags))
+	if c_flags&0x0f != 0 {
+		c_note += " !! reserved bits set"
+	}
+	h.field(4, 5, 0, c_note)
+
+	c_cmd_code := byteArrayToUint32(append([]byte{0}, in[5:8]...))
+	h.field(5, 8, 0, "command code "+cmdCodeToString(h.dc, c_cmd_code))
+	h.field(8, 12, 0, "application id "+cmdAppidToString(h.dc, byteArrayToUint32(in[8:12])))
+	h.field(12, 16, 0, fmt.Sprintf("hop-by-hop 0x%08x", byteArrayToUint32(in[12:16])))
+	h.field(16, 20, 0, fmt.Sprintf("end-to-end 0x%08x", byteArrayToUint32(in[16:20])))
+
+	c_end := len(in)
+	if c_length >= 20 && c_length < c_end {
+		c_end = c_length
+	}
+	h.avps(20, c_end, 0)
+	if c_end < len(in) {
+		h.problem(c_end, 0, "%d bytes after the message length", len(in)-c_end)
+		h.unparsed(c_end, len(in), 0)
+	}
+}
+
+// avps annotates the AVPs between start and end, it returns false if the
+// rest could not be parsed.
+func (h *hexDumper) avps(start int, end int, level int) bool {
+	in := h.in
+	pos := start
+	for pos < end {
+		c_left := end - pos
+		if c_left < 8 {
+			h.problem(pos, level, "AVP header needs 8 bytes, %d left", c_left)
+			h.unparsed(pos, end, level)
+			return false
+		}
+		c_code := byteArrayToUint32(in[pos : pos+4])
+		c_flags := in[pos+4]
+		c_length := int(byteArrayToUint32(append([]byte{0}, in[pos+5:pos+8]...)))
+		c_vendor_flag := c_flags&0x80 != 0
+		c_head_size := 8
+		var c_vendor_id uint32
+		if c_vendor_flag {
+			c_head_size = 12
+			if c_left >= 12 {
+				c_vendor_id = byteArrayToUint32(in[pos+8 : pos+12])
+			}
+		}
+		dict_entry := h.dc.LookUpAvp(c_code, c_vendor_id)
+
+		h.field(pos, pos+4, level, fmt.Sprintf("AVP code %d %s", c_code, dict_entry.name))
+		c_note := fmt.Sprintf("flags 0x%02x %s", c_flags, avpFlagString(c_flags))
+		if c_flags&0x1f != 0 {
+			c_note += " !! reserved bits set"
+		}
+		h.field(pos+4, pos+5, level+1, c_note)
+		h.field(pos+5, pos+8, level+1, fmt.Sprintf("length %d", c_length))
+
+		if c_vendor_flag {
+			if c_left < 12 {
+				h.problem(pos+8, level+1, "V flag is set, vendor id needs 4 bytes, %d left", c_left-8)
+				h.unparsed(pos+8, end, level)
+				return false
+			}
+			h.field(pos+8, pos+12, level+1, fmt.Sprintf("vendor id %d %s", c_vendor_id, vendorToString(h.dc, c_vendor_id)))
+		}
+
+		if c_length < c_head_size {
+			h.problem(pos+5, level+1, "length %d is less than the %d byte AVP header", c_length, c_head_size)
+			h.unparsed(pos+c_head_size, end, level)
+			return false
+		}
+		if c_length > c_left {
+			h.problem(pos+5, level+1, "length %d exceeds the %d bytes left", c_length, c_left)
+			h.unparsed(pos+c_head_size, end, level)
+			return false
+		}
+
+		c_data_start := pos + c_head_size
+		c_data_end := pos + c_length
+		if dict_entry.avptype == Avp_Grouped {
+			h.avps(c_data_start, c_data_end, level+1)
+		} else {
+			h.value(c_data_start, c_data_end, level+1, c_code, c_flags, c_vendor_id, dict_entry)
+		}
+
+		pos = c_data_end
+		c_pad := (4 - c_length%4) % 4
+		if c_pad == 0 {
+			continue
+		}
+		if end-pos < c_pad {
+			if end-pos > 0 {
+				h.field(pos, end, level+1, "padding")
+			}
+			h.problem(end, level+1, "%d bytes of padding missing", c_pad-(end-pos))
+			return false
+		}
+		c_note = "padding"
+		for _, b := range in[pos : pos+c_pad] {
+			if b != 0 {
+				c_note += " !! not zero"
+				break
+			}
+		}
+		h.field(pos, pos+c_pad, level+1, c_note)
+		pos += c_pad
+	}
+	return true
+}
+
+func (h *hexDumper) value(start int, end int, level int, c_code uint32, c_flags byte, c_vendor_id uint32, dict_entry AVPDictEntry) {
+	c_data := h.in[start:end]
+	c_format := dict_entry.avptype
+	c_type := avp_format_names[c_format]
+
+	if c_size, ok := avp_fixed_sizes[c_format]; ok && len(c_data) != c_size {
+		h.field(start, end, level, fmt.Sprintf("value !! %s needs %d bytes, got %d", c_type, c_size, len(c_data)))
+		return
+	}
+	if c_format == Avp_Address && len(c_data) < 2 {
+		h.field(start, end, level, fmt.Sprintf("value !! Address needs the 2 byte family, got %d bytes", len(c_data)))
+		return
+	}
+	if len(c_data) == 0 {
+		h.problem(start, level, "%s value is empty", c_type)
+		return
+	}
+
+	var c_val string
+	if c_format == Avp_code_unknown {
+		c_val = rawValue(AVP{data: c_data})
+	} else {
+		c_avp := h.dc.Decode_AVP(c_code, c_flags&0x80 != 0, c_flags&0x40 != 0, c_vendor_id, h.in[start-avpHeaderLen(c_flags):end])
+		c_val = avpToValue(h.dc, c_avp)
+	}
+	if len(c_val) > 60 {
+		c_val = c_val[:57] + "..."
+	}
+	h.field(start, end, level, "value "+c_type+" "+c_val)
+}
+
+func avpHeaderLen(c_flags byte) int {
+	if c_flags&0x80 != 0 {
+		return 12
+	}
+	return 8
+}
+
+// field adds the bytes from start to end, the note goes to the first line.
+func (h *hexDumper) field(start int, end int, level int, note string) {
+	for c_pos := start; c_pos < end; c_pos += hexdump_bytes_per_line {
+		c_line_end := c_pos + hexdump_bytes_per_line
+		if c_line_end > end {
+			c_line_end = end
+		}
+		c_line := fmt.Sprintf("%04x  % x", c_pos, h.in[c_pos:c_line_end])
+		if c_pos == start {
+			c_line += strings.Repeat(" ", hexdump_note_col-len(c_line)) + strings.Repeat("  ", level) + note
+		}
+		h.lines = append(h.lines, strings.TrimRight(c_line, " "))
+	}
+}
+
+func (h *hexDumper) problem(pos int, level int, format string, a ...interface{}) {
+	c_line := fmt.Sprintf("%04x", pos)
+	c_line += strings.Repeat(" ", hexdump_note_col-len(c_line)) + strings.Repeat("  ", level) + "!! " + fmt.Sprintf(format, a...)
+	h.lines = append(h.lines, c_line)
+}
+
+func (h *hexDumper) unparsed(start int, end int, level int) {
+	if start < end {
+		h.field(start, end, level, "not parsed")
+	}
+}
+
+func msgFlagString(c_flags byte) string {
+	var res []string
+	if c_flags&msg_flag_request != 0 {
+		res = append(res, "Request")
+	} else {
+		res = append(res, "Answer")
+	}
+	if c_flags&msg_flag_proxiable != 0 {
+		res = append(res, "Proxiable")
+	}
+	if c_flags&msg_flag_error != 0 {
+		res = append(res, "Error")
+	}
+	if c_flags&msg_flag_retransmit != 0 {
+		res = append(res, "Retransmit")
+	}
+	return strings.Join(res, ",")
+}
+
+func avpFlagString(c_flags byte) string {
+	ret := []byte("---")
+	if c_flags&0x80 != 0 {
+		ret[0] = 'V'
+	}
+	if c_flags&0x40 != 0 {
+		ret[1] = 'M'
+	}
+	if c_flags&0x20 != 0 {
+		ret[2] = 'P'
+	}
+	return string(ret)
+}
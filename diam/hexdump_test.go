@@ -0,0 +1,39 @@
+package diam
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHexDump(t *testing.T) {
+	dc := testDictionary(t)
+	c_mess := testMessage()
+	c_dump := dc.HexDump(c_mess.Encode())
+	for _, v := range []string{"command code Credit-Control(272)", "AVP code 263 Session-Id", "value UTF8String host;1;2", "AVP code 450 Subscription-Id-Type", "padding"} {
+		if !strings.Contains(c_dump, v) {
+			t.Errorf("%q missing\n%s", v, c_dump)
+		}
+	}
+	if strings.Contains(c_dump, "!!") {
+		t.Errorf("problem in a valid message\n%s", c_dump)
+	}
+}
+
+// TestHexDumpTruncated dumps the message cut at every byte, each dump
+// has to point to a problem.
+func TestHexDumpTruncated(t *testing.T) {
+	dc := testDictionary(t)
+	c_mess := testMessage()
+	c_enc := c_mess.Encode()
+	for i := 0; i < len(c_enc); i++ {
+		if c_dump := dc.HexDump(c_enc[:i]); !strings.Contains(c_dump, "!!") {
+			t.Errorf("no problem marked in the message cut to %d bytes\n%s", i, c_dump)
+		}
+	}
+	c_dump := dc.HexDump(c_enc[:30])
+	for _, v := range []string{"length 84 !! got 30 bytes", "!! length 16 exceeds the 10 bytes left", "001c  68 6f"} {
+		if !strings.Contains(c_dump, v) {
+			t.Errorf("%q missing\n%s", v, c_dump)
+		}
+	}
+}
@@ -22,7 +22,6 @@ https://www.iana.org/assignments/aaa-parameters/aaa-parameters.txt
 import (
 	"fmt"
 	l "github.com/lehotomi/diam/mlog"
-	"strings"
 )
 
 type Header struct {
@@ -55,6 +54,24 @@ func (d *Message) Set_request_flag(val bool) {
 	}
 }
 
+// Set_retransmit_flag sets the T flag of a request sent again.
+func (d *Message) Set_retransmit_flag(val bool) {
+	if val {
+		d.header.cmd_flags = d.header.cmd_flags | 0b00010000
+	} else {
+		d.header.cmd_flags = d.header.cmd_flags & 0b11101111
+	}
+}
+
+// Set_error_flag sets the E flag of an answer with a protocol error.
+func (d *Message) Set_error_flag(val bool) {
+	if val {
+		d.header.cmd_flags = d.header.cmd_flags | 0b00100000
+	} else {
+		d.header.cmd_flags = d.header.cmd_flags & 0b11011111
+	}
+}
+
 func (d *Message) Get_hop_by_hop() uint32 {
 	return d.header.hop_by_hop
 }
@@ -165,6 +182,15 @@ func (d *Message) GetCmdCode() uint32 {
 	return d.header.cmd_code
 }
 
+func (d *Message) GetAppId() uint32 {
+	return d.header.app_id
+}
+
+// GetAVPs returns the top level AVPs of the message.
+func (d *Message) GetAVPs() []AVP {
+	return d.avps
+}
+
 func (d *Message) GetCmdFlags() uint8 {
 	return d.header.cmd_flags
 }
@@ -210,6 +236,37 @@ func DecodeHeader(in []byte) Message {
 }
 
 func Decode(in []byte) Message {
+	return Default().Decode(in)
+}
+
+// Decode decodes in with the types defined in dc. A malformed message is
+// logged, the AVPs before the problem are kept.
+func (dc *Dictionary) Decode(in []byte) Message {
+	c_mess, err := dc.decodeMessage(in)
+	if err != nil {
+		l.Warn.Printf("message decode error: %v", err)
+	}
+	return c_mess
+}
+
+func DecodeMessage(in []byte) (Message, error) {
+	return Default().DecodeMessage(in)
+}
+
+// DecodeMessage is Decode with a malformed message, e.g. a truncated one or
+// an AVP length not matching its type, returned as an error.
+func (dc *Dictionary) DecodeMessage(in []byte) (Message, error) {
+	c_mess, err := dc.decodeMessage(in)
+	if err != nil {
+		return Message{}, err
+	}
+	return c_mess, nil
+}
+
+func (dc *Dictionary) decodeMessage(in []byte) (Message, error) {
+	if len(in) < 20 {
+		return Message{}, fmt.Errorf("message is %d bytes, shorter than the 20 byte header", len(in))
+	}
 	header := in[0:20]
 
 	length_b := make([]byte, 4)
@@ -233,13 +290,9 @@ func Decode(in []byte) Message {
 	c_end_to_end := byteArrayToUint32(header[16:20])
 
 	avp_data := in[20:]
-
-	if c_length != uint32(len(avp_data))+20 {
-		l.Warn.Println("lent:", len(avp_data), c_length)
-	}
 	//l.Trace.Printf("avps d dec:% x",avp_data)
 
-	var avps_dec []AVP = Decode_AVPs(avp_data)
+	avps_dec, err := dc.decodeAVPs(avp_data, 20)
 
 	c_mess := Message{
 		header: Header{
@@ -251,169 +304,20 @@ func Decode(in []byte) Message {
 		},
 		avps: avps_dec,
 	}
-	return c_mess
-}
-
-func (d *Message) ToString() string {
-	var res []string
-
-	res = append(res, fmt.Sprintf("%-11s %s", "cmd_code:", cmdCodeToString(d.header.cmd_code)))
-
-	flag_str := ""
-	if d.IsRequest() {
-		flag_str += "Request"
-	} else {
-		flag_str += "Answer"
-	}
-
-	//fmt.Println(d.header.cmd_flags & 0b01000000)
-	if d.header.cmd_flags&0b01000000 != 0 {
-		flag_str += ",Proxiable"
-	}
-
-	res = append(res, fmt.Sprintf("%-11s 0x%x %s", "flags:", d.header.cmd_flags, flag_str))
-
-	//app_id := fmt.Sprintf("%d", d.header.app_id)
-	res = append(res, fmt.Sprintf("%-11s %s", "app_id:", cmdAppidToString(d.header.app_id)))
-
-	res = append(res, fmt.Sprintf("%-11s 0x%08x", "hop_by_hop:", d.header.hop_by_hop))
-	res = append(res, fmt.Sprintf("%-11s 0x%08x", "end_by_end:", d.header.end_to_end))
-	res = append(res, "----")
-	res = append(res, avpsToString(d.avps, 0))
-	return strings.Join(res, "\n")
-}
-
-const (
-	const_pre = "    "
-)
-
-func avpsToString(avps []AVP, level int) string {
-	var res []string
-	pref := ""
-	for k := 0; k < level; k++ {
-		pref += const_pre
+	if err != nil {
+		return c_mess, err
 	}
-	for _, v := range avps {
-		//func LookUpAvp(avp_code uint32, vendor_id uint32) AVPDictEntry {
-		c_avp_code := v.avp_code
-		c_vendor_id := v.vendor_id
-		dict_entry := LookUpAvp(c_avp_code, c_vendor_id)
-		var cline string
-		cflags := ""
-
-		if c_vendor_id != 0 {
-			cflags = "V"
-		} else {
-			cflags = "-"
-		}
-
-		if v.mandatory_flag {
-			cflags += "M"
-		} else {
-			cflags += "-"
-		}
-		if c_vendor_id != 0 {
-			if dict_entry.avptype == Avp_Grouped {
-				cline = fmt.Sprintf("%sAVP: %s(%d) f=%s vnd=%s(%d)", pref, dict_entry.name, c_avp_code, cflags, vendorToString(c_vendor_id), c_vendor_id)
-			} else {
-				var c_val string
-				if dict_entry.avptype != Avp_code_unknown {
-					c_val = avpToValue(v)
-				} else {
-					c_val = fmt.Sprintf("0x%x", v.data)
-				}
-				cline = fmt.Sprintf("%sAVP: %s(%d) f=%s vnd=%s(%d) val=%s", pref, dict_entry.name, c_avp_code, cflags, vendorToString(c_vendor_id), c_vendor_id, c_val)
-			}
-		} else {
-			if dict_entry.avptype == Avp_Grouped {
-				cline = fmt.Sprintf("%sAVP: %s(%d) f=%s", pref, dict_entry.name, c_avp_code, cflags)
-			} else {
-				var c_val string
-				if dict_entry.avptype != Avp_code_unknown {
-					c_val = avpToValue(v)
-				} else {
-					c_val = fmt.Sprintf("0x%x", v.data)
-				}
-				cline = fmt.Sprintf("%sAVP: %s(%d) f=%s val=%s", pref, dict_entry.name, c_avp_code, cflags, c_val)
-			}
-		}
-
-		if dict_entry.avptype == Avp_Grouped {
-			child_avps, ok := v.data.([]AVP)
-			if !ok {
-				continue
-			}
-			if len(child_avps) != 0 {
-				child_string := avpsToString(child_avps, level+1)
-				cline += "\n" + child_string
-			}
-		}
-
-		res = append(res, cline)
-
+	if c_length != uint32(len(in)) {
+		return c_mess, fmt.Errorf("message length %d, got %d bytes", c_length, len(in))
 	}
-	return strings.Join(res, "\n")
+	return c_mess, nil
 }
 
-//TODO: put this to config
-var vendorToStringMap map[uint32]string = map[uint32]string{
-	61:       "Merit",
-	429:      "USR",
-	1751:     "Lucent",
-	2011:     "Huawei",
-	2937:     "Deutsche_Telekom_AG",
-	3830:     "Acision",
-	5806:     "SKT",
-	10415:    "TGPP",
-	12951:    "VerizonWireless",
-	13019:    "ETSI",
-	13421:    "Tango",
-	81000:    "ChinaTelecom",
-	16777216: "TGPPCX",
-	12645:    "Vodafone",
-}
-
-func vendorToString(vendor_id uint32) string {
-	c_val, ok := vendorToStringMap[vendor_id]
-	if ok {
-		return c_val
-	}
-	return "Unknown"
-}
-
-func cmdCodeToString(cmd_code uint32) string {
-	cmd_str, ok := LookUpAvp_command(cmd_code)
-	if !ok {
-		return fmt.Sprintf("%d", cmd_code)
-	}
-	return fmt.Sprintf("%s(%d)", cmd_str, cmd_code)
-}
-
-func cmdAppidToString(app_id uint32) string {
-	cmd_str, ok := LookUpAvp_appid(app_id)
-	if !ok {
-		return fmt.Sprintf("%d", app_id)
-	}
-	return fmt.Sprintf("%s(%d)", cmd_str, app_id)
+func (d *Message) ToString() string {
+	return d.ToStringDict(Default())
 }
 
-func avpToValue(avp AVP) string {
-	if avp.format == Avp_OctetString {
-		return fmt.Sprintf("0x%x", avp.data)
-	}
-
-	if avp.format == Avp_Enumerated {
-
-		enum_int_val, ok := avp.data.(int32)
-		if !ok {
-			return fmt.Sprintf("%v", avp.data)
-		}
-		mapped_str, ok := LookUpAvp_Enum(avp.avp_code, avp.vendor_id, enum_int_val)
-
-		if !ok {
-			return fmt.Sprintf("%d", avp.data)
-		}
-		return fmt.Sprintf("%s(%d)", mapped_str, avp.data)
-	}
-	return fmt.Sprintf("%v", avp.data)
+// ToStringDict is ToString with the names taken from dc.
+func (d *Message) ToStringDict(dc *Dictionary) string {
+	return d.Format(FormatOptions{Dict: dc})
 }
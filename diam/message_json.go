@@ -0,0 +1,521 @@
+package diam
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageJSON is the structured form of a Message used by MarshalJSON and
+// MarshalYAML. As input the names may be given instead of the codes:
+//
+//	{"command": "Credit-Control", "application": "Diameter Credit Control Application",
+//	 "flags": {"request": true, "proxiable": true},
+//	 "avps": [{"name": "CC-Request-Type", "value": "EVENT_REQUEST"}]}
+type MessageJSON struct {
+	Command       string       `json:"command,omitempty" yaml:"command,omitempty"`
+	CommandCode   uint32       `json:"command_code" yaml:"command_code"`
+	Application   string       `json:"application,omitempty" yaml:"application,omitempty"`
+	ApplicationId uint32       `json:"application_id" yaml:"application_id"`
+	Flags         MessageFlags `json:"flags" yaml:"flags"`
+	HopByHop      uint32       `json:"hop_by_hop" yaml:"hop_by_hop"`
+	EndToEnd      uint32       `json:"end_to_end" yaml:"end_to_end"`
+	Avps          []MessageAvp `json:"avps" yaml:"avps"`
+}
+
+type MessageFlags struct {
+	Request    bool `json:"request" yaml:"request"`
+	Proxiable  bool `json:"proxiable" yaml:"proxiable"`
+	Error      bool `json:"error" yaml:"error"`
+	Retransmit bool `json:"retransmit" yaml:"retransmit"`
+}
+
+// MessageAvp is the structured form of an AVP. Type is the format the value is
+// encoded with, Unknown for AVPs not in the dictionary. OctetString and
+// Unknown values are hex, Time is RFC 3339, Enumerated has the number in
+// Value and the name in Enum. A UTF8String that is not valid UTF-8 is
+// written as OctetString to keep its bytes. As input the type comes from the
+// dictionary if not given, Enumerated values may be names and Mandatory
+// defaults to true.
+type MessageAvp struct {
+	Name      string       `json:"name,omitempty" yaml:"name,omitempty"`
+	Code      uint32       `json:"code" yaml:"code"`
+	VendorId  uint32       `json:"vendor_id,omitempty" yaml:"vendor_id,omitempty"`
+	Vendor    string       `json:"vendor,omitempty" yaml:"vendor,omitempty"`
+	Mandatory *bool        `json:"mandatory,omitempty" yaml:"mandatory,omitempty"`
+	Type      string       `json:"type,omitempty" yaml:"type,omitempty"`
+	Value     interface{}  `json:"value,omitempty" yaml:"value,omitempty"`
+	Enum      string       `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Family    *uint16      `json:"family,omitempty" yaml:"family,omitempty"`
+	Avps      []MessageAvp `json:"avps,omitempty" yaml:"avps,omitempty"`
+}
+
+const (
+	msg_flag_request    = 0b10000000
+	msg_flag_proxiable  = 0b01000000
+	msg_flag_error      = 0b00100000
+	msg_flag_retransmit = 0b00010000
+)
+
+var avp_format_names map[int]string = map[int]string{
+	Avp_Integer32:    "Integer32",
+	Avp_Integer64:    "Integer64",
+	Avp_Unsigned32:   "Unsigned32",
+	Avp_Unsigned64:   "Unsigned64",
+	Avp_Float32:      "Float32",
+	Avp_Float64:      "Float64",
+	Avp_OctetString:  "OctetString",
+	Avp_UTF8String:   "UTF8String",
+	Avp_Enumerated:   "Enumerated",
+	Avp_Time:         "Time",
+	Avp_Grouped:      "Grouped",
+	Avp_Address:      "Address",
+	Avp_code_unknown: "Unknown",
+}
+
+func (d Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Default().ToMessageJSON(d))
+}
+
+func (d *Message) UnmarshalJSON(b []byte) error {
+	c_mess, err := Default().UnmarshalMessage(b)
+	if err != nil {
+		return err
+	}
+	*d = c_mess
+	return nil
+}
+
+// MarshalYAML gives the same structure as MarshalJSON to yaml encoders. It
+// implements the Marshaler interface of gopkg.in/yaml.v2, the module does not
+// depend on a yaml package and it is not tested with one.
+func (d Message) MarshalYAML() (interface{}, error) {
+	return Default().ToMessageJSON(d), nil
+}
+
+// UnmarshalYAML reads the structure written by MarshalYAML.
+func (d *Message) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var c_json MessageJSON
+	if err := unmarshal(&c_json); err != nil {
+		return err
+	}
+	c_mess, err := Default().FromMessageJSON(c_json)
+	if err != nil {
+		return err
+	}
+	*d = c_mess
+	return nil
+}
+
+func (a AVP) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Default().ToMessageAvp(a))
+}
+
+func (a *AVP) UnmarshalJSON(b []byte) error {
+	var c_json MessageAvp
+	if err := decodeJSONNumbers(b, &c_json); err != nil {
+		return err
+	}
+	c_avp, err := Default().FromMessageAvp(c_json)
+	if err != nil {
+		return err
+	}
+	*a = c_avp
+	return nil
+}
+
+func (a AVP) MarshalYAML() (interface{}, error) {
+	return Default().ToMessageAvp(a), nil
+}
+
+func (a *AVP) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var c_json MessageAvp
+	if err := unmarshal(&c_json); err != nil {
+		return err
+	}
+	c_avp, err := Default().FromMessageAvp(c_json)
+	if err != nil {
+		return err
+	}
+	*a = c_avp
+	return nil
+}
+
+// MarshalMessage is json.Marshal of msg with the names of dc.
+func (dc *Dictionary) MarshalMessage(msg Message) ([]byte, error) {
+	return json.Marshal(dc.ToMessageJSON(msg))
+}
+
+// UnmarshalMessage reads a message written by MarshalMessage, or given by
+// names, see MessageJSON.
+func (dc *Dictionary) UnmarshalMessage(b []byte) (Message, error) {
+	var c_json MessageJSON
+	if err := decodeJSONNumbers(b, &c_json); err != nil {
+		return Message{}, err
+	}
+	return dc.FromMessageJSON(c_json)
+}
+
+// decodeJSONNumbers keeps the numbers of interface{} fields as json.Number,
+// so 64 bit values are not rounded.
+func decodeJSONNumbers(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func (dc *Dictionary) ToMessageJSON(msg Message) MessageJSON {
+	ret := MessageJSON{
+		CommandCode:   msg.header.cmd_code,
+		ApplicationId: msg.header.app_id,
+		Flags: MessageFlags{
+			Request:    msg.header.cmd_flags&msg_flag_request != 0,
+			Proxiable:  msg.header.cmd_flags&msg_flag_proxiable != 0,
+			Error:      msg.header.cmd_flags&msg_flag_error != 0,
+			Retransmit: msg.header.cmd_flags&msg_flag_retransmit != 0,
+		},
+		HopByHop: msg.header.hop_by_hop,
+		EndToEnd: msg.header.end_to_end,
+		Avps:     []MessageAvp{},
+	}
+	ret.Command, _ = dc.LookUpAvp_command(msg.header.cmd_code)
+	ret.Application, _ = dc.LookUpAvp_appid(msg.header.app_id)
+	for _, v := range msg.avps {
+		ret.Avps = append(ret.Avps, dc.ToMessageAvp(v))
+	}
+	return ret
+}
+
+func (dc *Dictionary) ToMessageAvp(avp AVP) MessageAvp {
+	c_mand := avp.mandatory_flag
+	ret := MessageAvp{
+		Code:      avp.avp_code,
+		VendorId:  avp.vendor_id,
+		Mandatory: &c_mand,
+		Type:      avp_format_names[avp.format],
+	}
+	c_entry := dc.LookUpAvp(avp.avp_code, avp.vendor_id)
+	if c_entry.avptype != Avp_code_unknown {
+		ret.Name = c_entry.name
+	}
+	if avp.vendor_id != 0 {
+		ret.Vendor, _ = dc.LookUpVendor(avp.vendor_id)
+	}
+
+	switch c_val := avp.data.(type) {
+	case []AVP:
+		ret.Avps = []MessageAvp{}
+		for _, v := range c_val {
+			ret.Avps = append(ret.Avps, dc.ToMessageAvp(v))
+		}
+	case []byte:
+		ret.Value = hex.EncodeToString(c_val)
+	case time.Time:
+		ret.Value = c_val.UTC().Format(time.RFC3339)
+	case Address:
+		c_family := c_val.family
+		ret.Family = &c_family
+		if c_ip, ok := addressIP(c_val); ok {
+			ret.Value = c_ip
+		} else {
+			ret.Value = hex.EncodeToString(c_val.addr)
+		}
+	case int32:
+		ret.Value = c_val
+		if avp.format == Avp_Enumerated {
+			ret.Enum, _ = dc.LookUpAvp_Enum(avp.avp_code, avp.vendor_id, c_val)
+		}
+	case string:
+		// the JSON string would replace the invalid bytes, OctetString keeps them
+		if !utf8.ValidString(c_val) {
+			ret.Type = avp_format_names[Avp_OctetString]
+			ret.Value = hex.EncodeToString([]byte(c_val))
+		} else {
+			ret.Value = c_val
+		}
+	default:
+		ret.Value = c_val
+	}
+	return ret
+}
+
+// addressIP returns the text form of IPv4 and IPv6 addresses.
+func addressIP(a Address) (string, bool) {
+	if (a.family == 1 && len(a.addr) == 4) || (a.family == 2 && len(a.addr) == 16) {
+		return net.IP(a.addr).String(), true
+	}
+	return "", false
+}
+
+func (dc *Dictionary) FromMessageJSON(in MessageJSON) (Message, error) {
+	c_cmd_code := in.CommandCode
+	if c_cmd_code == 0 && in.Command != "" {
+		c_code, ok := dc.LookUpCommandByName(in.Command)
+		if !ok {
+			return Message{}, fmt.Errorf("unknown command %s", in.Command)
+		}
+		c_cmd_code = c_code
+	}
+	c_app_id := in.ApplicationId
+	if c_app_id == 0 && in.Application != "" {
+		c_id, ok := dc.LookUpAppByName(in.Application)
+		if !ok {
+			return Message{}, fmt.Errorf("unknown application %s", in.Application)
+		}
+		c_app_id = c_id
+	}
+
+	var c_flags uint8
+	if in.Flags.Request {
+		c_flags |= msg_flag_request
+	}
+	if in.Flags.Proxiable {
+		c_flags |= msg_flag_proxiable
+	}
+	if in.Flags.Error {
+		c_flags |= msg_flag_error
+	}
+	if in.Flags.Retransmit {
+		c_flags |= msg_flag_retransmit
+	}
+
+	var avps []AVP
+	for i, v := range in.Avps {
+		c_avp, err := dc.FromMessageAvp(v)
+		if err != nil {
+			return Message{}, fmt.Errorf("avps[%d]: %v", i, err)
+		}
+		avps = append(avps, c_avp)
+	}
+
+	return Message{
+		header: Header{
+			cmd_flags:  c_flags,
+			cmd_code:   c_cmd_code,
+			app_id:     c_app_id,
+			hop_by_hop: in.HopByHop,
+			end_to_end: in.EndToEnd,
+		},
+		avps: avps,
+	}, nil
+}
+
+func (dc *Dictionary) FromMessageAvp(in MessageAvp) (AVP, error) {
+	c_vendor_id := in.VendorId
+	if c_vendor_id == 0 && in.Vendor != "" {
+		c_id, ok := dc.LookUpVendorByName(in.Vendor)
+		if !ok {
+			return AVP{}, fmt.Errorf("unknown vendor %s", in.Vendor)
+		}
+		c_vendor_id = c_id
+	}
+
+	c_code := in.Code
+	var c_entry AVPDictEntry
+	if c_code == 0 {
+		if in.Name == "" {
+			return AVP{}, fmt.Errorf("avp needs a code or a name")
+		}
+		var ok bool
+		if c_vendor_id != 0 || in.Vendor != "" {
+			c_entry, ok = dc.LookUpAvpByVendorName(c_vendor_id, in.Name)
+		} else {
+			c_entry, ok = dc.LookUpAvpByName(in.Name)
+		}
+		if !ok {
+			return AVP{}, fmt.Errorf("unknown avp %s", in.Name)
+		}
+		c_code = c_entry.code
+		c_vendor_id = c_entry.vendor_id
+	} else {
+		c_entry = dc.LookUpAvp(c_code, c_vendor_id)
+	}
+
+	c_name := in.Name
+	if c_name == "" {
+		c_name = fmt.Sprintf("%d.%d", c_vendor_id, c_code)
+	}
+
+	c_format := c_entry.avptype
+	if in.Type != "" {
+		c_format = -1
+		for k, v := range avp_format_names {
+			if v == in.Type {
+				c_format = k
+			}
+		}
+		if c_format == -1 {
+			return AVP{}, fmt.Errorf("%s: unknown type %s", c_name, in.Type)
+		}
+	}
+	if in.Avps != nil && in.Type == "" {
+		c_format = Avp_Grouped
+	}
+
+	c_mand := true
+	if in.Mandatory != nil {
+		c_mand = *in.Mandatory
+	}
+
+	c_data, err := dc.messageAvpValue(in, c_format, c_code, c_vendor_id)
+	if err != nil {
+		return AVP{}, fmt.Errorf("%s: %v", c_name, err)
+	}
+	ret := Basic_AVP(c_code, c_format, c_data, c_mand, c_vendor_id)
+	return ret, nil
+}
+
+func (dc *Dictionary) messageAvpValue(in MessageAvp, c_format int, c_code uint32, c_vendor_id uint32) (interface{}, error) {
+	switch c_format {
+	case Avp_Grouped:
+		var ret []AVP
+		for i, v := range in.Avps {
+			c_avp, err := dc.FromMessageAvp(v)
+			if err != nil {
+				return nil, fmt.Errorf("avps[%d]: %v", i, err)
+			}
+			ret = append(ret, c_avp)
+		}
+		return ret, nil
+	case Avp_Enumerated:
+		c_val := in.Value
+		if c_val == nil && in.Enum != "" {
+			c_val = in.Enum
+		}
+		if c_str, ok := c_val.(string); ok {
+			if _, err := strconv.ParseInt(c_str, 10, 32); err != nil {
+				c_num, ok := dc.LookUpAvp_EnumValue(c_code, c_vendor_id, c_str)
+				if !ok {
+					return nil, fmt.Errorf("unknown enum value %s", c_str)
+				}
+				return c_num, nil
+			}
+		}
+		c_num, err := jsonInt(c_val, 32)
+		return int32(c_num), err
+	case Avp_Integer32:
+		c_num, err := jsonInt(in.Value, 32)
+		return int32(c_num), err
+	case Avp_Integer64:
+		return jsonInt(in.Value, 64)
+	case Avp_Unsigned32:
+		c_num, err := jsonUint(in.Value, 32)
+		return uint32(c_num), err
+	case Avp_Unsigned64:
+		return jsonUint(in.Value, 64)
+	case Avp_Float32:
+		c_num, err := jsonFloat(in.Value)
+		return float32(c_num), err
+	case Avp_Float64:
+		return jsonFloat(in.Value)
+	case Avp_UTF8String:
+		c_str, ok := in.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("value should be a string")
+		}
+		return c_str, nil
+	case Avp_Time:
+		switch c_val := in.Value.(type) {
+		case time.Time:
+			return c_val, nil
+		case string:
+			return time.Parse(time.RFC3339, c_val)
+		}
+		return nil, fmt.Errorf("value should be an RFC 3339 time")
+	case Avp_Address:
+		c_str, ok := in.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("value should be a string")
+		}
+		if c_ip := net.ParseIP(c_str); c_ip != nil {
+			if c_ip4 := c_ip.To4(); c_ip4 != nil {
+				return NewAddress(1, c_ip4), nil
+			}
+			return NewAddress(2, c_ip), nil
+		}
+		if in.Family == nil {
+			return nil, fmt.Errorf("%s is not an IP address, hex values need the family", c_str)
+		}
+		c_raw, err := hex.DecodeString(c_str)
+		if err != nil {
+			return nil, fmt.Errorf("value should be an IP address or hex")
+		}
+		return NewAddress(*in.Family, c_raw), nil
+	}
+	// OctetString and Unknown
+	c_str, ok := in.Value.(string)
+	if !ok {
+		if in.Value == nil {
+			return []byte{}, nil
+		}
+		return nil, fmt.Errorf("value should be a hex string")
+	}
+	return hex.DecodeString(c_str)
+}
+
+func jsonInt(in interface{}, bits int) (int64, error) {
+	switch c_val := in.(type) {
+	case json.Number:
+		return strconv.ParseInt(c_val.String(), 10, bits)
+	case string:
+		return strconv.ParseInt(c_val, 10, bits)
+	case int:
+		return int64(c_val), nil
+	case int64:
+		return c_val, nil
+	case uint64:
+		if c_val > math.MaxInt64 {
+			return 0, fmt.Errorf("%d is out of range", c_val)
+		}
+		return int64(c_val), nil
+	case float64:
+		if c_val != math.Trunc(c_val) {
+			return 0, fmt.Errorf("%v is not an integer", c_val)
+		}
+		return int64(c_val), nil
+	}
+	return 0, fmt.Errorf("value should be an integer")
+}
+
+func jsonUint(in interface{}, bits int) (uint64, error) {
+	switch c_val := in.(type) {
+	case json.Number:
+		return strconv.ParseUint(c_val.String(), 10, bits)
+	case string:
+		return strconv.ParseUint(c_val, 10, bits)
+	case uint64:
+		return c_val, nil
+	}
+	c_int, err := jsonInt(in, 64)
+	if err != nil {
+		return 0, err
+	}
+	if c_int < 0 {
+		return 0, fmt.Errorf("%d is negative", c_int)
+	}
+	return uint64(c_int), nil
+}
+
+func jsonFloat(in interface{}) (float64, error) {
+	switch c_val := in.(type) {
+	case json.Number:
+		return c_val.Float64()
+	case string:
+		return strconv.ParseFloat(c_val, 64)
+	case float64:
+		return c_val, nil
+	case int:
+		return float64(c_val), nil
+	case int64:
+		return float64(c_val), nil
+	case uint64:
+		return float64(c_val), nil
+	}
+	return 0, fmt.Errorf("value should be a number")
+}
@@ -0,0 +1,74 @@
+package diam
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestMessageJSONRoundTrip encodes the message read back from its JSON form,
+// the bytes must be the same.
+func TestMessageJSONRoundTrip(t *testing.T) {
+	dc := NewDictionary()
+	if err := dc.LoadDir("../dict"); err != nil {
+		t.Fatal(err)
+	}
+	c_prev := Default()
+	SetDefault(dc)
+	defer SetDefault(c_prev)
+
+	c_mess := GenMess(272, true, true, 4, 11, 22, []AVP{
+		AVP_UTF8String(AVP_CODE_Session_Id, "host;1;2", true, 0),
+		AVP_Enumerated(AVP_CODE_CC_Request_Type, 1, true, 0),
+		AVP_Unsigned32(AVP_CODE_CC_Request_Number, 0, true, 0),
+		AVP_Time(AVP_CODE_Event_Timestamp, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), true, 0),
+		AVP_Address(AVP_CODE_Host_IP_Address, NewAddress(1, []byte{10, 0, 0, 1}), true, 0),
+		AVP_Group(AVP_CODE_Subscription_Id, []AVP{
+			AVP_Enumerated(AVP_CODE_Subscription_Id_Type, 0, true, 0),
+			AVP_UTF8String(AVP_CODE_Subscription_Id_Data, "36201234567", true, 0),
+		}, true, 0),
+		// not valid UTF-8
+		AVP_UTF8String(AVP_CODE_User_Name, "\x3f\xc0", true, 0),
+		AVP_OctetString(99999, []byte{1, 2, 3}, false, 10415),
+	})
+
+	c_json, err := json.Marshal(c_mess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c_back Message
+	if err := json.Unmarshal(c_json, &c_back); err != nil {
+		t.Fatalf("%v\n%s", err, c_json)
+	}
+	if !bytes.Equal(c_back.Encode(), c_mess.Encode()) {
+		t.Errorf("the message read back differs\n%s", c_json)
+	}
+	if c_avp := c_back.FindAVP(0, AVP_CODE_User_Name); c_avp == nil {
+		t.Error("User-Name lost")
+	} else if c_val, _ := c_avp.GetValue().([]byte); !bytes.Equal(c_val, []byte{0x3f, 0xc0}) {
+		t.Errorf("invalid UTF-8 string read back as %v", c_avp.GetValue())
+	}
+}
+
+func TestMessageJSONNames(t *testing.T) {
+	dc := NewDictionary()
+	if err := dc.LoadDir("../dict"); err != nil {
+		t.Fatal(err)
+	}
+	c_mess, err := dc.UnmarshalMessage([]byte(`{"command": "Credit-Control", "application_id": 4,
+	 "flags": {"request": true},
+	 "avps": [{"name": "CC-Request-Type", "value": "EVENT_REQUEST"}, {"name": "CC-Request-Number", "value": 3}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c_mess.GetCmdCode() != 272 || !c_mess.IsRequest() {
+		t.Errorf("command %d request %v", c_mess.GetCmdCode(), c_mess.IsRequest())
+	}
+	if c_avp := c_mess.FindAVP(0, AVP_CODE_CC_Request_Type); c_avp == nil || c_avp.GetValue() != int32(4) {
+		t.Errorf("CC-Request-Type %v", c_avp)
+	}
+	if c_avp := c_mess.FindAVP(0, AVP_CODE_CC_Request_Number); c_avp == nil || c_avp.GetValue() != uint32(3) {
+		t.Errorf("CC-Request-Number %v", c_avp)
+	}
+}
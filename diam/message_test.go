@@ -0,0 +1,82 @@
+package diam
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testMessage() Message {
+	return GenMess(272, true, true, 4, 1, 2, []AVP{
+		AVP_UTF8String(AVP_CODE_Session_Id, "host;1;2", true, 0),
+		AVP_Enumerated(AVP_CODE_CC_Request_Type, 1, true, 0),
+		AVP_Group(AVP_CODE_Subscription_Id, []AVP{
+			AVP_Enumerated(AVP_CODE_Subscription_Id_Type, 0, true, 0),
+			AVP_UTF8String(AVP_CODE_Subscription_Id_Data, "36201", true, 0),
+		}, true, 0),
+	})
+}
+
+func testDictionary(t *testing.T) *Dictionary {
+	t.Helper()
+	dc := NewDictionary()
+	if err := dc.LoadDir("../dict"); err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func TestDecodeMessage(t *testing.T) {
+	dc := testDictionary(t)
+	c_mess := testMessage()
+	c_enc := c_mess.Encode()
+	c_dec, err := dc.DecodeMessage(c_enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c_dec.Encode(), c_enc) {
+		t.Error("the decoded message encodes differently")
+	}
+}
+
+// TestDecodeMessageTruncated cuts the message at every byte, the decoder
+// has to return an error without panicking.
+func TestDecodeMessageTruncated(t *testing.T) {
+	dc := testDictionary(t)
+	c_mess := testMessage()
+	c_enc := c_mess.Encode()
+	for i := 0; i < len(c_enc); i++ {
+		if _, err := dc.DecodeMessage(c_enc[:i]); err == nil {
+			t.Errorf("message cut to %d bytes decoded", i)
+		}
+	}
+}
+
+func TestDecodeMessageMalformed(t *testing.T) {
+	dc := testDictionary(t)
+	c_mess := testMessage()
+	c_header := c_mess.Encode()[:20]
+	for _, c := range []struct {
+		name string
+		avps []byte
+		want string
+	}{
+		{"short avp header", []byte{0, 0, 1, 7, 0x40, 0}, "offset 0x0014"},
+		{"avp length below the header", []byte{0, 0, 1, 7, 0x40, 0, 0, 4}, "less than the 8 byte header"},
+		{"vendor avp length below the header", []byte{0, 0, 1, 7, 0xc0, 0, 0, 10, 0, 0, 0x28, 0xaf}, "less than the 12 byte header"},
+		{"avp length over the message", []byte{0, 0, 1, 7, 0x40, 0, 0, 40, 'a', 'b', 'c', 'd'}, "exceeds the 12 bytes left"},
+		{"unsigned32 of 2 bytes", []byte{0, 0, 1, 0x9f, 0x40, 0, 0, 10, 0, 1, 0, 0}, "Unsigned32 needs 4 bytes, got 2"},
+		{"enumerated of 8 bytes", []byte{0, 0, 1, 0xa0, 0x40, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0, 1}, "Enumerated needs 4 bytes, got 8"},
+		{"address without family", []byte{0, 0, 1, 0x4e, 0x40, 0, 0, 9, 1, 0, 0, 0}, "Address needs the 2 byte family"},
+		{"padding missing", []byte{0, 0, 0, 1, 0x40, 0, 0, 9, 'a'}, "padding missing"},
+		{"grouped child over the group", []byte{0, 0, 1, 0xbb, 0x40, 0, 0, 16, 0, 0, 1, 0xc2, 0x40, 0, 0, 12}, "offset 0x001c"},
+	} {
+		c_len := uint32ToByteArray(uint32(20 + len(c.avps)))
+		c_in := append(append([]byte{1}, c_len[1:]...), c_header[4:]...)
+		c_in = append(c_in, c.avps...)
+		_, err := dc.DecodeMessage(c_in)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: %v, want an error with %q", c.name, err, c.want)
+		}
+	}
+}
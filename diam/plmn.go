@@ -0,0 +1,47 @@
+package diam
+
+import "fmt"
+
+// PLMNId encodes the MCC and the MNC (2 or 3 digits) as the 3 bytes of a
+// PLMN identity (3GPP TS 24.008), e.g. a Visited-PLMN-Id. A 2 digit MNC is
+// filled with F.
+func PLMNId(mcc string, mnc string) ([]byte, error) {
+	if len(mcc) != 3 || (len(mnc) != 2 && len(mnc) != 3) {
+		return nil, fmt.Errorf("invalid PLMN %s-%s", mcc, mnc)
+	}
+	c_digits := make([]byte, 6)
+	for i, v := range mcc + mnc {
+		if v < '0' || v > '9' {
+			return nil, fmt.Errorf("invalid PLMN %s-%s", mcc, mnc)
+		}
+		c_digits[i] = byte(v - '0')
+	}
+	if len(mnc) == 2 {
+		c_digits[5] = 0xf
+	}
+	return []byte{
+		c_digits[1]<<4 | c_digits[0],
+		c_digits[5]<<4 | c_digits[2],
+		c_digits[4]<<4 | c_digits[3],
+	}, nil
+}
+
+// ParsePLMNId decodes a PLMN identity of PLMNId. Only the third digit of
+// the MNC may be the F filler.
+func ParsePLMNId(id []byte) (mcc string, mnc string, err error) {
+	if len(id) != 3 {
+		return "", "", fmt.Errorf("PLMN id of %d bytes", len(id))
+	}
+	c_nibbles := []byte{id[0] & 0xf, id[0] >> 4, id[1] & 0xf, id[2] & 0xf, id[2] >> 4, id[1] >> 4}
+	c_digits := make([]byte, 0, 6)
+	for i, v := range c_nibbles {
+		if i == 5 && v == 0xf {
+			break
+		}
+		if v > 9 {
+			return "", "", fmt.Errorf("invalid PLMN id %x", id)
+		}
+		c_digits = append(c_digits, '0'+v)
+	}
+	return string(c_digits[:3]), string(c_digits[3:]), nil
+}
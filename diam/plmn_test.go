@@ -0,0 +1,51 @@
+package diam
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestPLMNId(t *testing.T) {
+	for _, c := range []struct {
+		mcc  string
+		mnc  string
+		want string
+	}{
+		{"001", "01", "00f110"},
+		{"216", "30", "12f603"},
+		{"310", "410", "130014"},
+		{"262", "001", "621200"},
+	} {
+		got, err := PLMNId(c.mcc, c.mnc)
+		if err != nil {
+			t.Errorf("%s-%s: %v", c.mcc, c.mnc, err)
+			continue
+		}
+		if hex.EncodeToString(got) != c.want {
+			t.Errorf("%s-%s: %x, want %s", c.mcc, c.mnc, got, c.want)
+		}
+		c_mcc, c_mnc, err := ParsePLMNId(got)
+		if err != nil || c_mcc != c.mcc || c_mnc != c.mnc {
+			t.Errorf("%x: decoded %s-%s %v", got, c_mcc, c_mnc, err)
+		}
+	}
+}
+
+func TestPLMNIdInvalid(t *testing.T) {
+	for _, c := range []struct {
+		mcc string
+		mnc string
+	}{
+		{"01", "01"}, {"001", "1"}, {"001", "0001"}, {"0a1", "01"}, {"001", "f1"},
+	} {
+		if got, err := PLMNId(c.mcc, c.mnc); err == nil {
+			t.Errorf("%s-%s: %x, want an error", c.mcc, c.mnc, got)
+		}
+	}
+	for _, v := range []string{"", "00f1", "0af110", "00f11a", "00fa10", "ff0110"} {
+		c_id, _ := hex.DecodeString(v)
+		if c_mcc, c_mnc, err := ParsePLMNId(c_id); err == nil {
+			t.Errorf("%s: %s-%s, want an error", v, c_mcc, c_mnc)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package diam
+
+import (
+	"fmt"
+	"strings"
+)
+
+const tbcd_digits = "0123456789*#abcf"
+
+// TBCDEncode encodes a digit string (IMSI, MSISDN) as TBCD, the digits in
+// swapped nibbles and filled with F. Besides the digits * # a b c are
+// accepted (nibbles A to E), and an F as the last character, the filler.
+func TBCDEncode(digits string) ([]byte, error) {
+	ret := make([]byte, 0, (len(digits)+1)/2)
+	var c_byte byte
+	for i := 0; i < len(digits); i++ {
+		c_val := tbcdNibble(digits[i])
+		if c_val < 0 || (c_val == 0xf && i != len(digits)-1) {
+			return nil, fmt.Errorf("'%s' is not a digit string", digits)
+		}
+		if i%2 == 0 {
+			c_byte = byte(c_val)
+		} else {
+			ret = append(ret, c_byte|byte(c_val)<<4)
+		}
+	}
+	if len(digits)%2 == 1 {
+		ret = append(ret, c_byte|0xf0)
+	}
+	return ret, nil
+}
+
+// tbcdNibble is the nibble of a TBCD character, -1 if it has none.
+func tbcdNibble(c byte) int {
+	if c >= 'A' && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+	return strings.IndexByte(tbcd_digits, c)
+}
+
+// TBCDDecode is the digit string of TBCD encoded bytes, it stops at the
+// F filler.
+func TBCDDecode(data []byte) string {
+	var ret strings.Builder
+	for _, v := range data {
+		for _, c_nibble := range []byte{v & 0x0f, v >> 4} {
+			if c_nibble == 0xf {
+				return ret.String()
+			}
+			ret.WriteByte(tbcd_digits[c_nibble])
+		}
+	}
+	return ret.String()
+}
@@ -0,0 +1,73 @@
+package diam
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestTBCDEncode(t *testing.T) {
+	for _, c := range []struct {
+		digits string
+		want   string
+	}{
+		{"", ""},
+		{"1", "f1"},
+		{"12", "21"},
+		{"001010000000001", "00010100000000f1"},
+		{"36301234567", "6303214365f7"},
+		{"*#", "ba"},
+		{"12*", "21fa"},
+		{"1a2b3c", "c1d2e3"},
+		{"1A2B3C", "c1d2e3"},
+		{"123f", "21f3"},
+	} {
+		got, err := TBCDEncode(c.digits)
+		if err != nil {
+			t.Errorf("%q: %v", c.digits, err)
+			continue
+		}
+		if hex.EncodeToString(got) != c.want {
+			t.Errorf("%q: %x, want %s", c.digits, got, c.want)
+		}
+	}
+}
+
+func TestTBCDEncodeInvalid(t *testing.T) {
+	for _, v := range []string{"12x", "+3630", "1f2", "d", "1 2"} {
+		if got, err := TBCDEncode(v); err == nil {
+			t.Errorf("%q: %x, want an error", v, got)
+		}
+	}
+}
+
+func TestTBCDDecode(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		want string
+	}{
+		{"", ""},
+		{"f1", "1"},
+		{"00010100000000f1", "001010000000001"},
+		{"6303214365f7", "36301234567"},
+		{"ba", "*#"},
+		{"c1d2e3", "1a2b3c"},
+		{"21f3ff", "123"},
+	} {
+		c_data, _ := hex.DecodeString(c.data)
+		if got := TBCDDecode(c_data); got != c.want {
+			t.Errorf("%s: %q, want %q", c.data, got, c.want)
+		}
+	}
+}
+
+func TestTBCDRoundTrip(t *testing.T) {
+	for _, v := range []string{"001010000000001", "4915112345678", "*100#", "0"} {
+		c_data, err := TBCDEncode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := TBCDDecode(c_data); got != v {
+			t.Errorf("%q: decoded %q", v, got)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Package gmb is the MBMS Gmb interface (3GPP TS 29.061 17) between the
+// GGSN and the BM-SC: the GGSN side in Client and the helpers of both sides
+// for the TMGI, the bearer service and the MBMS session AVPs.
+//
+// A Client sends the AARs and STRs of its sessions on the send channel of
+// a DiamConn and gets the answers through Handle (or Run). A session either
+// registers the GGSN for a multicast bearer service (Register) or activates
+// the MBMS UE context of a user (Activate); the AAA gives the TMGI and the
+// Required-MBMS-Bearer-Capabilities of the service. The BM-SC starts,
+// updates and stops the MBMS sessions of the registered services with
+// RARs. The RAR starting a broadcast service opens a new session, the STR
+// of the GGSN follows the RAR stopping it.
+//
+//	cl := gmb.NewClient(&diam_conn, send_ch, gmb.ClientConfig{Callbacks: cbs})
+//	cl.Register(&diam_conn)
+//	go cl.Run(rcv_ch, nil)
+//	s := cl.NewSession()
+//	s.Register(gmb.Service{Multicast: "239.1.1.1", APN: "mbms.test"}, nil)
+//	s.Terminate(d.ENUM_TERMINATION_CAUSE_LOGOUT, nil)
+package gmb
+
+import (
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+const (
+	default_tx = 10 * time.Second
+)
+
+// Callbacks report the life of the sessions to the application, every field
+// may be nil. They are called without locks held.
+type Callbacks struct {
+	OnStateChange func(s *Session, from State, to State)
+	// OnAnswer gets every AAA and STA of the session.
+	OnAnswer func(s *Session, ans d.Message)
+	// OnMBMSSession gets the accepted RARs, indication is the
+	// MBMS-StartStop-Indication. m is the new MBMS session after a START
+	// or UPDATE and the stopped one after a STOP.
+	OnMBMSSession func(s *Session, indication int32, m MBMSSession, rar d.Message)
+	// OnAbort tells the BM-SC sent an ASR, the STR is sent after it.
+	OnAbort func(s *Session)
+	// OnTerminate tells the Gmb session is over, err is nil after a
+	// successful STR.
+	OnTerminate func(s *Session, err error)
+}
+
+// ClientConfig sets up a Client.
+type ClientConfig struct {
+	// Tx is the answer timeout, 10s if zero.
+	Tx time.Duration
+	// RejectBroadcast answers the RARs starting a broadcast service with
+	// ERROR_UNKNOWN_MBMS_BEARER_SERVICE.
+	RejectBroadcast bool
+	Callbacks       Callbacks
+}
+
+// Client runs the Gmb sessions of a GGSN on one connection.
+type Client struct {
+	base     app.Base
+	conf     ClientConfig
+	mtx      sync.Mutex
+	sessions map[string]*Session
+	pending  map[uint32]*Session
+}
+
+// NewClient creates a client sending on send_ch, the send channel of c.
+func NewClient(c app.Conn, send_ch chan d.Message, conf ClientConfig) *Client {
+	if conf.Tx <= 0 {
+		conf.Tx = default_tx
+	}
+	return &Client{
+		base:     app.NewBase("gmb client", c, send_ch),
+		conf:     conf,
+		sessions: make(map[string]*Session),
+		pending:  make(map[uint32]*Session),
+	}
+}
+
+// NewSession creates an idle session with a new Session-Id.
+func (cl *Client) NewSession() *Session {
+	s := &Session{
+		cl: cl,
+		id: cl.base.Conn().Gen_Session_Id(),
+	}
+	cl.mtx.Lock()
+	cl.sessions[s.id] = s
+	cl.mtx.Unlock()
+	return s
+}
+
+// Session returns the active session with the Session-Id id.
+func (cl *Client) Session(id string) (*Session, bool) {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	s, ok := cl.sessions[id]
+	return s, ok
+}
+
+// Run handles the messages of rcv_ch until it is closed. The messages that
+// are not for the client go to rest, or are dropped if rest is nil.
+func (cl *Client) Run(rcv_ch chan d.Message, rest chan d.Message) {
+	cl.base.Run(rcv_ch, rest, cl.Handle)
+}
+
+// Handle processes a received message: the AAAs and STAs of the sessions
+// and the RARs and ASRs of Gmb. It returns false for other messages.
+func (cl *Client) Handle(msg d.Message) bool {
+	if msg.GetAppId() != d.APPID_GMB {
+		return false
+	}
+	switch c_code := msg.GetCmdCode(); {
+	case (c_code == d.CC_AA || c_code == d.CC_SESSION_TERMINATION) && msg.IsAnswer():
+		cl.mtx.Lock()
+		s, ok := cl.pending[msg.Get_hop_by_hop()]
+		cl.mtx.Unlock()
+		if !ok {
+			l.Warn.Printf("gmb client: answer without request, hop-by-hop 0x%08x session %s", msg.Get_hop_by_hop(), app.SessionId(&msg))
+			return true
+		}
+		s.answer(msg)
+		return true
+	case (c_code == d.CC_RE_AUTH || c_code == d.CC_ABORT_SESSION) && msg.IsRequest():
+		if c_ans, ok := cl.HandleRequest(msg); ok {
+			cl.base.Send(c_ans)
+		}
+		return true
+	}
+	return false
+}
+
+// Register makes r answer the Gmb RARs and ASRs with the client.
+func (cl *Client) Register(r app.Registry) {
+	r.Handle(d.CC_RE_AUTH, d.APPID_GMB, cl.HandleRequest)
+	r.Handle(d.CC_ABORT_SESSION, d.APPID_GMB, cl.HandleRequest)
+}
+
+// HandleRequest answers a RAR or an ASR, it is a conn.RequestHandler. The
+// STR that follows an ASR, or the RAR stopping a broadcast service, is
+// sent after the answer.
+func (cl *Client) HandleRequest(req d.Message) (d.Message, bool) {
+	c_id := app.SessionId(&req)
+	cl.mtx.Lock()
+	s, ok := cl.sessions[c_id]
+	cl.mtx.Unlock()
+	if req.GetCmdCode() == d.CC_ABORT_SESSION {
+		if !ok {
+			l.Warn.Println("gmb client: ASR for unknown session", c_id)
+			return cl.base.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+		}
+		go s.abort()
+		return cl.base.AnswerTo(req, d.SUCCESS), true
+	}
+
+	c_ind := req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_MBMS_StartStop_Indication)
+	if c_ind == nil {
+		return cl.base.AnswerTo(req, d.MISSING_AVP), true
+	}
+	if !ok {
+		if int32(c_ind.GetIntValue()) != d.ENUM_MBMS_START || !isBroadcast(&req) {
+			l.Warn.Println("gmb client: RAR for unknown session", c_id)
+			return cl.base.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+		}
+		if cl.conf.RejectBroadcast {
+			return cl.base.ExperimentalTo(req, d.ERROR_UNKNOWN_MBMS_BEARER_SERVICE), true
+		}
+		s = cl.broadcastSession(c_id, ServiceOf(&req))
+	}
+	return s.mbmsSession(int32(c_ind.GetIntValue()), req), true
+}
+
+// broadcastSession opens the session of a broadcast service started by
+// the BM-SC.
+func (cl *Client) broadcastSession(id string, service Service) *Session {
+	s := &Session{
+		cl:        cl,
+		id:        id,
+		service:   service,
+		broadcast: true,
+	}
+	var c_todo app.Todo
+	cl.mtx.Lock()
+	cl.sessions[id] = s
+	s.setState(STATE_OPEN, &c_todo)
+	cl.mtx.Unlock()
+	c_todo.Run()
+	return s
+}
+
+func isBroadcast(msg *d.Message) bool {
+	c_avp := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_MBMS_Service_Type)
+	return c_avp != nil && int32(c_avp.GetIntValue()) == d.ENUM_MBMS_SERVICE_TYPE_BROADCAST
+}
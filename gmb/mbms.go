@@ -0,0 +1,316 @@
+package gmb
+
+import (
+	"encoding/binary"
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"net"
+)
+
+const seconds_per_day = 24 * 60 * 60
+
+// TMGI is the Temporary Mobile Group Identity of an MBMS bearer service.
+type TMGI struct {
+	// ServiceId is the MBMS Service ID, 3 octets.
+	ServiceId uint32 `json:"service_id"`
+	MCC       string `json:"mcc"`
+	MNC       string `json:"mnc"`
+}
+
+// Bytes encodes the TMGI in 6 octets, the MBMS Service ID and the PLMN.
+func (t TMGI) Bytes() ([]byte, error) {
+	if t.ServiceId > 0xffffff {
+		return nil, fmt.Errorf("MBMS Service ID %d out of range", t.ServiceId)
+	}
+	c_plmn, err := d.PLMNId(t.MCC, t.MNC)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(t.ServiceId >> 16), byte(t.ServiceId >> 8), byte(t.ServiceId)}, c_plmn...), nil
+}
+
+// AVP builds the TMGI AVP.
+func (t TMGI) AVP() (d.AVP, error) {
+	c_val, err := t.Bytes()
+	if err != nil {
+		return d.AVP{}, fmt.Errorf("TMGI: %w", err)
+	}
+	return d.AVP_OctetString(d.AVP_CODE_TMGI, c_val, d.MAND, d.VENDOR_3GPP), nil
+}
+
+func (t TMGI) String() string {
+	return fmt.Sprintf("%06x-%s%s", t.ServiceId, t.MCC, t.MNC)
+}
+
+// ParseTMGI decodes the 6 octets of a TMGI.
+func ParseTMGI(b []byte) (TMGI, error) {
+	if len(b) != 6 {
+		return TMGI{}, fmt.Errorf("TMGI of %d octets", len(b))
+	}
+	c_mcc, c_mnc, err := d.ParsePLMNId(b[3:])
+	if err != nil {
+		return TMGI{}, err
+	}
+	return TMGI{ServiceId: uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]), MCC: c_mcc, MNC: c_mnc}, nil
+}
+
+// TMGIOf reads the TMGI of msg, false if it has none or it is malformed.
+func TMGIOf(msg *d.Message) (TMGI, bool) {
+	c_avp := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_TMGI)
+	if c_avp == nil {
+		return TMGI{}, false
+	}
+	c_val, _ := c_avp.GetValue().([]byte)
+	ret, err := ParseTMGI(c_val)
+	return ret, err == nil
+}
+
+// Service identifies an MBMS bearer service by its IP multicast address
+// and APN.
+type Service struct {
+	Multicast string `json:"multicast"`
+	APN       string `json:"apn"`
+}
+
+// AVPs builds the Framed-IP-Address, or Framed-IPv6-Prefix of 128 bits,
+// with the multicast address and the Called-Station-Id with the APN.
+func (sv Service) AVPs() ([]d.AVP, error) {
+	c_ip := net.ParseIP(sv.Multicast)
+	if c_ip == nil || !c_ip.IsMulticast() {
+		return nil, fmt.Errorf("not an IP multicast address: %q", sv.Multicast)
+	}
+	var ret []d.AVP
+	if c_ip4 := c_ip.To4(); c_ip4 != nil {
+		ret = append(ret, d.AVP_OctetString(d.AVP_CODE_Framed_IP_Address, []byte(c_ip4), d.MAND, 0))
+	} else {
+		ret = append(ret, d.AVP_OctetString(d.AVP_CODE_Framed_IPv6_Prefix, append([]byte{0, 128}, c_ip...), d.MAND, 0))
+	}
+	if sv.APN != "" {
+		ret = append(ret, d.AVP_UTF8String(d.AVP_CODE_Called_Station_Id, sv.APN, d.MAND, 0))
+	}
+	return ret, nil
+}
+
+// ServiceOf reads the bearer service of an AAR or RAR, the multicast
+// address is empty if msg has none.
+func ServiceOf(msg *d.Message) Service {
+	var ret Service
+	if c_avp := msg.FindAVP(0, d.AVP_CODE_Framed_IP_Address); c_avp != nil {
+		if c_val, ok := c_avp.GetValue().([]byte); ok && len(c_val) == net.IPv4len {
+			ret.Multicast = net.IP(c_val).String()
+		}
+	} else if c_avp := msg.FindAVP(0, d.AVP_CODE_Framed_IPv6_Prefix); c_avp != nil {
+		if c_val, ok := c_avp.GetValue().([]byte); ok && len(c_val) == 2+net.IPv6len {
+			ret.Multicast = net.IP(c_val[2:]).String()
+		}
+	}
+	if c_avp := msg.FindAVP(0, d.AVP_CODE_Called_Station_Id); c_avp != nil {
+		ret.APN = c_avp.GetStringValue()
+	}
+	return ret
+}
+
+// UE is the user of an MBMS UE context activation.
+type UE struct {
+	IMSI   string `json:"imsi"`
+	MSISDN string `json:"msisdn,omitempty"`
+	// RAI is the routing area of the SGSN, as text.
+	RAI    string `json:"rai,omitempty"`
+	IMEISV string `json:"imeisv,omitempty"`
+}
+
+// AVPs builds the 3GPP-IMSI, Calling-Station-Id, RAI and 3GPP-IMEISV of
+// the UE.
+func (u UE) AVPs() []d.AVP {
+	ret := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_TGPP_IMSI, u.IMSI, d.MAND, d.VENDOR_3GPP)}
+	if u.MSISDN != "" {
+		ret = append(ret, d.AVP_UTF8String(d.AVP_CODE_Calling_Station_Id, u.MSISDN, d.MAND, 0))
+	}
+	if u.RAI != "" {
+		ret = append(ret, d.AVP_UTF8String(d.AVP_CODE_RAI, u.RAI, d.MAND, d.VENDOR_3GPP))
+	}
+	if u.IMEISV != "" {
+		ret = append(ret, d.AVP_OctetString(d.AVP_CODE_TGPP_IMEISV, []byte(u.IMEISV), d.NOT_MAND, d.VENDOR_3GPP))
+	}
+	return ret
+}
+
+// UEOf reads the UE of an AAR, false for the AARs of a registration.
+func UEOf(msg *d.Message) (UE, bool) {
+	c_imsi := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_TGPP_IMSI)
+	if c_imsi == nil {
+		return UE{}, false
+	}
+	ret := UE{IMSI: c_imsi.GetStringValue()}
+	if c_avp := msg.FindAVP(0, d.AVP_CODE_Calling_Station_Id); c_avp != nil {
+		ret.MSISDN = c_avp.GetStringValue()
+	}
+	if c_avp := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_RAI); c_avp != nil {
+		ret.RAI = c_avp.GetStringValue()
+	}
+	if c_avp := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_TGPP_IMEISV); c_avp != nil {
+		if c_val, ok := c_avp.GetValue().([]byte); ok {
+			ret.IMEISV = string(c_val)
+		}
+	}
+	return ret, true
+}
+
+// MBMSSession is the MBMS session of a session start or update RAR. The
+// zero and nil fields are not sent, except ServiceType.
+type MBMSSession struct {
+	TMGI TMGI `json:"tmgi"`
+	// ServiceType is a d.ENUM_MBMS_SERVICE_TYPE value.
+	ServiceType int32 `json:"service_type"`
+	// UserServiceType is a d.ENUM_MBMS_USER_SERVICE_TYPE value.
+	UserServiceType int32 `json:"user_service_type,omitempty"`
+	// ServiceAreas are the MBMS Service Area codes, 1 to 256.
+	ServiceAreas []uint16 `json:"service_areas,omitempty"`
+	// RequiredQoS is the MBMS-Required-QoS, the QoS profile as text.
+	RequiredQoS string `json:"required_qos,omitempty"`
+	// Duration is the MBMS-Session-Duration in seconds.
+	Duration uint32 `json:"duration,omitempty"`
+	// SessionIdentity is sent if RepetitionNumber is not zero.
+	SessionIdentity  uint8 `json:"session_identity,omitempty"`
+	RepetitionNumber uint8 `json:"repetition_number,omitempty"`
+	// TimeToDataTransfer is 1 to 256 seconds.
+	TimeToDataTransfer uint32 `json:"time_to_data_transfer,omitempty"`
+	// Indicator2G3G is a d.ENUM_MBMS_2G_3G value.
+	Indicator2G3G *int32 `json:"indicator_2g_3g,omitempty"`
+	FlowId        uint16 `json:"flow_id,omitempty"`
+	// BMSCSSMAddress is the source address of the multicast data.
+	BMSCSSMAddress string `json:"bmsc_ssm_address,omitempty"`
+}
+
+// AVPs builds the AVPs of the session, without the
+// MBMS-StartStop-Indication.
+func (m MBMSSession) AVPs() ([]d.AVP, error) {
+	c_tmgi, err := m.TMGI.AVP()
+	if err != nil {
+		return nil, err
+	}
+	ret := []d.AVP{
+		c_tmgi,
+		d.AVP_Enumerated(d.AVP_CODE_MBMS_Service_Type, m.ServiceType, d.MAND, d.VENDOR_3GPP),
+	}
+	if m.UserServiceType != 0 {
+		ret = append(ret, d.AVP_Enumerated(d.AVP_CODE_MBMS_User_Service_Type, m.UserServiceType, d.MAND, d.VENDOR_3GPP))
+	}
+	if len(m.ServiceAreas) != 0 {
+		if len(m.ServiceAreas) > 256 {
+			return nil, fmt.Errorf("%d MBMS service areas", len(m.ServiceAreas))
+		}
+		c_area := []byte{byte(len(m.ServiceAreas) - 1)}
+		for _, v := range m.ServiceAreas {
+			c_area = append(c_area, byte(v>>8), byte(v))
+		}
+		ret = append(ret, d.AVP_OctetString(d.AVP_CODE_MBMS_Service_Area, c_area, d.MAND, d.VENDOR_3GPP))
+	}
+	if m.RequiredQoS != "" {
+		ret = append(ret, d.AVP_UTF8String(d.AVP_CODE_MBMS_Required_QoS, m.RequiredQoS, d.MAND, d.VENDOR_3GPP))
+	}
+	if m.Duration != 0 {
+		ret = append(ret, d.AVP_OctetString(d.AVP_CODE_MBMS_Session_Duration, sessionDuration(m.Duration), d.MAND, d.VENDOR_3GPP))
+	}
+	if m.RepetitionNumber != 0 {
+		ret = append(ret,
+			d.AVP_OctetString(d.AVP_CODE_MBMS_Session_Identity, []byte{m.SessionIdentity}, d.MAND, d.VENDOR_3GPP),
+			d.AVP_OctetString(d.AVP_CODE_MBMS_Session_Repetition_Number, []byte{m.RepetitionNumber}, d.MAND, d.VENDOR_3GPP))
+	}
+	if m.TimeToDataTransfer != 0 {
+		if m.TimeToDataTransfer > 256 {
+			return nil, fmt.Errorf("MBMS time to data transfer %ds out of range", m.TimeToDataTransfer)
+		}
+		ret = append(ret, d.AVP_OctetString(d.AVP_CODE_MBMS_Time_To_Data_Transfer, []byte{byte(m.TimeToDataTransfer - 1)}, d.MAND, d.VENDOR_3GPP))
+	}
+	if m.Indicator2G3G != nil {
+		ret = append(ret, d.AVP_Enumerated(d.AVP_CODE_MBMS_2G_3G_Indicator, *m.Indicator2G3G, d.MAND, d.VENDOR_3GPP))
+	}
+	if m.FlowId != 0 {
+		ret = append(ret, d.AVP_OctetString(d.AVP_CODE_MBMS_Flow_Identifier, []byte{byte(m.FlowId >> 8), byte(m.FlowId)}, d.MAND, d.VENDOR_3GPP))
+	}
+	if m.BMSCSSMAddress != "" {
+		c_ip := net.ParseIP(m.BMSCSSMAddress)
+		switch {
+		case c_ip == nil:
+			return nil, fmt.Errorf("BM-SC SSM address %q", m.BMSCSSMAddress)
+		case c_ip.To4() != nil:
+			ret = append(ret, d.AVP_OctetString(d.AVP_CODE_MBMS_BMSC_SSM_IP_Address, []byte(c_ip.To4()), d.MAND, d.VENDOR_3GPP))
+		default:
+			ret = append(ret, d.AVP_OctetString(d.AVP_CODE_MBMS_BMSC_SSM_IPv6_Address, []byte(c_ip), d.MAND, d.VENDOR_3GPP))
+		}
+	}
+	return ret, nil
+}
+
+// ParseMBMSSession reads the MBMS session of a RAR, the TMGI is mandatory.
+func ParseMBMSSession(msg *d.Message) (MBMSSession, error) {
+	var ret MBMSSession
+	c_tmgi, ok := TMGIOf(msg)
+	if !ok {
+		return ret, fmt.Errorf("no valid TMGI")
+	}
+	ret.TMGI = c_tmgi
+	for _, v := range msg.GetAVPs() {
+		if v.GetVendorId() != d.VENDOR_3GPP {
+			continue
+		}
+		c_val, _ := v.GetValue().([]byte)
+		switch v.GetAVPCode() {
+		case d.AVP_CODE_MBMS_Service_Type:
+			ret.ServiceType = int32(v.GetIntValue())
+		case d.AVP_CODE_MBMS_User_Service_Type:
+			ret.UserServiceType = int32(v.GetIntValue())
+		case d.AVP_CODE_MBMS_Service_Area:
+			if len(c_val) == 0 || len(c_val) != 1+2*(int(c_val[0])+1) {
+				return ret, fmt.Errorf("MBMS-Service-Area of %d octets", len(c_val))
+			}
+			for i := 1; i < len(c_val); i += 2 {
+				ret.ServiceAreas = append(ret.ServiceAreas, binary.BigEndian.Uint16(c_val[i:]))
+			}
+		case d.AVP_CODE_MBMS_Required_QoS:
+			ret.RequiredQoS = v.GetStringValue()
+		case d.AVP_CODE_MBMS_Session_Duration:
+			if len(c_val) != 3 {
+				return ret, fmt.Errorf("MBMS-Session-Duration of %d octets", len(c_val))
+			}
+			c_raw := uint32(c_val[0])<<16 | uint32(c_val[1])<<8 | uint32(c_val[2])
+			ret.Duration = c_raw>>7 + (c_raw&0x7f)*seconds_per_day
+		case d.AVP_CODE_MBMS_Session_Identity:
+			if len(c_val) == 1 {
+				ret.SessionIdentity = c_val[0]
+			}
+		case d.AVP_CODE_MBMS_Session_Repetition_Number:
+			if len(c_val) == 1 {
+				ret.RepetitionNumber = c_val[0]
+			}
+		case d.AVP_CODE_MBMS_Time_To_Data_Transfer:
+			if len(c_val) == 1 {
+				ret.TimeToDataTransfer = uint32(c_val[0]) + 1
+			}
+		case d.AVP_CODE_MBMS_2G_3G_Indicator:
+			c_ind := int32(v.GetIntValue())
+			ret.Indicator2G3G = &c_ind
+		case d.AVP_CODE_MBMS_Flow_Identifier:
+			if len(c_val) == 2 {
+				ret.FlowId = binary.BigEndian.Uint16(c_val)
+			}
+		case d.AVP_CODE_MBMS_BMSC_SSM_IP_Address, d.AVP_CODE_MBMS_BMSC_SSM_IPv6_Address:
+			if len(c_val) == net.IPv4len || len(c_val) == net.IPv6len {
+				ret.BMSCSSMAddress = net.IP(c_val).String()
+			}
+		}
+	}
+	return ret, nil
+}
+
+// sessionDuration encodes the MBMS-Session-Duration, 17 bits of seconds
+// and 7 bits of days.
+func sessionDuration(secs uint32) []byte {
+	c_days := secs / seconds_per_day
+	if c_days > 0x7f {
+		c_days = 0x7f
+	}
+	c_raw := (secs%seconds_per_day)<<7 | c_days
+	return []byte{byte(c_raw >> 16), byte(c_raw >> 8), byte(c_raw)}
+}
@@ -0,0 +1,102 @@
+package gmb
+
+import (
+	"bytes"
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if err := d.InitWith("../dict", d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestTMGI(t *testing.T) {
+	for _, c := range []struct {
+		tmgi TMGI
+		want []byte
+	}{
+		{TMGI{ServiceId: 0x123456, MCC: "262", MNC: "01"}, []byte{0x12, 0x34, 0x56, 0x62, 0xf2, 0x10}},
+		{TMGI{ServiceId: 1, MCC: "310", MNC: "410"}, []byte{0, 0, 1, 0x13, 0x00, 0x14}},
+	} {
+		got, err := c.tmgi.Bytes()
+		if err != nil {
+			t.Errorf("%s: %v", c.tmgi, err)
+			continue
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%s encoded as %x, want %x", c.tmgi, got, c.want)
+		}
+		if c_back, err := ParseTMGI(got); err != nil || c_back != c.tmgi {
+			t.Errorf("%s read back as %s, %v", c.tmgi, c_back, err)
+		}
+	}
+
+	for _, v := range []TMGI{
+		{ServiceId: 0x1000000, MCC: "262", MNC: "01"},
+		{ServiceId: 1, MCC: "26", MNC: "01"},
+		{ServiceId: 1, MCC: "262", MNC: "0a"},
+	} {
+		if _, err := v.AVP(); err == nil {
+			t.Errorf("%+v encoded", v)
+		}
+	}
+	if _, err := ParseTMGI([]byte{0, 0, 1, 0x62, 0xf2}); err == nil {
+		t.Error("TMGI of 5 octets read")
+	}
+}
+
+func TestSessionDuration(t *testing.T) {
+	for _, c := range []struct {
+		secs uint32
+		want []byte
+	}{
+		{59, []byte{0x00, 0x1d, 0x80}},
+		// 1 day 1:01:01
+		{seconds_per_day + 3661, []byte{0x07, 0x26, 0x81}},
+		{2 * seconds_per_day, []byte{0x00, 0x00, 0x02}},
+	} {
+		if got := sessionDuration(c.secs); !bytes.Equal(got, c.want) {
+			t.Errorf("%ds encoded as %x, want %x", c.secs, got, c.want)
+		}
+	}
+}
+
+// TestMBMSSession reads back the AVPs of the session from a RAR.
+func TestMBMSSession(t *testing.T) {
+	c_ind := int32(d.ENUM_MBMS_2G_AND_3G)
+	m := MBMSSession{
+		TMGI:               TMGI{ServiceId: 0x123456, MCC: "262", MNC: "01"},
+		ServiceType:        d.ENUM_MBMS_SERVICE_TYPE_BROADCAST,
+		ServiceAreas:       []uint16{1, 0x1234},
+		Duration:           seconds_per_day + 3661,
+		SessionIdentity:    3,
+		RepetitionNumber:   1,
+		TimeToDataTransfer: 10,
+		Indicator2G3G:      &c_ind,
+		FlowId:             7,
+		BMSCSSMAddress:     "10.1.2.3",
+	}
+	c_avps, err := m.AVPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c_mess := d.GenMess(d.CC_RE_AUTH, true, true, d.APPID_GMB, 1, 1, c_avps)
+	c_back, err := d.DecodeMessage(c_mess.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseMBMSSession(&c_back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("read back as\n%+v\nwant\n%+v", got, m)
+	}
+}
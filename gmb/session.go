@@ -0,0 +1,362 @@
+package gmb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"time"
+)
+
+// State is the state of a Gmb session of the GGSN.
+type State int
+
+const (
+	STATE_IDLE State = iota
+	STATE_PENDING_AA
+	STATE_PENDING_ST
+	STATE_OPEN
+)
+
+var state_names map[State]string = map[State]string{
+	STATE_IDLE:       "Idle",
+	STATE_PENDING_AA: "PendingAA",
+	STATE_PENDING_ST: "PendingST",
+	STATE_OPEN:       "Open",
+}
+
+func (st State) String() string {
+	if c_name, ok := state_names[st]; ok {
+		return c_name
+	}
+	return fmt.Sprintf("State(%d)", int(st))
+}
+
+var (
+	ErrTxExpired  = errors.New("no answer within Tx")
+	ErrWrongState = errors.New("request not allowed in this state")
+)
+
+// Session is one Gmb session of a Client: the registration for a bearer
+// service, an MBMS UE context or a broadcast service.
+type Session struct {
+	cl         *Client
+	id         string
+	state      State
+	hop_by_hop uint32
+	tx_timer   *time.Timer
+	aborted    bool
+	service    Service
+	ue         *UE
+	broadcast  bool
+	// tmgi and capabilities are given by the AAA.
+	tmgi         *TMGI
+	capabilities string
+	// mbms is the started MBMS session, nil if none.
+	mbms *MBMSSession
+}
+
+func (s *Session) Id() string {
+	return s.id
+}
+
+func (s *Session) State() State {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.state
+}
+
+// Service is the bearer service of the session.
+func (s *Session) Service() Service {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.service
+}
+
+// UE is the user of an MBMS UE context, false for the other sessions.
+func (s *Session) UE() (UE, bool) {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	if s.ue == nil {
+		return UE{}, false
+	}
+	return *s.ue, true
+}
+
+// Broadcast tells the BM-SC opened the session for a broadcast service.
+func (s *Session) Broadcast() bool {
+	return s.broadcast
+}
+
+// TMGI is the TMGI of the AAA, or of the MBMS session of a broadcast
+// service.
+func (s *Session) TMGI() (TMGI, bool) {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	if s.tmgi != nil {
+		return *s.tmgi, true
+	}
+	if s.mbms != nil {
+		return s.mbms.TMGI, true
+	}
+	return TMGI{}, false
+}
+
+// BearerCapabilities is the Required-MBMS-Bearer-Capabilities of the AAA.
+func (s *Session) BearerCapabilities() string {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.capabilities
+}
+
+// MBMSSession is the started MBMS session, false if none.
+func (s *Session) MBMSSession() (MBMSSession, bool) {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	if s.mbms == nil {
+		return MBMSSession{}, false
+	}
+	return *s.mbms, true
+}
+
+// Register sends the AAR registering the GGSN for the multicast bearer
+// service.
+func (s *Session) Register(service Service, avps []d.AVP) error {
+	return s.sendAAR(service, nil, avps)
+}
+
+// Activate sends the AAR authorizing the MBMS UE context of ue for the
+// bearer service.
+func (s *Session) Activate(service Service, ue UE, avps []d.AVP) error {
+	return s.sendAAR(service, &ue, avps)
+}
+
+// Terminate sends the STR of the session with the Termination-Cause
+// cause: the de-registration, the UE context deactivation or the end of
+// a broadcast service. A pending AAR is given up.
+func (s *Session) Terminate(cause int32, avps []d.AVP) error {
+	return s.do(func(c_todo *app.Todo) error {
+		if s.state == STATE_IDLE || s.state == STATE_PENDING_ST {
+			return fmt.Errorf("%s: STR in state %s: %w", s.id, s.state, ErrWrongState)
+		}
+		c_avps := append([]d.AVP{d.AVP_Enumerated(d.AVP_CODE_Termination_Cause, cause, d.MAND, 0)}, avps...)
+		s.send(d.CC_SESSION_TERMINATION, c_avps, STATE_PENDING_ST, c_todo)
+		return nil
+	})
+}
+
+func (s *Session) do(f func(c_todo *app.Todo) error) error {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	err := f(&c_todo)
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+	return err
+}
+
+func (s *Session) sendAAR(service Service, ue *UE, avps []d.AVP) error {
+	c_avps, err := service.AVPs()
+	if err != nil {
+		return err
+	}
+	if ue != nil {
+		c_avps = append(c_avps, ue.AVPs()...)
+	}
+	return s.do(func(c_todo *app.Todo) error {
+		if s.state != STATE_IDLE {
+			return fmt.Errorf("%s: AAR in state %s: %w", s.id, s.state, ErrWrongState)
+		}
+		s.service = service
+		s.ue = ue
+		s.send(d.CC_AA, append(c_avps, avps...), STATE_PENDING_AA, c_todo)
+		return nil
+	})
+}
+
+func (s *Session) send(cmd_code uint32, avps []d.AVP, to State, c_todo *app.Todo) {
+	s.stopTx()
+	delete(s.cl.pending, s.hop_by_hop)
+	c_req := s.request(cmd_code, avps)
+	s.hop_by_hop = c_req.Get_hop_by_hop()
+	s.cl.pending[s.hop_by_hop] = s
+	s.cl.sessions[s.id] = s
+	s.startTx()
+	s.setState(to, c_todo)
+
+	c_todo.Add(func() {
+		s.cl.base.Send(c_req)
+	})
+}
+
+func (s *Session) request(cmd_code uint32, avps []d.AVP) d.Message {
+	cl := s.cl
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, s.id, d.MAND, 0)}
+	c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_GMB, d.MAND, 0))
+	c_avps = append(c_avps, cl.base.Origin()...)
+	c_avps = append(c_avps, cl.base.Destination()...)
+	c_avps = append(c_avps, avps...)
+	return d.GenMess(cmd_code, true, true, d.APPID_GMB, cl.base.Conn().NextHopByHop(), 0, c_avps)
+}
+
+func (s *Session) setState(to State, c_todo *app.Todo) {
+	c_from := s.state
+	s.state = to
+	if to == STATE_IDLE {
+		s.stopTx()
+		delete(s.cl.sessions, s.id)
+	}
+	if c_from == to {
+		return
+	}
+	l.Trace.Printf("gmb session %s: %s -> %s", s.id, c_from, to)
+	if cb := s.cl.conf.Callbacks.OnStateChange; cb != nil {
+		c_todo.Add(func() { cb(s, c_from, to) })
+	}
+}
+
+func (s *Session) terminated(err error, c_todo *app.Todo) {
+	s.mbms = nil
+	s.setState(STATE_IDLE, c_todo)
+	if cb := s.cl.conf.Callbacks.OnTerminate; cb != nil {
+		c_todo.Add(func() { cb(s, err) })
+	}
+}
+
+// answer runs the state machine for a received AAA or STA.
+func (s *Session) answer(ans d.Message) {
+	s.do(func(c_todo *app.Todo) error {
+		if ans.Get_hop_by_hop() != s.hop_by_hop {
+			l.Warn.Printf("gmb session %s: late answer, hop-by-hop 0x%08x", s.id, ans.Get_hop_by_hop())
+			delete(s.cl.pending, ans.Get_hop_by_hop())
+			return nil
+		}
+		delete(s.cl.pending, s.hop_by_hop)
+		s.stopTx()
+		if cb := s.cl.conf.Callbacks.OnAnswer; cb != nil {
+			c_todo.Add(func() { cb(s, ans) })
+		}
+
+		c_result := app.ResultCode(&ans)
+		c_success := c_result >= 2000 && c_result < 3000
+		switch s.state {
+		case STATE_PENDING_AA:
+			if !c_success {
+				s.terminated(&app.ResultError{ResultCode: c_result}, c_todo)
+				return nil
+			}
+			if c_tmgi, ok := TMGIOf(&ans); ok {
+				s.tmgi = &c_tmgi
+			}
+			if c_avp := ans.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Required_MBMS_Bearer_Capabilities); c_avp != nil {
+				s.capabilities = c_avp.GetStringValue()
+			}
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_ST:
+			var err error
+			if !c_success {
+				err = &app.ResultError{ResultCode: c_result}
+			}
+			s.terminated(err, c_todo)
+		}
+		return nil
+	})
+}
+
+// mbmsSession answers a RAR starting, updating or stopping the MBMS
+// session. The STR of a broadcast service is sent after the answer to its
+// stop.
+func (s *Session) mbmsSession(indication int32, rar d.Message) d.Message {
+	c_mbms, err := ParseMBMSSession(&rar)
+	if err != nil && indication != d.ENUM_MBMS_STOP {
+		l.Warn.Println("gmb session", s.id, "RAR:", err)
+		return s.cl.base.AnswerTo(rar, d.INVALID_AVP_VALUE)
+	}
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	c_code := uint32(d.SUCCESS)
+	switch {
+	case s.state != STATE_OPEN:
+		c_code = d.UNABLE_TO_COMPLY
+	case indication == d.ENUM_MBMS_START && s.mbms != nil:
+		c_code = d.ERROR_START_INDICATION
+	case indication == d.ENUM_MBMS_UPDATE && s.mbms == nil:
+		c_code = d.UNABLE_TO_COMPLY
+	case indication == d.ENUM_MBMS_STOP && s.mbms == nil:
+		c_code = d.ERROR_STOP_INDICATION
+	case indication == d.ENUM_MBMS_STOP:
+		c_mbms = *s.mbms
+		s.mbms = nil
+	case indication == d.ENUM_MBMS_START || indication == d.ENUM_MBMS_UPDATE:
+		s.mbms = &c_mbms
+	default:
+		c_code = d.INVALID_AVP_VALUE
+	}
+	c_stop_broadcast := c_code == d.SUCCESS && indication == d.ENUM_MBMS_STOP && s.broadcast
+	if cb := s.cl.conf.Callbacks.OnMBMSSession; cb != nil && c_code == d.SUCCESS {
+		c_todo.Add(func() { cb(s, indication, c_mbms, rar) })
+	}
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+
+	if c_stop_broadcast {
+		go func() {
+			if err := s.Terminate(d.ENUM_TERMINATION_CAUSE_LOGOUT, nil); err != nil {
+				l.Warn.Println("gmb session", s.id, "cannot terminate after stop:", err)
+			}
+		}()
+	}
+	switch c_code {
+	case d.ERROR_START_INDICATION, d.ERROR_STOP_INDICATION:
+		return s.cl.base.ExperimentalTo(rar, c_code)
+	}
+	return s.cl.base.AnswerTo(rar, c_code)
+}
+
+// abort terminates the session after an ASR, it runs after the ASA is
+// sent.
+func (s *Session) abort() {
+	c_first := false
+	s.do(func(c_todo *app.Todo) error {
+		c_first = !s.aborted
+		s.aborted = true
+		if cb := s.cl.conf.Callbacks.OnAbort; cb != nil && c_first {
+			c_todo.Add(func() { cb(s) })
+		}
+		return nil
+	})
+	if !c_first {
+		return
+	}
+	if err := s.Terminate(d.ENUM_TERMINATION_CAUSE_ADMINISTRATIVE, nil); err != nil {
+		l.Warn.Println("gmb session", s.id, "cannot terminate after ASR:", err)
+	}
+}
+
+func (s *Session) startTx() {
+	c_hop_by_hop := s.hop_by_hop
+	s.tx_timer = time.AfterFunc(s.cl.conf.Tx, func() {
+		s.txExpired(c_hop_by_hop)
+	})
+}
+
+func (s *Session) stopTx() {
+	if s.tx_timer != nil {
+		s.tx_timer.Stop()
+		s.tx_timer = nil
+	}
+}
+
+// txExpired gives up the request with c_hop_by_hop and ends the session.
+func (s *Session) txExpired(c_hop_by_hop uint32) {
+	s.do(func(c_todo *app.Todo) error {
+		if s.hop_by_hop != c_hop_by_hop || s.tx_timer == nil {
+			return nil
+		}
+		s.tx_timer = nil
+		delete(s.cl.pending, s.hop_by_hop)
+		l.Warn.Printf("gmb session %s: Tx expired in state %s", s.id, s.state)
+		s.terminated(ErrTxExpired, c_todo)
+		return nil
+	})
+}
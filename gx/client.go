@@ -0,0 +1,148 @@
+// Package gx is the PCEF side of the Gx interface (3GPP TS 29.212), the
+// IP-CAN sessions a gateway opens towards the PCRF.
+//
+// A Client sends the CCRs of its sessions on the send channel of a DiamConn
+// and gets the answers through Handle (or Run). The PCC rules, event
+// triggers and QoS of the CCAs and RARs are kept per session; a RAR is
+// answered and a RAR with Session-Release-Cause terminates the session.
+//
+//	cl := gx.NewClient(&diam_conn, send_ch, gx.ClientConfig{Callbacks: cbs})
+//	cl.Register(&diam_conn)
+//	go cl.Run(rcv_ch, nil)
+//	s := cl.NewSession()
+//	s.Start(avps)
+//	s.Update([]int32{d.ENUM_EVENT_TRIGGER_RAT_CHANGE}, avps)
+package gx
+
+import (
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+const (
+	default_tx = 10 * time.Second
+)
+
+// Callbacks report the life of the sessions to the application, every field
+// may be nil. They are called without locks held.
+type Callbacks struct {
+	OnStateChange func(s *Session, from State, to State)
+	// OnAnswer gets every CCA of the session.
+	OnAnswer func(s *Session, cca d.Message)
+	// OnRules reports the rules installed and the names of the rules
+	// removed by a CCA or a RAR.
+	OnRules func(s *Session, installed []Rule, removed []string)
+	// OnTerminate tells the IP-CAN session is over, err is nil after a
+	// successful CCR-T.
+	OnTerminate func(s *Session, err error)
+}
+
+// ClientConfig sets up a Client.
+type ClientConfig struct {
+	// Tx is the answer timeout, 10s if zero.
+	Tx time.Duration
+	// FeatureList is sent in the Supported-Features of the CCR-I (3GPP,
+	// Feature-List-ID 1) if not zero.
+	FeatureList uint32
+	Callbacks   Callbacks
+}
+
+// Client runs the Gx sessions of one connection.
+type Client struct {
+	base     app.Base
+	conf     ClientConfig
+	mtx      sync.Mutex
+	sessions map[string]*Session
+	pending  map[uint32]*Session
+}
+
+// NewClient creates a client sending on send_ch, the send channel of c.
+func NewClient(c app.Conn, send_ch chan d.Message, conf ClientConfig) *Client {
+	if conf.Tx <= 0 {
+		conf.Tx = default_tx
+	}
+	return &Client{
+		base:     app.NewBase("gx client", c, send_ch),
+		conf:     conf,
+		sessions: make(map[string]*Session),
+		pending:  make(map[uint32]*Session),
+	}
+}
+
+// NewSession creates an idle session with a new Session-Id.
+func (cl *Client) NewSession() *Session {
+	s := &Session{
+		cl:         cl,
+		id:         cl.base.Conn().Gen_Session_Id(),
+		rules:      make(map[string]Rule),
+		base_rules: make(map[string]Rule),
+		triggers:   make(map[int32]bool),
+	}
+	cl.mtx.Lock()
+	cl.sessions[s.id] = s
+	cl.mtx.Unlock()
+	return s
+}
+
+// Session returns the active session with the Session-Id id.
+func (cl *Client) Session(id string) (*Session, bool) {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	s, ok := cl.sessions[id]
+	return s, ok
+}
+
+// Run handles the messages of rcv_ch until it is closed. The messages that
+// are not for the client go to rest, or are dropped if rest is nil.
+func (cl *Client) Run(rcv_ch chan d.Message, rest chan d.Message) {
+	cl.base.Run(rcv_ch, rest, cl.Handle)
+}
+
+// Handle processes a received message: the CCAs of the sessions and the
+// RARs of Gx. It returns false for other messages.
+func (cl *Client) Handle(msg d.Message) bool {
+	if msg.GetAppId() != d.APPID_GX {
+		return false
+	}
+	switch {
+	case msg.GetCmdCode() == d.CC_CREDIT_CONTROL && msg.IsAnswer():
+		cl.mtx.Lock()
+		s, ok := cl.pending[msg.Get_hop_by_hop()]
+		cl.mtx.Unlock()
+		if !ok {
+			l.Warn.Printf("gx client: CCA without request, hop-by-hop 0x%08x session %s", msg.Get_hop_by_hop(), app.SessionId(&msg))
+			return true
+		}
+		s.answer(msg)
+		return true
+	case msg.GetCmdCode() == d.CC_RE_AUTH && msg.IsRequest():
+		if c_ans, ok := cl.HandleRequest(msg); ok {
+			cl.base.Send(c_ans)
+		}
+		return true
+	}
+	return false
+}
+
+// Register makes r answer the Gx RARs with the client.
+func (cl *Client) Register(r app.Registry) {
+	r.Handle(d.CC_RE_AUTH, d.APPID_GX, cl.HandleRequest)
+}
+
+// HandleRequest answers a RAR, it is a conn.RequestHandler. The rules and
+// triggers of the RAR are applied to the session.
+func (cl *Client) HandleRequest(req d.Message) (d.Message, bool) {
+	c_id := app.SessionId(&req)
+	cl.mtx.Lock()
+	s, ok := cl.sessions[c_id]
+	cl.mtx.Unlock()
+	if !ok {
+		l.Warn.Println("gx client: RAR for unknown session", c_id)
+		return cl.base.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+	}
+	s.reAuth(req)
+	return cl.base.AnswerTo(req, d.SUCCESS), true
+}
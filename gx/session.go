@@ -0,0 +1,456 @@
+package gx
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sort"
+	"time"
+)
+
+// State is the state of a Gx session of the PCEF.
+type State int
+
+const (
+	STATE_IDLE State = iota
+	STATE_PENDING_I
+	STATE_PENDING_U
+	STATE_PENDING_T
+	STATE_OPEN
+)
+
+var state_names map[State]string = map[State]string{
+	STATE_IDLE:      "Idle",
+	STATE_PENDING_I: "PendingI",
+	STATE_PENDING_U: "PendingU",
+	STATE_PENDING_T: "PendingT",
+	STATE_OPEN:      "Open",
+}
+
+func (st State) String() string {
+	if c_name, ok := state_names[st]; ok {
+		return c_name
+	}
+	return fmt.Sprintf("State(%d)", int(st))
+}
+
+// Rule is an installed PCC rule.
+type Rule struct {
+	Name string
+	// Base is true for a Charging-Rule-Base-Name, a group of predefined
+	// rules.
+	Base bool
+	// Definition is the Charging-Rule-Definition of a dynamic rule, nil for
+	// a predefined one.
+	Definition *d.AVP
+}
+
+var (
+	ErrTxExpired  = errors.New("no answer within Tx")
+	ErrWrongState = errors.New("request not allowed in this state")
+	// ErrNotArmed is an event the PCRF did not subscribe to with
+	// Event-Trigger.
+	ErrNotArmed = errors.New("event trigger not armed by the PCRF")
+)
+
+// Session is one IP-CAN session of a Client.
+type Session struct {
+	cl         *Client
+	id         string
+	state      State
+	req_number uint32
+	hop_by_hop uint32
+	tx_timer   *time.Timer
+	rules      map[string]Rule
+	base_rules map[string]Rule
+	triggers   map[int32]bool
+	qos        *d.AVP
+}
+
+func (s *Session) Id() string {
+	return s.id
+}
+
+func (s *Session) State() State {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.state
+}
+
+// Rules returns the installed rules sorted by name, the base names after
+// the rules.
+func (s *Session) Rules() []Rule {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	var ret []Rule
+	for _, c_map := range []map[string]Rule{s.rules, s.base_rules} {
+		var c_names []string
+		for k := range c_map {
+			c_names = append(c_names, k)
+		}
+		sort.Strings(c_names)
+		for _, v := range c_names {
+			ret = append(ret, c_map[v])
+		}
+	}
+	return ret
+}
+
+// Triggers returns the Event-Triggers armed by the PCRF.
+func (s *Session) Triggers() []int32 {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	var ret []int32
+	for k := range s.triggers {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// Armed tells if the PCRF wants the event trigger reported.
+func (s *Session) Armed(trigger int32) bool {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.triggers[trigger]
+}
+
+// QoS returns the last QoS-Information of the PCRF, nil if none.
+func (s *Session) QoS() *d.AVP {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.qos
+}
+
+// Start sends the CCR-I of an idle session. avps are e.g. Subscription-Id,
+// Framed-IP-Address, IP-CAN-Type, RAT-Type and Called-Station-Id.
+func (s *Session) Start(avps []d.AVP) error {
+	if s.cl.conf.FeatureList != 0 && !hasAVP(avps, d.AVP_CODE_Supported_Features, d.VENDOR_3GPP) {
+		avps = append(avps, d.AVP_Group(d.AVP_CODE_Supported_Features, []d.AVP{
+			d.AVP_Unsigned32(d.AVP_CODE_Vendor_Id, d.VENDOR_3GPP, d.MAND, 0),
+			d.AVP_Unsigned32(d.AVP_CODE_Feature_List_ID, 1, false, d.VENDOR_3GPP),
+			d.AVP_Unsigned32(d.AVP_CODE_Feature_List, s.cl.conf.FeatureList, false, d.VENDOR_3GPP),
+		}, false, d.VENDOR_3GPP))
+	}
+	return s.do(func(c_todo *app.Todo) error {
+		return s.sendRequest(d.ENUM_CC_REQUEST_INITIAL, avps, []State{STATE_IDLE}, STATE_PENDING_I, c_todo)
+	})
+}
+
+// Update reports the triggers with a CCR-U, every trigger has to be armed
+// by the PCRF.
+func (s *Session) Update(triggers []int32, avps []d.AVP) error {
+	return s.do(func(c_todo *app.Todo) error {
+		for _, v := range triggers {
+			if !s.triggers[v] {
+				return fmt.Errorf("%s: Event-Trigger %d: %w", s.id, v, ErrNotArmed)
+			}
+		}
+		var c_avps []d.AVP
+		for _, v := range triggers {
+			c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Event_Trigger, v, d.MAND, d.VENDOR_3GPP))
+		}
+		return s.sendRequest(d.ENUM_CC_REQUEST_UPDATE, append(c_avps, avps...), []State{STATE_OPEN}, STATE_PENDING_U, c_todo)
+	})
+}
+
+// ReportRules reports with a CCR-U that the rules names could not be
+// enforced (status d.ENUM_PCC_RULE_INACTIVE and a Rule-Failure-Code) or
+// are active again. Inactive rules are removed from the session.
+func (s *Session) ReportRules(names []string, status int32, failure_code int32) error {
+	c_report := []d.AVP{}
+	for _, v := range names {
+		c_report = append(c_report, d.AVP_OctetString(d.AVP_CODE_Charging_Rule_Name, []byte(v), d.MAND, d.VENDOR_3GPP))
+	}
+	c_report = append(c_report, d.AVP_Enumerated(d.AVP_CODE_PCC_Rule_Status, status, d.MAND, d.VENDOR_3GPP))
+	if status != d.ENUM_PCC_RULE_ACTIVE {
+		c_report = append(c_report, d.AVP_Enumerated(d.AVP_CODE_Rule_Failure_Code, failure_code, d.MAND, d.VENDOR_3GPP))
+	}
+	c_avps := []d.AVP{d.AVP_Group(d.AVP_CODE_Charging_Rule_Report, c_report, d.MAND, d.VENDOR_3GPP)}
+	return s.do(func(c_todo *app.Todo) error {
+		if err := s.sendRequest(d.ENUM_CC_REQUEST_UPDATE, c_avps, []State{STATE_OPEN}, STATE_PENDING_U, c_todo); err != nil {
+			return err
+		}
+		if status != d.ENUM_PCC_RULE_ACTIVE {
+			for _, v := range names {
+				delete(s.rules, v)
+			}
+		}
+		return nil
+	})
+}
+
+// Terminate sends the CCR-T of an open session, a pending CCR-U is given
+// up. A Termination-Cause DIAMETER_LOGOUT is added if avps has none.
+func (s *Session) Terminate(avps []d.AVP) error {
+	if !hasAVP(avps, d.AVP_CODE_Termination_Cause, 0) {
+		avps = append(avps, d.AVP_Enumerated(d.AVP_CODE_Termination_Cause, d.ENUM_TERMINATION_CAUSE_LOGOUT, d.MAND, 0))
+	}
+	return s.do(func(c_todo *app.Todo) error {
+		return s.sendRequest(d.ENUM_CC_REQUEST_TERMINATION, avps, []State{STATE_OPEN, STATE_PENDING_U}, STATE_PENDING_T, c_todo)
+	})
+}
+
+func (s *Session) do(f func(c_todo *app.Todo) error) error {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	err := f(&c_todo)
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+	return err
+}
+
+// sendRequest sends a CCR if the session is in one of the from states.
+func (s *Session) sendRequest(c_type int32, avps []d.AVP, from []State, to State, c_todo *app.Todo) error {
+	c_allowed := false
+	for _, v := range from {
+		if s.state == v {
+			c_allowed = true
+		}
+	}
+	if !c_allowed {
+		return fmt.Errorf("%s: CC-Request-Type %d in state %s: %w", s.id, c_type, s.state, ErrWrongState)
+	}
+
+	if c_type == d.ENUM_CC_REQUEST_INITIAL {
+		s.req_number = 0
+	} else {
+		s.req_number++
+	}
+	s.stopTx()
+	delete(s.cl.pending, s.hop_by_hop)
+	c_req := s.request(c_type, avps)
+	s.hop_by_hop = c_req.Get_hop_by_hop()
+	s.cl.pending[s.hop_by_hop] = s
+	s.cl.sessions[s.id] = s
+	s.startTx()
+	s.setState(to, c_todo)
+
+	c_todo.Add(func() {
+		s.cl.base.Send(c_req)
+	})
+	return nil
+}
+
+func (s *Session) request(c_type int32, avps []d.AVP) d.Message {
+	cl := s.cl
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, s.id, d.MAND, 0)}
+	c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_GX, d.MAND, 0))
+	c_avps = append(c_avps, cl.base.Origin()...)
+	c_avps = append(c_avps, cl.base.Destination()...)
+	c_avps = append(c_avps,
+		d.AVP_Enumerated(d.AVP_CODE_CC_Request_Type, c_type, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_CC_Request_Number, s.req_number, d.MAND, 0),
+	)
+	c_avps = append(c_avps, avps...)
+	return d.GenMess(d.CC_CREDIT_CONTROL, true, true, d.APPID_GX, cl.base.Conn().NextHopByHop(), 0, c_avps)
+}
+
+func (s *Session) setState(to State, c_todo *app.Todo) {
+	c_from := s.state
+	s.state = to
+	if to == STATE_IDLE {
+		s.stopTx()
+		delete(s.cl.sessions, s.id)
+	}
+	if c_from == to {
+		return
+	}
+	l.Trace.Printf("gx session %s: %s -> %s", s.id, c_from, to)
+	if cb := s.cl.conf.Callbacks.OnStateChange; cb != nil {
+		c_todo.Add(func() { cb(s, c_from, to) })
+	}
+}
+
+func (s *Session) terminated(err error, c_todo *app.Todo) {
+	s.setState(STATE_IDLE, c_todo)
+	if cb := s.cl.conf.Callbacks.OnTerminate; cb != nil {
+		c_todo.Add(func() { cb(s, err) })
+	}
+}
+
+// answer runs the state machine for a received CCA.
+func (s *Session) answer(cca d.Message) {
+	s.do(func(c_todo *app.Todo) error {
+		if cca.Get_hop_by_hop() != s.hop_by_hop {
+			l.Warn.Printf("gx session %s: late answer, hop-by-hop 0x%08x", s.id, cca.Get_hop_by_hop())
+			delete(s.cl.pending, cca.Get_hop_by_hop())
+			return nil
+		}
+		delete(s.cl.pending, s.hop_by_hop)
+		s.stopTx()
+		if cb := s.cl.conf.Callbacks.OnAnswer; cb != nil {
+			c_todo.Add(func() { cb(s, cca) })
+		}
+
+		c_result := app.ResultCode(&cca)
+		c_success := c_result >= 2000 && c_result < 3000
+		switch s.state {
+		case STATE_PENDING_I:
+			if !c_success {
+				s.terminated(&app.ResultError{ResultCode: c_result}, c_todo)
+				return nil
+			}
+			s.apply(&cca, c_todo)
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_U:
+			if c_result == d.UNKNOWN_SESSION_ID {
+				s.terminated(&app.ResultError{ResultCode: c_result}, c_todo)
+				return nil
+			}
+			// a failed update keeps the rules in force
+			if c_success {
+				s.apply(&cca, c_todo)
+			}
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_T:
+			var err error
+			if !c_success {
+				err = &app.ResultError{ResultCode: c_result}
+			}
+			s.terminated(err, c_todo)
+		}
+		return nil
+	})
+}
+
+// reAuth applies a RAR, a Session-Release-Cause terminates the session
+// after the answer.
+func (s *Session) reAuth(rar d.Message) {
+	s.do(func(c_todo *app.Todo) error {
+		s.apply(&rar, c_todo)
+		return nil
+	})
+	if rar.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Session_Release_Cause) == nil {
+		return
+	}
+	// the RAA is sent before the CCR-T, the session sends on the send
+	// channel which may block
+	go func() {
+		if err := s.Terminate(nil); err != nil {
+			l.Warn.Println("gx session", s.id, "cannot terminate after RAR:", err)
+		}
+	}()
+}
+
+// apply takes the rules, event triggers and QoS of a CCA or a RAR.
+func (s *Session) apply(msg *d.Message, c_todo *app.Todo) {
+	var c_removed []string
+	for _, c_remove := range msg.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Remove) {
+		for _, v := range c_remove.GetGroupAVPs() {
+			switch {
+			case v.GetVendorId() != d.VENDOR_3GPP:
+			case v.GetAVPCode() == d.AVP_CODE_Charging_Rule_Name:
+				delete(s.rules, nameOf(&v))
+				c_removed = append(c_removed, nameOf(&v))
+			case v.GetAVPCode() == d.AVP_CODE_Charging_Rule_Base_Name:
+				delete(s.base_rules, v.GetStringValue())
+				c_removed = append(c_removed, v.GetStringValue())
+			}
+		}
+	}
+
+	var c_installed []Rule
+	for _, c_install := range msg.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Install) {
+		for _, v := range c_install.GetGroupAVPs() {
+			c_rule := Rule{}
+			switch {
+			case v.GetVendorId() != d.VENDOR_3GPP:
+				continue
+			case v.GetAVPCode() == d.AVP_CODE_Charging_Rule_Definition:
+				c_def := v
+				c_name := c_def.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Name)
+				if c_name == nil {
+					l.Warn.Println("gx session", s.id, "Charging-Rule-Definition without Charging-Rule-Name")
+					continue
+				}
+				c_rule = Rule{Name: nameOf(c_name), Definition: &c_def}
+			case v.GetAVPCode() == d.AVP_CODE_Charging_Rule_Name:
+				c_rule = Rule{Name: nameOf(&v)}
+			case v.GetAVPCode() == d.AVP_CODE_Charging_Rule_Base_Name:
+				c_rule = Rule{Name: v.GetStringValue(), Base: true}
+			default:
+				continue
+			}
+			if c_rule.Base {
+				s.base_rules[c_rule.Name] = c_rule
+			} else {
+				s.rules[c_rule.Name] = c_rule
+			}
+			c_installed = append(c_installed, c_rule)
+		}
+	}
+
+	if c_triggers := msg.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Event_Trigger); len(c_triggers) != 0 {
+		s.triggers = make(map[int32]bool)
+		for _, v := range c_triggers {
+			if c_val := int32(v.GetIntValue()); c_val != d.ENUM_EVENT_TRIGGER_NO_EVENT_TRIGGERS {
+				s.triggers[c_val] = true
+			}
+		}
+	}
+	if c_qos := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_QoS_Information); c_qos != nil {
+		c_val := *c_qos
+		s.qos = &c_val
+	}
+
+	if len(c_installed) == 0 && len(c_removed) == 0 {
+		return
+	}
+	if cb := s.cl.conf.Callbacks.OnRules; cb != nil {
+		c_todo.Add(func() { cb(s, c_installed, c_removed) })
+	}
+}
+
+func (s *Session) startTx() {
+	c_hop_by_hop := s.hop_by_hop
+	s.tx_timer = time.AfterFunc(s.cl.conf.Tx, func() {
+		s.txExpired(c_hop_by_hop)
+	})
+}
+
+func (s *Session) stopTx() {
+	if s.tx_timer != nil {
+		s.tx_timer.Stop()
+		s.tx_timer = nil
+	}
+}
+
+// txExpired gives up the request with c_hop_by_hop: an update keeps the
+// session open, the other requests end it.
+func (s *Session) txExpired(c_hop_by_hop uint32) {
+	s.do(func(c_todo *app.Todo) error {
+		if s.hop_by_hop != c_hop_by_hop || s.tx_timer == nil {
+			return nil
+		}
+		s.tx_timer = nil
+		delete(s.cl.pending, s.hop_by_hop)
+		l.Warn.Printf("gx session %s: Tx expired in state %s", s.id, s.state)
+		switch s.state {
+		case STATE_PENDING_U:
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_I, STATE_PENDING_T:
+			s.terminated(ErrTxExpired, c_todo)
+		}
+		return nil
+	})
+}
+
+func hasAVP(avps []d.AVP, avp_code uint32, vendor_id uint32) bool {
+	for _, v := range avps {
+		if v.GetAVPCode() == avp_code && v.GetVendorId() == vendor_id {
+			return true
+		}
+	}
+	return false
+}
+
+// nameOf is the text of a Charging-Rule-Name, an OctetString.
+func nameOf(avp *d.AVP) string {
+	if c_val, ok := avp.GetValue().([]byte); ok {
+		return string(c_val)
+	}
+	return avp.GetStringValue()
+}
@@ -0,0 +1,389 @@
+// Package hpcrf is an H-PCRF stub, the home side of S9 (3GPP TS 29.215)
+// for testing V-PCRFs without a home network.
+//
+// The subsessions of the S9 sessions are the Gx sessions of a pcrf.PCRF
+// with the rule sets of its configuration: a Subsession-Enforcement-Info
+// becomes a Gx CCR of the session "<S9 Session-Id>;<Subsession-Id>" with
+// the Subscription-Ids of the S9 session, the CCA of the PCRF the
+// Subsession-Decision-Info of the answer. The RARs of the PCRF, rule set
+// pushes and the rules of the Rx sessions of a roaming UE, go to the
+// V-PCRF as S9 RARs.
+//
+//	h := hpcrf.New(conf)
+//	srv := conn.NewServer(conn.ServerConfig{Listen: ":3868", AuthAppIds: []uint32{d.APPID_S9, d.APPID_RX}, Handler: h.Handle, AnswerHandler: h.HandleAnswer})
+//	h.SetSender(srv)
+//	h.PushRuleSet(session_id, 1, "throttled")
+package hpcrf
+
+import (
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"github.com/lehotomi/diam/pcrf"
+	"github.com/lehotomi/diam/s9"
+	"sort"
+	"sync"
+)
+
+// Sender sends a request to a connected V-PCRF or AF, conn.Server
+// implements it.
+type Sender interface {
+	SendTo(host string, msg d.Message) error
+}
+
+// HPCRF keeps the S9 sessions and evaluates their subsessions with a PCRF.
+type HPCRF struct {
+	conf     pcrf.Config
+	ans      app.Answerer
+	p        *pcrf.PCRF
+	mtx      sync.Mutex
+	sessions map[string]*session
+	// gx is the subsession of the Gx sessions of the PCRF.
+	gx     map[string]subsessionRef
+	sender Sender
+}
+
+type session struct {
+	// host and realm are the origin of the V-PCRF, the destination of
+	// RARs.
+	host         string
+	realm        string
+	subscription []d.AVP
+	// subs are the last CC-Request-Numbers of the Gx sessions of the
+	// subsessions.
+	subs map[uint32]uint32
+	// pushed are the Gx sessions of the RARs waiting for the RAA, "" for a
+	// RAR releasing the S9 session.
+	pushed []string
+}
+
+type subsessionRef struct {
+	session string
+	sub     uint32
+}
+
+// gxSender takes the requests of the PCRF.
+type gxSender struct {
+	h *HPCRF
+}
+
+func (g gxSender) SendTo(host string, msg d.Message) error {
+	return g.h.relay(host, msg)
+}
+
+func New(conf pcrf.Config) *HPCRF {
+	h := &HPCRF{
+		conf: conf,
+		ans: app.Answerer{
+			OriginHost:  conf.OriginHost,
+			OriginRealm: conf.OriginRealm,
+			Echo:        []uint32{d.AVP_CODE_CC_Request_Type, d.AVP_CODE_CC_Request_Number},
+		},
+		p:        pcrf.New(conf),
+		sessions: make(map[string]*session),
+		gx:       make(map[string]subsessionRef),
+	}
+	h.p.SetSender(gxSender{h})
+	return h
+}
+
+// SetSender sets where the RARs are sent.
+func (h *HPCRF) SetSender(sender Sender) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.sender = sender
+}
+
+// Sessions returns the Session-Ids of the open S9 sessions.
+func (h *HPCRF) Sessions() []string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var ret []string
+	for k := range h.sessions {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Subsessions returns the Subsession-Ids of an S9 session.
+func (h *HPCRF) Subsessions(session_id string) []uint32 {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s, ok := h.sessions[session_id]
+	if !ok {
+		return nil
+	}
+	var ret []uint32
+	for k := range s.subs {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// RuleSet returns the rule set of a subsession.
+func (h *HPCRF) RuleSet(session_id string, sub uint32) (string, bool) {
+	return h.p.RuleSet(gxSessionId(session_id, sub))
+}
+
+// PushRuleSet switches a subsession to another rule set with a RAR.
+func (h *HPCRF) PushRuleSet(session_id string, sub uint32, rule_set string) error {
+	return h.p.PushRuleSet(gxSessionId(session_id, sub), rule_set)
+}
+
+// Release asks the V-PCRF with a RAR to terminate a subsession, cause is a
+// Session-Release-Cause.
+func (h *HPCRF) Release(session_id string, sub uint32, cause int32) error {
+	return h.p.Release(gxSessionId(session_id, sub), cause)
+}
+
+// ReleaseSession asks the V-PCRF with a RAR to terminate the S9 session.
+func (h *HPCRF) ReleaseSession(session_id string, cause int32) error {
+	h.mtx.Lock()
+	s, ok := h.sessions[session_id]
+	if !ok {
+		h.mtx.Unlock()
+		return fmt.Errorf("hpcrf: unknown session %s", session_id)
+	}
+	s.pushed = append(s.pushed, "")
+	c_rar := h.request(session_id, s, d.CC_RE_AUTH, []d.AVP{
+		d.AVP_Enumerated(d.AVP_CODE_Re_Auth_Request_Type, d.ENUM_RE_AUTH_AUTHORIZE_ONLY, d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_Session_Release_Cause, cause, d.MAND, d.VENDOR_3GPP),
+	})
+	c_sender := h.sender
+	h.mtx.Unlock()
+	if c_sender == nil {
+		return fmt.Errorf("hpcrf: no sender for the RAR of %s", session_id)
+	}
+	return c_sender.SendTo(s.host, c_rar)
+}
+
+// Handle answers the S9 CCRs and the Rx AARs and STRs, it is a
+// conn.RequestHandler. Other requests get 3001 with the E flag.
+func (h *HPCRF) Handle(req d.Message) (d.Message, bool) {
+	if req.GetAppId() == d.APPID_RX {
+		return h.p.Handle(req)
+	}
+	if req.GetCmdCode() != d.CC_CREDIT_CONTROL || req.GetAppId() != d.APPID_S9 {
+		l.Warn.Println("hpcrf: unsupported command", req.GetCmdCode(), "app", req.GetAppId())
+		return h.ans.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+	}
+	c_session_id := app.SessionId(&req)
+	c_type_avp := req.FindAVP(0, d.AVP_CODE_CC_Request_Type)
+	if c_session_id == "" || c_type_avp == nil {
+		return h.ans.AnswerTo(req, d.MISSING_AVP), true
+	}
+	c_type := int32(c_type_avp.GetIntValue())
+
+	h.mtx.Lock()
+	_, ok := h.sessions[c_session_id]
+	switch {
+	case c_type == d.ENUM_CC_REQUEST_INITIAL:
+		if !ok {
+			c_sub := []d.AVP{}
+			for _, v := range req.FindAVPs(0, d.AVP_CODE_Subscription_Id) {
+				c_sub = append(c_sub, *v)
+			}
+			h.sessions[c_session_id] = &session{
+				host:         app.StringValue(&req, d.AVP_CODE_Origin_Host),
+				realm:        app.StringValue(&req, d.AVP_CODE_Origin_Realm),
+				subscription: c_sub,
+				subs:         make(map[uint32]uint32),
+			}
+		}
+	case c_type != d.ENUM_CC_REQUEST_UPDATE && c_type != d.ENUM_CC_REQUEST_TERMINATION:
+		h.mtx.Unlock()
+		return h.ans.AnswerTo(req, d.INVALID_AVP_VALUE,
+			d.AVP_Group(d.AVP_CODE_Failed_AVP, []d.AVP{*c_type_avp}, d.MAND, 0)), true
+	case !ok:
+		h.mtx.Unlock()
+		return h.ans.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+	}
+	h.mtx.Unlock()
+
+	if c_type == d.ENUM_CC_REQUEST_TERMINATION {
+		for _, v := range h.Subsessions(c_session_id) {
+			h.evaluate(c_session_id, s9.Subsession{Id: v, Operation: d.ENUM_SUBSESSION_OPERATION_TERMINATION})
+		}
+		h.close(c_session_id)
+		l.Info.Println("hpcrf: session", c_session_id, "terminated")
+		return h.ans.AnswerTo(req, d.SUCCESS), true
+	}
+
+	var c_decisions []d.AVP
+	c_failed := uint32(0)
+	c_accepted := false
+	c_infos := s9.Enforcements(&req)
+	for _, v := range c_infos {
+		c_dec := h.evaluate(c_session_id, v)
+		if c_result := s9.ParseSubsession(&c_dec); c_result.Success() {
+			c_accepted = true
+		} else {
+			l.Info.Println("hpcrf: session", c_session_id, "subsession", v.Id, "Result-Code", c_result.ResultCode)
+			if c_failed == 0 {
+				c_failed = c_result.ResultCode
+			}
+		}
+		c_decisions = append(c_decisions, c_dec)
+	}
+	// a CCR-I with only rejected subsessions does not open the session
+	if c_type == d.ENUM_CC_REQUEST_INITIAL && len(c_infos) != 0 && !c_accepted {
+		h.close(c_session_id)
+		return h.ans.AnswerTo(req, c_failed, c_decisions...), true
+	}
+	return h.ans.AnswerTo(req, d.SUCCESS, c_decisions...), true
+}
+
+// evaluate runs the subsession as a Gx CCR of the PCRF, it returns the
+// Subsession-Decision-Info of the CCA.
+func (h *HPCRF) evaluate(session_id string, sub s9.Subsession) d.AVP {
+	c_type := s9.RequestType(sub.Operation)
+	c_gx := gxSessionId(session_id, sub.Id)
+
+	h.mtx.Lock()
+	s, ok := h.sessions[session_id]
+	if !ok {
+		h.mtx.Unlock()
+		return s9.DecisionInfo(sub.Id, d.UNKNOWN_SESSION_ID, nil)
+	}
+	c_number, c_known := s.subs[sub.Id]
+	switch {
+	case c_type == d.ENUM_CC_REQUEST_INITIAL:
+		c_number = 0
+		h.gx[c_gx] = subsessionRef{session_id, sub.Id}
+	case c_known:
+		c_number++
+	}
+	s.subs[sub.Id] = c_number
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, c_gx, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_GX, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, s.host, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, s.realm, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Destination_Realm, h.conf.OriginRealm, d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_CC_Request_Type, c_type, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_CC_Request_Number, c_number, d.MAND, 0),
+	}
+	if c_type == d.ENUM_CC_REQUEST_INITIAL {
+		c_avps = append(c_avps, s.subscription...)
+	}
+	c_avps = append(c_avps, sub.AVPs...)
+	h.mtx.Unlock()
+
+	c_cca, _ := h.p.Handle(d.GenMess(d.CC_CREDIT_CONTROL, true, true, d.APPID_GX, 0, 0, c_avps))
+	c_dec := s9.DecisionOf(sub.Id, &c_cca)
+	c_result := s9.ParseSubsession(&c_dec)
+	// a failed modification keeps the subsession
+	if c_type == d.ENUM_CC_REQUEST_TERMINATION || c_type == d.ENUM_CC_REQUEST_INITIAL && !c_result.Success() || c_result.ResultCode == d.UNKNOWN_SESSION_ID {
+		h.mtx.Lock()
+		delete(s.subs, sub.Id)
+		delete(h.gx, c_gx)
+		h.mtx.Unlock()
+	}
+	return c_dec
+}
+
+// close forgets an S9 session and its subsessions.
+func (h *HPCRF) close(session_id string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s, ok := h.sessions[session_id]
+	if !ok {
+		return
+	}
+	for k := range s.subs {
+		delete(h.gx, gxSessionId(session_id, k))
+	}
+	delete(h.sessions, session_id)
+}
+
+// relay sends a Gx RAR of the PCRF to the V-PCRF as the S9 RAR of its
+// subsession, the requests of the other applications as they are.
+func (h *HPCRF) relay(host string, msg d.Message) error {
+	h.mtx.Lock()
+	c_sender := h.sender
+	if msg.GetAppId() != d.APPID_GX {
+		h.mtx.Unlock()
+		if c_sender == nil {
+			return fmt.Errorf("hpcrf: no sender for the request %d", msg.GetCmdCode())
+		}
+		return c_sender.SendTo(host, msg)
+	}
+	c_gx := app.SessionId(&msg)
+	c_ref, ok := h.gx[c_gx]
+	s, c_open := h.sessions[c_ref.session]
+	if !ok || !c_open {
+		h.mtx.Unlock()
+		return fmt.Errorf("hpcrf: no subsession of the Gx session %s", c_gx)
+	}
+	s.pushed = append(s.pushed, c_gx)
+	c_rar := h.request(c_ref.session, s, d.CC_RE_AUTH, []d.AVP{
+		d.AVP_Enumerated(d.AVP_CODE_Re_Auth_Request_Type, d.ENUM_RE_AUTH_AUTHORIZE_ONLY, d.MAND, 0),
+		s9.DecisionOf(c_ref.sub, &msg),
+	})
+	h.mtx.Unlock()
+	if c_sender == nil {
+		return fmt.Errorf("hpcrf: no sender for the RAR of %s", c_ref.session)
+	}
+	return c_sender.SendTo(s.host, c_rar)
+}
+
+// HandleAnswer takes the answers of the peers, e.g. as the AnswerHandler
+// of conn.Server. The RAA of a subsession is given to the PCRF as the RAA
+// of its Gx session, so the AFs learn whether their rules are installed.
+func (h *HPCRF) HandleAnswer(ans d.Message) {
+	if ans.GetAppId() != d.APPID_S9 {
+		h.p.HandleAnswer(ans)
+		return
+	}
+	if ans.GetCmdCode() != d.CC_RE_AUTH || !ans.IsAnswer() {
+		return
+	}
+	c_session_id := app.SessionId(&ans)
+	c_result := app.ResultCode(&ans)
+	if c_result < 2000 || c_result >= 3000 {
+		l.Warn.Println("hpcrf: RAA of", c_session_id, "Result-Code", c_result)
+	}
+
+	h.mtx.Lock()
+	c_gx := ""
+	if s, ok := h.sessions[c_session_id]; ok && len(s.pushed) != 0 {
+		c_gx = s.pushed[0]
+		s.pushed = s.pushed[1:]
+	}
+	c_ref, ok := h.gx[c_gx]
+	h.mtx.Unlock()
+	if !ok {
+		return
+	}
+	for _, v := range s9.Enforcements(&ans) {
+		if v.Id == c_ref.sub && v.ResultCode != 0 {
+			c_result = v.ResultCode
+		}
+	}
+	h.p.HandleAnswer(d.GenMess(d.CC_RE_AUTH, false, true, d.APPID_GX, ans.Get_hop_by_hop(), ans.Get_end_to_end(), []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, c_gx, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Result_Code, c_result, d.MAND, 0),
+	}))
+}
+
+// request creates a request of the S9 session s.
+func (h *HPCRF) request(session_id string, s *session, cmd_code uint32, avps []d.AVP) d.Message {
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, session_id, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_S9, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, h.conf.OriginHost, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, h.conf.OriginRealm, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Destination_Realm, s.realm, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Destination_Host, s.host, d.MAND, 0),
+	}
+	c_avps = append(c_avps, avps...)
+	return d.GenMess(cmd_code, true, true, d.APPID_S9, 0, 0, c_avps)
+}
+
+// gxSessionId is the Session-Id of a subsession in the PCRF.
+func gxSessionId(session_id string, sub uint32) string {
+	return fmt.Sprintf("%s;%d", session_id, sub)
+}
@@ -0,0 +1,255 @@
+// Package hss is an HSS stub with an in-memory user repository, the server
+// side of Sh (3GPP TS 29.328/29.329) for testing application servers and
+// of S6a/S6d (3GPP TS 29.272) for testing MMEs without an HSS.
+//
+// The users of the configuration are found by their public identities or
+// MSISDN. The AS reads their IMS data and the transparent repository data
+// with User-Data, writes the repository data with Profile-Update and gets
+// the changes in Push-Notifications after Subscribe-Notifications.
+//
+// The EPS subscribers are found by their IMSI. The MME gets Milenage
+// authentication vectors of their K and OPc with Authentication-Information
+// and their subscription data with Update-Location. The HSS cancels the
+// location at the previous MME and sends the subscription changes with
+// Insert-Subscriber-Data.
+//
+//	h := hss.New(conf)
+//	srv := conn.NewServer(conn.ServerConfig{Listen: ":3868", AuthAppIds: []uint32{d.APPID_SH}, Handler: h.Handle})
+//	h.SetSender(srv)
+//	h.SetRepository("sip:alice@ims.test", "svc", "<cfu>on</cfu>")
+package hss
+
+import (
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+// User is a subscriber of the repository.
+type User struct {
+	// PublicIdentities are the SIP and tel URIs of the user, the first one
+	// names the user.
+	PublicIdentities []string `json:"public_identities"`
+	MSISDN           string   `json:"msisdn,omitempty"`
+	SCSCFName        string   `json:"s_cscf_name,omitempty"`
+	// IMSUserState is one of the sh.IMS_USER_STATE values.
+	IMSUserState int `json:"ims_user_state"`
+	// IFCs is the content of the IFCs element, InitialFilterCriteria
+	// elements.
+	IFCs string `json:"ifcs,omitempty"`
+	// Repository is the service data (XML) by Service-Indication.
+	Repository map[string]string `json:"repository,omitempty"`
+}
+
+// Config sets up an HSS.
+type Config struct {
+	OriginHost  string `json:"origin_host"`
+	OriginRealm string `json:"origin_realm"`
+	Users       []User `json:"users"`
+	// Subscribers are the EPS subscribers of S6a.
+	Subscribers []Subscriber `json:"subscribers,omitempty"`
+}
+
+// Sender sends a request to a connected AS or MME, conn.Server implements
+// it.
+type Sender interface {
+	SendTo(host string, msg d.Message) error
+}
+
+// HSS keeps the users, the subscriptions of the application servers and
+// the EPS subscribers.
+type HSS struct {
+	conf        Config
+	mtx         sync.Mutex
+	users       []*user
+	subs        []*subscription
+	subscribers []*subscriber
+	sender      Sender
+	start       int64
+	session_no  uint32
+	ans         app.Answerer
+}
+
+type user struct {
+	User
+	// seq is the Sequence-Number of the repository data.
+	seq map[string]uint32
+}
+
+// subscription is a Subscribe-Notifications of an AS.
+type subscription struct {
+	host   string
+	realm  string
+	user   *user
+	refs   map[int32]bool
+	sis    map[string]bool
+	expiry time.Time
+}
+
+func New(conf Config) *HSS {
+	h := &HSS{
+		conf:  conf,
+		start: time.Now().Unix(),
+		ans: app.Answerer{
+			OriginHost:  conf.OriginHost,
+			OriginRealm: conf.OriginRealm,
+			AppAVPs:     appAVPs,
+		},
+	}
+	for _, v := range conf.Users {
+		h.users = append(h.users, newUser(v))
+	}
+	for _, v := range conf.Subscribers {
+		h.subscribers = append(h.subscribers, newSubscriber(v))
+	}
+	return h
+}
+
+func newUser(u User) *user {
+	ret := &user{User: u, seq: make(map[string]uint32)}
+	c_repo := make(map[string]string)
+	for k, v := range u.Repository {
+		c_repo[k] = v
+		ret.seq[k] = 0
+	}
+	ret.Repository = c_repo
+	return ret
+}
+
+// SetSender sets where the Push-Notifications and the requests to the MMEs
+// are sent.
+func (h *HSS) SetSender(sender Sender) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.sender = sender
+}
+
+// User returns the user with the public identity or MSISDN id.
+func (h *HSS) User(id string) (User, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	u := h.find(id, id)
+	if u == nil {
+		return User{}, false
+	}
+	c_ret := u.User
+	c_ret.Repository = make(map[string]string)
+	for k, v := range u.Repository {
+		c_ret.Repository[k] = v
+	}
+	return c_ret, true
+}
+
+// SetUser adds a user or replaces the one with the same first public
+// identity, keeping its repository data. The subscribers of the IMS user
+// state and the S-CSCF name are notified of their changes.
+func (h *HSS) SetUser(u User) error {
+	if len(u.PublicIdentities) == 0 {
+		return fmt.Errorf("hss: user without public identity")
+	}
+	h.mtx.Lock()
+	c_old := h.find(u.PublicIdentities[0], "")
+	if c_old == nil {
+		h.users = append(h.users, newUser(u))
+		h.mtx.Unlock()
+		return nil
+	}
+	var c_changed []int32
+	if c_old.IMSUserState != u.IMSUserState {
+		c_changed = append(c_changed, d.ENUM_DATA_REFERENCE_IMS_USER_STATE)
+	}
+	if c_old.SCSCFName != u.SCSCFName {
+		c_changed = append(c_changed, d.ENUM_DATA_REFERENCE_S_CSCF_NAME)
+	}
+	c_repo := c_old.Repository
+	c_old.User = u
+	c_old.Repository = c_repo
+	c_notes := h.notifications(c_old, c_changed, nil, "")
+	h.mtx.Unlock()
+	h.send(c_notes)
+	return nil
+}
+
+// SetRepository sets the repository data of a user and notifies its
+// subscribers, an empty data deletes it.
+func (h *HSS) SetRepository(id string, service_indication string, data string) error {
+	h.mtx.Lock()
+	u := h.find(id, id)
+	if u == nil {
+		h.mtx.Unlock()
+		return fmt.Errorf("hss: unknown user %s", id)
+	}
+	if _, ok := u.Repository[service_indication]; ok {
+		u.seq[service_indication] = nextSequence(u.seq[service_indication])
+	} else {
+		u.seq[service_indication] = 0
+	}
+	u.setRepository(service_indication, data)
+	c_notes := h.notifications(u, []int32{d.ENUM_DATA_REFERENCE_REPOSITORY_DATA}, []string{service_indication}, "")
+	h.mtx.Unlock()
+	h.send(c_notes)
+	return nil
+}
+
+// find returns the user with the public identity or the MSISDN, nil if
+// none.
+func (h *HSS) find(public_identity string, msisdn string) *user {
+	for _, u := range h.users {
+		if msisdn != "" && u.MSISDN == msisdn {
+			return u
+		}
+		for _, v := range u.PublicIdentities {
+			if public_identity != "" && v == public_identity {
+				return u
+			}
+		}
+	}
+	return nil
+}
+
+func (u *user) setRepository(service_indication string, data string) {
+	if data == "" {
+		delete(u.Repository, service_indication)
+		delete(u.seq, service_indication)
+		return
+	}
+	u.Repository[service_indication] = data
+}
+
+func (u *user) name() string {
+	if len(u.PublicIdentities) != 0 {
+		return u.PublicIdentities[0]
+	}
+	return u.MSISDN
+}
+
+// nextSequence is the Sequence-Number after seq, it wraps from 65535 to 1.
+func nextSequence(seq uint32) uint32 {
+	if seq >= 65535 {
+		return 1
+	}
+	return seq + 1
+}
+
+func (h *HSS) newSessionId() string {
+	h.session_no++
+	return fmt.Sprintf("%s;%d;%d", h.conf.OriginHost, h.start, h.session_no)
+}
+
+func (h *HSS) send(msgs []note) {
+	h.mtx.Lock()
+	c_sender := h.sender
+	h.mtx.Unlock()
+	for _, v := range msgs {
+		if c_sender == nil {
+			l.Warn.Println("hss: no sender for the request to", v.host)
+			return
+		}
+		if err := c_sender.SendTo(v.host, v.msg); err != nil {
+			l.Warn.Println("hss: request", v.msg.GetCmdCode(), "to", v.host, err)
+		}
+	}
+}
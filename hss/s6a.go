@@ -0,0 +1,445 @@
+package hss
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"github.com/lehotomi/diam/s6a"
+	"github.com/lehotomi/diam/sh"
+)
+
+const (
+	// max_vectors limits the Number-Of-Requested-Vectors.
+	max_vectors = 5
+	// sqn_step is the SEQ part of the SQN, IND is its low 5 bits (3GPP TS
+	// 33.102 annex C.3.2).
+	sqn_step = 32
+	sqn_max  = 1<<48 - 1
+	// access_restriction_eutran is the E-UTRAN Not Allowed bit of the
+	// Access-Restriction-Data.
+	access_restriction_eutran = 1 << 5
+)
+
+// Subscriber is an EPS subscriber of S6a.
+type Subscriber struct {
+	IMSI string `json:"imsi"`
+	// K and OPc (or OP) are the Milenage keys in hex, without them the
+	// Authentication-Information-Requests get
+	// AUTHENTICATION_DATA_UNAVAILABLE.
+	K   string `json:"k"`
+	OPc string `json:"opc,omitempty"`
+	OP  string `json:"op,omitempty"`
+	// AMF is in hex, 8000 (the E-UTRAN separation bit) if empty.
+	AMF string `json:"amf,omitempty"`
+	// SQN is the last sequence number sent.
+	SQN          uint64           `json:"sqn"`
+	Subscription s6a.Subscription `json:"subscription"`
+}
+
+// subscriber is a Subscriber with its registration.
+type subscriber struct {
+	Subscriber
+	// milenage is nil without valid keys.
+	milenage  *s6a.Milenage
+	amf       []byte
+	mme_host  string
+	mme_realm string
+	// mme_sms is set if the MME is registered for SMS too.
+	mme_sms bool
+	purged  bool
+}
+
+func newSubscriber(s Subscriber) *subscriber {
+	ret := &subscriber{Subscriber: s, amf: []byte{0x80, 0x00}}
+	if s.AMF != "" {
+		c_amf, err := hex.DecodeString(s.AMF)
+		if err != nil || len(c_amf) != 2 {
+			l.Error.Println("hss: invalid AMF of", s.IMSI)
+		} else {
+			ret.amf = c_amf
+		}
+	}
+	if s.K == "" {
+		return ret
+	}
+	c_m, err := s.keys()
+	if err != nil {
+		l.Error.Println("hss: keys of", s.IMSI, err)
+		return ret
+	}
+	ret.milenage = c_m
+	return ret
+}
+
+func (s Subscriber) keys() (*s6a.Milenage, error) {
+	c_k, err := hex.DecodeString(s.K)
+	if err != nil {
+		return nil, fmt.Errorf("K: %w", err)
+	}
+	var c_opc []byte
+	switch {
+	case s.OPc != "":
+		if c_opc, err = hex.DecodeString(s.OPc); err != nil {
+			return nil, fmt.Errorf("OPc: %w", err)
+		}
+	case s.OP != "":
+		c_op, err := hex.DecodeString(s.OP)
+		if err != nil {
+			return nil, fmt.Errorf("OP: %w", err)
+		}
+		if c_opc, err = s6a.OPc(c_k, c_op); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("neither OPc nor OP")
+	}
+	return s6a.NewMilenage(c_k, c_opc)
+}
+
+// Subscriber returns the EPS subscriber of imsi with its current SQN.
+func (h *HSS) Subscriber(imsi string) (Subscriber, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s := h.findSubscriber(imsi)
+	if s == nil {
+		return Subscriber{}, false
+	}
+	return s.Subscriber, true
+}
+
+// SetSubscriber adds an EPS subscriber or replaces the one with the same
+// IMSI, keeping its registration and the higher SQN. The MME of a
+// registered subscriber gets the new subscription data in an
+// Insert-Subscriber-Data.
+func (h *HSS) SetSubscriber(s Subscriber) error {
+	if s.IMSI == "" {
+		return fmt.Errorf("hss: subscriber without IMSI")
+	}
+	c_new := newSubscriber(s)
+	h.mtx.Lock()
+	c_old := h.findSubscriber(s.IMSI)
+	if c_old == nil {
+		h.subscribers = append(h.subscribers, c_new)
+		h.mtx.Unlock()
+		return nil
+	}
+	if c_old.SQN > c_new.SQN {
+		c_new.SQN = c_old.SQN
+	}
+	c_new.mme_host, c_new.mme_realm, c_new.mme_sms, c_new.purged = c_old.mme_host, c_old.mme_realm, c_old.mme_sms, c_old.purged
+	*c_old = *c_new
+	c_note, err := h.insertSubscriberData(c_old)
+	h.mtx.Unlock()
+	if err != nil || c_note == nil {
+		return err
+	}
+	h.send([]note{*c_note})
+	return nil
+}
+
+// InsertSubscriberData sends the subscription data of imsi to its MME.
+func (h *HSS) InsertSubscriberData(imsi string) error {
+	h.mtx.Lock()
+	s := h.findSubscriber(imsi)
+	if s == nil {
+		h.mtx.Unlock()
+		return fmt.Errorf("hss: unknown subscriber %s", imsi)
+	}
+	c_note, err := h.insertSubscriberData(s)
+	h.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if c_note == nil {
+		return fmt.Errorf("hss: subscriber %s not registered", imsi)
+	}
+	h.send([]note{*c_note})
+	return nil
+}
+
+// CancelLocation sends a Cancel-Location with cancellation_type to the MME
+// of imsi and removes the registration.
+func (h *HSS) CancelLocation(imsi string, cancellation_type int32) error {
+	h.mtx.Lock()
+	s := h.findSubscriber(imsi)
+	if s == nil {
+		h.mtx.Unlock()
+		return fmt.Errorf("hss: unknown subscriber %s", imsi)
+	}
+	if s.mme_host == "" {
+		h.mtx.Unlock()
+		return fmt.Errorf("hss: subscriber %s not registered", imsi)
+	}
+	c_note := h.cancelLocation(s, cancellation_type)
+	s.mme_host, s.mme_realm, s.mme_sms = "", "", false
+	h.mtx.Unlock()
+	h.send([]note{c_note})
+	return nil
+}
+
+// handleS6a answers the S6a requests of the MMEs.
+func (h *HSS) handleS6a(req *d.Message) d.Message {
+	c_imsi := s6a.UserName(req)
+	if c_imsi == "" {
+		return h.ans.AnswerTo(*req, d.MISSING_AVP)
+	}
+	switch req.GetCmdCode() {
+	case d.CC_UPDATE_LOCATION:
+		return h.updateLocation(c_imsi, req)
+	case d.CC_AUTHENTICATION_INFORMATION:
+		return h.authenticationInformation(c_imsi, req)
+	case d.CC_PURGE_UE:
+		return h.purgeUE(c_imsi, req)
+	case d.CC_NOTIFY:
+		return h.notify(c_imsi, req)
+	}
+	l.Warn.Println("hss: unsupported S6a command", req.GetCmdCode())
+	return h.ans.AnswerTo(*req, d.COMMAND_UNSUPPORTED)
+}
+
+// updateLocation answers an Update-Location-Request, the previous MME of
+// the subscriber gets a Cancel-Location.
+func (h *HSS) updateLocation(imsi string, req *d.Message) d.Message {
+	c_host := app.StringValue(req, d.AVP_CODE_Origin_Host)
+	c_realm := app.StringValue(req, d.AVP_CODE_Origin_Realm)
+	var c_flags uint32
+	if c_avp := req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_ULR_Flags); c_avp != nil {
+		c_flags = uint32(c_avp.GetIntValue())
+	}
+
+	h.mtx.Lock()
+	s := h.findSubscriber(imsi)
+	if s == nil {
+		h.mtx.Unlock()
+		return h.ans.ExperimentalTo(*req, d.ERROR_USER_UNKNOWN)
+	}
+	if c_rat := req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_RAT_Type); c_rat != nil && c_rat.GetIntValue() == d.ENUM_RAT_TYPE_EUTRAN && s.Subscription.AccessRestriction&access_restriction_eutran != 0 {
+		h.mtx.Unlock()
+		return h.ans.ExperimentalTo(*req, d.ERROR_RAT_NOT_ALLOWED)
+	}
+	if len(s.Subscription.APNs) == 0 {
+		h.mtx.Unlock()
+		return h.ans.ExperimentalTo(*req, d.ERROR_UNKNOWN_EPS_SUBSCRIPTION)
+	}
+	var c_notes []note
+	if s.mme_host != "" && s.mme_host != c_host {
+		c_type := int32(d.ENUM_CANCELLATION_TYPE_MME_UPDATE_PROCEDURE)
+		if c_flags&d.ULR_FLAG_INITIAL_ATTACH_INDICATOR != 0 {
+			c_type = d.ENUM_CANCELLATION_TYPE_INITIAL_ATTACH_PROCEDURE
+		}
+		c_notes = append(c_notes, h.cancelLocation(s, c_type))
+	}
+	s.mme_host, s.mme_realm, s.purged = c_host, c_realm, false
+	s.mme_sms = c_flags&d.ULR_FLAG_SMS_ONLY_INDICATION != 0
+	c_sub := s.Subscription
+	h.mtx.Unlock()
+	h.send(c_notes)
+
+	var c_ula_flags uint32 = d.ULA_FLAG_SEPARATION_INDICATION
+	if c_flags&d.ULR_FLAG_SMS_ONLY_INDICATION != 0 {
+		c_ula_flags |= d.ULA_FLAG_MME_REGISTERED_FOR_SMS
+	}
+	c_avps := []d.AVP{d.AVP_Unsigned32(d.AVP_CODE_ULA_Flags, c_ula_flags, d.MAND, d.VENDOR_3GPP)}
+	if c_flags&d.ULR_FLAG_SKIP_SUBSCRIBER_DATA == 0 {
+		c_data, err := c_sub.AVP()
+		if err != nil {
+			l.Error.Println("hss: Subscription-Data of", imsi, err)
+			return h.ans.AnswerTo(*req, d.UNABLE_TO_COMPLY)
+		}
+		c_avps = append(c_avps, c_data)
+	}
+	return h.ans.AnswerTo(*req, d.SUCCESS, c_avps...)
+}
+
+// authenticationInformation answers an Authentication-Information-Request
+// with new vectors, after the resynchronisation of the SQN if asked.
+func (h *HSS) authenticationInformation(imsi string, req *d.Message) d.Message {
+	var c_plmn []byte
+	if c_avp := req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Visited_PLMN_Id); c_avp != nil {
+		c_plmn, _ = c_avp.GetValue().([]byte)
+	}
+	if c_plmn == nil {
+		return h.ans.AnswerTo(*req, d.MISSING_AVP)
+	}
+	c_eutran, c_eutran_resync := requestedVectors(req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Requested_EUTRAN_Authentication_Info))
+	c_utran, c_utran_resync := requestedVectors(req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Requested_UTRAN_GERAN_Authentication_Info))
+	if c_eutran == 0 && c_utran == 0 {
+		return h.ans.AnswerTo(*req, d.MISSING_AVP)
+	}
+	c_resync := c_eutran_resync
+	if c_resync == nil {
+		c_resync = c_utran_resync
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s := h.findSubscriber(imsi)
+	if s == nil {
+		return h.ans.ExperimentalTo(*req, d.ERROR_USER_UNKNOWN)
+	}
+	if s.milenage == nil {
+		return h.ans.ExperimentalTo(*req, d.AUTHENTICATION_DATA_UNAVAILABLE)
+	}
+	if c_resync != nil {
+		c_sqn, err := s.milenage.Resync(c_resync)
+		if err != nil {
+			l.Warn.Println("hss: resynchronisation of", imsi, err)
+			return h.ans.ExperimentalTo(*req, d.AUTHENTICATION_DATA_UNAVAILABLE)
+		}
+		s.SQN = c_sqn
+	}
+
+	var c_info []d.AVP
+	for i := uint32(1); i <= c_eutran+c_utran; i++ {
+		c_rand := make([]byte, 16)
+		if _, err := rand.Read(c_rand); err != nil {
+			l.Error.Println("hss: RAND", err)
+			return h.ans.AnswerTo(*req, d.UNABLE_TO_COMPLY)
+		}
+		s.SQN = nextSQN(s.SQN)
+		c_vector, err := s6a.NewVector(s.milenage, c_rand, s.SQN, s.amf, c_plmn)
+		if err != nil {
+			l.Error.Println("hss: vector of", imsi, err)
+			return h.ans.AnswerTo(*req, d.UNABLE_TO_COMPLY)
+		}
+		if i <= c_eutran {
+			c_info = append(c_info, c_vector.EUTRANAVP(i))
+		} else {
+			c_info = append(c_info, c_vector.UTRANAVP(i-c_eutran))
+		}
+	}
+	return h.ans.AnswerTo(*req, d.SUCCESS, d.AVP_Group(d.AVP_CODE_Authentication_Info, c_info, d.MAND, d.VENDOR_3GPP))
+}
+
+// purgeUE answers a Purge-UE-Request, the M-TMSI is kept if the UE is
+// purged in its registered MME.
+func (h *HSS) purgeUE(imsi string, req *d.Message) d.Message {
+	c_host := app.StringValue(req, d.AVP_CODE_Origin_Host)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s := h.findSubscriber(imsi)
+	if s == nil {
+		return h.ans.ExperimentalTo(*req, d.ERROR_USER_UNKNOWN)
+	}
+	var c_flags uint32
+	if s.mme_host == c_host {
+		s.purged = true
+		c_flags = d.PUA_FLAG_FREEZE_M_TMSI
+	}
+	return h.ans.AnswerTo(*req, d.SUCCESS, d.AVP_Unsigned32(d.AVP_CODE_PUA_Flags, c_flags, d.MAND, d.VENDOR_3GPP))
+}
+
+// notify answers a Notify-Request, only the removal of the MME
+// registration for SMS changes the subscriber. The MME stays registered
+// for the EPS services.
+func (h *HSS) notify(imsi string, req *d.Message) d.Message {
+	c_host := app.StringValue(req, d.AVP_CODE_Origin_Host)
+	var c_flags uint32
+	if c_avp := req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_NOR_Flags); c_avp != nil {
+		c_flags = uint32(c_avp.GetIntValue())
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s := h.findSubscriber(imsi)
+	if s == nil {
+		return h.ans.ExperimentalTo(*req, d.ERROR_USER_UNKNOWN)
+	}
+	l.Info.Printf("hss: Notify of %s from %s, NOR-Flags 0x%x", imsi, c_host, c_flags)
+	if c_flags&d.NOR_FLAG_REMOVAL_OF_MME_REGISTRATION_FOR_SMS != 0 && s.mme_host == c_host {
+		s.mme_sms = false
+	}
+	return h.ans.AnswerTo(*req, d.SUCCESS)
+}
+
+// cancelLocation is the Cancel-Location of the MME of s. It is called
+// with the lock held.
+func (h *HSS) cancelLocation(s *subscriber, cancellation_type int32) note {
+	return h.mmeRequest(s, d.CC_CANCEL_LOCATION, []d.AVP{
+		d.AVP_Enumerated(d.AVP_CODE_Cancellation_Type, cancellation_type, d.MAND, d.VENDOR_3GPP),
+		d.AVP_Unsigned32(d.AVP_CODE_CLR_Flags, d.CLR_FLAG_S6A_S6D_INDICATOR, d.MAND, d.VENDOR_3GPP),
+	})
+}
+
+// insertSubscriberData is the Insert-Subscriber-Data of the MME of s, nil
+// if s is not registered. It is called with the lock held.
+func (h *HSS) insertSubscriberData(s *subscriber) (*note, error) {
+	if s.mme_host == "" || s.purged {
+		return nil, nil
+	}
+	c_data, err := s.Subscription.AVP()
+	if err != nil {
+		return nil, fmt.Errorf("hss: Subscription-Data of %s: %w", s.IMSI, err)
+	}
+	ret := h.mmeRequest(s, d.CC_INSERT_SUBSCRIBER_DATA, []d.AVP{
+		c_data,
+		d.AVP_Unsigned32(d.AVP_CODE_IDR_Flags, 0, d.MAND, d.VENDOR_3GPP),
+	})
+	return &ret, nil
+}
+
+func (h *HSS) mmeRequest(s *subscriber, cmd_code uint32, avps []d.AVP) note {
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, h.newSessionId(), d.MAND, 0)}
+	c_avps = append(c_avps, s6a.AppAVPs()...)
+	c_avps = append(c_avps,
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, h.conf.OriginHost, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, h.conf.OriginRealm, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Destination_Host, s.mme_host, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Destination_Realm, s.mme_realm, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_User_Name, s.IMSI, d.MAND, 0),
+	)
+	c_avps = append(c_avps, avps...)
+	return note{
+		host: s.mme_host,
+		msg:  d.GenMess(cmd_code, true, true, d.APPID_S6A, 0, 0, c_avps),
+	}
+}
+
+func (h *HSS) findSubscriber(imsi string) *subscriber {
+	for _, s := range h.subscribers {
+		if s.IMSI == imsi {
+			return s
+		}
+	}
+	return nil
+}
+
+// requestedVectors reads a Requested-EUTRAN-Authentication-Info or a
+// Requested-UTRAN-GERAN-Authentication-Info, the number of vectors and
+// the Re-Synchronization-Info.
+func requestedVectors(avp *d.AVP) (uint32, []byte) {
+	if avp == nil {
+		return 0, nil
+	}
+	c_count := uint32(1)
+	if c_avp := avp.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Number_Of_Requested_Vectors); c_avp != nil {
+		c_count = uint32(c_avp.GetIntValue())
+	}
+	if c_count > max_vectors {
+		c_count = max_vectors
+	}
+	var c_resync []byte
+	if c_avp := avp.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Re_Synchronization_Info); c_avp != nil {
+		c_resync, _ = c_avp.GetValue().([]byte)
+	}
+	return c_count, c_resync
+}
+
+// nextSQN is the SQN after sqn, SEQ is incremented and IND kept.
+func nextSQN(sqn uint64) uint64 {
+	if sqn+sqn_step > sqn_max {
+		return sqn & (sqn_step - 1)
+	}
+	return sqn + sqn_step
+}
+
+// appAVPs are the Vendor-Specific-Application-Id and the
+// Auth-Session-State of the application app_id.
+func appAVPs(app_id uint32) []d.AVP {
+	if app_id == d.APPID_S6A {
+		return s6a.AppAVPs()
+	}
+	return sh.AppAVPs()
+}
@@ -0,0 +1,336 @@
+package hss
+
+import (
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"github.com/lehotomi/diam/sh"
+	"time"
+)
+
+// note is a request to send after the lock is released.
+type note struct {
+	host string
+	msg  d.Message
+}
+
+// Handle answers the Sh and the S6a requests, it is a
+// conn.RequestHandler. Other requests get 3001 with the E flag.
+func (h *HSS) Handle(req d.Message) (d.Message, bool) {
+	if req.GetAppId() == d.APPID_S6A {
+		return h.handleS6a(&req), true
+	}
+	if req.GetAppId() != d.APPID_SH {
+		l.Warn.Println("hss: unsupported command", req.GetCmdCode(), "app", req.GetAppId())
+		return h.ans.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+	}
+	c_id := sh.IdentityOf(&req)
+	if c_id == (sh.Identity{}) {
+		return h.ans.AnswerTo(req, d.MISSING_AVP), true
+	}
+
+	switch req.GetCmdCode() {
+	case d.CC_USER_DATA:
+		return h.userData(c_id, &req), true
+	case d.CC_PROFILE_UPDATE:
+		return h.profileUpdate(c_id, &req), true
+	case d.CC_SUBSCRIBE_NOTIFICATIONS:
+		return h.subscribe(c_id, &req), true
+	}
+	l.Warn.Println("hss: unsupported Sh command", req.GetCmdCode())
+	return h.ans.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+}
+
+// userData answers a User-Data-Request.
+func (h *HSS) userData(id sh.Identity, req *d.Message) d.Message {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	u := h.find(id.PublicIdentity, id.MSISDN)
+	if u == nil {
+		return h.ans.ExperimentalTo(*req, d.ERROR_USER_UNKNOWN)
+	}
+	c_data, c_code := u.shData(dataReferences(req), serviceIndications(req))
+	if c_code != d.SUCCESS {
+		return h.ans.ExperimentalTo(*req, c_code)
+	}
+	c_avp, err := c_data.AVP()
+	if err != nil {
+		l.Error.Println("hss: User-Data of", u.name(), err)
+		return h.ans.AnswerTo(*req, d.UNABLE_TO_COMPLY)
+	}
+	return h.ans.AnswerTo(*req, d.SUCCESS, c_avp)
+}
+
+// profileUpdate answers a Profile-Update-Request, only the repository data
+// can be changed. Every Sequence-Number has to follow the stored one, 0
+// creates new data.
+func (h *HSS) profileUpdate(id sh.Identity, req *d.Message) d.Message {
+	for _, v := range dataReferences(req) {
+		if v != d.ENUM_DATA_REFERENCE_REPOSITORY_DATA {
+			return h.ans.ExperimentalTo(*req, d.ERROR_USER_DATA_CANNOT_BE_MODIFIED)
+		}
+	}
+	c_data, err := sh.UserDataOf(req)
+	if err != nil {
+		l.Warn.Println("hss: Profile-Update", err)
+		return h.ans.ExperimentalTo(*req, d.ERROR_USER_DATA_NOT_RECOGNIZED)
+	}
+	if c_data == nil {
+		return h.ans.AnswerTo(*req, d.MISSING_AVP)
+	}
+
+	h.mtx.Lock()
+	u := h.find(id.PublicIdentity, id.MSISDN)
+	if u == nil {
+		h.mtx.Unlock()
+		return h.ans.ExperimentalTo(*req, d.ERROR_USER_UNKNOWN)
+	}
+	for _, v := range c_data.RepositoryData {
+		c_seq, ok := u.seq[v.ServiceIndication]
+		if (!ok && v.SequenceNumber != 0) || (ok && v.SequenceNumber != nextSequence(c_seq)) {
+			h.mtx.Unlock()
+			l.Warn.Println("hss: Profile-Update of", u.name(), v.ServiceIndication, "Sequence-Number", v.SequenceNumber, "stored", c_seq)
+			return h.ans.ExperimentalTo(*req, d.ERROR_TRANSPARENT_DATA_OUT_OF_SYNC)
+		}
+	}
+	var c_sis []string
+	for _, v := range c_data.RepositoryData {
+		u.seq[v.ServiceIndication] = v.SequenceNumber
+		u.setRepository(v.ServiceIndication, v.Data())
+		c_sis = append(c_sis, v.ServiceIndication)
+	}
+	c_origin := app.StringValue(req, d.AVP_CODE_Origin_Host)
+	c_notes := h.notifications(u, []int32{d.ENUM_DATA_REFERENCE_REPOSITORY_DATA}, c_sis, c_origin)
+	h.mtx.Unlock()
+
+	l.Info.Println("hss: repository of", u.name(), "updated by", c_origin, c_sis)
+	go h.send(c_notes)
+	return h.ans.AnswerTo(*req, d.SUCCESS)
+}
+
+// subscribe answers a Subscribe-Notifications-Request. A subscription is
+// replaced by the next one of the same AS and user.
+func (h *HSS) subscribe(id sh.Identity, req *d.Message) d.Message {
+	c_refs := dataReferences(req)
+	c_sis := serviceIndications(req)
+	c_type := int32(d.ENUM_SUBS_REQ_TYPE_SUBSCRIBE)
+	if c_avp := req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Subs_Req_Type); c_avp != nil {
+		c_type = int32(c_avp.GetIntValue())
+	}
+	for _, v := range c_refs {
+		if v == d.ENUM_DATA_REFERENCE_REPOSITORY_DATA && len(c_sis) == 0 {
+			return h.ans.AnswerTo(*req, d.MISSING_AVP)
+		}
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	u := h.find(id.PublicIdentity, id.MSISDN)
+	if u == nil {
+		return h.ans.ExperimentalTo(*req, d.ERROR_USER_UNKNOWN)
+	}
+	c_host := app.StringValue(req, d.AVP_CODE_Origin_Host)
+	c_subs := h.subs[:0]
+	for _, v := range h.subs {
+		if v.user != u || v.host != c_host {
+			c_subs = append(c_subs, v)
+		}
+	}
+	h.subs = c_subs
+	if c_type == d.ENUM_SUBS_REQ_TYPE_UNSUBSCRIBE {
+		l.Info.Println("hss:", c_host, "unsubscribed from", u.name())
+		return h.ans.AnswerTo(*req, d.SUCCESS)
+	}
+
+	c_sub := &subscription{
+		host:  c_host,
+		realm: app.StringValue(req, d.AVP_CODE_Origin_Realm),
+		user:  u,
+		refs:  make(map[int32]bool),
+		sis:   make(map[string]bool),
+	}
+	for _, v := range c_refs {
+		c_sub.refs[v] = true
+	}
+	for _, v := range c_sis {
+		c_sub.sis[v] = true
+	}
+	var c_avps []d.AVP
+	if c_avp := req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Expiry_Time); c_avp != nil {
+		if c_val, ok := c_avp.GetValue().(time.Time); ok {
+			c_sub.expiry = c_val
+			c_avps = append(c_avps, *c_avp)
+		}
+	}
+	h.subs = append(h.subs, c_sub)
+	l.Info.Println("hss:", c_host, "subscribed to", u.name(), c_refs, c_sis)
+
+	if c_avp := req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Send_Data_Indication); c_avp != nil && c_avp.GetIntValue() == d.ENUM_SEND_DATA_INDICATION_REQUESTED {
+		if c_data, c_code := u.shData(c_refs, c_sis); c_code == d.SUCCESS {
+			if c_user_data, err := c_data.AVP(); err == nil {
+				c_avps = append(c_avps, c_user_data)
+			}
+		}
+	}
+	return h.ans.AnswerTo(*req, d.SUCCESS, c_avps...)
+}
+
+// notifications are the Push-Notifications of the change of the data
+// references refs (and the service indications sis of the repository
+// data) of u, except to the AS except_host. It is called with the lock
+// held.
+func (h *HSS) notifications(u *user, refs []int32, sis []string, except_host string) []note {
+	var ret []note
+	c_now := time.Now()
+	for _, c_sub := range h.subs {
+		if c_sub.user != u || c_sub.host == except_host {
+			continue
+		}
+		if !c_sub.expiry.IsZero() && c_now.After(c_sub.expiry) {
+			continue
+		}
+		var c_refs []int32
+		for _, v := range refs {
+			if c_sub.refs[v] {
+				c_refs = append(c_refs, v)
+			}
+		}
+		var c_sis []string
+		for _, v := range sis {
+			if c_sub.sis[v] {
+				c_sis = append(c_sis, v)
+			}
+		}
+		if len(c_refs) == 0 || (len(c_refs) == 1 && c_refs[0] == d.ENUM_DATA_REFERENCE_REPOSITORY_DATA && len(c_sis) == 0) {
+			continue
+		}
+		c_data := u.changes(c_refs, c_sis)
+		c_user_data, err := c_data.AVP()
+		if err != nil {
+			l.Error.Println("hss: User-Data of", u.name(), err)
+			continue
+		}
+		c_id, _ := sh.Identity{PublicIdentity: u.name()}.AVP()
+		c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, h.newSessionId(), d.MAND, 0)}
+		c_avps = append(c_avps, sh.AppAVPs()...)
+		c_avps = append(c_avps,
+			d.AVP_UTF8String(d.AVP_CODE_Origin_Host, h.conf.OriginHost, d.MAND, 0),
+			d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, h.conf.OriginRealm, d.MAND, 0),
+			d.AVP_UTF8String(d.AVP_CODE_Destination_Host, c_sub.host, d.MAND, 0),
+			d.AVP_UTF8String(d.AVP_CODE_Destination_Realm, c_sub.realm, d.MAND, 0),
+			c_id,
+			c_user_data,
+		)
+		ret = append(ret, note{
+			host: c_sub.host,
+			msg:  d.GenMess(d.CC_PUSH_NOTIFICATION, true, true, d.APPID_SH, 0, 0, c_avps),
+		})
+	}
+	return ret
+}
+
+// shData is the Sh-Data of the data references of a User-Data-Request,
+// with the Experimental-Result-Code if it cannot be given.
+func (u *user) shData(refs []int32, sis []string) (*sh.ShData, uint32) {
+	ret := &sh.ShData{}
+	c_empty := true
+	for _, c_ref := range refs {
+		switch c_ref {
+		case d.ENUM_DATA_REFERENCE_REPOSITORY_DATA:
+			for _, v := range sis {
+				if c_data, ok := u.Repository[v]; ok {
+					ret.RepositoryData = append(ret.RepositoryData, sh.RepositoryData{
+						ServiceIndication: v,
+						SequenceNumber:    u.seq[v],
+						ServiceData:       &sh.RawXML{Inner: c_data},
+					})
+					c_empty = false
+				}
+			}
+			continue
+		case d.ENUM_DATA_REFERENCE_IMS_PUBLIC_IDENTITY, d.ENUM_DATA_REFERENCE_MSISDN:
+		case d.ENUM_DATA_REFERENCE_IMS_USER_STATE:
+		case d.ENUM_DATA_REFERENCE_S_CSCF_NAME:
+			if u.SCSCFName == "" {
+				continue
+			}
+		case d.ENUM_DATA_REFERENCE_INITIAL_FILTER_CRITERIA:
+			if u.IFCs == "" {
+				continue
+			}
+		default:
+			return nil, d.ERROR_USER_DATA_CANNOT_BE_READ
+		}
+		u.addData(ret, c_ref)
+		c_empty = false
+	}
+	if c_empty {
+		return nil, d.USER_DATA_NOT_AVAILABLE
+	}
+	return ret, d.SUCCESS
+}
+
+// changes is the Sh-Data of a Push-Notification, the deleted repository
+// data is sent without ServiceData.
+func (u *user) changes(refs []int32, sis []string) *sh.ShData {
+	ret := &sh.ShData{}
+	for _, c_ref := range refs {
+		if c_ref != d.ENUM_DATA_REFERENCE_REPOSITORY_DATA {
+			u.addData(ret, c_ref)
+			continue
+		}
+		for _, v := range sis {
+			c_rd := sh.RepositoryData{ServiceIndication: v, SequenceNumber: u.seq[v]}
+			if c_data, ok := u.Repository[v]; ok {
+				c_rd.ServiceData = &sh.RawXML{Inner: c_data}
+			}
+			ret.RepositoryData = append(ret.RepositoryData, c_rd)
+		}
+	}
+	return ret
+}
+
+// addData adds the IMS data of a data reference to sd.
+func (u *user) addData(sd *sh.ShData, ref int32) {
+	if sd.IMSData == nil && (ref == d.ENUM_DATA_REFERENCE_IMS_USER_STATE || ref == d.ENUM_DATA_REFERENCE_S_CSCF_NAME || ref == d.ENUM_DATA_REFERENCE_INITIAL_FILTER_CRITERIA) {
+		sd.IMSData = &sh.IMSData{}
+	}
+	if sd.PublicIdentifiers == nil && (ref == d.ENUM_DATA_REFERENCE_IMS_PUBLIC_IDENTITY || ref == d.ENUM_DATA_REFERENCE_MSISDN) {
+		sd.PublicIdentifiers = &sh.PublicIdentifiers{}
+	}
+	switch ref {
+	case d.ENUM_DATA_REFERENCE_IMS_PUBLIC_IDENTITY:
+		sd.PublicIdentifiers.IMSPublicIdentity = u.PublicIdentities
+	case d.ENUM_DATA_REFERENCE_MSISDN:
+		if u.MSISDN != "" {
+			sd.PublicIdentifiers.MSISDN = []string{u.MSISDN}
+		}
+	case d.ENUM_DATA_REFERENCE_IMS_USER_STATE:
+		c_state := u.IMSUserState
+		sd.IMSData.IMSUserState = &c_state
+	case d.ENUM_DATA_REFERENCE_S_CSCF_NAME:
+		sd.IMSData.SCSCFName = u.SCSCFName
+	case d.ENUM_DATA_REFERENCE_INITIAL_FILTER_CRITERIA:
+		sd.IMSData.IFCs = &sh.RawXML{Inner: u.IFCs}
+	}
+}
+
+func dataReferences(req *d.Message) []int32 {
+	var ret []int32
+	for _, v := range req.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Data_Reference) {
+		ret = append(ret, int32(v.GetIntValue()))
+	}
+	return ret
+}
+
+func serviceIndications(req *d.Message) []string {
+	var ret []string
+	for _, v := range req.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Service_Indication) {
+		if c_val, ok := v.GetValue().([]byte); ok {
+			ret = append(ret, string(c_val))
+		} else {
+			ret = append(ret, v.GetStringValue())
+		}
+	}
+	return ret
+}
@@ -0,0 +1,133 @@
+package hss
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/internal/apptest"
+	"github.com/lehotomi/diam/sh"
+	"os"
+	"testing"
+	"time"
+)
+
+const test_user = "sip:alice@test"
+
+func TestMain(m *testing.M) {
+	if err := d.InitWith("../dict", d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// testShClient returns an Sh client whose requests are answered by h.
+func testShClient(t *testing.T, h *HSS) *sh.Client {
+	send_ch := make(chan d.Message, 10)
+	cl := sh.NewClient(&apptest.Conn{}, send_ch, sh.ClientConfig{Tx: time.Second})
+	c_done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case c_req := <-send_ch:
+				if c_ans, ok := h.Handle(c_req); ok {
+					cl.Handle(c_ans)
+				}
+			case <-c_done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(c_done) })
+	return cl
+}
+
+func testHSS() *HSS {
+	return New(Config{
+		OriginHost:  "hss.test",
+		OriginRealm: "test",
+		Users: []User{{
+			PublicIdentities: []string{test_user, "tel:+36201234567"},
+			MSISDN:           "36201234567",
+			Repository:       map[string]string{"svc": "<x/>"},
+		}},
+	})
+}
+
+// checkAppId checks the Vendor-Specific-Application-Id of the answer.
+func checkAppId(t *testing.T, ans d.Message, app_id uint32) {
+	t.Helper()
+	c_vsai := ans.FindAVP(0, d.AVP_CODE_Vendor_Specific_Application_Id)
+	if c_vsai == nil {
+		t.Fatal("no Vendor-Specific-Application-Id")
+	}
+	if c_app := c_vsai.FindAVP(0, d.AVP_CODE_Auth_Application_Id); c_app == nil || uint32(c_app.GetIntValue()) != app_id {
+		t.Errorf("Auth-Application-Id %v, want %d", c_app, app_id)
+	}
+	if ans.FindAVP(0, d.AVP_CODE_Auth_Session_State) == nil {
+		t.Error("no Auth-Session-State")
+	}
+	if app.StringValue(&ans, d.AVP_CODE_Origin_Host) != "hss.test" {
+		t.Error("Origin-Host not in the answer")
+	}
+}
+
+func TestUserData(t *testing.T) {
+	cl := testShClient(t, testHSS())
+	c_data, c_ans, err := cl.Pull(sh.Identity{MSISDN: "36201234567"},
+		[]int32{d.ENUM_DATA_REFERENCE_IMS_PUBLIC_IDENTITY, d.ENUM_DATA_REFERENCE_REPOSITORY_DATA}, []string{"svc"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAppId(t, c_ans, d.APPID_SH)
+	if got := fmt.Sprint(c_data.PublicIdentifiers.IMSPublicIdentity); got != "["+test_user+" tel:+36201234567]" {
+		t.Errorf("public identities %s", got)
+	}
+	if c_repo := c_data.Repository("svc"); c_repo == nil || c_repo.Data() != "<x/>" {
+		t.Errorf("repository data %+v", c_repo)
+	}
+
+	_, c_ans, err = cl.Pull(sh.Identity{PublicIdentity: "sip:bob@test"}, []int32{d.ENUM_DATA_REFERENCE_IMS_PUBLIC_IDENTITY}, nil, nil)
+	var c_result *app.ResultError
+	if !errors.As(err, &c_result) || c_result.ResultCode != d.ERROR_USER_UNKNOWN {
+		t.Fatalf("unknown user: %v", err)
+	}
+	if c_ans.FindAVP(0, d.AVP_CODE_Experimental_Result) == nil {
+		t.Error("no Experimental-Result")
+	}
+	checkAppId(t, c_ans, d.APPID_SH)
+}
+
+// TestUnsupported answers the requests the HSS does not serve with 3001 and
+// the E flag, the application AVPs are the ones of the request.
+func TestUnsupported(t *testing.T) {
+	h := testHSS()
+	c_id, _ := sh.Identity{PublicIdentity: test_user}.AVP()
+	for _, c := range []struct {
+		name string
+		req  d.Message
+	}{
+		{"Sh", d.GenMess(d.CC_PUSH_NOTIFICATION, true, true, d.APPID_SH, 7, 8, []d.AVP{
+			d.AVP_UTF8String(d.AVP_CODE_Session_Id, "as.test;1", d.MAND, 0), c_id,
+		})},
+		{"S6a", d.GenMess(d.CC_CANCEL_LOCATION, true, true, d.APPID_S6A, 7, 8, []d.AVP{
+			d.AVP_UTF8String(d.AVP_CODE_Session_Id, "mme.test;1", d.MAND, 0),
+			d.AVP_UTF8String(d.AVP_CODE_User_Name, "001010123456789", d.MAND, 0),
+		})},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ans, ok := h.Handle(c.req)
+			if !ok {
+				t.Fatal("no answer")
+			}
+			if c_result := app.ResultCode(&ans); c_result != d.COMMAND_UNSUPPORTED || ans.GetCmdFlags()&0b00100000 == 0 {
+				t.Errorf("Result-Code %d flags 0x%x, want 3001 with the E flag", c_result, ans.GetCmdFlags())
+			}
+			if app.SessionId(&ans) != app.SessionId(&c.req) {
+				t.Error("Session-Id not in the answer")
+			}
+			checkAppId(t, ans, c.req.GetAppId())
+		})
+	}
+}
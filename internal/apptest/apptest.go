@@ -0,0 +1,44 @@
+// Package apptest has the fakes shared by the tests of the application
+// clients.
+package apptest
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Conn is a fake app.Conn of the host client.test in the realm test, the
+// peer is in the same realm. Session ids and hop-by-hop ids count from 1.
+type Conn struct {
+	mtx        sync.Mutex
+	run        int
+	hop_by_hop uint32
+}
+
+func (c *Conn) Gen_Session_Id() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.run++
+	return fmt.Sprintf("client.test;1;%d", c.run)
+}
+
+func (c *Conn) ConfValue(key string) (string, bool) {
+	switch key {
+	case "origin_host":
+		return "client.test", true
+	case "origin_realm", "destination_realm":
+		return "test", true
+	}
+	return "", false
+}
+
+func (c *Conn) NextHopByHop() uint32 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.hop_by_hop++
+	return c.hop_by_hop
+}
+
+func (c *Conn) NextEndToEnd() uint32 {
+	return 1
+}
@@ -0,0 +1,563 @@
+// Package ocs is an online charging server simulator, the Gy/Ro server side
+// of Diameter Credit Control (RFC 4006).
+//
+// The subscribers have one balance each, found by the Subscription-Id-Data
+// of the CCR. The units are reserved from the balance per Rating-Group when
+// they are granted and the Used-Service-Unit is debited on the next request
+// that reports it.
+// The rules of the configuration give fixed answers (e.g. 4012 or 5030) to
+// selected requests.
+//
+//	o := ocs.New(conf)
+//	srv := conn.NewServer(conn.ServerConfig{Listen: ":3868", AuthAppIds: []uint32{d.APPID_CC}, Handler: o.Handle})
+package ocs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"strings"
+	"sync"
+)
+
+// The units of a Rating-Group, the AVP of the Granted-Service-Unit.
+const (
+	UNIT_TIME             = "time"
+	UNIT_TOTAL_OCTETS     = "total_octets"
+	UNIT_SERVICE_SPECIFIC = "service_specific"
+)
+
+// RatingGroup is the unit and the default size of a grant.
+type RatingGroup struct {
+	Unit  string `json:"unit"`
+	Grant uint64 `json:"grant"`
+}
+
+// Subscriber is a balance of the initial configuration.
+type Subscriber struct {
+	// Id is matched against the Subscription-Id-Data of the CCR.
+	Id      string `json:"id"`
+	Balance uint64 `json:"balance"`
+}
+
+// Rule answers the matching requests with ResultCode. The empty fields
+// match everything, the first matching rule is used.
+type Rule struct {
+	// SubscriptionId matches the Subscription-Id-Data, a trailing * matches
+	// a prefix.
+	SubscriptionId string `json:"subscription_id"`
+	// RequestType matches the CC-Request-Type.
+	RequestType int32 `json:"request_type"`
+	// RatingGroup limits the rule to one Multiple-Services-Credit-Control,
+	// the Result-Code goes into that MSCC and the others are charged.
+	RatingGroup *uint32 `json:"rating_group"`
+	ResultCode  uint32  `json:"result_code"`
+	// Drop sends no answer at all.
+	Drop bool `json:"drop"`
+}
+
+// Config sets up an OCS.
+type Config struct {
+	OriginHost  string `json:"origin_host"`
+	OriginRealm string `json:"origin_realm"`
+	// RatingGroups are the units of the Rating-Groups, the others use
+	// DefaultGrant (60 seconds if not set).
+	RatingGroups map[uint32]RatingGroup `json:"rating_groups"`
+	DefaultGrant RatingGroup            `json:"default_grant"`
+	// ValidityTime is added to the granted MSCCs if not zero.
+	ValidityTime uint32 `json:"validity_time"`
+	// FinalUnitAction is sent in the Final-Unit-Indication when the grant
+	// uses up the balance.
+	FinalUnitAction int32        `json:"final_unit_action"`
+	Subscribers     []Subscriber `json:"subscribers"`
+	Rules           []Rule       `json:"rules"`
+}
+
+// OCS keeps the balances and the credit control sessions.
+type OCS struct {
+	conf     Config
+	ans      app.Answerer
+	mtx      sync.Mutex
+	balances map[string]uint64
+	sessions map[string]*session
+}
+
+type session struct {
+	subscriber string
+	// reserved are the units granted and not yet reported, per Rating-Group.
+	reserved map[uint32]uint64
+}
+
+// mscc is a Multiple-Services-Credit-Control of the request, the top level
+// units make one (top) if there is none.
+type mscc struct {
+	top              bool
+	rating_group     uint32
+	has_rating_group bool
+	service_id       *d.AVP
+	requested        *d.AVP
+	used             []*d.AVP
+}
+
+// Validate checks the rules of the configuration.
+func (c Config) Validate() error {
+	for i, v := range c.Rules {
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("rules[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// validate rejects a rule that would answer with Result-Code 0.
+func (r Rule) validate() error {
+	if !r.Drop && r.ResultCode == 0 {
+		return errors.New("result_code is missing")
+	}
+	return nil
+}
+
+// New creates an OCS, the invalid rules of conf are left out, see
+// Config.Validate.
+func New(conf Config) *OCS {
+	if conf.DefaultGrant.Unit == "" {
+		conf.DefaultGrant.Unit = UNIT_TIME
+	}
+	if conf.DefaultGrant.Grant == 0 {
+		conf.DefaultGrant.Grant = 60
+	}
+	o := &OCS{
+		conf: conf,
+		ans: app.Answerer{
+			OriginHost:  conf.OriginHost,
+			OriginRealm: conf.OriginRealm,
+			Echo:        []uint32{d.AVP_CODE_CC_Request_Type, d.AVP_CODE_CC_Request_Number},
+		},
+		balances: make(map[string]uint64),
+		sessions: make(map[string]*session),
+	}
+	for _, v := range conf.Subscribers {
+		o.balances[v.Id] = v.Balance
+	}
+	o.conf.Rules = nil
+	for i, v := range conf.Rules {
+		if err := v.validate(); err != nil {
+			l.Warn.Printf("ocs: rules[%d] left out: %v", i, err)
+			continue
+		}
+		o.conf.Rules = append(o.conf.Rules, v)
+	}
+	return o
+}
+
+// SetBalance creates or updates a subscriber.
+func (o *OCS) SetBalance(id string, balance uint64) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.balances[id] = balance
+}
+
+// Balance returns the balance of a subscriber, the reserved units are not
+// included.
+func (o *OCS) Balance(id string) (uint64, bool) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	c_balance, ok := o.balances[id]
+	return c_balance, ok
+}
+
+// RemoveSubscriber deletes a subscriber, its requests get 5030.
+func (o *OCS) RemoveSubscriber(id string) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	delete(o.balances, id)
+}
+
+// SetRules replaces the rules of the configuration, the rules are kept if
+// one of the new ones is invalid.
+func (o *OCS) SetRules(rules []Rule) error {
+	if err := (Config{Rules: rules}).Validate(); err != nil {
+		return err
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.conf.Rules = rules
+	return nil
+}
+
+// Handle answers a CCR, it is a conn.RequestHandler. Other requests get
+// 3001 with the E flag.
+func (o *OCS) Handle(req d.Message) (d.Message, bool) {
+	if req.GetCmdCode() != d.CC_CREDIT_CONTROL || req.GetAppId() != d.APPID_CC {
+		l.Warn.Println("ocs: unsupported command", req.GetCmdCode(), "app", req.GetAppId())
+		return o.ans.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+	}
+	c_session_id := app.SessionId(&req)
+	c_type_avp := req.FindAVP(0, d.AVP_CODE_CC_Request_Type)
+	if c_session_id == "" || c_type_avp == nil || req.FindAVP(0, d.AVP_CODE_CC_Request_Number) == nil {
+		return o.ans.AnswerTo(req, d.MISSING_AVP), true
+	}
+	c_type := int32(c_type_avp.GetIntValue())
+	c_ids := subscriptionIds(&req)
+	c_msccs := requestMSCCs(&req)
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	c_rule := o.matchRule(c_ids, c_type, c_msccs)
+	if c_rule != nil && c_rule.Drop {
+		l.Info.Println("ocs: dropped request of session", c_session_id)
+		return d.Message{}, false
+	}
+	if c_rule != nil && c_rule.RatingGroup == nil {
+		if c_type == d.ENUM_CC_REQUEST_TERMINATION {
+			o.release(c_session_id)
+		}
+		return o.ans.AnswerTo(req, c_rule.ResultCode), true
+	}
+
+	switch c_type {
+	case d.ENUM_CC_REQUEST_INITIAL:
+		c_sub, ok := o.subscriber(c_ids)
+		if !ok {
+			return o.ans.AnswerTo(req, d.USER_UNKNOWN), true
+		}
+		o.release(c_session_id)
+		s := &session{subscriber: c_sub, reserved: make(map[uint32]uint64)}
+		o.sessions[c_session_id] = s
+		c_result, c_avps := o.charge(s, c_msccs, c_rule, false)
+		if c_result != d.SUCCESS {
+			delete(o.sessions, c_session_id)
+		}
+		return o.ans.AnswerTo(req, c_result, c_avps...), true
+	case d.ENUM_CC_REQUEST_UPDATE:
+		s, ok := o.sessions[c_session_id]
+		if !ok {
+			return o.ans.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+		}
+		c_result, c_avps := o.charge(s, c_msccs, c_rule, false)
+		return o.ans.AnswerTo(req, c_result, c_avps...), true
+	case d.ENUM_CC_REQUEST_TERMINATION:
+		s, ok := o.sessions[c_session_id]
+		if !ok {
+			return o.ans.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+		}
+		o.charge(s, c_msccs, nil, true)
+		o.release(c_session_id)
+		return o.ans.AnswerTo(req, d.SUCCESS), true
+	case d.ENUM_CC_REQUEST_EVENT:
+		c_sub, ok := o.subscriber(c_ids)
+		if !ok {
+			return o.ans.AnswerTo(req, d.USER_UNKNOWN), true
+		}
+		c_result, c_avps := o.event(&req, c_sub, c_msccs)
+		return o.ans.AnswerTo(req, c_result, c_avps...), true
+	}
+	return o.ans.AnswerTo(req, d.INVALID_AVP_VALUE,
+		d.AVP_Group(d.AVP_CODE_Failed_AVP, []d.AVP{*c_type_avp}, d.MAND, 0),
+	), true
+}
+
+// charge debits the used units of the MSCCs and reserves new ones for the
+// MSCCs with Requested-Service-Unit. It returns the Result-Code and the
+// AVPs of the answer.
+func (o *OCS) charge(s *session, msccs []mscc, rule *Rule, final bool) (uint32, []d.AVP) {
+	var c_avps []d.AVP
+	c_granted := 0
+	var c_denied []uint32
+	for _, m := range msccs {
+		c_conf := o.ratingGroup(m.rating_group)
+		// without Used-Service-Unit the reservation stays, the units may
+		// still be in use
+		if len(m.used) > 0 {
+			o.debit(s, m.rating_group, units(c_conf.Unit, m.used...))
+		}
+		if final || (m.requested == nil && !m.top) {
+			continue
+		}
+
+		c_ans := m.answerHead()
+		if rule != nil && rule.RatingGroup != nil && *rule.RatingGroup == m.rating_group {
+			c_denied = append(c_denied, rule.ResultCode)
+			c_ans = append(c_ans, d.AVP_Unsigned32(d.AVP_CODE_Result_Code, rule.ResultCode, d.MAND, 0))
+			c_avps = append(c_avps, m.answer(c_ans)...)
+			continue
+		}
+		c_balance := o.balances[s.subscriber]
+		if c_balance == 0 {
+			c_denied = append(c_denied, d.CREDIT_LIMIT_REACHED)
+			c_ans = append(c_ans, d.AVP_Unsigned32(d.AVP_CODE_Result_Code, d.CREDIT_LIMIT_REACHED, d.MAND, 0))
+			c_avps = append(c_avps, m.answer(c_ans)...)
+			continue
+		}
+
+		c_want := c_conf.Grant
+		if c_req := units(c_conf.Unit, m.requested); c_req > 0 {
+			c_want = c_req
+		}
+		c_final := c_want >= c_balance
+		if c_final {
+			c_want = c_balance
+		}
+		o.balances[s.subscriber] = c_balance - c_want
+		s.reserved[m.rating_group] += c_want
+		c_granted++
+
+		c_ans = append(c_ans, grantedUnits(c_conf.Unit, c_want))
+		c_ans = append(c_ans, d.AVP_Unsigned32(d.AVP_CODE_Result_Code, d.SUCCESS, d.MAND, 0))
+		if o.conf.ValidityTime != 0 {
+			c_ans = append(c_ans, d.AVP_Unsigned32(d.AVP_CODE_Validity_Time, o.conf.ValidityTime, d.MAND, 0))
+		}
+		if c_final {
+			c_ans = append(c_ans, d.AVP_Group(d.AVP_CODE_Final_Unit_Indication, []d.AVP{
+				d.AVP_Enumerated(d.AVP_CODE_Final_Unit_Action, o.conf.FinalUnitAction, d.MAND, 0),
+			}, d.MAND, 0))
+		}
+		c_avps = append(c_avps, m.answer(c_ans)...)
+	}
+	// the command fails only if no service got units
+	if c_granted == 0 && len(c_denied) > 0 {
+		return c_denied[0], c_avps
+	}
+	return d.SUCCESS, c_avps
+}
+
+// event handles a CCR-E by its Requested-Action, the units are debited at
+// once.
+func (o *OCS) event(req *d.Message, c_sub string, msccs []mscc) (uint32, []d.AVP) {
+	c_action := int32(d.ENUM_REQUESTED_ACTION_DIRECT_DEBITING)
+	if c_avp := req.FindAVP(0, d.AVP_CODE_Requested_Action); c_avp != nil {
+		c_action = int32(c_avp.GetIntValue())
+	}
+
+	var c_total uint64
+	c_wants := make([]uint64, len(msccs))
+	for i, m := range msccs {
+		c_conf := o.ratingGroup(m.rating_group)
+		c_wants[i] = c_conf.Grant
+		if c_req := units(c_conf.Unit, m.requested); c_req > 0 {
+			c_wants[i] = c_req
+		}
+		c_total += c_wants[i]
+	}
+	c_balance := o.balances[c_sub]
+
+	switch c_action {
+	case d.ENUM_REQUESTED_ACTION_DIRECT_DEBITING:
+		if c_total > c_balance {
+			return d.CREDIT_LIMIT_REACHED, nil
+		}
+		o.balances[c_sub] = c_balance - c_total
+		var c_avps []d.AVP
+		for i, m := range msccs {
+			c_ans := m.answerHead()
+			c_ans = append(c_ans, grantedUnits(o.ratingGroup(m.rating_group).Unit, c_wants[i]))
+			c_ans = append(c_ans, d.AVP_Unsigned32(d.AVP_CODE_Result_Code, d.SUCCESS, d.MAND, 0))
+			c_avps = append(c_avps, m.answer(c_ans)...)
+		}
+		return d.SUCCESS, c_avps
+	case d.ENUM_REQUESTED_ACTION_REFUND_ACCOUNT:
+		o.balances[c_sub] = c_balance + c_total
+		return d.SUCCESS, nil
+	case d.ENUM_REQUESTED_ACTION_CHECK_BALANCE:
+		c_result := int32(d.ENUM_CHECK_BALANCE_ENOUGH_CREDIT)
+		if c_balance == 0 || c_total > c_balance {
+			c_result = d.ENUM_CHECK_BALANCE_NO_CREDIT
+		}
+		return d.SUCCESS, []d.AVP{d.AVP_Enumerated(d.AVP_CODE_Check_Balance_Result, c_result, d.MAND, 0)}
+	}
+	// PRICE_ENQUIRY has no tariffs to answer with
+	return d.UNABLE_TO_COMPLY, nil
+}
+
+// debit takes the used units from the reservation of the Rating-Group, the
+// rest of the reservation goes back to the balance.
+func (o *OCS) debit(s *session, c_rg uint32, used uint64) {
+	c_reserved, ok := s.reserved[c_rg]
+	if !ok && used == 0 {
+		return
+	}
+	delete(s.reserved, c_rg)
+	c_balance := o.balances[s.subscriber] + c_reserved
+	if used > c_balance {
+		l.Warn.Printf("ocs: subscriber %s used %d, only %d left", s.subscriber, used, c_balance)
+		used = c_balance
+	}
+	o.balances[s.subscriber] = c_balance - used
+}
+
+// release ends a session, the reserved units go back to the balance.
+func (o *OCS) release(c_session_id string) {
+	s, ok := o.sessions[c_session_id]
+	if !ok {
+		return
+	}
+	for c_rg := range s.reserved {
+		o.debit(s, c_rg, 0)
+	}
+	delete(o.sessions, c_session_id)
+}
+
+func (o *OCS) subscriber(ids []string) (string, bool) {
+	for _, v := range ids {
+		if _, ok := o.balances[v]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (o *OCS) ratingGroup(c_rg uint32) RatingGroup {
+	if c_conf, ok := o.conf.RatingGroups[c_rg]; ok {
+		if c_conf.Unit == "" {
+			c_conf.Unit = o.conf.DefaultGrant.Unit
+		}
+		if c_conf.Grant == 0 {
+			c_conf.Grant = o.conf.DefaultGrant.Grant
+		}
+		return c_conf
+	}
+	return o.conf.DefaultGrant
+}
+
+func (o *OCS) matchRule(ids []string, c_type int32, msccs []mscc) *Rule {
+	for i := range o.conf.Rules {
+		r := &o.conf.Rules[i]
+		if r.RequestType != 0 && r.RequestType != c_type {
+			continue
+		}
+		if r.SubscriptionId != "" && !matchId(r.SubscriptionId, ids) {
+			continue
+		}
+		if r.RatingGroup != nil && !hasRatingGroup(msccs, *r.RatingGroup) {
+			continue
+		}
+		return r
+	}
+	return nil
+}
+
+func matchId(pattern string, ids []string) bool {
+	for _, v := range ids {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(v, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if v == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRatingGroup(msccs []mscc, c_rg uint32) bool {
+	for _, m := range msccs {
+		if m.rating_group == c_rg && m.requested != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// answerHead are the AVPs identifying the service in the answer MSCC.
+func (m mscc) answerHead() []d.AVP {
+	var ret []d.AVP
+	if m.service_id != nil {
+		ret = append(ret, *m.service_id)
+	}
+	if m.has_rating_group {
+		ret = append(ret, d.AVP_Unsigned32(d.AVP_CODE_Rating_Group, m.rating_group, d.MAND, 0))
+	}
+	return ret
+}
+
+// answer wraps the AVPs into an MSCC. Without MSCC in the request they go
+// to the top level, the Result-Code of the command is used instead.
+func (m mscc) answer(avps []d.AVP) []d.AVP {
+	if !m.top {
+		return []d.AVP{d.AVP_Group(d.AVP_CODE_Multiple_Services_Credit_Control, avps, d.MAND, 0)}
+	}
+	var ret []d.AVP
+	for _, v := range avps {
+		if v.GetAVPCode() != d.AVP_CODE_Result_Code {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func requestMSCCs(req *d.Message) []mscc {
+	var ret []mscc
+	for _, c_avp := range req.FindAVPs(0, d.AVP_CODE_Multiple_Services_Credit_Control) {
+		m := mscc{
+			service_id: c_avp.FindAVP(0, d.AVP_CODE_Service_Identifier),
+			requested:  c_avp.FindAVP(0, d.AVP_CODE_Requested_Service_Unit),
+		}
+		if c_rg := c_avp.FindAVP(0, d.AVP_CODE_Rating_Group); c_rg != nil {
+			m.rating_group = uint32(c_rg.GetIntValue())
+			m.has_rating_group = true
+		}
+		for _, v := range c_avp.GetGroupAVPs() {
+			if v.GetAVPCode() == d.AVP_CODE_Used_Service_Unit && v.GetVendorId() == 0 {
+				c_used := v
+				m.used = append(m.used, &c_used)
+			}
+		}
+		ret = append(ret, m)
+	}
+	if len(ret) != 0 {
+		return ret
+	}
+	return []mscc{{
+		top:       true,
+		requested: req.FindAVP(0, d.AVP_CODE_Requested_Service_Unit),
+		used:      req.FindAVPs(0, d.AVP_CODE_Used_Service_Unit),
+	}}
+}
+
+func subscriptionIds(req *d.Message) []string {
+	var ret []string
+	for _, c_avp := range req.FindAVPs(0, d.AVP_CODE_Subscription_Id) {
+		if c_data := c_avp.FindAVP(0, d.AVP_CODE_Subscription_Id_Data); c_data != nil {
+			ret = append(ret, c_data.GetStringValue())
+		}
+	}
+	return ret
+}
+
+// units sums the unit AVPs of the Service-Unit AVPs.
+func units(c_unit string, avps ...*d.AVP) uint64 {
+	c_code := unitCode(c_unit)
+	var ret uint64
+	for _, v := range avps {
+		if v == nil {
+			continue
+		}
+		if c_val := v.FindAVP(0, c_code); c_val != nil && c_val.GetIntValue() > 0 {
+			ret += uint64(c_val.GetIntValue())
+		}
+	}
+	return ret
+}
+
+func unitCode(c_unit string) uint32 {
+	switch c_unit {
+	case UNIT_TOTAL_OCTETS:
+		return d.AVP_CODE_CC_Total_Octets
+	case UNIT_SERVICE_SPECIFIC:
+		return d.AVP_CODE_CC_Service_Specific_Units
+	}
+	return d.AVP_CODE_CC_Time
+}
+
+func grantedUnits(c_unit string, value uint64) d.AVP {
+	var c_val d.AVP
+	if c_unit == UNIT_TOTAL_OCTETS || c_unit == UNIT_SERVICE_SPECIFIC {
+		c_val = d.AVP_Unsigned64(unitCode(c_unit), value, d.MAND, 0)
+	} else {
+		c_val = d.AVP_Unsigned32(d.AVP_CODE_CC_Time, uint32(value), d.MAND, 0)
+	}
+	return d.AVP_Group(d.AVP_CODE_Granted_Service_Unit, []d.AVP{c_val}, d.MAND, 0)
+}
@@ -0,0 +1,228 @@
+package ocs
+
+import (
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"testing"
+)
+
+const test_sub = "36201234567"
+
+func testOCS(balance uint64) *OCS {
+	return New(Config{
+		OriginHost:   "ocs.test",
+		OriginRealm:  "test",
+		RatingGroups: map[uint32]RatingGroup{1: {Unit: UNIT_TIME, Grant: 30}, 2: {Unit: UNIT_TOTAL_OCTETS, Grant: 1000}},
+		Subscribers:  []Subscriber{{Id: test_sub, Balance: balance}},
+	})
+}
+
+// ccr creates a CCR of test_sub with the MSCCs.
+func ccr(session_id string, c_type int32, c_number uint32, msccs ...d.AVP) d.Message {
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, session_id, d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_CC_Request_Type, c_type, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_CC_Request_Number, c_number, d.MAND, 0),
+		d.AVP_Group(d.AVP_CODE_Subscription_Id, []d.AVP{
+			d.AVP_Enumerated(d.AVP_CODE_Subscription_Id_Type, 0, d.MAND, 0),
+			d.AVP_UTF8String(d.AVP_CODE_Subscription_Id_Data, test_sub, d.MAND, 0),
+		}, d.MAND, 0),
+	}
+	c_avps = append(c_avps, msccs...)
+	return d.GenMess(d.CC_CREDIT_CONTROL, true, true, d.APPID_CC, 7, 8, c_avps)
+}
+
+// testMSCC creates the MSCC of the Rating-Group c_rg asking for units if
+// requested, reporting used seconds if not zero.
+func testMSCC(c_rg uint32, requested bool, used uint32) d.AVP {
+	c_avps := []d.AVP{d.AVP_Unsigned32(d.AVP_CODE_Rating_Group, c_rg, d.MAND, 0)}
+	if requested {
+		c_avps = append(c_avps, d.AVP_Group(d.AVP_CODE_Requested_Service_Unit, nil, d.MAND, 0))
+	}
+	if used != 0 {
+		c_avps = append(c_avps, d.AVP_Group(d.AVP_CODE_Used_Service_Unit, []d.AVP{
+			d.AVP_Unsigned32(d.AVP_CODE_CC_Time, used, d.MAND, 0),
+		}, d.MAND, 0))
+	}
+	return d.AVP_Group(d.AVP_CODE_Multiple_Services_Credit_Control, c_avps, d.MAND, 0)
+}
+
+func handle(t *testing.T, o *OCS, req d.Message) d.Message {
+	t.Helper()
+	ans, ok := o.Handle(req)
+	if !ok {
+		t.Fatal("no answer")
+	}
+	if ans.Get_hop_by_hop() != req.Get_hop_by_hop() || ans.IsRequest() {
+		t.Errorf("not the answer of the request")
+	}
+	return ans
+}
+
+// msccResult returns the Result-Code, the granted seconds and the
+// Final-Unit-Indication of the MSCC of c_rg.
+func msccResult(ans d.Message, c_rg uint32) (uint32, int, *d.AVP) {
+	for _, v := range ans.FindAVPs(0, d.AVP_CODE_Multiple_Services_Credit_Control) {
+		if c_avp := v.FindAVP(0, d.AVP_CODE_Rating_Group); c_avp == nil || uint32(c_avp.GetIntValue()) != c_rg {
+			continue
+		}
+		c_granted := -1
+		if c_gsu := v.FindAVP(0, d.AVP_CODE_Granted_Service_Unit); c_gsu != nil {
+			if c_time := c_gsu.FindAVP(0, d.AVP_CODE_CC_Time); c_time != nil {
+				c_granted = c_time.GetIntValue()
+			}
+		}
+		return uint32(v.FindAVP(0, d.AVP_CODE_Result_Code).GetIntValue()), c_granted, v.FindAVP(0, d.AVP_CODE_Final_Unit_Indication)
+	}
+	return 0, -1, nil
+}
+
+func checkBalance(t *testing.T, o *OCS, want uint64) {
+	t.Helper()
+	if got, _ := o.Balance(test_sub); got != want {
+		t.Errorf("balance %d, want %d", got, want)
+	}
+}
+
+// TestDebit reserves the granted units and debits the used ones, the rest
+// of the reservation goes back to the balance.
+func TestDebit(t *testing.T) {
+	o := testOCS(100)
+	ans := handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)))
+	if c_result, c_granted, _ := msccResult(ans, 1); c_result != d.SUCCESS || c_granted != 30 {
+		t.Errorf("CCR-I: %d granted %d", c_result, c_granted)
+	}
+	if c_type := ans.FindAVP(0, d.AVP_CODE_CC_Request_Type); c_type == nil || c_type.GetIntValue() != d.ENUM_CC_REQUEST_INITIAL {
+		t.Error("CC-Request-Type not in the answer")
+	}
+	checkBalance(t, o, 70)
+
+	handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_UPDATE, 1, testMSCC(1, true, 10)))
+	checkBalance(t, o, 60)
+
+	ans = handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_TERMINATION, 2, testMSCC(1, false, 20)))
+	if c_result := app.ResultCode(&ans); c_result != d.SUCCESS {
+		t.Errorf("CCR-T: %d", c_result)
+	}
+	checkBalance(t, o, 70)
+
+	ans = handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_UPDATE, 3, testMSCC(1, true, 0)))
+	if c_result := app.ResultCode(&ans); c_result != d.UNKNOWN_SESSION_ID {
+		t.Errorf("CCR-U of the terminated session: %d", c_result)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	o := testOCS(100)
+	handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)))
+	// a new CCR-I of the session replaces the reservation
+	handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)))
+	checkBalance(t, o, 70)
+	handle(t, o, ccr("s2", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)))
+	checkBalance(t, o, 40)
+
+	// an update without Used-Service-Unit keeps the reservation
+	handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_UPDATE, 1, testMSCC(1, false, 0)))
+	checkBalance(t, o, 40)
+
+	handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_TERMINATION, 2))
+	handle(t, o, ccr("s2", d.ENUM_CC_REQUEST_TERMINATION, 1))
+	checkBalance(t, o, 100)
+}
+
+// TestFinalUnit grants the rest of the balance with a Final-Unit-Indication,
+// the next request gets CREDIT_LIMIT_REACHED.
+func TestFinalUnit(t *testing.T) {
+	o := testOCS(20)
+	ans := handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)))
+	c_result, c_granted, c_fui := msccResult(ans, 1)
+	if c_result != d.SUCCESS || c_granted != 20 {
+		t.Errorf("CCR-I: %d granted %d", c_result, c_granted)
+	}
+	if c_fui == nil {
+		t.Fatal("no Final-Unit-Indication")
+	}
+	if c_action := c_fui.FindAVP(0, d.AVP_CODE_Final_Unit_Action); c_action == nil || c_action.GetIntValue() != d.ENUM_FUA_TERMINATE {
+		t.Errorf("Final-Unit-Action %v", c_action)
+	}
+
+	ans = handle(t, o, ccr("s1", d.ENUM_CC_REQUEST_UPDATE, 1, testMSCC(1, true, 20)))
+	if c_result := app.ResultCode(&ans); c_result != d.CREDIT_LIMIT_REACHED {
+		t.Errorf("CCR-U: %d", c_result)
+	}
+	if c_result, _, _ := msccResult(ans, 1); c_result != d.CREDIT_LIMIT_REACHED {
+		t.Errorf("CCR-U MSCC: %d", c_result)
+	}
+	checkBalance(t, o, 0)
+}
+
+func TestRules(t *testing.T) {
+	c_rg2 := uint32(2)
+	for _, c := range []struct {
+		name string
+		rule Rule
+		req  d.Message
+		// want is the Result-Code of the command, 0 if not answered
+		want uint32
+		// want_rg are the Result-Codes of the MSCCs
+		want_rg map[uint32]uint32
+	}{
+		{"prefix", Rule{SubscriptionId: "3620*", ResultCode: d.END_USER_SERVICE_DENIED},
+			ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)), d.END_USER_SERVICE_DENIED, nil},
+		{"other subscriber", Rule{SubscriptionId: "3630*", ResultCode: d.END_USER_SERVICE_DENIED},
+			ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)), d.SUCCESS, nil},
+		{"request type", Rule{RequestType: d.ENUM_CC_REQUEST_UPDATE, ResultCode: d.RATING_FAILED},
+			ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)), d.SUCCESS, nil},
+		{"rating group", Rule{RatingGroup: &c_rg2, ResultCode: d.RATING_FAILED},
+			ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0), testMSCC(2, true, 0)), d.SUCCESS,
+			map[uint32]uint32{1: d.SUCCESS, 2: d.RATING_FAILED}},
+		{"protocol error", Rule{ResultCode: d.TOO_BUSY},
+			ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)), d.TOO_BUSY, nil},
+		{"drop", Rule{Drop: true}, ccr("s1", d.ENUM_CC_REQUEST_INITIAL, 0, testMSCC(1, true, 0)), 0, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			o := testOCS(100)
+			if err := o.SetRules([]Rule{c.rule}); err != nil {
+				t.Fatal(err)
+			}
+			ans, ok := o.Handle(c.req)
+			if !ok {
+				if c.want != 0 {
+					t.Fatal("no answer")
+				}
+				return
+			}
+			if c.want == 0 {
+				t.Fatal("answer to a dropped request")
+			}
+			if c_result := app.ResultCode(&ans); c_result != c.want {
+				t.Errorf("Result-Code %d, want %d", c_result, c.want)
+			}
+			if c_error := ans.GetCmdFlags()&0b00100000 != 0; c_error != (c.want/1000 == 3) {
+				t.Errorf("E flag %v", c_error)
+			}
+			for c_rg, want := range c.want_rg {
+				if c_result, _, _ := msccResult(ans, c_rg); c_result != want {
+					t.Errorf("Rating-Group %d: %d, want %d", c_rg, c_result, want)
+				}
+			}
+		})
+	}
+
+	if err := testOCS(100).SetRules([]Rule{{SubscriptionId: "1*"}}); err == nil {
+		t.Error("rule without result_code accepted")
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	o := testOCS(100)
+	ans := handle(t, o, d.GenMess(d.CC_RE_AUTH, true, true, d.APPID_CC, 7, 8, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "s1", d.MAND, 0),
+	}))
+	if c_result := app.ResultCode(&ans); c_result != d.COMMAND_UNSUPPORTED || ans.GetCmdFlags()&0b00100000 == 0 {
+		t.Errorf("Result-Code %d flags 0x%x, want 3001 with the E flag", c_result, ans.GetCmdFlags())
+	}
+	if app.SessionId(&ans) != "s1" {
+		t.Error("Session-Id not in the answer")
+	}
+}
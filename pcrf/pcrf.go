@@ -0,0 +1,534 @@
+// Package pcrf is a PCRF simulator, the server side of Gx (3GPP TS 29.212)
+// and a stub of Rx (3GPP TS 29.214).
+//
+// The CCR-I of a subscriber is answered with the rule set of the
+// configuration selected by the Subscription-Id-Data: PCC rules, event
+// triggers and the QoS of the default bearer. A reported event trigger may
+// switch the session to another rule set, and the rule sets can be pushed
+// with RAR at any time.
+//
+// The AAR of an AF is bound to the Gx session of its Framed-IP-Address and
+// every media component becomes a dynamic rule pushed to the PCEF, so a
+// VoLTE call gets its dedicated bearer; see rx.go.
+//
+//	p := pcrf.New(conf)
+//	srv := conn.NewServer(conn.ServerConfig{Listen: ":3868", AuthAppIds: []uint32{d.APPID_GX, d.APPID_RX}, Handler: p.Handle, AnswerHandler: p.HandleAnswer})
+//	p.SetSender(srv)
+//	p.PushRuleSet(session_id, "throttled")
+package pcrf
+
+import (
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ChargingRule is a dynamic PCC rule, sent as Charging-Rule-Definition.
+type ChargingRule struct {
+	Name              string  `json:"name"`
+	ServiceIdentifier *uint32 `json:"service_identifier,omitempty"`
+	RatingGroup       *uint32 `json:"rating_group,omitempty"`
+	// Flows are the Flow-Descriptions (IPFilterRule), e.g.
+	// "permit out ip from any to assigned".
+	Flows []string `json:"flows,omitempty"`
+	// FlowStatus is ENABLED (2) if not set.
+	FlowStatus *int32 `json:"flow_status,omitempty"`
+	// QCI, MBRUL, MBRDL, GBRUL and GBRDL give the QoS-Information of the
+	// rule if QCI is not zero.
+	QCI           int32  `json:"qci,omitempty"`
+	MBRUL         uint32 `json:"mbr_ul,omitempty"`
+	MBRDL         uint32 `json:"mbr_dl,omitempty"`
+	GBRUL         uint32 `json:"gbr_ul,omitempty"`
+	GBRDL         uint32 `json:"gbr_dl,omitempty"`
+	Online        *int32 `json:"online,omitempty"`
+	Offline       *int32 `json:"offline,omitempty"`
+	Precedence    uint32 `json:"precedence,omitempty"`
+	MonitoringKey string `json:"monitoring_key,omitempty"`
+}
+
+// QoS is the QoS of the default bearer and the APN-AMBR of the session.
+type QoS struct {
+	QCI           int32  `json:"qci"`
+	PriorityLevel uint32 `json:"priority_level"`
+	AMBRUL        uint32 `json:"apn_ambr_ul"`
+	AMBRDL        uint32 `json:"apn_ambr_dl"`
+}
+
+// RuleSet is the policy of a session.
+type RuleSet struct {
+	// ResultCode rejects the CCR-I with this code if not zero or 2001.
+	ResultCode uint32         `json:"result_code,omitempty"`
+	Rules      []ChargingRule `json:"rules,omitempty"`
+	// Predefined are Charging-Rule-Names of rules defined in the PCEF.
+	Predefined []string `json:"predefined,omitempty"`
+	BaseNames  []string `json:"base_names,omitempty"`
+	// EventTriggers are armed in the PCEF.
+	EventTriggers []int32 `json:"event_triggers,omitempty"`
+	QoS           *QoS    `json:"qos,omitempty"`
+}
+
+// Subscriber selects the rule set of a Subscription-Id-Data, a trailing *
+// matches a prefix.
+type Subscriber struct {
+	Id      string `json:"id"`
+	RuleSet string `json:"rule_set"`
+}
+
+// Config sets up a PCRF.
+type Config struct {
+	OriginHost  string             `json:"origin_host"`
+	OriginRealm string             `json:"origin_realm"`
+	RuleSets    map[string]RuleSet `json:"rule_sets"`
+	// Subscribers are checked in order, the first match wins.
+	Subscribers []Subscriber `json:"subscribers"`
+	// DefaultRuleSet is used for the unknown subscribers, they get 5030
+	// if it is empty.
+	DefaultRuleSet string `json:"default_rule_set"`
+	// OnTrigger switches the session to a rule set when the PCEF reports
+	// the Event-Trigger.
+	OnTrigger map[int32]string `json:"on_trigger"`
+}
+
+// Sender sends a request to a connected PCEF, conn.Server implements it.
+type Sender interface {
+	SendTo(host string, msg d.Message) error
+}
+
+// PCRF keeps the Gx sessions and their rule sets, and the Rx sessions
+// bound to them.
+type PCRF struct {
+	conf        Config
+	mtx         sync.Mutex
+	sessions    map[string]*session
+	rx_sessions map[string]*rxSession
+	rx_next     int
+	sender      Sender
+	ans         app.Answerer
+}
+
+type session struct {
+	// host and realm are the origin of the PCEF, the destination of RARs.
+	host       string
+	realm      string
+	subscriber string
+	rule_set   string
+	// ue_ip is the Framed-IP-Address of the CCR-I, the Rx sessions are
+	// bound with it.
+	ue_ip string
+	// pushed are the rule sets of the RARs waiting for their RAA in order,
+	// "" for a RAR that does not switch the rule set.
+	pushed []string
+}
+
+func New(conf Config) *PCRF {
+	return &PCRF{
+		conf:        conf,
+		sessions:    make(map[string]*session),
+		rx_sessions: make(map[string]*rxSession),
+		ans: app.Answerer{
+			OriginHost:  conf.OriginHost,
+			OriginRealm: conf.OriginRealm,
+			Echo:        []uint32{d.AVP_CODE_CC_Request_Type, d.AVP_CODE_CC_Request_Number},
+		},
+	}
+}
+
+// SetSender sets where the RARs are sent.
+func (p *PCRF) SetSender(sender Sender) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.sender = sender
+}
+
+// Sessions returns the Session-Ids of the open sessions.
+func (p *PCRF) Sessions() []string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	var ret []string
+	for k := range p.sessions {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// RuleSet returns the rule set of an open session.
+func (p *PCRF) RuleSet(session_id string) (string, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	s, ok := p.sessions[session_id]
+	if !ok {
+		return "", false
+	}
+	return s.rule_set, true
+}
+
+// Handle answers a Gx CCR and the Rx AARs and STRs, it is a
+// conn.RequestHandler. Other requests get 3001 with the E flag.
+func (p *PCRF) Handle(req d.Message) (d.Message, bool) {
+	if req.GetAppId() == d.APPID_RX {
+		return p.handleRx(req)
+	}
+	if req.GetCmdCode() != d.CC_CREDIT_CONTROL || req.GetAppId() != d.APPID_GX {
+		l.Warn.Println("pcrf: unsupported command", req.GetCmdCode(), "app", req.GetAppId())
+		return p.ans.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+	}
+	c_session_id := app.SessionId(&req)
+	c_type_avp := req.FindAVP(0, d.AVP_CODE_CC_Request_Type)
+	if c_session_id == "" || c_type_avp == nil {
+		return p.ans.AnswerTo(req, d.MISSING_AVP), true
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	switch int32(c_type_avp.GetIntValue()) {
+	case d.ENUM_CC_REQUEST_INITIAL:
+		c_sub, c_set_name, ok := p.ruleSetOf(subscriptionIds(&req))
+		if !ok {
+			return p.ans.AnswerTo(req, d.USER_UNKNOWN), true
+		}
+		c_set := p.conf.RuleSets[c_set_name]
+		if c_set.ResultCode != 0 && c_set.ResultCode != d.SUCCESS {
+			return p.ans.AnswerTo(req, c_set.ResultCode), true
+		}
+		p.sessions[c_session_id] = &session{
+			host:       app.StringValue(&req, d.AVP_CODE_Origin_Host),
+			realm:      app.StringValue(&req, d.AVP_CODE_Origin_Realm),
+			subscriber: c_sub,
+			rule_set:   c_set_name,
+			ue_ip:      ipValue(req.FindAVP(0, d.AVP_CODE_Framed_IP_Address)),
+		}
+		l.Info.Println("pcrf: session", c_session_id, "of", c_sub, "rule set", c_set_name)
+		return p.ans.AnswerTo(req, d.SUCCESS, policyAVPs(nil, c_set)...), true
+	case d.ENUM_CC_REQUEST_UPDATE:
+		s, ok := p.sessions[c_session_id]
+		if !ok {
+			return p.ans.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+		}
+		p.ruleReports(c_session_id, &req)
+		for _, v := range req.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Event_Trigger) {
+			c_to, ok := p.conf.OnTrigger[int32(v.GetIntValue())]
+			if !ok || c_to == s.rule_set {
+				continue
+			}
+			c_from := p.conf.RuleSets[s.rule_set]
+			s.rule_set = c_to
+			l.Info.Println("pcrf: session", c_session_id, "Event-Trigger", v.GetIntValue(), "rule set", c_to)
+			return p.ans.AnswerTo(req, d.SUCCESS, policyAVPs(&c_from, p.conf.RuleSets[c_to])...), true
+		}
+		return p.ans.AnswerTo(req, d.SUCCESS), true
+	case d.ENUM_CC_REQUEST_TERMINATION:
+		if _, ok := p.sessions[c_session_id]; !ok {
+			return p.ans.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+		}
+		delete(p.sessions, c_session_id)
+		p.unbind(c_session_id)
+		return p.ans.AnswerTo(req, d.SUCCESS), true
+	}
+	return p.ans.AnswerTo(req, d.INVALID_AVP_VALUE,
+		d.AVP_Group(d.AVP_CODE_Failed_AVP, []d.AVP{*c_type_avp}, d.MAND, 0),
+	), true
+}
+
+// PushRuleSet switches a session to another rule set with a RAR, the rules
+// of the old set that are not in the new one are removed. The session has
+// the new rule set once the RAA is successful.
+func (p *PCRF) PushRuleSet(session_id string, rule_set string) error {
+	p.mtx.Lock()
+	s, ok := p.sessions[session_id]
+	c_to, c_known := p.conf.RuleSets[rule_set]
+	if !ok || !c_known {
+		p.mtx.Unlock()
+		if !ok {
+			return fmt.Errorf("pcrf: unknown session %s", session_id)
+		}
+		return fmt.Errorf("pcrf: unknown rule set %s", rule_set)
+	}
+	c_from := p.conf.RuleSets[s.rule_set]
+	p.mtx.Unlock()
+	return p.pushRAR(session_id, rule_set, policyAVPs(&c_from, c_to))
+}
+
+// Release asks the PCEF with a RAR to terminate the session, cause is a
+// Session-Release-Cause.
+func (p *PCRF) Release(session_id string, cause int32) error {
+	return p.PushRAR(session_id, []d.AVP{
+		d.AVP_Enumerated(d.AVP_CODE_Session_Release_Cause, cause, d.MAND, d.VENDOR_3GPP),
+	})
+}
+
+// PushRAR sends a RAR with avps to the PCEF of the session.
+func (p *PCRF) PushRAR(session_id string, avps []d.AVP) error {
+	return p.pushRAR(session_id, "", avps)
+}
+
+// pushRAR sends a RAR that switches the session to rule_set, if not empty,
+// when its RAA arrives.
+func (p *PCRF) pushRAR(session_id string, rule_set string, avps []d.AVP) error {
+	p.mtx.Lock()
+	s, ok := p.sessions[session_id]
+	if ok {
+		s.pushed = append(s.pushed, rule_set)
+	}
+	p.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("pcrf: unknown session %s", session_id)
+	}
+	c_avps := []d.AVP{d.AVP_Enumerated(d.AVP_CODE_Re_Auth_Request_Type, d.ENUM_RE_AUTH_AUTHORIZE_ONLY, d.MAND, 0)}
+	err := p.sendRequest(d.CC_RE_AUTH, d.APPID_GX, session_id, s.host, s.realm, append(c_avps, avps...))
+	if err != nil {
+		// no RAA will come for it
+		p.mtx.Lock()
+		for i := len(s.pushed) - 1; i >= 0; i-- {
+			if s.pushed[i] == rule_set {
+				s.pushed = append(s.pushed[:i], s.pushed[i+1:]...)
+				break
+			}
+		}
+		p.mtx.Unlock()
+	}
+	return err
+}
+
+// ruleSetAnswered takes the rule set of the oldest RAR of the session
+// waiting for its RAA and switches the session to it if c_result is a
+// success. It is called with the lock held.
+func (p *PCRF) ruleSetAnswered(session_id string, c_result uint32) {
+	s, ok := p.sessions[session_id]
+	if !ok || len(s.pushed) == 0 {
+		return
+	}
+	c_set := s.pushed[0]
+	s.pushed = s.pushed[1:]
+	if c_set == "" {
+		return
+	}
+	if c_result < 2000 || c_result >= 3000 {
+		l.Warn.Println("pcrf: session", session_id, "keeps rule set", s.rule_set, "RAA Result-Code", c_result)
+		return
+	}
+	s.rule_set = c_set
+	l.Info.Println("pcrf: session", session_id, "rule set", c_set)
+}
+
+// sendRequest sends a request of the session to the peer host.
+func (p *PCRF) sendRequest(cmd_code uint32, app_id uint32, session_id string, host string, realm string, avps []d.AVP) error {
+	p.mtx.Lock()
+	c_sender := p.sender
+	p.mtx.Unlock()
+	if c_sender == nil {
+		return fmt.Errorf("pcrf: no sender for the request %d of %s", cmd_code, session_id)
+	}
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, session_id, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, app_id, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, p.conf.OriginHost, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, p.conf.OriginRealm, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Destination_Realm, realm, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Destination_Host, host, d.MAND, 0),
+	}
+	c_avps = append(c_avps, avps...)
+	return c_sender.SendTo(host, d.GenMess(cmd_code, true, true, app_id, 0, 0, c_avps))
+}
+
+// ruleSetOf finds the subscriber and its rule set.
+func (p *PCRF) ruleSetOf(ids []string) (string, string, bool) {
+	for _, c_sub := range p.conf.Subscribers {
+		for _, v := range ids {
+			if matchId(c_sub.Id, v) {
+				return v, c_sub.RuleSet, true
+			}
+		}
+	}
+	if p.conf.DefaultRuleSet == "" {
+		return "", "", false
+	}
+	c_sub := ""
+	if len(ids) != 0 {
+		c_sub = ids[0]
+	}
+	return c_sub, p.conf.DefaultRuleSet, true
+}
+
+// policyAVPs installs the rule set to, after removing the rules of from
+// that to does not have.
+func policyAVPs(from *RuleSet, to RuleSet) []d.AVP {
+	var ret []d.AVP
+	if from != nil {
+		var c_remove []d.AVP
+		for _, v := range from.Rules {
+			if !to.hasRule(v.Name) {
+				c_remove = append(c_remove, ruleName(v.Name))
+			}
+		}
+		for _, v := range from.Predefined {
+			if !to.hasRule(v) {
+				c_remove = append(c_remove, ruleName(v))
+			}
+		}
+		for _, v := range from.BaseNames {
+			if !contains(to.BaseNames, v) {
+				c_remove = append(c_remove, baseName(v))
+			}
+		}
+		if len(c_remove) != 0 {
+			ret = append(ret, d.AVP_Group(d.AVP_CODE_Charging_Rule_Remove, c_remove, d.MAND, d.VENDOR_3GPP))
+		}
+	}
+
+	var c_install []d.AVP
+	for _, v := range to.Rules {
+		c_install = append(c_install, v.definition())
+	}
+	for _, v := range to.Predefined {
+		c_install = append(c_install, ruleName(v))
+	}
+	for _, v := range to.BaseNames {
+		c_install = append(c_install, baseName(v))
+	}
+	if len(c_install) != 0 {
+		ret = append(ret, d.AVP_Group(d.AVP_CODE_Charging_Rule_Install, c_install, d.MAND, d.VENDOR_3GPP))
+	}
+
+	c_triggers := to.EventTriggers
+	if len(c_triggers) == 0 && from != nil && len(from.EventTriggers) != 0 {
+		c_triggers = []int32{d.ENUM_EVENT_TRIGGER_NO_EVENT_TRIGGERS}
+	}
+	for _, v := range c_triggers {
+		ret = append(ret, d.AVP_Enumerated(d.AVP_CODE_Event_Trigger, v, d.MAND, d.VENDOR_3GPP))
+	}
+	if to.QoS != nil {
+		ret = append(ret, to.QoS.avps()...)
+	}
+	return ret
+}
+
+func (rs RuleSet) hasRule(name string) bool {
+	for _, v := range rs.Rules {
+		if v.Name == name {
+			return true
+		}
+	}
+	return contains(rs.Predefined, name)
+}
+
+func (r ChargingRule) definition() d.AVP {
+	c_avps := []d.AVP{ruleName(r.Name)}
+	if r.ServiceIdentifier != nil {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Service_Identifier, *r.ServiceIdentifier, d.MAND, 0))
+	}
+	if r.RatingGroup != nil {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Rating_Group, *r.RatingGroup, d.MAND, 0))
+	}
+	for _, v := range r.Flows {
+		c_avps = append(c_avps, d.AVP_Group(d.AVP_CODE_Flow_Information, []d.AVP{
+			d.AVP_OctetString(d.AVP_CODE_Flow_Description, []byte(v), d.MAND, d.VENDOR_3GPP),
+		}, d.MAND, d.VENDOR_3GPP))
+	}
+	c_status := int32(d.ENUM_FLOW_STATUS_ENABLED)
+	if r.FlowStatus != nil {
+		c_status = *r.FlowStatus
+	}
+	c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Flow_Status, c_status, d.MAND, d.VENDOR_3GPP))
+	if r.QCI != 0 {
+		c_qos := []d.AVP{d.AVP_Enumerated(d.AVP_CODE_QoS_Class_Identifier, r.QCI, d.MAND, d.VENDOR_3GPP)}
+		if r.MBRUL != 0 {
+			c_qos = append(c_qos, d.AVP_Unsigned32(d.AVP_CODE_Max_Requested_Bandwidth_UL, r.MBRUL, d.MAND, d.VENDOR_3GPP))
+		}
+		if r.MBRDL != 0 {
+			c_qos = append(c_qos, d.AVP_Unsigned32(d.AVP_CODE_Max_Requested_Bandwidth_DL, r.MBRDL, d.MAND, d.VENDOR_3GPP))
+		}
+		if r.GBRUL != 0 {
+			c_qos = append(c_qos, d.AVP_Unsigned32(d.AVP_CODE_Guaranteed_Bitrate_UL, r.GBRUL, d.MAND, d.VENDOR_3GPP))
+		}
+		if r.GBRDL != 0 {
+			c_qos = append(c_qos, d.AVP_Unsigned32(d.AVP_CODE_Guaranteed_Bitrate_DL, r.GBRDL, d.MAND, d.VENDOR_3GPP))
+		}
+		c_avps = append(c_avps, d.AVP_Group(d.AVP_CODE_QoS_Information, c_qos, d.MAND, d.VENDOR_3GPP))
+	}
+	if r.Online != nil {
+		c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Online, *r.Online, d.MAND, d.VENDOR_3GPP))
+	}
+	if r.Offline != nil {
+		c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Offline, *r.Offline, d.MAND, d.VENDOR_3GPP))
+	}
+	if r.Precedence != 0 {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Precedence, r.Precedence, d.MAND, d.VENDOR_3GPP))
+	}
+	if r.MonitoringKey != "" {
+		c_avps = append(c_avps, d.AVP_OctetString(d.AVP_CODE_Monitoring_Key, []byte(r.MonitoringKey), d.MAND, d.VENDOR_3GPP))
+	}
+	return d.AVP_Group(d.AVP_CODE_Charging_Rule_Definition, c_avps, d.MAND, d.VENDOR_3GPP)
+}
+
+// avps are the Default-EPS-Bearer-QoS and the QoS-Information with the
+// APN-AMBR.
+func (q QoS) avps() []d.AVP {
+	var ret []d.AVP
+	if q.QCI != 0 {
+		ret = append(ret, d.AVP_Group(d.AVP_CODE_Default_EPS_Bearer_QoS, []d.AVP{
+			d.AVP_Enumerated(d.AVP_CODE_QoS_Class_Identifier, q.QCI, d.MAND, d.VENDOR_3GPP),
+			d.AVP_Group(d.AVP_CODE_Allocation_Retention_Priority, []d.AVP{
+				d.AVP_Unsigned32(d.AVP_CODE_Priority_Level, q.PriorityLevel, d.MAND, d.VENDOR_3GPP),
+			}, d.MAND, d.VENDOR_3GPP),
+		}, d.MAND, d.VENDOR_3GPP))
+	}
+	if q.AMBRUL != 0 || q.AMBRDL != 0 {
+		ret = append(ret, d.AVP_Group(d.AVP_CODE_QoS_Information, []d.AVP{
+			d.AVP_Unsigned32(d.AVP_CODE_APN_Aggregate_Max_Bitrate_UL, q.AMBRUL, d.MAND, d.VENDOR_3GPP),
+			d.AVP_Unsigned32(d.AVP_CODE_APN_Aggregate_Max_Bitrate_DL, q.AMBRDL, d.MAND, d.VENDOR_3GPP),
+		}, d.MAND, d.VENDOR_3GPP))
+	}
+	return ret
+}
+
+func ruleName(name string) d.AVP {
+	return d.AVP_OctetString(d.AVP_CODE_Charging_Rule_Name, []byte(name), d.MAND, d.VENDOR_3GPP)
+}
+
+func baseName(name string) d.AVP {
+	return d.AVP_UTF8String(d.AVP_CODE_Charging_Rule_Base_Name, name, d.MAND, d.VENDOR_3GPP)
+}
+
+func contains(list []string, v string) bool {
+	for _, c_val := range list {
+		if c_val == v {
+			return true
+		}
+	}
+	return false
+}
+
+func matchId(pattern string, id string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(id, strings.TrimSuffix(pattern, "*"))
+	}
+	return id == pattern
+}
+
+func subscriptionIds(req *d.Message) []string {
+	var ret []string
+	for _, c_avp := range req.FindAVPs(0, d.AVP_CODE_Subscription_Id) {
+		if c_data := c_avp.FindAVP(0, d.AVP_CODE_Subscription_Id_Data); c_data != nil {
+			ret = append(ret, c_data.GetStringValue())
+		}
+	}
+	return ret
+}
+
+// ipValue is the text of an IPAddress AVP, e.g. Framed-IP-Address.
+func ipValue(avp *d.AVP) string {
+	if avp == nil {
+		return ""
+	}
+	if c_val, ok := avp.GetValue().([]byte); ok && (len(c_val) == net.IPv4len || len(c_val) == net.IPv6len) {
+		return net.IP(c_val).String()
+	}
+	return avp.GetStringValue()
+}
@@ -0,0 +1,229 @@
+package pcrf
+
+import (
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if err := d.InitWith("../dict", d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// testSender keeps the requests sent to the PCEF.
+type testSender struct {
+	mtx  sync.Mutex
+	sent []d.Message
+}
+
+func (s *testSender) SendTo(host string, msg d.Message) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	msg.Set_hop_by_hop(uint32(len(s.sent) + 1))
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func (s *testSender) last(t *testing.T) d.Message {
+	t.Helper()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.sent) == 0 {
+		t.Fatal("nothing sent")
+	}
+	return s.sent[len(s.sent)-1]
+}
+
+// wait returns the request n (from 1), sent by a goroutine of the PCRF.
+func (s *testSender) wait(t *testing.T, n int) d.Message {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.mtx.Lock()
+		if len(s.sent) >= n {
+			ret := s.sent[n-1]
+			s.mtx.Unlock()
+			return ret
+		}
+		s.mtx.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("request %d not sent", n)
+	return d.Message{}
+}
+
+func testPCRF() (*PCRF, *testSender) {
+	p := New(Config{
+		OriginHost:  "pcrf.test",
+		OriginRealm: "test",
+		RuleSets: map[string]RuleSet{
+			"default":   {Rules: []ChargingRule{{Name: "all", Flows: []string{"permit out ip from any to assigned"}}}, Predefined: []string{"web"}},
+			"throttled": {Predefined: []string{"slow"}, EventTriggers: []int32{d.ENUM_EVENT_TRIGGER_RAT_CHANGE}},
+			"rejected":  {ResultCode: d.AUTHORIZATION_REJECTED},
+		},
+		Subscribers: []Subscriber{{Id: "3620*", RuleSet: "default"}, {Id: "3630*", RuleSet: "rejected"}},
+		OnTrigger:   map[int32]string{d.ENUM_EVENT_TRIGGER_QOS_CHANGE: "throttled"},
+	})
+	c_sender := &testSender{}
+	p.SetSender(c_sender)
+	return p, c_sender
+}
+
+func ccr(session_id string, sub string, c_type int32, avps ...d.AVP) d.Message {
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, session_id, d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, "pcef.test", d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Realm, "test", d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_CC_Request_Type, c_type, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_CC_Request_Number, 0, d.MAND, 0),
+		d.AVP_Group(d.AVP_CODE_Subscription_Id, []d.AVP{
+			d.AVP_Enumerated(d.AVP_CODE_Subscription_Id_Type, 0, d.MAND, 0),
+			d.AVP_UTF8String(d.AVP_CODE_Subscription_Id_Data, sub, d.MAND, 0),
+		}, d.MAND, 0),
+	}
+	return d.GenMess(d.CC_CREDIT_CONTROL, true, true, d.APPID_GX, 7, 8, append(c_avps, avps...))
+}
+
+func handle(t *testing.T, p *PCRF, req d.Message) d.Message {
+	t.Helper()
+	ans, ok := p.Handle(req)
+	if !ok {
+		t.Fatal("no answer")
+	}
+	if ans.IsRequest() || ans.Get_hop_by_hop() != req.Get_hop_by_hop() {
+		t.Error("not the answer of the request")
+	}
+	return ans
+}
+
+// ruleNames returns the Charging-Rule-Names and Charging-Rule-Definitions
+// in the Charging-Rule-Install or Remove c_code of msg.
+func ruleNames(msg d.Message, c_code uint32) []string {
+	var ret []string
+	for _, v := range msg.FindAVPs(d.VENDOR_3GPP, c_code) {
+		for _, c_avp := range v.GetGroupAVPs() {
+			switch {
+			case c_avp.IsTheSameAVP(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Name):
+				ret = append(ret, ruleNameOf(&c_avp))
+			case c_avp.IsTheSameAVP(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Definition):
+				ret = append(ret, ruleNameOf(c_avp.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Name)))
+			}
+		}
+	}
+	return ret
+}
+
+func raa(rar d.Message, c_result uint32) d.Message {
+	return d.GenMess(d.CC_RE_AUTH, false, true, d.APPID_GX, rar.Get_hop_by_hop(), rar.Get_end_to_end(), []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, app.SessionId(&rar), d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Result_Code, c_result, d.MAND, 0),
+	})
+}
+
+func checkRuleSet(t *testing.T, p *PCRF, session_id string, want string) {
+	t.Helper()
+	if got, _ := p.RuleSet(session_id); got != want {
+		t.Errorf("rule set %q, want %q", got, want)
+	}
+}
+
+func TestCCR(t *testing.T) {
+	p, _ := testPCRF()
+	ans := handle(t, p, ccr("s1", "36201234567", d.ENUM_CC_REQUEST_INITIAL))
+	if c_result := app.ResultCode(&ans); c_result != d.SUCCESS {
+		t.Fatalf("CCA-I: %d", c_result)
+	}
+	if got := fmt.Sprint(ruleNames(ans, d.AVP_CODE_Charging_Rule_Install)); got != "[all web]" {
+		t.Errorf("installed %s", got)
+	}
+	if c_type := ans.FindAVP(0, d.AVP_CODE_CC_Request_Type); c_type == nil || c_type.GetIntValue() != d.ENUM_CC_REQUEST_INITIAL {
+		t.Error("CC-Request-Type not in the answer")
+	}
+
+	ans = handle(t, p, ccr("s2", "36301234567", d.ENUM_CC_REQUEST_INITIAL))
+	if c_result := app.ResultCode(&ans); c_result != d.AUTHORIZATION_REJECTED {
+		t.Errorf("CCA-I of a rejected subscriber: %d", c_result)
+	}
+	ans = handle(t, p, ccr("s3", "1234", d.ENUM_CC_REQUEST_INITIAL))
+	if c_result := app.ResultCode(&ans); c_result != d.USER_UNKNOWN {
+		t.Errorf("CCA-I of an unknown subscriber: %d", c_result)
+	}
+
+	// the reported Event-Trigger switches the rule set
+	ans = handle(t, p, ccr("s1", "36201234567", d.ENUM_CC_REQUEST_UPDATE,
+		d.AVP_Enumerated(d.AVP_CODE_Event_Trigger, d.ENUM_EVENT_TRIGGER_QOS_CHANGE, d.MAND, d.VENDOR_3GPP)))
+	if got := fmt.Sprint(ruleNames(ans, d.AVP_CODE_Charging_Rule_Remove)); got != "[all web]" {
+		t.Errorf("removed %s", got)
+	}
+	if got := fmt.Sprint(ruleNames(ans, d.AVP_CODE_Charging_Rule_Install)); got != "[slow]" {
+		t.Errorf("installed %s", got)
+	}
+	checkRuleSet(t, p, "s1", "throttled")
+
+	handle(t, p, ccr("s1", "36201234567", d.ENUM_CC_REQUEST_TERMINATION))
+	if len(p.Sessions()) != 0 {
+		t.Errorf("open sessions %v", p.Sessions())
+	}
+	ans = handle(t, p, ccr("s1", "36201234567", d.ENUM_CC_REQUEST_UPDATE))
+	if c_result := app.ResultCode(&ans); c_result != d.UNKNOWN_SESSION_ID {
+		t.Errorf("CCA-U of the terminated session: %d", c_result)
+	}
+}
+
+// TestPushRuleSet switches the rule set of the session once the RAA is
+// successful.
+func TestPushRuleSet(t *testing.T) {
+	p, c_sender := testPCRF()
+	handle(t, p, ccr("s1", "36201234567", d.ENUM_CC_REQUEST_INITIAL))
+	if err := p.PushRuleSet("s1", "unknown"); err == nil {
+		t.Error("unknown rule set pushed")
+	}
+	if err := p.PushRuleSet("s9", "throttled"); err == nil {
+		t.Error("rule set pushed to an unknown session")
+	}
+
+	if err := p.PushRuleSet("s1", "throttled"); err != nil {
+		t.Fatal(err)
+	}
+	c_rar := c_sender.last(t)
+	if c_rar.GetCmdCode() != d.CC_RE_AUTH || !c_rar.IsRequest() || app.StringValue(&c_rar, d.AVP_CODE_Destination_Host) != "pcef.test" {
+		t.Fatalf("RAR: %s", c_rar.ToString())
+	}
+	if got := fmt.Sprint(ruleNames(c_rar, d.AVP_CODE_Charging_Rule_Remove)); got != "[all web]" {
+		t.Errorf("removed %s", got)
+	}
+	if got := fmt.Sprint(ruleNames(c_rar, d.AVP_CODE_Charging_Rule_Install)); got != "[slow]" {
+		t.Errorf("installed %s", got)
+	}
+	checkRuleSet(t, p, "s1", "default")
+	p.HandleAnswer(raa(c_rar, d.SUCCESS))
+	checkRuleSet(t, p, "s1", "throttled")
+
+	// a failed RAA keeps the rule set
+	if err := p.PushRuleSet("s1", "default"); err != nil {
+		t.Fatal(err)
+	}
+	c_rar = c_sender.last(t)
+	if c_triggers := c_rar.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Event_Trigger); len(c_triggers) != 1 || c_triggers[0].GetIntValue() != d.ENUM_EVENT_TRIGGER_NO_EVENT_TRIGGERS {
+		t.Errorf("Event-Triggers %v", c_triggers)
+	}
+	p.HandleAnswer(raa(c_rar, d.UNKNOWN_SESSION_ID))
+	checkRuleSet(t, p, "s1", "throttled")
+}
+
+func TestUnsupported(t *testing.T) {
+	p, _ := testPCRF()
+	ans := handle(t, p, d.GenMess(d.CC_ABORT_SESSION, true, true, d.APPID_GX, 7, 8, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "s1", d.MAND, 0),
+	}))
+	if c_result := app.ResultCode(&ans); c_result != d.COMMAND_UNSUPPORTED || ans.GetCmdFlags()&0b00100000 == 0 {
+		t.Errorf("Result-Code %d flags 0x%x, want 3001 with the E flag", c_result, ans.GetCmdFlags())
+	}
+}
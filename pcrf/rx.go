@@ -0,0 +1,391 @@
+package pcrf
+
+import (
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"github.com/lehotomi/diam/rx"
+	"sort"
+)
+
+// rxSession is the session of an AF, bound to a Gx session. Every media
+// component is installed as the dynamic rule <prefix>_<number>.
+type rxSession struct {
+	// host and realm are the origin of the AF.
+	host       string
+	realm      string
+	gx_session string
+	prefix     string
+	actions    map[int32]bool
+	components map[uint32]bool
+	// allocating is set while the RAR installing the rules waits for its
+	// RAA.
+	allocating bool
+}
+
+func (rs *rxSession) ruleName(number uint32) string {
+	return fmt.Sprintf("%s_%d", rs.prefix, number)
+}
+
+func (rs *rxSession) numbers() []uint32 {
+	var ret []uint32
+	for k := range rs.components {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// RxSessions returns the Session-Ids of the AF sessions.
+func (p *PCRF) RxSessions() []string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	var ret []string
+	for k := range p.rx_sessions {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// NotifyRx reports the Specific-Actions to the AF with a RAR, the Flows of
+// the media components are added.
+func (p *PCRF) NotifyRx(session_id string, actions []int32) error {
+	p.mtx.Lock()
+	rs, ok := p.rx_sessions[session_id]
+	var c_numbers []uint32
+	if ok {
+		c_numbers = rs.numbers()
+	}
+	p.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("pcrf: unknown AF session %s", session_id)
+	}
+	c_avps := []d.AVP{d.AVP_Enumerated(d.AVP_CODE_Re_Auth_Request_Type, d.ENUM_RE_AUTH_AUTHORIZE_ONLY, d.MAND, 0)}
+	for _, v := range actions {
+		c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Specific_Action, v, d.MAND, d.VENDOR_3GPP))
+	}
+	for _, v := range c_numbers {
+		c_avps = append(c_avps, d.AVP_Group(d.AVP_CODE_Flows, []d.AVP{
+			d.AVP_Unsigned32(d.AVP_CODE_Media_Component_Number, v, d.MAND, d.VENDOR_3GPP),
+		}, d.MAND, d.VENDOR_3GPP))
+	}
+	return p.sendRequest(d.CC_RE_AUTH, d.APPID_RX, session_id, rs.host, rs.realm, c_avps)
+}
+
+// AbortRx asks the AF with an ASR to end its session, cause is an
+// Abort-Cause.
+func (p *PCRF) AbortRx(session_id string, cause int32) error {
+	p.mtx.Lock()
+	rs, ok := p.rx_sessions[session_id]
+	p.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("pcrf: unknown AF session %s", session_id)
+	}
+	return p.sendRequest(d.CC_ABORT_SESSION, d.APPID_RX, session_id, rs.host, rs.realm, []d.AVP{
+		d.AVP_Enumerated(d.AVP_CODE_Abort_Cause, cause, d.MAND, d.VENDOR_3GPP),
+	})
+}
+
+// HandleAnswer takes the answers of the peers, e.g. as the AnswerHandler
+// of conn.Server. A successful RAA of PushRuleSet switches the rule set of
+// the session. The RAA of a RAR installing the rules of an AF session is
+// reported to the AF as successful or failed resource allocation.
+func (p *PCRF) HandleAnswer(ans d.Message) {
+	if ans.GetAppId() != d.APPID_GX || ans.GetCmdCode() != d.CC_RE_AUTH || !ans.IsAnswer() {
+		return
+	}
+	c_result := app.ResultCode(&ans)
+	c_gx := app.SessionId(&ans)
+	p.mtx.Lock()
+	p.ruleSetAnswered(c_gx, c_result)
+	p.mtx.Unlock()
+	p.allocated(c_gx, c_result)
+}
+
+// allocated reports the result of the RAR of the Gx session c_gx to the AF
+// sessions waiting for their resources.
+func (p *PCRF) allocated(c_gx string, c_result uint32) {
+	c_action := int32(d.ENUM_SPECIFIC_ACTION_SUCCESSFUL_RESOURCES_ALLOC)
+	if c_result < 2000 || c_result >= 3000 {
+		c_action = d.ENUM_SPECIFIC_ACTION_FAILED_RESOURCES_ALLOC
+	}
+
+	c_notes := make(map[string][]int32)
+	p.mtx.Lock()
+	for k, rs := range p.rx_sessions {
+		if rs.gx_session != c_gx || !rs.allocating {
+			continue
+		}
+		rs.allocating = false
+		if rs.actions[c_action] {
+			c_notes[k] = []int32{c_action}
+		}
+	}
+	p.mtx.Unlock()
+	p.notifyAll(c_notes)
+}
+
+// handleRx answers the AARs and STRs of the AFs.
+func (p *PCRF) handleRx(req d.Message) (d.Message, bool) {
+	c_session_id := app.SessionId(&req)
+	if c_session_id == "" {
+		return p.ans.AnswerTo(req, d.MISSING_AVP), true
+	}
+	switch req.GetCmdCode() {
+	case d.CC_AA:
+		return p.authorize(c_session_id, &req), true
+	case d.CC_SESSION_TERMINATION:
+		return p.terminateRx(c_session_id, &req), true
+	}
+	l.Warn.Println("pcrf: unsupported Rx command", req.GetCmdCode())
+	return p.ans.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+}
+
+// authorize binds a new AF session to the Gx session of its UE and pushes
+// the rules of the media components of the AAR. A media component with
+// Flow-Status REMOVED removes its rule, the components the AAR does not
+// have are kept.
+func (p *PCRF) authorize(session_id string, req *d.Message) d.Message {
+	var c_components []rx.MediaComponent
+	for _, v := range req.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Media_Component_Description) {
+		c_components = append(c_components, rx.ParseMediaComponent(v))
+	}
+
+	p.mtx.Lock()
+	rs, ok := p.rx_sessions[session_id]
+	if !ok {
+		c_ip := ipValue(req.FindAVP(0, d.AVP_CODE_Framed_IP_Address))
+		c_gx, found := p.sessionOf(c_ip)
+		if !found {
+			p.mtx.Unlock()
+			l.Warn.Println("pcrf: no IP-CAN session of UE", c_ip, "for AF session", session_id)
+			return p.ans.ExperimentalTo(*req, d.IP_CAN_SESSION_NOT_AVAILABLE)
+		}
+		p.rx_next++
+		rs = &rxSession{
+			host:       app.StringValue(req, d.AVP_CODE_Origin_Host),
+			realm:      app.StringValue(req, d.AVP_CODE_Origin_Realm),
+			gx_session: c_gx,
+			prefix:     fmt.Sprintf("af%d", p.rx_next),
+			actions:    make(map[int32]bool),
+			components: make(map[uint32]bool),
+		}
+		p.rx_sessions[session_id] = rs
+		l.Info.Println("pcrf: AF session", session_id, "bound to", c_gx)
+	}
+	if c_actions := req.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Specific_Action); len(c_actions) != 0 {
+		rs.actions = make(map[int32]bool)
+		for _, v := range c_actions {
+			rs.actions[int32(v.GetIntValue())] = true
+		}
+	}
+
+	var c_install, c_remove []d.AVP
+	for _, v := range c_components {
+		if v.FlowStatus != nil && *v.FlowStatus == d.ENUM_FLOW_STATUS_REMOVED {
+			if rs.components[v.Number] {
+				delete(rs.components, v.Number)
+				c_remove = append(c_remove, ruleName(rs.ruleName(v.Number)))
+			}
+			continue
+		}
+		rs.components[v.Number] = true
+		c_install = append(c_install, mediaRule(rs.ruleName(v.Number), v).definition())
+	}
+	var c_avps []d.AVP
+	if len(c_remove) != 0 {
+		c_avps = append(c_avps, d.AVP_Group(d.AVP_CODE_Charging_Rule_Remove, c_remove, d.MAND, d.VENDOR_3GPP))
+	}
+	if len(c_install) != 0 {
+		c_avps = append(c_avps, d.AVP_Group(d.AVP_CODE_Charging_Rule_Install, c_install, d.MAND, d.VENDOR_3GPP))
+		rs.allocating = true
+	}
+	c_gx := rs.gx_session
+	p.mtx.Unlock()
+
+	if len(c_avps) != 0 && c_gx != "" {
+		// the RAR goes after the AAA, the sender may block
+		go p.pushRx(session_id, c_gx, c_avps)
+	}
+	return p.ans.AnswerTo(*req, d.SUCCESS)
+}
+
+// terminateRx ends an AF session and removes its rules.
+func (p *PCRF) terminateRx(session_id string, req *d.Message) d.Message {
+	p.mtx.Lock()
+	rs, ok := p.rx_sessions[session_id]
+	if !ok {
+		p.mtx.Unlock()
+		return p.ans.AnswerTo(*req, d.UNKNOWN_SESSION_ID)
+	}
+	delete(p.rx_sessions, session_id)
+	var c_remove []d.AVP
+	for _, v := range rs.numbers() {
+		c_remove = append(c_remove, ruleName(rs.ruleName(v)))
+	}
+	_, c_bound := p.sessions[rs.gx_session]
+	p.mtx.Unlock()
+
+	l.Info.Println("pcrf: AF session", session_id, "terminated")
+	if c_bound && len(c_remove) != 0 {
+		c_avps := []d.AVP{d.AVP_Group(d.AVP_CODE_Charging_Rule_Remove, c_remove, d.MAND, d.VENDOR_3GPP)}
+		go func() {
+			if err := p.PushRAR(rs.gx_session, c_avps); err != nil {
+				l.Warn.Println("pcrf: cannot remove the rules of AF session", session_id, err)
+			}
+		}()
+	}
+	return p.ans.AnswerTo(*req, d.SUCCESS)
+}
+
+func (p *PCRF) pushRx(session_id string, gx_session string, avps []d.AVP) {
+	if err := p.PushRAR(gx_session, avps); err != nil {
+		l.Warn.Println("pcrf: cannot push the rules of AF session", session_id, err)
+		p.allocated(gx_session, d.UNABLE_TO_DELIVER)
+	}
+}
+
+// ruleReports turns the Charging-Rule-Reports of a CCR-U about the rules
+// of AF sessions into Specific-Actions. It is called with the lock held.
+func (p *PCRF) ruleReports(gx_session string, req *d.Message) {
+	c_notes := make(map[string][]int32)
+	for _, c_report := range req.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Report) {
+		c_status := int32(d.ENUM_PCC_RULE_ACTIVE)
+		if c_avp := c_report.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_PCC_Rule_Status); c_avp != nil {
+			c_status = int32(c_avp.GetIntValue())
+		}
+		for _, v := range c_report.GetGroupAVPs() {
+			if v.GetVendorId() != d.VENDOR_3GPP || v.GetAVPCode() != d.AVP_CODE_Charging_Rule_Name {
+				continue
+			}
+			c_id, rs := p.rxSessionOf(gx_session, ruleNameOf(&v))
+			if rs == nil {
+				continue
+			}
+			c_action := int32(d.ENUM_SPECIFIC_ACTION_RECOVERY_OF_BEARER)
+			switch {
+			case c_status != d.ENUM_PCC_RULE_ACTIVE && rs.allocating:
+				c_action = d.ENUM_SPECIFIC_ACTION_FAILED_RESOURCES_ALLOC
+				rs.allocating = false
+			case c_status != d.ENUM_PCC_RULE_ACTIVE:
+				c_action = d.ENUM_SPECIFIC_ACTION_LOSS_OF_BEARER
+			}
+			if rs.actions[c_action] && !containsAction(c_notes[c_id], c_action) {
+				c_notes[c_id] = append(c_notes[c_id], c_action)
+			}
+		}
+	}
+	if len(c_notes) != 0 {
+		go p.notifyAll(c_notes)
+	}
+}
+
+// unbind aborts the AF sessions of an ended Gx session. It is called with
+// the lock held.
+func (p *PCRF) unbind(gx_session string) {
+	var c_ids []string
+	for k, rs := range p.rx_sessions {
+		if rs.gx_session == gx_session {
+			rs.gx_session = ""
+			c_ids = append(c_ids, k)
+		}
+	}
+	if len(c_ids) == 0 {
+		return
+	}
+	sort.Strings(c_ids)
+	go func() {
+		for _, v := range c_ids {
+			if err := p.AbortRx(v, d.ENUM_ABORT_CAUSE_BEARER_RELEASED); err != nil {
+				l.Warn.Println("pcrf: cannot abort AF session", v, err)
+			}
+		}
+	}()
+}
+
+func (p *PCRF) notifyAll(notes map[string][]int32) {
+	var c_ids []string
+	for k := range notes {
+		c_ids = append(c_ids, k)
+	}
+	sort.Strings(c_ids)
+	for _, v := range c_ids {
+		if err := p.NotifyRx(v, notes[v]); err != nil {
+			l.Warn.Println("pcrf: cannot notify AF session", v, err)
+		}
+	}
+}
+
+// sessionOf finds the Gx session of the UE address ip.
+func (p *PCRF) sessionOf(ip string) (string, bool) {
+	if ip == "" {
+		return "", false
+	}
+	for k, s := range p.sessions {
+		if s.ue_ip == ip {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// rxSessionOf finds the AF session a rule of a Gx session belongs to.
+func (p *PCRF) rxSessionOf(gx_session string, rule string) (string, *rxSession) {
+	for k, rs := range p.rx_sessions {
+		if rs.gx_session != gx_session {
+			continue
+		}
+		for c_number := range rs.components {
+			if rs.ruleName(c_number) == rule {
+				return k, rs
+			}
+		}
+	}
+	return "", nil
+}
+
+// mediaRule is the dynamic rule of a media component: audio gets QCI 1
+// and video QCI 2 with the requested bandwidth guaranteed, the other media
+// are best effort (QCI 9).
+func mediaRule(name string, m rx.MediaComponent) ChargingRule {
+	c_rule := ChargingRule{
+		Name:       name,
+		FlowStatus: m.FlowStatus,
+		QCI:        9,
+		MBRUL:      m.MaxUL,
+		MBRDL:      m.MaxDL,
+	}
+	switch m.Type {
+	case d.ENUM_MEDIA_TYPE_AUDIO:
+		c_rule.QCI = 1
+	case d.ENUM_MEDIA_TYPE_VIDEO:
+		c_rule.QCI = 2
+	}
+	if c_rule.QCI != 9 {
+		c_rule.GBRUL = m.MaxUL
+		c_rule.GBRDL = m.MaxDL
+	}
+	for _, v := range m.SubComponents {
+		c_rule.Flows = append(c_rule.Flows, v.Flows...)
+	}
+	return c_rule
+}
+
+// ruleNameOf is the text of a Charging-Rule-Name, an OctetString.
+func ruleNameOf(avp *d.AVP) string {
+	if c_val, ok := avp.GetValue().([]byte); ok {
+		return string(c_val)
+	}
+	return avp.GetStringValue()
+}
+
+func containsAction(list []int32, v int32) bool {
+	for _, c_val := range list {
+		if c_val == v {
+			return true
+		}
+	}
+	return false
+}
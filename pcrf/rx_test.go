@@ -0,0 +1,192 @@
+package pcrf
+
+import (
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/internal/apptest"
+	"github.com/lehotomi/diam/rx"
+	"testing"
+	"time"
+)
+
+// rxPeer is an AF with an Rx client talking to the PCRF.
+type rxPeer struct {
+	cl       *rx.Client
+	send_ch  chan d.Message
+	notes    chan []int32
+	finished chan error
+}
+
+func newRxPeer() *rxPeer {
+	c := &rxPeer{
+		send_ch:  make(chan d.Message, 10),
+		notes:    make(chan []int32, 10),
+		finished: make(chan error, 10),
+	}
+	c.cl = rx.NewClient(&apptest.Conn{}, c.send_ch, rx.ClientConfig{
+		Tx: time.Second,
+		Callbacks: rx.Callbacks{
+			OnNotify:    func(s *rx.Session, actions []int32, rar d.Message) { c.notes <- actions },
+			OnTerminate: func(s *rx.Session, err error) { c.finished <- err },
+		},
+	})
+	return c
+}
+
+// exchange hands the request of the AF to the PCRF and its answer back.
+func (c *rxPeer) exchange(t *testing.T, p *PCRF) d.Message {
+	t.Helper()
+	var c_req d.Message
+	select {
+	case c_req = <-c.send_ch:
+	case <-time.After(time.Second):
+		t.Fatal("no request of the AF")
+	}
+	ans := handle(t, p, c_req)
+	c.cl.Handle(ans)
+	return ans
+}
+
+func ueAddress(t *testing.T, ip string) d.AVP {
+	t.Helper()
+	ret, err := rx.UEAddress(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+// TestRx binds an AF session to the Gx session of its UE, the rule of the
+// voice component is installed in the PCEF and removed by the STR.
+func TestRx(t *testing.T) {
+	p, c_sender := testPCRF()
+	handle(t, p, ccr("gx1", "36201234567", d.ENUM_CC_REQUEST_INITIAL, ueAddress(t, "10.1.2.3")))
+
+	c_af := newRxPeer()
+	s := c_af.cl.NewSession()
+	c_voice := rx.VoiceComponent(1, "10.1.2.3", 4000, "10.9.9.9", 5000, 64000, 32000)
+	if err := s.Start([]rx.MediaComponent{c_voice}, []int32{d.ENUM_SPECIFIC_ACTION_SUCCESSFUL_RESOURCES_ALLOC}, []d.AVP{ueAddress(t, "10.1.2.3")}); err != nil {
+		t.Fatal(err)
+	}
+	if c_aaa := c_af.exchange(t, p); app.ResultCode(&c_aaa) != d.SUCCESS {
+		t.Fatalf("AAA: %s", c_aaa.ToString())
+	}
+	if s.State() != rx.STATE_OPEN {
+		t.Errorf("state %s", s.State())
+	}
+	if got := p.RxSessions(); len(got) != 1 || got[0] != s.Id() {
+		t.Errorf("AF sessions %v", got)
+	}
+
+	// the rule of the component goes to the PCEF of the Gx session
+	c_rar := c_sender.wait(t, 1)
+	if app.SessionId(&c_rar) != "gx1" || c_rar.GetAppId() != d.APPID_GX {
+		t.Fatalf("RAR: %s", c_rar.ToString())
+	}
+	if got := fmt.Sprint(ruleNames(c_rar, d.AVP_CODE_Charging_Rule_Install)); got != "[af1_1]" {
+		t.Errorf("installed %s", got)
+	}
+	c_def := c_rar.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Install).FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Definition)
+	c_qos := c_def.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_QoS_Information)
+	if c_qos == nil {
+		t.Fatal("no QoS-Information in the rule")
+	}
+	if c_qci := c_qos.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_QoS_Class_Identifier); c_qci == nil || c_qci.GetIntValue() != 1 {
+		t.Errorf("QCI %v", c_qci)
+	}
+	if c_gbr := c_qos.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Guaranteed_Bitrate_DL); c_gbr == nil || c_gbr.GetIntValue() != 32000 {
+		t.Errorf("Guaranteed-Bitrate-DL %v", c_gbr)
+	}
+
+	// the successful RAA is reported to the AF
+	p.HandleAnswer(raa(c_rar, d.SUCCESS))
+	c_note := c_sender.wait(t, 2)
+	if c_note.GetAppId() != d.APPID_RX || app.SessionId(&c_note) != s.Id() || app.StringValue(&c_note, d.AVP_CODE_Destination_Host) != "client.test" {
+		t.Fatalf("RAR to the AF: %s", c_note.ToString())
+	}
+	if c_ans, ok := c_af.cl.HandleRequest(c_note); !ok || app.ResultCode(&c_ans) != d.SUCCESS {
+		t.Errorf("RAA of the AF: %s", c_ans.ToString())
+	}
+	select {
+	case got := <-c_af.notes:
+		if len(got) != 1 || got[0] != d.ENUM_SPECIFIC_ACTION_SUCCESSFUL_RESOURCES_ALLOC {
+			t.Errorf("Specific-Actions %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Error("Specific-Action not reported")
+	}
+
+	if err := s.Terminate(d.ENUM_TERMINATION_CAUSE_LOGOUT, nil); err != nil {
+		t.Fatal(err)
+	}
+	c_af.exchange(t, p)
+	if err := <-c_af.finished; err != nil {
+		t.Errorf("STR: %v", err)
+	}
+	c_rar = c_sender.wait(t, 3)
+	if got := fmt.Sprint(ruleNames(c_rar, d.AVP_CODE_Charging_Rule_Remove)); got != "[af1_1]" {
+		t.Errorf("removed %s", got)
+	}
+	if len(p.RxSessions()) != 0 {
+		t.Errorf("AF sessions %v", p.RxSessions())
+	}
+}
+
+// TestRxNoSession rejects the AAR of a UE without IP-CAN session.
+func TestRxNoSession(t *testing.T) {
+	p, _ := testPCRF()
+	c_af := newRxPeer()
+	s := c_af.cl.NewSession()
+	if err := s.Start(nil, nil, []d.AVP{ueAddress(t, "10.1.2.3")}); err != nil {
+		t.Fatal(err)
+	}
+	c_aaa := c_af.exchange(t, p)
+	if c_result := app.ResultCode(&c_aaa); c_result != d.IP_CAN_SESSION_NOT_AVAILABLE || c_aaa.FindAVP(0, d.AVP_CODE_Experimental_Result) == nil {
+		t.Errorf("AAA: %s", c_aaa.ToString())
+	}
+	if err, ok := (<-c_af.finished).(*app.ResultError); !ok || err.ResultCode != d.IP_CAN_SESSION_NOT_AVAILABLE {
+		t.Errorf("session ended with %v", err)
+	}
+}
+
+// TestRxUnbind aborts the AF sessions of a terminated Gx session.
+func TestRxUnbind(t *testing.T) {
+	p, c_sender := testPCRF()
+	handle(t, p, ccr("gx1", "36201234567", d.ENUM_CC_REQUEST_INITIAL, ueAddress(t, "10.1.2.3")))
+	c_af := newRxPeer()
+	s := c_af.cl.NewSession()
+	if err := s.Start(nil, nil, []d.AVP{ueAddress(t, "10.1.2.3")}); err != nil {
+		t.Fatal(err)
+	}
+	c_af.exchange(t, p)
+
+	handle(t, p, ccr("gx1", "36201234567", d.ENUM_CC_REQUEST_TERMINATION))
+	c_asr := c_sender.wait(t, 1)
+	if c_asr.GetCmdCode() != d.CC_ABORT_SESSION || app.SessionId(&c_asr) != s.Id() {
+		t.Fatalf("ASR: %s", c_asr.ToString())
+	}
+	if c_cause := c_asr.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Abort_Cause); c_cause == nil || c_cause.GetIntValue() != d.ENUM_ABORT_CAUSE_BEARER_RELEASED {
+		t.Errorf("Abort-Cause %v", c_cause)
+	}
+
+	// the ASR is followed by the STR of the AF
+	c_af.cl.HandleRequest(c_asr)
+	c_af.exchange(t, p)
+	if err := <-c_af.finished; err != nil {
+		t.Errorf("STR: %v", err)
+	}
+	if len(p.RxSessions()) != 0 {
+		t.Errorf("AF sessions %v", p.RxSessions())
+	}
+}
+
+func TestRxUnsupported(t *testing.T) {
+	p, _ := testPCRF()
+	ans := handle(t, p, d.GenMess(d.CC_RE_AUTH, true, true, d.APPID_RX, 7, 8, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "af1", d.MAND, 0),
+	}))
+	if c_result := app.ResultCode(&ans); c_result != d.COMMAND_UNSUPPORTED || ans.GetCmdFlags()&0b00100000 == 0 {
+		t.Errorf("Result-Code %d flags 0x%x, want 3001 with the E flag", c_result, ans.GetCmdFlags())
+	}
+}
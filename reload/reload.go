@@ -0,0 +1,197 @@
+// Package reload watches the dictionary and template directories and reloads
+// them when a file changes.
+//
+// The directories are polled. A changed directory is parsed completely; the
+// new dictionary or template set replaces the working one only if it loaded
+// without error, so traffic in flight keeps using the set it started with.
+package reload
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	templates "github.com/lehotomi/diam/templ"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_interval = 2 * time.Second
+)
+
+const (
+	KIND_DICT     = "dictionary"
+	KIND_TEMPLATE = "template"
+)
+
+// Config selects what to watch. An empty directory is not watched.
+type Config struct {
+	DictDir     string
+	DictOptions d.LoadOptions
+	TemplateDir string
+	// Interval between two polls, 2s if zero.
+	Interval time.Duration
+	// OnReload is called after every reload attempt, err is nil on success.
+	OnReload func(kind string, dir string, err error)
+}
+
+// Watcher polls the configured directories until Stop is called.
+type Watcher struct {
+	conf      Config
+	dict_sig  string
+	templ_sig string
+	stop_ch   chan struct{}
+	stop_once sync.Once
+	done_ch   chan struct{}
+}
+
+// Start takes a snapshot of the directories and starts polling them. The
+// directories are expected to be loaded already (diam.Init, templates.Init).
+func Start(conf Config) *Watcher {
+	if conf.Interval <= 0 {
+		conf.Interval = default_interval
+	}
+	w := &Watcher{
+		conf:    conf,
+		stop_ch: make(chan struct{}),
+		done_ch: make(chan struct{}),
+	}
+	if conf.DictDir != "" {
+		w.dict_sig, _ = dirSignature(conf.DictDir, isDictFile)
+	}
+	if conf.TemplateDir != "" {
+		w.templ_sig, _ = dirSignature(conf.TemplateDir, isTemplateFile)
+	}
+	go w.loop()
+	return w
+}
+
+// Stop ends polling and waits for a running reload to finish.
+func (w *Watcher) Stop() {
+	w.stop_once.Do(func() {
+		close(w.stop_ch)
+	})
+	<-w.done_ch
+}
+
+func (w *Watcher) loop() {
+	defer close(w.done_ch)
+	ticker := time.NewTicker(w.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop_ch:
+			return
+		case <-ticker.C:
+			w.Poll()
+		}
+	}
+}
+
+// Poll checks the directories once and reloads the changed ones. The
+// dictionary is reloaded before the templates. A failed reload is retried
+// at the next poll.
+func (w *Watcher) Poll() {
+	if w.conf.DictDir != "" {
+		if c_sig, err := dirSignature(w.conf.DictDir, isDictFile); err != nil {
+			w.report(KIND_DICT, w.conf.DictDir, err)
+		} else if c_sig != w.dict_sig {
+			err := ReloadDict(w.conf.DictDir, w.conf.DictOptions)
+			if err == nil {
+				w.dict_sig = c_sig
+			}
+			w.report(KIND_DICT, w.conf.DictDir, err)
+		}
+	}
+	if w.conf.TemplateDir != "" {
+		if c_sig, err := dirSignature(w.conf.TemplateDir, isTemplateFile); err != nil {
+			w.report(KIND_TEMPLATE, w.conf.TemplateDir, err)
+		} else if c_sig != w.templ_sig {
+			err := templates.Load(w.conf.TemplateDir)
+			if err == nil {
+				w.templ_sig = c_sig
+			}
+			w.report(KIND_TEMPLATE, w.conf.TemplateDir, err)
+		}
+	}
+}
+
+func (w *Watcher) report(kind string, dir string, err error) {
+	if err != nil {
+		l.Error.Printf("reload of %s %s failed, keeping the loaded one: %v", kind, dir, err)
+	} else {
+		l.Info.Printf("%s %s reloaded", kind, dir)
+	}
+	if w.conf.OnReload != nil {
+		w.conf.OnReload(kind, dir, err)
+	}
+}
+
+// ReloadDict loads dir and merges it into a copy of the default dictionary,
+// which then replaces the default one. The definitions added at runtime
+// (AddDefs, Merge) are kept. The default dictionary is not changed if dir
+// cannot be loaded, or if the loaded templates have problems with the new
+// dictionary they do not have with the current one.
+func ReloadDict(dir string, opts d.LoadOptions) error {
+	c_loaded := d.NewDictionary()
+	if err := c_loaded.Load(dir, opts); err != nil {
+		return err
+	}
+	dc := d.Default().Clone()
+	dc.Merge(c_loaded)
+	if err := checkTemplates(dc); err != nil {
+		return err
+	}
+	d.SetDefault(dc)
+	return nil
+}
+
+// checkTemplates lints the loaded templates against dc. The problems the
+// templates already have with the default dictionary are not counted.
+func checkTemplates(dc *d.Dictionary) error {
+	c_known := make(map[string]bool)
+	for _, err := range templates.LintLoaded(d.Default()) {
+		c_known[err.Error()] = true
+	}
+	var c_new []string
+	for _, err := range templates.LintLoaded(dc) {
+		if !c_known[err.Error()] {
+			c_new = append(c_new, err.Error())
+		}
+	}
+	if len(c_new) > 0 {
+		return fmt.Errorf("the loaded templates do not match the new dictionary: %s", strings.Join(c_new, "; "))
+	}
+	return nil
+}
+
+func isDictFile(name string) bool {
+	_, ok := d.DictLoaderFor(name)
+	return ok
+}
+
+func isTemplateFile(name string) bool {
+	return strings.HasSuffix(name, ".template") || strings.HasSuffix(name, ".fragment")
+}
+
+// dirSignature summarizes name, size and modification time of the matching
+// files of dir.
+func dirSignature(dir string, match func(string) bool) (string, error) {
+	fileInfo, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, file := range fileInfo {
+		if file.IsDir() || !match(file.Name()) {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", filepath.Join(dir, file.Name()), file.Size(), file.ModTime().UnixNano()))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "|"), nil
+}
@@ -0,0 +1,68 @@
+package reload
+
+import (
+	d "github.com/lehotomi/diam/diam"
+	templates "github.com/lehotomi/diam/templ"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir string, name string, cont string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(cont), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadDict(t *testing.T) {
+	c_dict := d.NewDictionary()
+	if err := c_dict.AddDef(d.DictDef{
+		Commands: []d.CommandDef{{Code: 272, Name: "Credit-Control"}},
+		Avps: []d.AvpDef{
+			{Code: 416, Name: "CC-Request-Type", Type: "Enumerated", Enum: map[int32]string{1: "INITIAL_REQUEST"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	d.SetDefault(c_dict)
+	defer d.SetDefault(d.NewDictionary())
+
+	c_templ_dir := t.TempDir()
+	writeFile(t, c_templ_dir, "ccr.template", "!header command_code:272 application_id:4 request:1 proxiable:1\n0.416.1 Enumerated '1'\n")
+	if err := templates.Load(c_templ_dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// an AVP added at runtime is kept over the reload
+	if err := d.AddDef(d.DictDef{Avps: []d.AvpDef{{Code: 99999, Name: "Runtime-Avp", Type: "UTF8String"}}}); err != nil {
+		t.Fatal(err)
+	}
+	c_dir := t.TempDir()
+	writeFile(t, c_dir, "dict.json", `{"commands":[{"code":271,"name":"Accounting"}],"avps":[]}`)
+	if err := ReloadDict(c_dir, d.LoadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.LookUpAvp_command(271); !ok {
+		t.Error("the reloaded command is missing")
+	}
+	for _, c_code := range []uint32{416, 99999} {
+		if d.LookUpAvp(c_code, 0).GetType() == d.Avp_code_unknown {
+			t.Errorf("avp %d lost by the reload", c_code)
+		}
+	}
+
+	// the template row does not match the new type of CC-Request-Type
+	c_before := d.Default()
+	writeFile(t, c_dir, "dict.json", `{"commands":[],"avps":[{"code":416,"name":"CC-Request-Type","vendor-id":0,"type":"Unsigned32"}]}`)
+	if err := ReloadDict(c_dir, d.LoadOptions{}); err == nil {
+		t.Error("reload breaking the loaded template accepted")
+	}
+	if d.Default() != c_before {
+		t.Error("default dictionary replaced by a failed reload")
+	}
+
+	if err := ReloadDict(filepath.Join(c_dir, "missing"), d.LoadOptions{}); err == nil || d.Default() != c_before {
+		t.Errorf("reload of a missing directory: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Package rx is the AF side of the Rx interface (3GPP TS 29.214), the
+// sessions a P-CSCF or another application function opens towards the
+// PCRF to authorize the media of its service.
+//
+// A Client sends the AARs and STRs of its sessions on the send channel of
+// a DiamConn and gets the answers through Handle (or Run). The RARs of the
+// PCRF report the Specific-Actions the session subscribed to, an ASR is
+// answered and followed by the STR of the session.
+//
+//	cl := rx.NewClient(&diam_conn, send_ch, rx.ClientConfig{Callbacks: cbs})
+//	cl.Register(&diam_conn)
+//	go cl.Run(rcv_ch, nil)
+//	s := cl.NewSession()
+//	c_ue, _ := rx.UEAddress("10.1.2.3")
+//	s.Start([]rx.MediaComponent{rx.VoiceComponent(1, "10.1.2.3", 4000, "10.9.9.9", 5000, 64000, 64000)}, nil, []d.AVP{c_ue})
+//	s.Terminate(d.ENUM_TERMINATION_CAUSE_LOGOUT, nil)
+package rx
+
+import (
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+const (
+	default_tx = 10 * time.Second
+)
+
+// Callbacks report the life of the sessions to the application, every field
+// may be nil. They are called without locks held.
+type Callbacks struct {
+	OnStateChange func(s *Session, from State, to State)
+	// OnAnswer gets every AAA and STA of the session.
+	OnAnswer func(s *Session, ans d.Message)
+	// OnNotify gets the Specific-Actions of a RAR of the PCRF, e.g.
+	// d.ENUM_SPECIFIC_ACTION_SUCCESSFUL_RESOURCES_ALLOC.
+	OnNotify func(s *Session, actions []int32, rar d.Message)
+	// OnAbort gets the Abort-Cause of an ASR, the STR is sent after it.
+	OnAbort func(s *Session, cause int32)
+	// OnTerminate tells the Rx session is over, err is nil after a
+	// successful STR.
+	OnTerminate func(s *Session, err error)
+}
+
+// ClientConfig sets up a Client.
+type ClientConfig struct {
+	// Tx is the answer timeout, 10s if zero.
+	Tx time.Duration
+	// ApplicationId is sent as AF-Application-Identifier if not empty.
+	ApplicationId string
+	// Actions are the Specific-Actions subscribed by the sessions that do
+	// not give their own.
+	Actions   []int32
+	Callbacks Callbacks
+}
+
+// Client runs the Rx sessions of one connection.
+type Client struct {
+	base     app.Base
+	conf     ClientConfig
+	mtx      sync.Mutex
+	sessions map[string]*Session
+	pending  map[uint32]*Session
+}
+
+// NewClient creates a client sending on send_ch, the send channel of c.
+func NewClient(c app.Conn, send_ch chan d.Message, conf ClientConfig) *Client {
+	if conf.Tx <= 0 {
+		conf.Tx = default_tx
+	}
+	return &Client{
+		base:     app.NewBase("rx client", c, send_ch),
+		conf:     conf,
+		sessions: make(map[string]*Session),
+		pending:  make(map[uint32]*Session),
+	}
+}
+
+// NewSession creates an idle session with a new Session-Id.
+func (cl *Client) NewSession() *Session {
+	s := &Session{
+		cl:      cl,
+		id:      cl.base.Conn().Gen_Session_Id(),
+		actions: make(map[int32]bool),
+	}
+	cl.mtx.Lock()
+	cl.sessions[s.id] = s
+	cl.mtx.Unlock()
+	return s
+}
+
+// Session returns the active session with the Session-Id id.
+func (cl *Client) Session(id string) (*Session, bool) {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	s, ok := cl.sessions[id]
+	return s, ok
+}
+
+// Run handles the messages of rcv_ch until it is closed. The messages that
+// are not for the client go to rest, or are dropped if rest is nil.
+func (cl *Client) Run(rcv_ch chan d.Message, rest chan d.Message) {
+	cl.base.Run(rcv_ch, rest, cl.Handle)
+}
+
+// Handle processes a received message: the AAAs and STAs of the sessions
+// and the RARs and ASRs of Rx. It returns false for other messages.
+func (cl *Client) Handle(msg d.Message) bool {
+	if msg.GetAppId() != d.APPID_RX {
+		return false
+	}
+	switch c_code := msg.GetCmdCode(); {
+	case (c_code == d.CC_AA || c_code == d.CC_SESSION_TERMINATION) && msg.IsAnswer():
+		cl.mtx.Lock()
+		s, ok := cl.pending[msg.Get_hop_by_hop()]
+		cl.mtx.Unlock()
+		if !ok {
+			l.Warn.Printf("rx client: answer without request, hop-by-hop 0x%08x session %s", msg.Get_hop_by_hop(), app.SessionId(&msg))
+			return true
+		}
+		s.answer(msg)
+		return true
+	case (c_code == d.CC_RE_AUTH || c_code == d.CC_ABORT_SESSION) && msg.IsRequest():
+		if c_ans, ok := cl.HandleRequest(msg); ok {
+			cl.base.Send(c_ans)
+		}
+		return true
+	}
+	return false
+}
+
+// Register makes r answer the Rx RARs and ASRs with the client.
+func (cl *Client) Register(r app.Registry) {
+	r.Handle(d.CC_RE_AUTH, d.APPID_RX, cl.HandleRequest)
+	r.Handle(d.CC_ABORT_SESSION, d.APPID_RX, cl.HandleRequest)
+}
+
+// HandleRequest answers a RAR or an ASR, it is a conn.RequestHandler. The
+// STR that follows an ASR is sent after the answer.
+func (cl *Client) HandleRequest(req d.Message) (d.Message, bool) {
+	c_id := app.SessionId(&req)
+	cl.mtx.Lock()
+	s, ok := cl.sessions[c_id]
+	cl.mtx.Unlock()
+	if !ok {
+		l.Warn.Println("rx client: request", req.GetCmdCode(), "for unknown session", c_id)
+		return cl.base.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+	}
+	if req.GetCmdCode() == d.CC_ABORT_SESSION {
+		go s.abort(req)
+	} else {
+		s.notify(req)
+	}
+	return cl.base.AnswerTo(req, d.SUCCESS), true
+}
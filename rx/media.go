@@ -0,0 +1,176 @@
+package rx
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"net"
+)
+
+// MediaSubComponent is one Media-Sub-Component, the IP flows of a media
+// component.
+type MediaSubComponent struct {
+	FlowNumber uint32
+	// Flows are the Flow-Descriptions, "permit in" rules for the uplink and
+	// "permit out" rules for the downlink.
+	Flows []string
+	// FlowUsage is sent if not nil, e.g. d.ENUM_FLOW_USAGE_RTCP.
+	FlowUsage *int32
+}
+
+// MediaComponent is a Media-Component-Description of an AAR.
+type MediaComponent struct {
+	Number uint32
+	// Type is a Media-Type, e.g. d.ENUM_MEDIA_TYPE_AUDIO.
+	Type int32
+	// MaxUL and MaxDL are the Max-Requested-Bandwidths in bit/s, RR and
+	// RS the RTCP bandwidths. A zero value is not sent.
+	MaxUL uint32
+	MaxDL uint32
+	RR    uint32
+	RS    uint32
+	// FlowStatus is sent if not nil, the PCRF takes ENABLED if missing.
+	FlowStatus *int32
+	// Codecs are the Codec-Data, e.g. "uplink\noffer\nm=audio ...".
+	Codecs        []string
+	SubComponents []MediaSubComponent
+}
+
+// AVP builds the Media-Component-Description.
+func (m MediaComponent) AVP() d.AVP {
+	c_avps := []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Media_Component_Number, m.Number, d.MAND, d.VENDOR_3GPP),
+	}
+	for _, v := range m.SubComponents {
+		c_avps = append(c_avps, v.AVP())
+	}
+	c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Media_Type, m.Type, d.MAND, d.VENDOR_3GPP))
+	for _, v := range []struct {
+		code uint32
+		val  uint32
+	}{
+		{d.AVP_CODE_Max_Requested_Bandwidth_UL, m.MaxUL},
+		{d.AVP_CODE_Max_Requested_Bandwidth_DL, m.MaxDL},
+		{d.AVP_CODE_RR_Bandwidth, m.RR},
+		{d.AVP_CODE_RS_Bandwidth, m.RS},
+	} {
+		if v.val != 0 {
+			c_avps = append(c_avps, d.AVP_Unsigned32(v.code, v.val, d.MAND, d.VENDOR_3GPP))
+		}
+	}
+	if m.FlowStatus != nil {
+		c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Flow_Status, *m.FlowStatus, d.MAND, d.VENDOR_3GPP))
+	}
+	for _, v := range m.Codecs {
+		c_avps = append(c_avps, d.AVP_UTF8String(d.AVP_CODE_Codec_Data, v, d.MAND, d.VENDOR_3GPP))
+	}
+	return d.AVP_Group(d.AVP_CODE_Media_Component_Description, c_avps, d.MAND, d.VENDOR_3GPP)
+}
+
+// AVP builds the Media-Sub-Component.
+func (m MediaSubComponent) AVP() d.AVP {
+	c_avps := []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Flow_Number, m.FlowNumber, d.MAND, d.VENDOR_3GPP),
+	}
+	for _, v := range m.Flows {
+		c_avps = append(c_avps, d.AVP_OctetString(d.AVP_CODE_Flow_Description, []byte(v), d.MAND, d.VENDOR_3GPP))
+	}
+	if m.FlowUsage != nil {
+		c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Flow_Usage, *m.FlowUsage, d.MAND, d.VENDOR_3GPP))
+	}
+	return d.AVP_Group(d.AVP_CODE_Media_Sub_Component, c_avps, d.MAND, d.VENDOR_3GPP)
+}
+
+// FlowDescriptions are the uplink and the downlink Flow-Description of
+// the flow between the UE and the remote end, proto is an IP protocol
+// number (17 for UDP).
+func FlowDescriptions(proto uint8, ue_ip string, ue_port uint16, remote_ip string, remote_port uint16) []string {
+	return []string{
+		fmt.Sprintf("permit in %d from %s %d to %s %d", proto, ue_ip, ue_port, remote_ip, remote_port),
+		fmt.Sprintf("permit out %d from %s %d to %s %d", proto, remote_ip, remote_port, ue_ip, ue_port),
+	}
+}
+
+// VoiceComponent is the audio component of a VoLTE call: RTP on the
+// ports and RTCP on the ports + 1, ul and dl are the bandwidths in bit/s.
+func VoiceComponent(number uint32, ue_ip string, ue_port uint16, remote_ip string, remote_port uint16, ul uint32, dl uint32) MediaComponent {
+	c_rtcp := int32(d.ENUM_FLOW_USAGE_RTCP)
+	return MediaComponent{
+		Number: number,
+		Type:   d.ENUM_MEDIA_TYPE_AUDIO,
+		MaxUL:  ul,
+		MaxDL:  dl,
+		SubComponents: []MediaSubComponent{
+			{FlowNumber: 1, Flows: FlowDescriptions(17, ue_ip, ue_port, remote_ip, remote_port)},
+			{FlowNumber: 2, Flows: FlowDescriptions(17, ue_ip, ue_port+1, remote_ip, remote_port+1), FlowUsage: &c_rtcp},
+		},
+	}
+}
+
+// ParseMediaComponent reads a Media-Component-Description.
+func ParseMediaComponent(avp *d.AVP) MediaComponent {
+	var ret MediaComponent
+	for _, v := range avp.GetGroupAVPs() {
+		if v.GetVendorId() != d.VENDOR_3GPP {
+			continue
+		}
+		switch v.GetAVPCode() {
+		case d.AVP_CODE_Media_Component_Number:
+			ret.Number = uint32(v.GetIntValue())
+		case d.AVP_CODE_Media_Type:
+			ret.Type = int32(v.GetIntValue())
+		case d.AVP_CODE_Max_Requested_Bandwidth_UL:
+			ret.MaxUL = uint32(v.GetIntValue())
+		case d.AVP_CODE_Max_Requested_Bandwidth_DL:
+			ret.MaxDL = uint32(v.GetIntValue())
+		case d.AVP_CODE_RR_Bandwidth:
+			ret.RR = uint32(v.GetIntValue())
+		case d.AVP_CODE_RS_Bandwidth:
+			ret.RS = uint32(v.GetIntValue())
+		case d.AVP_CODE_Flow_Status:
+			c_val := int32(v.GetIntValue())
+			ret.FlowStatus = &c_val
+		case d.AVP_CODE_Codec_Data:
+			ret.Codecs = append(ret.Codecs, v.GetStringValue())
+		case d.AVP_CODE_Media_Sub_Component:
+			ret.SubComponents = append(ret.SubComponents, parseSubComponent(&v))
+		}
+	}
+	return ret
+}
+
+func parseSubComponent(avp *d.AVP) MediaSubComponent {
+	var ret MediaSubComponent
+	for _, v := range avp.GetGroupAVPs() {
+		if v.GetVendorId() != d.VENDOR_3GPP {
+			continue
+		}
+		switch v.GetAVPCode() {
+		case d.AVP_CODE_Flow_Number:
+			ret.FlowNumber = uint32(v.GetIntValue())
+		case d.AVP_CODE_Flow_Description:
+			ret.Flows = append(ret.Flows, octets(&v))
+		case d.AVP_CODE_Flow_Usage:
+			c_val := int32(v.GetIntValue())
+			ret.FlowUsage = &c_val
+		}
+	}
+	return ret
+}
+
+// UEAddress is the Framed-IP-Address of an IPv4 address, the PCRF binds
+// the Rx session to the IP-CAN session of the UE with it.
+func UEAddress(ip string) (d.AVP, error) {
+	c_ip := net.ParseIP(ip).To4()
+	if c_ip == nil {
+		return d.AVP{}, fmt.Errorf("not an IPv4 address: %q", ip)
+	}
+	return d.AVP_OctetString(d.AVP_CODE_Framed_IP_Address, []byte(c_ip), d.MAND, 0), nil
+}
+
+// octets is the text of an OctetString AVP.
+func octets(avp *d.AVP) string {
+	if c_val, ok := avp.GetValue().([]byte); ok {
+		return string(c_val)
+	}
+	return avp.GetStringValue()
+}
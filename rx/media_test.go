@@ -0,0 +1,56 @@
+package rx
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if err := d.InitWith("../dict", d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// TestMediaComponent reads back the encoded Media-Component-Description.
+func TestMediaComponent(t *testing.T) {
+	c_status := int32(d.ENUM_FLOW_STATUS_ENABLED)
+	c_voice := VoiceComponent(1, "10.1.2.3", 4000, "10.9.9.9", 5000, 64000, 32000)
+	c_voice.FlowStatus = &c_status
+	c_voice.Codecs = []string{"uplink\noffer\nm=audio 4000 RTP/AVP 96"}
+
+	c_mess := d.GenMess(d.CC_AA, true, true, d.APPID_RX, 1, 1, []d.AVP{c_voice.AVP()})
+	c_back, err := d.DecodeMessage(c_mess.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c_avp := c_back.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Media_Component_Description)
+	if c_avp == nil {
+		t.Fatal("no Media-Component-Description")
+	}
+	if got := ParseMediaComponent(c_avp); !reflect.DeepEqual(got, c_voice) {
+		t.Errorf("read back as\n%+v\nwant\n%+v", got, c_voice)
+	}
+	if got := c_voice.SubComponents[1].Flows[0]; got != "permit in 17 from 10.1.2.3 4001 to 10.9.9.9 5001" {
+		t.Errorf("RTCP uplink flow %q", got)
+	}
+}
+
+func TestUEAddress(t *testing.T) {
+	c_avp, err := UEAddress("10.1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c_val, _ := c_avp.GetValue().([]byte); !reflect.DeepEqual(c_val, []byte{10, 1, 2, 3}) {
+		t.Errorf("Framed-IP-Address %v", c_avp.GetValue())
+	}
+	for _, v := range []string{"", "::1", "10.1.2"} {
+		if _, err := UEAddress(v); err == nil {
+			t.Errorf("%q accepted", v)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package rx
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sort"
+	"time"
+)
+
+// State is the state of an Rx session of the AF.
+type State int
+
+const (
+	STATE_IDLE State = iota
+	// STATE_PENDING_AA waits for the AAA of the first AAR.
+	STATE_PENDING_AA
+	// STATE_PENDING_MODIFY waits for the AAA of a later AAR.
+	STATE_PENDING_MODIFY
+	STATE_PENDING_ST
+	STATE_OPEN
+)
+
+var state_names map[State]string = map[State]string{
+	STATE_IDLE:           "Idle",
+	STATE_PENDING_AA:     "PendingAA",
+	STATE_PENDING_MODIFY: "PendingModify",
+	STATE_PENDING_ST:     "PendingST",
+	STATE_OPEN:           "Open",
+}
+
+func (st State) String() string {
+	if c_name, ok := state_names[st]; ok {
+		return c_name
+	}
+	return fmt.Sprintf("State(%d)", int(st))
+}
+
+var (
+	ErrTxExpired  = errors.New("no answer within Tx")
+	ErrWrongState = errors.New("request not allowed in this state")
+)
+
+// Session is one Rx session of a Client.
+type Session struct {
+	cl         *Client
+	id         string
+	state      State
+	hop_by_hop uint32
+	tx_timer   *time.Timer
+	actions    map[int32]bool
+	aborted    bool
+}
+
+func (s *Session) Id() string {
+	return s.id
+}
+
+func (s *Session) State() State {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.state
+}
+
+// Actions returns the subscribed Specific-Actions.
+func (s *Session) Actions() []int32 {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	var ret []int32
+	for k := range s.actions {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// Start sends the first AAR of an idle session with the media components
+// and the subscription to actions, the ones of the ClientConfig if nil.
+// avps are e.g. Framed-IP-Address (see UEAddress), Subscription-Id and
+// AF-Charging-Identifier.
+func (s *Session) Start(components []MediaComponent, actions []int32, avps []d.AVP) error {
+	if actions == nil {
+		actions = s.cl.conf.Actions
+	}
+	return s.do(func(c_todo *app.Todo) error {
+		if err := s.sendAAR(components, actions, avps, STATE_IDLE, STATE_PENDING_AA, c_todo); err != nil {
+			return err
+		}
+		s.actions = make(map[int32]bool)
+		for _, v := range actions {
+			s.actions[v] = true
+		}
+		return nil
+	})
+}
+
+// Modify sends an AAR with the changed media components of an open
+// session, e.g. after a re-INVITE. The subscribed actions are kept.
+func (s *Session) Modify(components []MediaComponent, avps []d.AVP) error {
+	return s.do(func(c_todo *app.Todo) error {
+		return s.sendAAR(components, nil, avps, STATE_OPEN, STATE_PENDING_MODIFY, c_todo)
+	})
+}
+
+// Terminate sends the STR of the session with the Termination-Cause
+// cause, a pending AAR is given up.
+func (s *Session) Terminate(cause int32, avps []d.AVP) error {
+	return s.do(func(c_todo *app.Todo) error {
+		if s.state == STATE_IDLE || s.state == STATE_PENDING_ST {
+			return fmt.Errorf("%s: STR in state %s: %w", s.id, s.state, ErrWrongState)
+		}
+		c_avps := append([]d.AVP{d.AVP_Enumerated(d.AVP_CODE_Termination_Cause, cause, d.MAND, 0)}, avps...)
+		s.send(d.CC_SESSION_TERMINATION, c_avps, STATE_PENDING_ST, c_todo)
+		return nil
+	})
+}
+
+func (s *Session) do(f func(c_todo *app.Todo) error) error {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	err := f(&c_todo)
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+	return err
+}
+
+// sendAAR sends an AAR if the session is in the state from.
+func (s *Session) sendAAR(components []MediaComponent, actions []int32, avps []d.AVP, from State, to State, c_todo *app.Todo) error {
+	if s.state != from {
+		return fmt.Errorf("%s: AAR in state %s: %w", s.id, s.state, ErrWrongState)
+	}
+	var c_avps []d.AVP
+	if s.cl.conf.ApplicationId != "" {
+		c_avps = append(c_avps, d.AVP_OctetString(d.AVP_CODE_AF_Application_Identifier, []byte(s.cl.conf.ApplicationId), d.MAND, d.VENDOR_3GPP))
+	}
+	for _, v := range components {
+		c_avps = append(c_avps, v.AVP())
+	}
+	for _, v := range actions {
+		c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Specific_Action, v, d.MAND, d.VENDOR_3GPP))
+	}
+	s.send(d.CC_AA, append(c_avps, avps...), to, c_todo)
+	return nil
+}
+
+func (s *Session) send(cmd_code uint32, avps []d.AVP, to State, c_todo *app.Todo) {
+	s.stopTx()
+	delete(s.cl.pending, s.hop_by_hop)
+	c_req := s.request(cmd_code, avps)
+	s.hop_by_hop = c_req.Get_hop_by_hop()
+	s.cl.pending[s.hop_by_hop] = s
+	s.cl.sessions[s.id] = s
+	s.startTx()
+	s.setState(to, c_todo)
+
+	c_todo.Add(func() {
+		s.cl.base.Send(c_req)
+	})
+}
+
+func (s *Session) request(cmd_code uint32, avps []d.AVP) d.Message {
+	cl := s.cl
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, s.id, d.MAND, 0)}
+	c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_RX, d.MAND, 0))
+	c_avps = append(c_avps, cl.base.Origin()...)
+	c_avps = append(c_avps, cl.base.Destination()...)
+	c_avps = append(c_avps, avps...)
+	return d.GenMess(cmd_code, true, true, d.APPID_RX, cl.base.Conn().NextHopByHop(), 0, c_avps)
+}
+
+func (s *Session) setState(to State, c_todo *app.Todo) {
+	c_from := s.state
+	s.state = to
+	if to == STATE_IDLE {
+		s.stopTx()
+		delete(s.cl.sessions, s.id)
+	}
+	if c_from == to {
+		return
+	}
+	l.Trace.Printf("rx session %s: %s -> %s", s.id, c_from, to)
+	if cb := s.cl.conf.Callbacks.OnStateChange; cb != nil {
+		c_todo.Add(func() { cb(s, c_from, to) })
+	}
+}
+
+func (s *Session) terminated(err error, c_todo *app.Todo) {
+	s.setState(STATE_IDLE, c_todo)
+	if cb := s.cl.conf.Callbacks.OnTerminate; cb != nil {
+		c_todo.Add(func() { cb(s, err) })
+	}
+}
+
+// answer runs the state machine for a received AAA or STA.
+func (s *Session) answer(ans d.Message) {
+	s.do(func(c_todo *app.Todo) error {
+		if ans.Get_hop_by_hop() != s.hop_by_hop {
+			l.Warn.Printf("rx session %s: late answer, hop-by-hop 0x%08x", s.id, ans.Get_hop_by_hop())
+			delete(s.cl.pending, ans.Get_hop_by_hop())
+			return nil
+		}
+		delete(s.cl.pending, s.hop_by_hop)
+		s.stopTx()
+		if cb := s.cl.conf.Callbacks.OnAnswer; cb != nil {
+			c_todo.Add(func() { cb(s, ans) })
+		}
+
+		c_result := app.ResultCode(&ans)
+		c_success := c_result >= 2000 && c_result < 3000
+		switch s.state {
+		case STATE_PENDING_AA:
+			if !c_success {
+				s.terminated(&app.ResultError{ResultCode: c_result}, c_todo)
+				return nil
+			}
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_MODIFY:
+			if c_result == d.UNKNOWN_SESSION_ID {
+				s.terminated(&app.ResultError{ResultCode: c_result}, c_todo)
+				return nil
+			}
+			// a rejected modification keeps the authorized media
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_ST:
+			var err error
+			if !c_success {
+				err = &app.ResultError{ResultCode: c_result}
+			}
+			s.terminated(err, c_todo)
+		}
+		return nil
+	})
+}
+
+// notify reports the Specific-Actions of a RAR.
+func (s *Session) notify(rar d.Message) {
+	var c_actions []int32
+	for _, v := range rar.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Specific_Action) {
+		c_actions = append(c_actions, int32(v.GetIntValue()))
+	}
+	s.do(func(c_todo *app.Todo) error {
+		for _, v := range c_actions {
+			if !s.actions[v] {
+				l.Warn.Println("rx session", s.id, "Specific-Action", v, "not subscribed")
+			}
+		}
+		if cb := s.cl.conf.Callbacks.OnNotify; cb != nil {
+			c_todo.Add(func() { cb(s, c_actions, rar) })
+		}
+		return nil
+	})
+}
+
+// abort terminates the session after an ASR, it runs after the ASA is
+// sent.
+func (s *Session) abort(asr d.Message) {
+	c_cause := int32(-1)
+	if c_avp := asr.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Abort_Cause); c_avp != nil {
+		c_cause = int32(c_avp.GetIntValue())
+	}
+	c_first := false
+	s.do(func(c_todo *app.Todo) error {
+		c_first = !s.aborted
+		s.aborted = true
+		if cb := s.cl.conf.Callbacks.OnAbort; cb != nil && c_first {
+			c_todo.Add(func() { cb(s, c_cause) })
+		}
+		return nil
+	})
+	if !c_first {
+		return
+	}
+	if err := s.Terminate(d.ENUM_TERMINATION_CAUSE_ADMINISTRATIVE, nil); err != nil {
+		l.Warn.Println("rx session", s.id, "cannot terminate after ASR:", err)
+	}
+}
+
+func (s *Session) startTx() {
+	c_hop_by_hop := s.hop_by_hop
+	s.tx_timer = time.AfterFunc(s.cl.conf.Tx, func() {
+		s.txExpired(c_hop_by_hop)
+	})
+}
+
+func (s *Session) stopTx() {
+	if s.tx_timer != nil {
+		s.tx_timer.Stop()
+		s.tx_timer = nil
+	}
+}
+
+// txExpired gives up the request with c_hop_by_hop: a modification keeps
+// the session open, the other requests end it.
+func (s *Session) txExpired(c_hop_by_hop uint32) {
+	s.do(func(c_todo *app.Todo) error {
+		if s.hop_by_hop != c_hop_by_hop || s.tx_timer == nil {
+			return nil
+		}
+		s.tx_timer = nil
+		delete(s.cl.pending, s.hop_by_hop)
+		l.Warn.Printf("rx session %s: Tx expired in state %s", s.id, s.state)
+		switch s.state {
+		case STATE_PENDING_MODIFY:
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_AA, STATE_PENDING_ST:
+			s.terminated(ErrTxExpired, c_todo)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,245 @@
+// Package s6a is the S6a/S6d interface (3GPP TS 29.272) between the MME
+// (or SGSN) and the HSS: the MME side requests, the Subscription-Data they
+// carry and the Milenage authentication vectors of the HSS side.
+//
+// S6a keeps no session state, the requests of a Client block until their
+// answer arrives through Handle (or Run), so Run has to go on in another
+// goroutine. The Cancel-Location and Insert-Subscriber-Data requests of
+// the HSS are answered and reported to the callbacks of ClientConfig.
+//
+//	plmn, _ := d.PLMNId("001", "01")
+//	cl := s6a.NewClient(&diam_conn, send_ch, s6a.ClientConfig{VisitedPLMN: plmn})
+//	cl.Register(&diam_conn)
+//	go cl.Run(rcv_ch, nil)
+//	c_vectors, _, err := cl.AuthenticationInformation("001010000000001", 1, nil, nil)
+//	c_sub, _, err := cl.UpdateLocation("001010000000001", d.ULR_FLAG_S6A_S6D_INDICATOR|d.ULR_FLAG_INITIAL_ATTACH_INDICATOR, nil)
+package s6a
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+const (
+	default_tx = 10 * time.Second
+)
+
+var ErrTxExpired = errors.New("no answer within Tx")
+
+// ClientConfig sets up a Client.
+type ClientConfig struct {
+	// Tx is the answer timeout, 10s if zero.
+	Tx time.Duration
+	// VisitedPLMN is the Visited-PLMN-Id of the MME, see d.PLMNId.
+	VisitedPLMN []byte
+	// RATType is the RAT-Type of the Update-Location, E-UTRAN if zero.
+	RATType int32
+	// OnCancelLocation gets the Cancellation-Type of a Cancel-Location, it
+	// may be nil. It is called before the answer is sent.
+	OnCancelLocation func(imsi string, cancellation_type int32, clr d.Message)
+	// OnInsertSubscriberData gets the Subscription-Data of an
+	// Insert-Subscriber-Data, it may be nil.
+	OnInsertSubscriberData func(imsi string, sub *Subscription, idr d.Message)
+}
+
+// Client sends the S6a requests of an MME on one connection.
+type Client struct {
+	base    app.Base
+	conf    ClientConfig
+	mtx     sync.Mutex
+	pending map[uint32]chan d.Message
+}
+
+// NewClient creates a client sending on send_ch, the send channel of c.
+func NewClient(c app.Conn, send_ch chan d.Message, conf ClientConfig) *Client {
+	if conf.Tx <= 0 {
+		conf.Tx = default_tx
+	}
+	if conf.RATType == 0 {
+		conf.RATType = d.ENUM_RAT_TYPE_EUTRAN
+	}
+	return &Client{
+		base:    app.NewBase("s6a client", c, send_ch, AppAVPs()...),
+		conf:    conf,
+		pending: make(map[uint32]chan d.Message),
+	}
+}
+
+// Run handles the messages of rcv_ch until it is closed. The messages that
+// are not for the client go to rest, or are dropped if rest is nil.
+func (cl *Client) Run(rcv_ch chan d.Message, rest chan d.Message) {
+	cl.base.Run(rcv_ch, rest, cl.Handle)
+}
+
+// Handle processes a received message: the answers of the requests and the
+// requests of the HSS. It returns false for other messages.
+func (cl *Client) Handle(msg d.Message) bool {
+	if msg.GetAppId() != d.APPID_S6A {
+		return false
+	}
+	if msg.IsRequest() {
+		if c_ans, ok := cl.HandleRequest(msg); ok {
+			cl.base.Send(c_ans)
+		}
+		return true
+	}
+	cl.mtx.Lock()
+	c_ch, ok := cl.pending[msg.Get_hop_by_hop()]
+	delete(cl.pending, msg.Get_hop_by_hop())
+	cl.mtx.Unlock()
+	if !ok {
+		l.Warn.Printf("s6a client: answer without request, hop-by-hop 0x%08x", msg.Get_hop_by_hop())
+		return true
+	}
+	c_ch <- msg
+	return true
+}
+
+// Register makes r answer the Cancel-Location and Insert-Subscriber-Data
+// requests with the client.
+func (cl *Client) Register(r app.Registry) {
+	r.Handle(d.CC_CANCEL_LOCATION, d.APPID_S6A, cl.HandleRequest)
+	r.Handle(d.CC_INSERT_SUBSCRIBER_DATA, d.APPID_S6A, cl.HandleRequest)
+}
+
+// HandleRequest answers a Cancel-Location or an Insert-Subscriber-Data, it
+// is a conn.RequestHandler. Other requests get 3001 with the E flag.
+func (cl *Client) HandleRequest(req d.Message) (d.Message, bool) {
+	c_imsi := UserName(&req)
+	switch req.GetCmdCode() {
+	case d.CC_CANCEL_LOCATION:
+		c_type := req.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Cancellation_Type)
+		if c_type == nil {
+			return cl.base.AnswerTo(req, d.MISSING_AVP), true
+		}
+		if cb := cl.conf.OnCancelLocation; cb != nil {
+			cb(c_imsi, int32(c_type.GetIntValue()), req)
+		}
+	case d.CC_INSERT_SUBSCRIBER_DATA:
+		c_sub := SubscriptionOf(&req)
+		if c_sub == nil {
+			return cl.base.AnswerTo(req, d.MISSING_AVP), true
+		}
+		if cb := cl.conf.OnInsertSubscriberData; cb != nil {
+			cb(c_imsi, c_sub, req)
+		}
+	default:
+		return cl.base.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+	}
+	return cl.base.AnswerTo(req, d.SUCCESS), true
+}
+
+// UpdateLocation sends an Update-Location-Request with the ULR-Flags
+// flags and returns the Subscription-Data of the answer, nil if it has
+// none (d.ULR_FLAG_SKIP_SUBSCRIBER_DATA).
+func (cl *Client) UpdateLocation(imsi string, flags uint32, avps []d.AVP) (*Subscription, d.Message, error) {
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_User_Name, imsi, d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_RAT_Type, cl.conf.RATType, d.MAND, d.VENDOR_3GPP),
+		d.AVP_Unsigned32(d.AVP_CODE_ULR_Flags, flags, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_Visited_PLMN_Id, cl.conf.VisitedPLMN, d.MAND, d.VENDOR_3GPP),
+	}
+	c_ans, err := cl.Request(d.CC_UPDATE_LOCATION, append(c_avps, avps...))
+	if err != nil {
+		return nil, c_ans, err
+	}
+	return SubscriptionOf(&c_ans), c_ans, nil
+}
+
+// AuthenticationInformation sends an Authentication-Information-Request
+// for count E-UTRAN vectors. resync is the Re-Synchronization-Info (RAND
+// and AUTS of the UE) after a synchronisation failure, nil otherwise.
+func (cl *Client) AuthenticationInformation(imsi string, count uint32, resync []byte, avps []d.AVP) ([]Vector, d.Message, error) {
+	c_info := []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Number_Of_Requested_Vectors, count, d.MAND, d.VENDOR_3GPP),
+		d.AVP_Unsigned32(d.AVP_CODE_Immediate_Response_Preferred, 1, d.MAND, d.VENDOR_3GPP),
+	}
+	if resync != nil {
+		c_info = append(c_info, d.AVP_OctetString(d.AVP_CODE_Re_Synchronization_Info, resync, d.MAND, d.VENDOR_3GPP))
+	}
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_User_Name, imsi, d.MAND, 0),
+		d.AVP_Group(d.AVP_CODE_Requested_EUTRAN_Authentication_Info, c_info, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_Visited_PLMN_Id, cl.conf.VisitedPLMN, d.MAND, d.VENDOR_3GPP),
+	}
+	c_ans, err := cl.Request(d.CC_AUTHENTICATION_INFORMATION, append(c_avps, avps...))
+	if err != nil {
+		return nil, c_ans, err
+	}
+	c_vectors, _ := VectorsOf(&c_ans)
+	return c_vectors, c_ans, nil
+}
+
+// PurgeUE sends a Purge-UE-Request with the PUR-Flags flags.
+func (cl *Client) PurgeUE(imsi string, flags uint32, avps []d.AVP) (d.Message, error) {
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_User_Name, imsi, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_PUR_Flags, flags, d.MAND, d.VENDOR_3GPP),
+	}
+	return cl.Request(d.CC_PURGE_UE, append(c_avps, avps...))
+}
+
+// Notify sends a Notify-Request with the NOR-Flags flags.
+func (cl *Client) Notify(imsi string, flags uint32, avps []d.AVP) (d.Message, error) {
+	c_avps := []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_User_Name, imsi, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_NOR_Flags, flags, d.MAND, d.VENDOR_3GPP),
+	}
+	return cl.Request(d.CC_NOTIFY, append(c_avps, avps...))
+}
+
+// Request sends an S6a request with avps after the common AVPs and waits
+// for the answer. A not successful answer is returned with an
+// app.ResultError.
+func (cl *Client) Request(cmd_code uint32, avps []d.AVP) (d.Message, error) {
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, cl.base.Conn().Gen_Session_Id(), d.MAND, 0)}
+	c_avps = append(c_avps, AppAVPs()...)
+	c_avps = append(c_avps, cl.base.Origin()...)
+	c_avps = append(c_avps, cl.base.Destination()...)
+	c_avps = append(c_avps, avps...)
+	c_req := d.GenMess(cmd_code, true, true, d.APPID_S6A, cl.base.Conn().NextHopByHop(), 0, c_avps)
+
+	c_ch := make(chan d.Message, 1)
+	cl.mtx.Lock()
+	cl.pending[c_req.Get_hop_by_hop()] = c_ch
+	cl.mtx.Unlock()
+	cl.base.Send(c_req)
+
+	select {
+	case c_ans := <-c_ch:
+		if c_result := app.ResultCode(&c_ans); c_result < 2000 || c_result >= 3000 {
+			return c_ans, &app.ResultError{ResultCode: c_result}
+		}
+		return c_ans, nil
+	case <-time.After(cl.conf.Tx):
+		cl.mtx.Lock()
+		delete(cl.pending, c_req.Get_hop_by_hop())
+		cl.mtx.Unlock()
+		return d.Message{}, fmt.Errorf("s6a request %d: %w", cmd_code, ErrTxExpired)
+	}
+}
+
+// AppAVPs are the Vendor-Specific-Application-Id and the
+// Auth-Session-State of every S6a message.
+func AppAVPs() []d.AVP {
+	return []d.AVP{
+		d.AVP_Group(d.AVP_CODE_Vendor_Specific_Application_Id, []d.AVP{
+			d.AVP_Unsigned32(d.AVP_CODE_Vendor_Id, d.VENDOR_3GPP, d.MAND, 0),
+			d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_S6A, d.MAND, 0),
+		}, d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_Auth_Session_State, d.ENUM_AUTH_SESSION_NO_STATE_MAINTAINED, d.MAND, 0),
+	}
+}
+
+// UserName is the User-Name, the IMSI, of msg.
+func UserName(msg *d.Message) string {
+	if c_avp := msg.FindAVP(0, d.AVP_CODE_User_Name); c_avp != nil {
+		return c_avp.GetStringValue()
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package s6a
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// Milenage is the 3GPP authentication algorithm set (TS 35.206) for one
+// subscriber key K and operator variant OPc.
+type Milenage struct {
+	block cipher.Block
+	opc   []byte
+}
+
+// NewMilenage creates the algorithms of k and opc, both 16 bytes.
+func NewMilenage(k []byte, opc []byte) (*Milenage, error) {
+	if len(k) != 16 {
+		return nil, fmt.Errorf("milenage: K of %d bytes", len(k))
+	}
+	if len(opc) != 16 {
+		return nil, fmt.Errorf("milenage: OPc of %d bytes", len(opc))
+	}
+	c_block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return &Milenage{block: c_block, opc: append([]byte(nil), opc...)}, nil
+}
+
+// OPc derives the OPc of the operator variant op for the key k.
+func OPc(k []byte, op []byte) ([]byte, error) {
+	if len(op) != 16 {
+		return nil, fmt.Errorf("milenage: OP of %d bytes", len(op))
+	}
+	c_block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, 16)
+	c_block.Encrypt(ret, op)
+	xor(ret, op)
+	return ret, nil
+}
+
+// F1 is the network authentication code MAC-A of rand, sqn (6 bytes) and
+// amf (2 bytes).
+func (m *Milenage) F1(rand []byte, sqn []byte, amf []byte) []byte {
+	return m.out1(rand, sqn, amf)[:8]
+}
+
+// F1Star is the resynchronisation authentication code MAC-S.
+func (m *Milenage) F1Star(rand []byte, sqn []byte, amf []byte) []byte {
+	return m.out1(rand, sqn, amf)[8:]
+}
+
+// F2345 returns the response RES, the cipher key CK, the integrity key IK
+// and the anonymity key AK of rand.
+func (m *Milenage) F2345(rand []byte) (res []byte, ck []byte, ik []byte, ak []byte) {
+	c_temp := m.temp(rand)
+	c_out2 := m.out(c_temp, 0, 1)
+	return c_out2[8:], m.out(c_temp, 4, 2), m.out(c_temp, 8, 4), c_out2[:6]
+}
+
+// F5Star is the anonymity key of the resynchronisation.
+func (m *Milenage) F5Star(rand []byte) []byte {
+	return m.out(m.temp(rand), 12, 8)[:6]
+}
+
+// temp is E_K(RAND xor OPc).
+func (m *Milenage) temp(rand []byte) []byte {
+	ret := make([]byte, 16)
+	copy(ret, rand)
+	xor(ret, m.opc)
+	m.block.Encrypt(ret, ret)
+	return ret
+}
+
+func (m *Milenage) out1(rand []byte, sqn []byte, amf []byte) []byte {
+	c_in1 := make([]byte, 16)
+	copy(c_in1, sqn[:6])
+	copy(c_in1[6:], amf[:2])
+	copy(c_in1[8:], c_in1[:8])
+	xor(c_in1, m.opc)
+
+	// rotated by r1 = 64 bits, c1 is zero
+	c_val := make([]byte, 16)
+	for i := range c_val {
+		c_val[i] = c_in1[(i+8)%16]
+	}
+	xor(c_val, m.temp(rand))
+	m.block.Encrypt(c_val, c_val)
+	xor(c_val, m.opc)
+	return c_val
+}
+
+// out is f2-f5: E_K(rot(TEMP xor OPc, r) xor c) xor OPc, the rotation is
+// given in bytes and c by its last byte.
+func (m *Milenage) out(temp []byte, rot_bytes int, c byte) []byte {
+	c_val := make([]byte, 16)
+	for i := range c_val {
+		c_val[i] = temp[(i+rot_bytes)%16] ^ m.opc[(i+rot_bytes)%16]
+	}
+	c_val[15] ^= c
+	m.block.Encrypt(c_val, c_val)
+	xor(c_val, m.opc)
+	return c_val
+}
+
+func xor(dst []byte, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,173 @@
+package s6a
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	d "github.com/lehotomi/diam/diam"
+	"testing"
+)
+
+// milenageSets are the test sets 1 to 6 of 3GPP TS 35.208 4.3.
+var milenageSets = []struct {
+	k, rand, sqn, amf, op, opc string
+	f1, f1star, f2, f3, f4     string
+	f5, f5star                 string
+}{
+	{
+		k: "465b5ce8b199b49faa5f0a2ee238a6bc", rand: "23553cbe9637a89d218ae64dae47bf35",
+		sqn: "ff9bb4d0b607", amf: "b9b9", op: "cdc202d5123e20f62b6d676ac72cb318", opc: "cd63cb71954a9f4e48a5994e37a02baf",
+		f1: "4a9ffac354dfafb3", f1star: "01cfaf9ec4e871e9", f2: "a54211d5e3ba50bf",
+		f3: "b40ba9a3c58b2a05bbf0d987b21bf8cb", f4: "f769bcd751044604127672711c6d3441",
+		f5: "aa689c648370", f5star: "451e8beca43b",
+	},
+	{
+		k: "0396eb317b6d1c36f19c1c84cd6ffd16", rand: "c00d603103dcee52c4478119494202e8",
+		sqn: "fd8eef40df7d", amf: "af17", op: "ff53bade17df5d4e793073ce9d7579fa", opc: "53c15671c60a4b731c55b4a441c0bde2",
+		f1: "5df5b31807e258b0", f1star: "a8c016e51ef4a343", f2: "d3a628ed988620f0",
+		f3: "58c433ff7a7082acd424220f2b67c556", f4: "21a8c1f929702adb3e738488b9f5c5da",
+		f5: "c47783995f72", f5star: "30f1197061c1",
+	},
+	{
+		k: "fec86ba6eb707ed08905757b1bb44b8f", rand: "9f7c8d021accf4db213ccff0c7f71a6a",
+		sqn: "9d0277595ffc", amf: "725c", op: "dbc59adcb6f9a0ef735477b7fadf8374", opc: "1006020f0a478bf6b699f15c062e42b3",
+		f1: "9cabc3e99baf7281", f1star: "95814ba2b3044324", f2: "8011c48c0c214ed2",
+		f3: "5dbdbb2954e8f3cde665b046179a5098", f4: "59a92d3b476a0443487055cf88b2307b",
+		f5: "33484dc2136b", f5star: "deacdd848cc6",
+	},
+	{
+		k: "9e5944aea94b81165c82fbf9f32db751", rand: "ce83dbc54ac0274a157c17f80d017bd6",
+		sqn: "0b604a81eca8", amf: "9e09", op: "223014c5806694c007ca1eeef57f004f", opc: "a64a507ae1a2a98bb88eb4210135dc87",
+		f1: "74a58220cba84c49", f1star: "ac2cc74a96871837", f2: "f365cd683cd92e96",
+		f3: "e203edb3971574f5a94b0d61b816345d", f4: "0c4524adeac041c4dd830d20854fc46b",
+		f5: "f0b9c08ad02e", f5star: "6085a86c6f63",
+	},
+	{
+		k: "4ab1deb05ca6ceb051fc98e77d026a84", rand: "74b0cd6031a1c8339b2b6ce2b8c4a186",
+		sqn: "e880a1b580b6", amf: "9f07", op: "2d16c5cd1fdf6b22383584e3bef2a8d8", opc: "dcf07cbd51855290b92a07a9891e523e",
+		f1: "49e785dd12626ef2", f1star: "9e85790336bb3fa2", f2: "5860fc1bce351e7e",
+		f3: "7657766b373d1c2138f307e3de9242f9", f4: "1c42e960d89b8fa99f2744e0708ccb53",
+		f5: "31e11a609118", f5star: "fe2555e54aa9",
+	},
+	{
+		k: "6c38a116ac280c454f59332ee35c8c4f", rand: "ee6466bc96202c5a557abbeff8babf63",
+		sqn: "414b98222181", amf: "4464", op: "1ba00a1a7c6700ac8c3ff3e96ad08725", opc: "3803ef5363b947c6aaa225e58fae3934",
+		f1: "078adfb488241a57", f1star: "80246b8d0186bcf1", f2: "16c8233f05a0ac28",
+		f3: "3f8c7587fe8e4b233af676aede30ba3b", f4: "a7466cc1e6b2a1337d49d3b66e95d7b4",
+		f5: "45b0f69ab06c", f5star: "1f53cd2b1113",
+	},
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	ret, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestMilenage(t *testing.T) {
+	for i, v := range milenageSets {
+		c_k, c_rand, c_sqn, c_amf := unhex(t, v.k), unhex(t, v.rand), unhex(t, v.sqn), unhex(t, v.amf)
+		c_opc, err := OPc(c_k, unhex(t, v.op))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(c_opc); got != v.opc {
+			t.Errorf("set %d: OPc %s, want %s", i+1, got, v.opc)
+		}
+		m, err := NewMilenage(c_k, c_opc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c_res, c_ck, c_ik, c_ak := m.F2345(c_rand)
+		for _, c := range []struct {
+			name string
+			got  []byte
+			want string
+		}{
+			{"f1", m.F1(c_rand, c_sqn, c_amf), v.f1},
+			{"f1*", m.F1Star(c_rand, c_sqn, c_amf), v.f1star},
+			{"f2", c_res, v.f2},
+			{"f3", c_ck, v.f3},
+			{"f4", c_ik, v.f4},
+			{"f5", c_ak, v.f5},
+			{"f5*", m.F5Star(c_rand), v.f5star},
+		} {
+			if got := hex.EncodeToString(c.got); got != c.want {
+				t.Errorf("set %d: %s %s, want %s", i+1, c.name, got, c.want)
+			}
+		}
+	}
+}
+
+// TestKASME checks the key derivation of TS 33.401 annex A.2 against the
+// S string written out byte by byte.
+func TestKASME(t *testing.T) {
+	c_ck := unhex(t, "b40ba9a3c58b2a05bbf0d987b21bf8cb")
+	c_ik := unhex(t, "f769bcd751044604127672711c6d3441")
+	c_plmn, err := d.PLMNId("001", "01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c_plmn, []byte{0x00, 0xf1, 0x10}) {
+		t.Fatalf("PLMN-Id %x", c_plmn)
+	}
+	c_sqn_ak := unhex(t, "55f328b43577")
+
+	c_s := []byte{0x10, 0x00, 0xf1, 0x10, 0x00, 0x03, 0x55, 0xf3, 0x28, 0xb4, 0x35, 0x77, 0x00, 0x06}
+	c_mac := hmac.New(sha256.New, append(append([]byte(nil), c_ck...), c_ik...))
+	c_mac.Write(c_s)
+	c_want := c_mac.Sum(nil)
+
+	if got := KASME(c_ck, c_ik, c_plmn, c_sqn_ak); !bytes.Equal(got, c_want) {
+		t.Errorf("KASME %x, want %x", got, c_want)
+	}
+}
+
+func TestVector(t *testing.T) {
+	v := milenageSets[0]
+	m, err := NewMilenage(unhex(t, v.k), unhex(t, v.opc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c_rand := unhex(t, v.rand)
+	c_plmn, _ := d.PLMNId("001", "01")
+	c_vector, err := NewVector(m, c_rand, 0xff9bb4d0b607, unhex(t, v.amf), c_plmn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVector(m, c_rand, 0xff9bb4d0b607, []byte{0x80}, c_plmn); err == nil {
+		t.Error("vector of a 1 byte AMF")
+	}
+
+	if got, want := hex.EncodeToString(c_vector.AUTN), "55f328b43577"+v.amf+v.f1; got != want {
+		t.Errorf("AUTN %s, want %s", got, want)
+	}
+	if got := hex.EncodeToString(c_vector.XRES); got != v.f2 {
+		t.Errorf("XRES %s, want %s", got, v.f2)
+	}
+	if got := KASME(c_vector.CK, c_vector.IK, c_plmn, c_vector.AUTN[:6]); !bytes.Equal(got, c_vector.KASME) {
+		t.Errorf("KASME %x, want %x", c_vector.KASME, got)
+	}
+
+	c_res, _, _, c_sqn, err := m.Check(c_rand, c_vector.AUTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c_sqn != 0xff9bb4d0b607 || !bytes.Equal(c_res, c_vector.XRES) {
+		t.Errorf("Check: SQN %x RES %x", c_sqn, c_res)
+	}
+	c_autn := append([]byte(nil), c_vector.AUTN...)
+	c_autn[15] ^= 1
+	if _, _, _, _, err := m.Check(c_rand, c_autn); err != ErrMACFailure {
+		t.Errorf("Check of a bad AUTN: %v", err)
+	}
+
+	c_info := append(append([]byte(nil), c_rand...), m.AUTS(c_rand, 0x1234)...)
+	if c_sqn, err := m.Resync(c_info); err != nil || c_sqn != 0x1234 {
+		t.Errorf("Resync: %x %v", c_sqn, err)
+	}
+}
@@ -0,0 +1,15 @@
+package s6a
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+)
+
+// PLMNOfIMSI is the PLMN id of the home network of imsi, the length of
+// the MNC is mnc_len.
+func PLMNOfIMSI(imsi string, mnc_len int) ([]byte, error) {
+	if len(imsi) < 3+mnc_len {
+		return nil, fmt.Errorf("invalid IMSI %s", imsi)
+	}
+	return d.PLMNId(imsi[:3], imsi[3:3+mnc_len])
+}
@@ -0,0 +1,209 @@
+package s6a
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+)
+
+// APN is an APN-Configuration of the subscription.
+type APN struct {
+	ContextId uint32 `json:"context_id"`
+	// Name is the Service-Selection, "*" is the wildcard APN.
+	Name string `json:"name"`
+	// PDNType is a d.ENUM_PDN_TYPE value.
+	PDNType int32 `json:"pdn_type"`
+	// QCI is 9 and PriorityLevel 15 if zero.
+	QCI           int32  `json:"qci"`
+	PriorityLevel uint32 `json:"priority_level"`
+	// PreEmptionCapability and PreEmptionVulnerability are
+	// d.ENUM_PRE_EMPTION values.
+	PreEmptionCapability    int32 `json:"pre_emption_capability"`
+	PreEmptionVulnerability int32 `json:"pre_emption_vulnerability"`
+	// AMBRUL and AMBRDL are the APN-AMBR in bit/s, not sent if zero.
+	AMBRUL uint32 `json:"ambr_ul,omitempty"`
+	AMBRDL uint32 `json:"ambr_dl,omitempty"`
+}
+
+// Subscription is the EPS part of the Subscription-Data of an ULA or IDR.
+type Subscription struct {
+	MSISDN string `json:"msisdn,omitempty"`
+	// Status is a d.ENUM_SUBSCRIBER_STATUS value.
+	Status int32 `json:"subscriber_status"`
+	// NetworkAccessMode is a d.ENUM_NETWORK_ACCESS_MODE value.
+	NetworkAccessMode int32  `json:"network_access_mode"`
+	AccessRestriction uint32 `json:"access_restriction_data,omitempty"`
+	// AMBRUL and AMBRDL are the UE-AMBR in bit/s.
+	AMBRUL uint32 `json:"ambr_ul"`
+	AMBRDL uint32 `json:"ambr_dl"`
+	// DefaultContextId selects the default APN, the first one if zero.
+	DefaultContextId uint32 `json:"default_context_id,omitempty"`
+	APNs             []APN  `json:"apns"`
+	// TAUTimer is the Subscribed-Periodic-RAU-TAU-Timer in seconds, not
+	// sent if zero.
+	TAUTimer uint32 `json:"tau_timer,omitempty"`
+}
+
+// AVP builds the Subscription-Data.
+func (s Subscription) AVP() (d.AVP, error) {
+	c_avps := []d.AVP{
+		d.AVP_Enumerated(d.AVP_CODE_Subscriber_Status, s.Status, d.MAND, d.VENDOR_3GPP),
+	}
+	if s.MSISDN != "" {
+		c_msisdn, err := d.TBCDEncode(s.MSISDN)
+		if err != nil {
+			return d.AVP{}, fmt.Errorf("MSISDN: %w", err)
+		}
+		c_avps = append(c_avps, d.AVP_OctetString(d.AVP_CODE_MSISDN, c_msisdn, d.MAND, d.VENDOR_3GPP))
+	}
+	c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Network_Access_Mode, s.NetworkAccessMode, d.MAND, d.VENDOR_3GPP))
+	if s.AccessRestriction != 0 {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Access_Restriction_Data, s.AccessRestriction, d.MAND, d.VENDOR_3GPP))
+	}
+	c_avps = append(c_avps, ambr(s.AMBRUL, s.AMBRDL))
+	if len(s.APNs) != 0 {
+		c_default := s.DefaultContextId
+		if c_default == 0 {
+			c_default = s.APNs[0].ContextId
+		}
+		c_profile := []d.AVP{
+			d.AVP_Unsigned32(d.AVP_CODE_Context_Identifier, c_default, d.MAND, d.VENDOR_3GPP),
+			d.AVP_Enumerated(d.AVP_CODE_All_APN_Configurations_Included_Indicator, d.ENUM_ALL_APN_CONFIGURATIONS_INCLUDED, d.MAND, d.VENDOR_3GPP),
+		}
+		for _, v := range s.APNs {
+			c_profile = append(c_profile, v.AVP())
+		}
+		c_avps = append(c_avps, d.AVP_Group(d.AVP_CODE_APN_Configuration_Profile, c_profile, d.MAND, d.VENDOR_3GPP))
+	}
+	if s.TAUTimer != 0 {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Subscribed_Periodic_RAU_TAU_Timer, s.TAUTimer, d.MAND, d.VENDOR_3GPP))
+	}
+	return d.AVP_Group(d.AVP_CODE_Subscription_Data, c_avps, d.MAND, d.VENDOR_3GPP), nil
+}
+
+// AVP builds the APN-Configuration.
+func (a APN) AVP() d.AVP {
+	c_qci, c_priority := a.QCI, a.PriorityLevel
+	if c_qci == 0 {
+		c_qci = 9
+	}
+	if c_priority == 0 {
+		c_priority = 15
+	}
+	c_avps := []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Context_Identifier, a.ContextId, d.MAND, d.VENDOR_3GPP),
+		d.AVP_Enumerated(d.AVP_CODE_PDN_Type, a.PDNType, d.MAND, d.VENDOR_3GPP),
+		d.AVP_UTF8String(d.AVP_CODE_Service_Selection, a.Name, d.MAND, 0),
+		d.AVP_Group(d.AVP_CODE_EPS_Subscribed_QoS_Profile, []d.AVP{
+			d.AVP_Enumerated(d.AVP_CODE_QoS_Class_Identifier, c_qci, d.MAND, d.VENDOR_3GPP),
+			d.AVP_Group(d.AVP_CODE_Allocation_Retention_Priority, []d.AVP{
+				d.AVP_Unsigned32(d.AVP_CODE_Priority_Level, c_priority, d.MAND, d.VENDOR_3GPP),
+				d.AVP_Enumerated(d.AVP_CODE_Pre_emption_Capability, a.PreEmptionCapability, d.NOT_MAND, d.VENDOR_3GPP),
+				d.AVP_Enumerated(d.AVP_CODE_Pre_emption_Vulnerability, a.PreEmptionVulnerability, d.NOT_MAND, d.VENDOR_3GPP),
+			}, d.MAND, d.VENDOR_3GPP),
+		}, d.MAND, d.VENDOR_3GPP),
+	}
+	if a.AMBRUL != 0 || a.AMBRDL != 0 {
+		c_avps = append(c_avps, ambr(a.AMBRUL, a.AMBRDL))
+	}
+	return d.AVP_Group(d.AVP_CODE_APN_Configuration, c_avps, d.MAND, d.VENDOR_3GPP)
+}
+
+func ambr(ul uint32, dl uint32) d.AVP {
+	return d.AVP_Group(d.AVP_CODE_AMBR, []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Max_Requested_Bandwidth_UL, ul, d.MAND, d.VENDOR_3GPP),
+		d.AVP_Unsigned32(d.AVP_CODE_Max_Requested_Bandwidth_DL, dl, d.MAND, d.VENDOR_3GPP),
+	}, d.MAND, d.VENDOR_3GPP)
+}
+
+// SubscriptionOf reads the Subscription-Data of an ULA or IDR, nil if msg
+// has none.
+func SubscriptionOf(msg *d.Message) *Subscription {
+	c_avp := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Subscription_Data)
+	if c_avp == nil {
+		return nil
+	}
+	ret := ParseSubscription(c_avp)
+	return &ret
+}
+
+// ParseSubscription decodes a Subscription-Data, the AVPs not in
+// Subscription are skipped.
+func ParseSubscription(avp *d.AVP) Subscription {
+	var ret Subscription
+	for _, v := range avp.GetGroupAVPs() {
+		if v.GetVendorId() != d.VENDOR_3GPP {
+			continue
+		}
+		switch v.GetAVPCode() {
+		case d.AVP_CODE_Subscriber_Status:
+			ret.Status = int32(v.GetIntValue())
+		case d.AVP_CODE_MSISDN:
+			if c_val, ok := v.GetValue().([]byte); ok {
+				ret.MSISDN = d.TBCDDecode(c_val)
+			}
+		case d.AVP_CODE_Network_Access_Mode:
+			ret.NetworkAccessMode = int32(v.GetIntValue())
+		case d.AVP_CODE_Access_Restriction_Data:
+			ret.AccessRestriction = uint32(v.GetIntValue())
+		case d.AVP_CODE_AMBR:
+			ret.AMBRUL, ret.AMBRDL = parseAMBR(&v)
+		case d.AVP_CODE_APN_Configuration_Profile:
+			for _, w := range v.GetGroupAVPs() {
+				switch w.GetAVPCode() {
+				case d.AVP_CODE_Context_Identifier:
+					ret.DefaultContextId = uint32(w.GetIntValue())
+				case d.AVP_CODE_APN_Configuration:
+					ret.APNs = append(ret.APNs, parseAPN(&w))
+				}
+			}
+		case d.AVP_CODE_Subscribed_Periodic_RAU_TAU_Timer:
+			ret.TAUTimer = uint32(v.GetIntValue())
+		}
+	}
+	return ret
+}
+
+func parseAPN(avp *d.AVP) APN {
+	var ret APN
+	for _, v := range avp.GetGroupAVPs() {
+		switch v.GetAVPCode() {
+		case d.AVP_CODE_Context_Identifier:
+			ret.ContextId = uint32(v.GetIntValue())
+		case d.AVP_CODE_PDN_Type:
+			ret.PDNType = int32(v.GetIntValue())
+		case d.AVP_CODE_Service_Selection:
+			ret.Name = v.GetStringValue()
+		case d.AVP_CODE_AMBR:
+			ret.AMBRUL, ret.AMBRDL = parseAMBR(&v)
+		case d.AVP_CODE_EPS_Subscribed_QoS_Profile:
+			if c_qci := v.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_QoS_Class_Identifier); c_qci != nil {
+				ret.QCI = int32(c_qci.GetIntValue())
+			}
+			c_arp := v.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Allocation_Retention_Priority)
+			if c_arp == nil {
+				continue
+			}
+			for _, w := range c_arp.GetGroupAVPs() {
+				switch w.GetAVPCode() {
+				case d.AVP_CODE_Priority_Level:
+					ret.PriorityLevel = uint32(w.GetIntValue())
+				case d.AVP_CODE_Pre_emption_Capability:
+					ret.PreEmptionCapability = int32(w.GetIntValue())
+				case d.AVP_CODE_Pre_emption_Vulnerability:
+					ret.PreEmptionVulnerability = int32(w.GetIntValue())
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func parseAMBR(avp *d.AVP) (ul uint32, dl uint32) {
+	if c_ul := avp.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Max_Requested_Bandwidth_UL); c_ul != nil {
+		ul = uint32(c_ul.GetIntValue())
+	}
+	if c_dl := avp.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Max_Requested_Bandwidth_DL); c_dl != nil {
+		dl = uint32(c_dl.GetIntValue())
+	}
+	return ul, dl
+}
@@ -0,0 +1,184 @@
+package s6a
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+)
+
+// ErrMACFailure is an AUTN or AUTS not made with the key of the Milenage.
+var ErrMACFailure = errors.New("milenage: MAC failure")
+
+// Vector is an authentication vector of the HSS (3GPP TS 33.401), the
+// E-UTRAN vector carries KASME, the UTRAN one CK and IK.
+type Vector struct {
+	RAND  []byte
+	XRES  []byte
+	AUTN  []byte
+	KASME []byte
+	CK    []byte
+	IK    []byte
+}
+
+// NewVector generates the vector of rand (16 bytes), sqn and amf (2
+// bytes), KASME is bound to the serving network plmn_id, the
+// Visited-PLMN-Id.
+func NewVector(m *Milenage, rand []byte, sqn uint64, amf []byte, plmn_id []byte) (Vector, error) {
+	if len(amf) < 2 {
+		return Vector{}, fmt.Errorf("AMF of %d bytes", len(amf))
+	}
+	c_sqn := sqnBytes(sqn)
+	c_res, c_ck, c_ik, c_ak := m.F2345(rand)
+	c_autn := append([]byte(nil), c_sqn...)
+	xor(c_autn, c_ak)
+	c_sqn_ak := append([]byte(nil), c_autn...)
+	c_autn = append(c_autn, amf[:2]...)
+	c_autn = append(c_autn, m.F1(rand, c_sqn, amf)...)
+	return Vector{
+		RAND:  append([]byte(nil), rand...),
+		XRES:  c_res,
+		AUTN:  c_autn,
+		KASME: KASME(c_ck, c_ik, plmn_id, c_sqn_ak),
+		CK:    c_ck,
+		IK:    c_ik,
+	}, nil
+}
+
+// KASME derives the key of 3GPP TS 33.401 annex A.2 from CK, IK, the
+// serving network id and SQN xor AK.
+func KASME(ck []byte, ik []byte, plmn_id []byte, sqn_ak []byte) []byte {
+	c_s := []byte{0x10}
+	c_s = append(c_s, plmn_id...)
+	c_s = append(c_s, 0x00, byte(len(plmn_id)))
+	c_s = append(c_s, sqn_ak...)
+	c_s = append(c_s, 0x00, byte(len(sqn_ak)))
+	c_mac := hmac.New(sha256.New, append(append([]byte(nil), ck...), ik...))
+	c_mac.Write(c_s)
+	return c_mac.Sum(nil)
+}
+
+// EUTRANAVP is the E-UTRAN-Vector of an Authentication-Info, item is its
+// Item-Number.
+func (v Vector) EUTRANAVP(item uint32) d.AVP {
+	return d.AVP_Group(d.AVP_CODE_E_UTRAN_Vector, []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Item_Number, item, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_RAND, v.RAND, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_XRES, v.XRES, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_AUTN, v.AUTN, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_KASME, v.KASME, d.MAND, d.VENDOR_3GPP),
+	}, d.MAND, d.VENDOR_3GPP)
+}
+
+// UTRANAVP is the UTRAN-Vector of an Authentication-Info.
+func (v Vector) UTRANAVP(item uint32) d.AVP {
+	return d.AVP_Group(d.AVP_CODE_UTRAN_Vector, []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Item_Number, item, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_RAND, v.RAND, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_XRES, v.XRES, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_AUTN, v.AUTN, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_Confidentiality_Key, v.CK, d.MAND, d.VENDOR_3GPP),
+		d.AVP_OctetString(d.AVP_CODE_Integrity_Key, v.IK, d.MAND, d.VENDOR_3GPP),
+	}, d.MAND, d.VENDOR_3GPP)
+}
+
+// VectorsOf reads the E-UTRAN and the UTRAN vectors of the
+// Authentication-Info of an AIA.
+func VectorsOf(msg *d.Message) (eutran []Vector, utran []Vector) {
+	c_info := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Authentication_Info)
+	if c_info == nil {
+		return nil, nil
+	}
+	for _, v := range c_info.GetGroupAVPs() {
+		if v.GetVendorId() != d.VENDOR_3GPP {
+			continue
+		}
+		switch v.GetAVPCode() {
+		case d.AVP_CODE_E_UTRAN_Vector:
+			eutran = append(eutran, parseVector(&v))
+		case d.AVP_CODE_UTRAN_Vector:
+			utran = append(utran, parseVector(&v))
+		}
+	}
+	return eutran, utran
+}
+
+func parseVector(avp *d.AVP) Vector {
+	var ret Vector
+	for _, v := range avp.GetGroupAVPs() {
+		c_val, _ := v.GetValue().([]byte)
+		switch v.GetAVPCode() {
+		case d.AVP_CODE_RAND:
+			ret.RAND = c_val
+		case d.AVP_CODE_XRES:
+			ret.XRES = c_val
+		case d.AVP_CODE_AUTN:
+			ret.AUTN = c_val
+		case d.AVP_CODE_KASME:
+			ret.KASME = c_val
+		case d.AVP_CODE_Confidentiality_Key:
+			ret.CK = c_val
+		case d.AVP_CODE_Integrity_Key:
+			ret.IK = c_val
+		}
+	}
+	return ret
+}
+
+// Resync returns SQN_MS of a Re-Synchronization-Info, the RAND and the
+// AUTS of the UE.
+func (m *Milenage) Resync(info []byte) (uint64, error) {
+	if len(info) != 30 {
+		return 0, fmt.Errorf("Re-Synchronization-Info of %d bytes", len(info))
+	}
+	c_rand, c_auts := info[:16], info[16:]
+	c_sqn := append([]byte(nil), c_auts[:6]...)
+	xor(c_sqn, m.F5Star(c_rand))
+	if !hmac.Equal(m.F1Star(c_rand, c_sqn, []byte{0, 0}), c_auts[6:]) {
+		return 0, ErrMACFailure
+	}
+	return sqnValue(c_sqn), nil
+}
+
+// Check verifies autn the way a USIM does and returns RES, CK, IK and the
+// SQN of the network. The freshness of the SQN is left to the caller.
+func (m *Milenage) Check(rand []byte, autn []byte) (res []byte, ck []byte, ik []byte, sqn uint64, err error) {
+	if len(autn) != 16 {
+		return nil, nil, nil, 0, fmt.Errorf("AUTN of %d bytes", len(autn))
+	}
+	res, ck, ik, c_ak := m.F2345(rand)
+	c_sqn := append([]byte(nil), autn[:6]...)
+	xor(c_sqn, c_ak)
+	if !hmac.Equal(m.F1(rand, c_sqn, autn[6:8]), autn[8:]) {
+		return nil, nil, nil, 0, ErrMACFailure
+	}
+	return res, ck, ik, sqnValue(c_sqn), nil
+}
+
+// AUTS is the resynchronisation token of a USIM with sqn_ms for rand, the
+// Re-Synchronization-Info is rand followed by it.
+func (m *Milenage) AUTS(rand []byte, sqn_ms uint64) []byte {
+	c_sqn := sqnBytes(sqn_ms)
+	ret := append([]byte(nil), c_sqn...)
+	xor(ret, m.F5Star(rand))
+	return append(ret, m.F1Star(rand, c_sqn, []byte{0, 0})...)
+}
+
+// sqnBytes is the 48 bit SQN.
+func sqnBytes(sqn uint64) []byte {
+	ret := make([]byte, 6)
+	for i := 5; i >= 0; i-- {
+		ret[i] = byte(sqn)
+		sqn >>= 8
+	}
+	return ret
+}
+
+func sqnValue(b []byte) uint64 {
+	var ret uint64
+	for _, v := range b {
+		ret = ret<<8 | uint64(v)
+	}
+	return ret
+}
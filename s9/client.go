@@ -0,0 +1,158 @@
+// Package s9 is the S9 roaming interface (3GPP TS 29.215) between the
+// V-PCRF and the H-PCRF: the V-PCRF side in Client and the helpers mapping
+// the Gx sessions of the visited network to S9 subsessions.
+//
+// An S9 session is kept per roaming UE, each of its Gx (or Gxx) sessions is
+// a subsession. The CCRs of the V-PCRF carry a Subsession-Enforcement-Info
+// per subsession established, modified or terminated; the CCAs and the RARs
+// of the H-PCRF a Subsession-Decision-Info with the PCC rules, event
+// triggers and QoS of the subsession, in their Gx form. EnforcementOf and
+// DecisionOf map a Gx message to the subsession group, ParseSubsession and
+// RulesOf take it apart.
+//
+// A Client sends the CCRs of its sessions on the send channel of a DiamConn
+// and gets the answers through Handle (or Run).
+//
+//	cl := s9.NewClient(&diam_conn, send_ch, s9.ClientConfig{Callbacks: cbs})
+//	cl.Register(&diam_conn)
+//	go cl.Run(rcv_ch, nil)
+//	s := cl.NewSession()
+//	s.Start(subscription_ids, s9.EnforcementInfo(s.NextSubsession(), d.ENUM_SUBSESSION_OPERATION_ESTABLISHMENT, avps))
+//	s.Terminate(nil)
+package s9
+
+import (
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/gx"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+const (
+	default_tx = 10 * time.Second
+)
+
+// Callbacks report the life of the sessions to the application, every field
+// may be nil. They are called without locks held.
+type Callbacks struct {
+	OnStateChange func(s *Session, from State, to State)
+	// OnAnswer gets every CCA of the session.
+	OnAnswer func(s *Session, cca d.Message)
+	// OnDecision gets the Subsession-Decision-Infos of the CCAs and RARs
+	// with the rules they installed and removed.
+	OnDecision func(s *Session, dec Subsession, installed []gx.Rule, removed []gx.Rule)
+	// OnTerminate tells the S9 session is over, err is nil after a
+	// successful CCR-T.
+	OnTerminate func(s *Session, err error)
+}
+
+// ClientConfig sets up a Client.
+type ClientConfig struct {
+	// Tx is the answer timeout, 10s if zero.
+	Tx        time.Duration
+	Callbacks Callbacks
+}
+
+// Client runs the S9 sessions of a V-PCRF on one connection.
+type Client struct {
+	base     app.Base
+	conf     ClientConfig
+	mtx      sync.Mutex
+	sessions map[string]*Session
+	pending  map[uint32]*Session
+}
+
+// NewClient creates a client sending on send_ch, the send channel of c.
+func NewClient(c app.Conn, send_ch chan d.Message, conf ClientConfig) *Client {
+	if conf.Tx <= 0 {
+		conf.Tx = default_tx
+	}
+	return &Client{
+		base:     app.NewBase("s9 client", c, send_ch),
+		conf:     conf,
+		sessions: make(map[string]*Session),
+		pending:  make(map[uint32]*Session),
+	}
+}
+
+// NewSession creates an idle session with a new Session-Id.
+func (cl *Client) NewSession() *Session {
+	return &Session{
+		cl:   cl,
+		id:   cl.base.Conn().Gen_Session_Id(),
+		subs: make(map[uint32]*subsession),
+	}
+}
+
+// Session returns the active session with the Session-Id id.
+func (cl *Client) Session(id string) (*Session, bool) {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	s, ok := cl.sessions[id]
+	return s, ok
+}
+
+// Sessions returns the active sessions.
+func (cl *Client) Sessions() []*Session {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	var ret []*Session
+	for _, v := range cl.sessions {
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// Run handles the messages of rcv_ch until it is closed. The messages that
+// are not for the client go to rest, or are dropped if rest is nil.
+func (cl *Client) Run(rcv_ch chan d.Message, rest chan d.Message) {
+	cl.base.Run(rcv_ch, rest, cl.Handle)
+}
+
+// Handle processes a received message: the CCAs of the sessions and the
+// RARs of S9. It returns false for other messages.
+func (cl *Client) Handle(msg d.Message) bool {
+	if msg.GetAppId() != d.APPID_S9 {
+		return false
+	}
+	switch {
+	case msg.GetCmdCode() == d.CC_CREDIT_CONTROL && msg.IsAnswer():
+		cl.mtx.Lock()
+		s, ok := cl.pending[msg.Get_hop_by_hop()]
+		cl.mtx.Unlock()
+		if !ok {
+			l.Warn.Printf("s9 client: CCA without CCR, hop-by-hop 0x%08x session %s", msg.Get_hop_by_hop(), app.SessionId(&msg))
+			return true
+		}
+		s.answer(msg)
+		return true
+	case msg.GetCmdCode() == d.CC_RE_AUTH && msg.IsRequest():
+		if c_ans, ok := cl.HandleRequest(msg); ok {
+			cl.base.Send(c_ans)
+		}
+		return true
+	}
+	return false
+}
+
+// Register makes r answer the S9 RARs with the client.
+func (cl *Client) Register(r app.Registry) {
+	r.Handle(d.CC_RE_AUTH, d.APPID_S9, cl.HandleRequest)
+}
+
+// HandleRequest answers a RAR, it is a conn.RequestHandler. The decisions
+// of the RAR are applied to the subsessions.
+func (cl *Client) HandleRequest(req d.Message) (d.Message, bool) {
+	c_id := app.SessionId(&req)
+	cl.mtx.Lock()
+	s, ok := cl.sessions[c_id]
+	cl.mtx.Unlock()
+	if !ok {
+		l.Warn.Println("s9 client: RAR for unknown session", c_id)
+		return cl.base.AnswerTo(req, d.UNKNOWN_SESSION_ID), true
+	}
+	s.reAuth(req)
+	return cl.base.AnswerTo(req, d.SUCCESS), true
+}
@@ -0,0 +1,481 @@
+package s9
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/gx"
+	l "github.com/lehotomi/diam/mlog"
+	"sort"
+	"time"
+)
+
+// State is the state of an S9 session of the V-PCRF.
+type State int
+
+const (
+	STATE_IDLE State = iota
+	STATE_PENDING_I
+	STATE_PENDING_U
+	STATE_PENDING_T
+	STATE_OPEN
+)
+
+var state_names map[State]string = map[State]string{
+	STATE_IDLE:      "Idle",
+	STATE_PENDING_I: "PendingI",
+	STATE_PENDING_U: "PendingU",
+	STATE_PENDING_T: "PendingT",
+	STATE_OPEN:      "Open",
+}
+
+func (st State) String() string {
+	if c_name, ok := state_names[st]; ok {
+		return c_name
+	}
+	return fmt.Sprintf("State(%d)", int(st))
+}
+
+var (
+	ErrTxExpired  = errors.New("no answer within Tx")
+	ErrWrongState = errors.New("request not allowed in this state")
+)
+
+// Session is the S9 session of a roaming UE.
+type Session struct {
+	cl         *Client
+	id         string
+	state      State
+	req_number uint32
+	hop_by_hop uint32
+	tx_timer   *time.Timer
+	last_sub   uint32
+	subs       map[uint32]*subsession
+	// ops are the Subsession-Operations of the pending CCR.
+	ops map[uint32]int32
+}
+
+// subsession is the policy the H-PCRF decided for a subsession.
+type subsession struct {
+	rules      map[string]gx.Rule
+	base_rules map[string]gx.Rule
+	triggers   map[int32]bool
+	qos        *d.AVP
+}
+
+func (s *Session) Id() string {
+	return s.id
+}
+
+func (s *Session) State() State {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	return s.state
+}
+
+// NextSubsession returns a Subsession-Id not used in the session yet.
+func (s *Session) NextSubsession() uint32 {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	s.last_sub++
+	return s.last_sub
+}
+
+// Subsessions returns the Subsession-Ids of the established subsessions.
+func (s *Session) Subsessions() []uint32 {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	var ret []uint32
+	for k := range s.subs {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// Rules returns the rules installed in a subsession sorted by name, the
+// base names after the rules.
+func (s *Session) Rules(sub uint32) []gx.Rule {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	c_sub, ok := s.subs[sub]
+	if !ok {
+		return nil
+	}
+	var ret []gx.Rule
+	for _, c_map := range []map[string]gx.Rule{c_sub.rules, c_sub.base_rules} {
+		var c_names []string
+		for k := range c_map {
+			c_names = append(c_names, k)
+		}
+		sort.Strings(c_names)
+		for _, v := range c_names {
+			ret = append(ret, c_map[v])
+		}
+	}
+	return ret
+}
+
+// Triggers returns the Event-Triggers the H-PCRF armed in a subsession.
+func (s *Session) Triggers(sub uint32) []int32 {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	c_sub, ok := s.subs[sub]
+	if !ok {
+		return nil
+	}
+	var ret []int32
+	for k := range c_sub.triggers {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// QoS returns the last QoS-Information of a subsession, nil if none.
+func (s *Session) QoS(sub uint32) *d.AVP {
+	s.cl.mtx.Lock()
+	defer s.cl.mtx.Unlock()
+	if c_sub, ok := s.subs[sub]; ok {
+		return c_sub.qos
+	}
+	return nil
+}
+
+// Start sends the CCR-I of an idle session. avps are e.g. the
+// Subscription-Id of the UE, subsessions the Subsession-Enforcement-Infos of
+// the first subsessions (see EnforcementInfo and EnforcementOf).
+func (s *Session) Start(avps []d.AVP, subsessions ...d.AVP) error {
+	return s.do(func(c_todo *app.Todo) error {
+		return s.sendRequest(d.ENUM_CC_REQUEST_INITIAL, append(avps, subsessions...), []State{STATE_IDLE}, STATE_PENDING_I, c_todo)
+	})
+}
+
+// Update sends a CCR-U establishing, modifying or terminating subsessions.
+func (s *Session) Update(avps []d.AVP, subsessions ...d.AVP) error {
+	return s.do(func(c_todo *app.Todo) error {
+		return s.sendRequest(d.ENUM_CC_REQUEST_UPDATE, append(avps, subsessions...), []State{STATE_OPEN}, STATE_PENDING_U, c_todo)
+	})
+}
+
+// Terminate sends the CCR-T of an open session, ending all its subsessions.
+// A Termination-Cause DIAMETER_LOGOUT is added if avps has none.
+func (s *Session) Terminate(avps []d.AVP) error {
+	if !hasAVP(avps, d.AVP_CODE_Termination_Cause, 0) {
+		avps = append(avps, d.AVP_Enumerated(d.AVP_CODE_Termination_Cause, d.ENUM_TERMINATION_CAUSE_LOGOUT, d.MAND, 0))
+	}
+	return s.do(func(c_todo *app.Todo) error {
+		return s.sendRequest(d.ENUM_CC_REQUEST_TERMINATION, avps, []State{STATE_OPEN, STATE_PENDING_U}, STATE_PENDING_T, c_todo)
+	})
+}
+
+func (s *Session) do(f func(c_todo *app.Todo) error) error {
+	var c_todo app.Todo
+	s.cl.mtx.Lock()
+	err := f(&c_todo)
+	s.cl.mtx.Unlock()
+	c_todo.Run()
+	return err
+}
+
+// sendRequest sends a CCR if the session is in one of the from states. The
+// subsessions of an establishment are added, they are dropped again if the
+// H-PCRF rejects them.
+func (s *Session) sendRequest(c_type int32, avps []d.AVP, from []State, to State, c_todo *app.Todo) error {
+	c_allowed := false
+	for _, v := range from {
+		if s.state == v {
+			c_allowed = true
+		}
+	}
+	if !c_allowed {
+		return fmt.Errorf("%s: CC-Request-Type %d in state %s: %w", s.id, c_type, s.state, ErrWrongState)
+	}
+
+	if c_type == d.ENUM_CC_REQUEST_INITIAL {
+		s.req_number = 0
+	} else {
+		s.req_number++
+	}
+	s.ops = make(map[uint32]int32)
+	for _, v := range avps {
+		if v.GetAVPCode() != d.AVP_CODE_Subsession_Enforcement_Info || v.GetVendorId() != d.VENDOR_3GPP {
+			continue
+		}
+		c_sub := ParseSubsession(&v)
+		s.ops[c_sub.Id] = c_sub.Operation
+		if c_sub.Id > s.last_sub {
+			s.last_sub = c_sub.Id
+		}
+		if _, ok := s.subs[c_sub.Id]; !ok && c_sub.Operation == d.ENUM_SUBSESSION_OPERATION_ESTABLISHMENT {
+			s.subs[c_sub.Id] = &subsession{
+				rules:      make(map[string]gx.Rule),
+				base_rules: make(map[string]gx.Rule),
+				triggers:   make(map[int32]bool),
+			}
+		}
+	}
+	s.stopTx()
+	delete(s.cl.pending, s.hop_by_hop)
+	c_req := s.request(c_type, avps)
+	s.hop_by_hop = c_req.Get_hop_by_hop()
+	s.cl.pending[s.hop_by_hop] = s
+	s.cl.sessions[s.id] = s
+	s.startTx()
+	s.setState(to, c_todo)
+
+	c_todo.Add(func() {
+		s.cl.base.Send(c_req)
+	})
+	return nil
+}
+
+func (s *Session) request(c_type int32, avps []d.AVP) d.Message {
+	cl := s.cl
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, s.id, d.MAND, 0)}
+	c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_S9, d.MAND, 0))
+	c_avps = append(c_avps, cl.base.Origin()...)
+	c_avps = append(c_avps, cl.base.Destination()...)
+	c_avps = append(c_avps,
+		d.AVP_Enumerated(d.AVP_CODE_CC_Request_Type, c_type, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_CC_Request_Number, s.req_number, d.MAND, 0),
+	)
+	c_avps = append(c_avps, avps...)
+	return d.GenMess(d.CC_CREDIT_CONTROL, true, true, d.APPID_S9, cl.base.Conn().NextHopByHop(), 0, c_avps)
+}
+
+func (s *Session) setState(to State, c_todo *app.Todo) {
+	c_from := s.state
+	s.state = to
+	if to == STATE_IDLE {
+		s.stopTx()
+		delete(s.cl.sessions, s.id)
+		s.subs = make(map[uint32]*subsession)
+	}
+	if c_from == to {
+		return
+	}
+	l.Trace.Printf("s9 session %s: %s -> %s", s.id, c_from, to)
+	if cb := s.cl.conf.Callbacks.OnStateChange; cb != nil {
+		c_todo.Add(func() { cb(s, c_from, to) })
+	}
+}
+
+func (s *Session) terminated(err error, c_todo *app.Todo) {
+	s.setState(STATE_IDLE, c_todo)
+	if cb := s.cl.conf.Callbacks.OnTerminate; cb != nil {
+		c_todo.Add(func() { cb(s, err) })
+	}
+}
+
+// answer runs the state machine for a received CCA.
+func (s *Session) answer(cca d.Message) {
+	s.do(func(c_todo *app.Todo) error {
+		if cca.Get_hop_by_hop() != s.hop_by_hop {
+			l.Warn.Printf("s9 session %s: late answer, hop-by-hop 0x%08x", s.id, cca.Get_hop_by_hop())
+			delete(s.cl.pending, cca.Get_hop_by_hop())
+			return nil
+		}
+		delete(s.cl.pending, s.hop_by_hop)
+		s.stopTx()
+		if cb := s.cl.conf.Callbacks.OnAnswer; cb != nil {
+			c_todo.Add(func() { cb(s, cca) })
+		}
+
+		c_result := app.ResultCode(&cca)
+		c_success := c_result >= 2000 && c_result < 3000
+		switch s.state {
+		case STATE_PENDING_I:
+			if !c_success {
+				s.terminated(&app.ResultError{ResultCode: c_result}, c_todo)
+				return nil
+			}
+			s.decide(&cca, c_todo)
+			s.settle(&cca, true)
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_U:
+			if c_result == d.UNKNOWN_SESSION_ID {
+				s.terminated(&app.ResultError{ResultCode: c_result}, c_todo)
+				return nil
+			}
+			// a failed update keeps the subsessions in force
+			if c_success {
+				s.decide(&cca, c_todo)
+			}
+			s.settle(&cca, c_success)
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_T:
+			var err error
+			if !c_success {
+				err = &app.ResultError{ResultCode: c_result}
+			}
+			s.terminated(err, c_todo)
+		}
+		return nil
+	})
+}
+
+// settle ends the Subsession-Operations of the answered CCR: the terminated
+// subsessions and the rejected establishments are dropped.
+func (s *Session) settle(cca *d.Message, c_success bool) {
+	c_results := make(map[uint32]bool)
+	for _, v := range Decisions(cca) {
+		c_results[v.Id] = v.Success()
+	}
+	for k, c_op := range s.ops {
+		c_ok, c_decided := c_results[k]
+		switch {
+		case c_op == d.ENUM_SUBSESSION_OPERATION_TERMINATION && c_success:
+			delete(s.subs, k)
+		case c_op == d.ENUM_SUBSESSION_OPERATION_ESTABLISHMENT && (!c_success || c_decided && !c_ok):
+			l.Warn.Printf("s9 session %s: subsession %d rejected", s.id, k)
+			delete(s.subs, k)
+		}
+	}
+	s.ops = nil
+}
+
+// reAuth applies a RAR. A Session-Release-Cause terminates the session, or
+// the subsession of its decision, after the answer.
+func (s *Session) reAuth(rar d.Message) {
+	var c_released []uint32
+	s.do(func(c_todo *app.Todo) error {
+		c_released = s.decide(&rar, c_todo)
+		return nil
+	})
+	if rar.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Session_Release_Cause) != nil {
+		// the RAA is sent before the CCR, the session sends on the send
+		// channel which may block
+		go func() {
+			if err := s.Terminate(nil); err != nil {
+				l.Warn.Println("s9 session", s.id, "cannot terminate after RAR:", err)
+			}
+		}()
+		return
+	}
+	if len(c_released) == 0 {
+		return
+	}
+	var c_infos []d.AVP
+	for _, v := range c_released {
+		c_infos = append(c_infos, EnforcementInfo(v, d.ENUM_SUBSESSION_OPERATION_TERMINATION, nil))
+	}
+	go func() {
+		if err := s.Update(nil, c_infos...); err != nil {
+			l.Warn.Println("s9 session", s.id, "cannot terminate subsessions after RAR:", err)
+		}
+	}()
+}
+
+// decide applies the Subsession-Decision-Infos of a CCA or a RAR, it
+// returns the subsessions released by the H-PCRF.
+func (s *Session) decide(msg *d.Message, c_todo *app.Todo) []uint32 {
+	var ret []uint32
+	for _, c_dec := range Decisions(msg) {
+		c_sub, ok := s.subs[c_dec.Id]
+		if !ok {
+			l.Warn.Printf("s9 session %s: decision for unknown subsession %d", s.id, c_dec.Id)
+			continue
+		}
+		if !c_dec.Success() {
+			continue
+		}
+		c_installed, c_removed := c_sub.apply(c_dec.AVPs)
+		if hasAVP(c_dec.AVPs, d.AVP_CODE_Session_Release_Cause, d.VENDOR_3GPP) {
+			ret = append(ret, c_dec.Id)
+		}
+		if cb := s.cl.conf.Callbacks.OnDecision; cb != nil {
+			c_val := c_dec
+			c_todo.Add(func() { cb(s, c_val, c_installed, c_removed) })
+		}
+	}
+	return ret
+}
+
+// apply takes the rules, event triggers and QoS of a decision.
+func (sub *subsession) apply(avps []d.AVP) ([]gx.Rule, []gx.Rule) {
+	c_installed, c_removed := RulesOf(avps)
+	for _, v := range c_removed {
+		if v.Base {
+			delete(sub.base_rules, v.Name)
+		} else {
+			delete(sub.rules, v.Name)
+		}
+	}
+	for _, v := range c_installed {
+		if v.Base {
+			sub.base_rules[v.Name] = v
+		} else {
+			sub.rules[v.Name] = v
+		}
+	}
+
+	c_triggers := false
+	for _, v := range avps {
+		switch {
+		case v.GetVendorId() != d.VENDOR_3GPP:
+		case v.GetAVPCode() == d.AVP_CODE_Event_Trigger:
+			if !c_triggers {
+				sub.triggers = make(map[int32]bool)
+				c_triggers = true
+			}
+			if c_val := int32(v.GetIntValue()); c_val != d.ENUM_EVENT_TRIGGER_NO_EVENT_TRIGGERS {
+				sub.triggers[c_val] = true
+			}
+		case v.GetAVPCode() == d.AVP_CODE_QoS_Information:
+			c_val := v
+			sub.qos = &c_val
+		}
+	}
+	return c_installed, c_removed
+}
+
+func (s *Session) startTx() {
+	c_hop_by_hop := s.hop_by_hop
+	s.tx_timer = time.AfterFunc(s.cl.conf.Tx, func() {
+		s.txExpired(c_hop_by_hop)
+	})
+}
+
+func (s *Session) stopTx() {
+	if s.tx_timer != nil {
+		s.tx_timer.Stop()
+		s.tx_timer = nil
+	}
+}
+
+// txExpired gives up the request with c_hop_by_hop: an update keeps the
+// session open without its new subsessions, the other requests end it.
+func (s *Session) txExpired(c_hop_by_hop uint32) {
+	s.do(func(c_todo *app.Todo) error {
+		if s.hop_by_hop != c_hop_by_hop || s.tx_timer == nil {
+			return nil
+		}
+		s.tx_timer = nil
+		delete(s.cl.pending, s.hop_by_hop)
+		l.Warn.Printf("s9 session %s: Tx expired in state %s", s.id, s.state)
+		switch s.state {
+		case STATE_PENDING_U:
+			for k, c_op := range s.ops {
+				if c_op == d.ENUM_SUBSESSION_OPERATION_ESTABLISHMENT {
+					delete(s.subs, k)
+				}
+			}
+			s.ops = nil
+			s.setState(STATE_OPEN, c_todo)
+		case STATE_PENDING_I, STATE_PENDING_T:
+			s.terminated(ErrTxExpired, c_todo)
+		}
+		return nil
+	})
+}
+
+func hasAVP(avps []d.AVP, avp_code uint32, vendor_id uint32) bool {
+	for _, v := range avps {
+		if v.GetAVPCode() == avp_code && v.GetVendorId() == vendor_id {
+			return true
+		}
+	}
+	return false
+}
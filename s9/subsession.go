@@ -0,0 +1,243 @@
+package s9
+
+import (
+	d "github.com/lehotomi/diam/diam"
+	"github.com/lehotomi/diam/gx"
+)
+
+type avpKey struct {
+	code   uint32
+	vendor uint32
+}
+
+// enforcement_avps are the AVPs of a Gx CCR that a Subsession-Enforcement-Info
+// carries.
+var enforcement_avps []avpKey = []avpKey{
+	{d.AVP_CODE_AN_GW_Address, d.VENDOR_3GPP},
+	{d.AVP_CODE_Bearer_Identifier, d.VENDOR_3GPP},
+	{d.AVP_CODE_Bearer_Operation, d.VENDOR_3GPP},
+	{d.AVP_CODE_Packet_Filter_Information, d.VENDOR_3GPP},
+	{d.AVP_CODE_Packet_Filter_Operation, d.VENDOR_3GPP},
+	{d.AVP_CODE_QoS_Information, d.VENDOR_3GPP},
+	{d.AVP_CODE_Framed_IP_Address, 0},
+	{d.AVP_CODE_Framed_IPv6_Prefix, 0},
+	{d.AVP_CODE_CoA_Information, d.VENDOR_3GPP},
+	{d.AVP_CODE_Called_Station_Id, 0},
+	{d.AVP_CODE_PDN_Connection_ID, d.VENDOR_3GPP},
+	{d.AVP_CODE_Bearer_Usage, d.VENDOR_3GPP},
+	{d.AVP_CODE_TFT_Packet_Filter_Information, d.VENDOR_3GPP},
+	{d.AVP_CODE_Online, d.VENDOR_3GPP},
+	{d.AVP_CODE_Offline, d.VENDOR_3GPP},
+	{d.AVP_CODE_Charging_Rule_Report, d.VENDOR_3GPP},
+	{d.AVP_CODE_IP_CAN_Type, d.VENDOR_3GPP},
+	{d.AVP_CODE_RAT_Type, d.VENDOR_3GPP},
+	{d.AVP_CODE_Event_Trigger, d.VENDOR_3GPP},
+	{d.AVP_CODE_Event_Report_Indication, d.VENDOR_3GPP},
+	{d.AVP_CODE_Access_Network_Charging_Address, d.VENDOR_3GPP},
+	{d.AVP_CODE_Access_Network_Charging_Identifier_Gx, d.VENDOR_3GPP},
+	{d.AVP_CODE_TGPP_SGSN_MCC_MNC, d.VENDOR_3GPP},
+	{d.AVP_CODE_TGPP_User_Location_Info, d.VENDOR_3GPP},
+	{d.AVP_CODE_TGPP_MS_TimeZone, d.VENDOR_3GPP},
+	{d.AVP_CODE_Default_EPS_Bearer_QoS, d.VENDOR_3GPP},
+	{d.AVP_CODE_Usage_Monitoring_Information, d.VENDOR_3GPP},
+	{d.AVP_CODE_Multiple_BBERF_Action, d.VENDOR_3GPP},
+}
+
+// decision_avps are the AVPs of a Gx CCA or RAR that a
+// Subsession-Decision-Info carries.
+var decision_avps []avpKey = []avpKey{
+	{d.AVP_CODE_Result_Code, 0},
+	{d.AVP_CODE_Experimental_Result, 0},
+	{d.AVP_CODE_Charging_Rule_Remove, d.VENDOR_3GPP},
+	{d.AVP_CODE_Charging_Rule_Install, d.VENDOR_3GPP},
+	{d.AVP_CODE_Event_Trigger, d.VENDOR_3GPP},
+	{d.AVP_CODE_QoS_Information, d.VENDOR_3GPP},
+	{d.AVP_CODE_Default_EPS_Bearer_QoS, d.VENDOR_3GPP},
+	{d.AVP_CODE_Bearer_Control_Mode, d.VENDOR_3GPP},
+	{d.AVP_CODE_Online, d.VENDOR_3GPP},
+	{d.AVP_CODE_Offline, d.VENDOR_3GPP},
+	{d.AVP_CODE_Usage_Monitoring_Information, d.VENDOR_3GPP},
+	{d.AVP_CODE_Session_Release_Cause, d.VENDOR_3GPP},
+	{d.AVP_CODE_Revalidation_Time, d.VENDOR_3GPP},
+}
+
+// Subsession is a parsed Subsession-Enforcement-Info or
+// Subsession-Decision-Info.
+type Subsession struct {
+	Id uint32
+	// Operation is the Subsession-Operation of an enforcement info, -1
+	// without one.
+	Operation int32
+	// ResultCode is the Result-Code or the Experimental-Result-Code of a
+	// decision, 0 without one.
+	ResultCode uint32
+	// AVPs are the other AVPs of the group, as they are on Gx.
+	AVPs []d.AVP
+}
+
+// Success tells if the subsession has no result or a 2xxx one.
+func (sub Subsession) Success() bool {
+	return sub.ResultCode == 0 || sub.ResultCode >= 2000 && sub.ResultCode < 3000
+}
+
+// EnforcementInfo creates a Subsession-Enforcement-Info, op is a
+// Subsession-Operation.
+func EnforcementInfo(id uint32, op int32, avps []d.AVP) d.AVP {
+	c_avps := []d.AVP{
+		d.AVP_Unsigned32(d.AVP_CODE_Subsession_Id, id, d.MAND, d.VENDOR_3GPP),
+		d.AVP_Enumerated(d.AVP_CODE_Subsession_Operation, op, d.MAND, d.VENDOR_3GPP),
+	}
+	return d.AVP_Group(d.AVP_CODE_Subsession_Enforcement_Info, append(c_avps, avps...), d.MAND, d.VENDOR_3GPP)
+}
+
+// DecisionInfo creates a Subsession-Decision-Info, with a Result-Code if
+// result is not zero.
+func DecisionInfo(id uint32, result uint32, avps []d.AVP) d.AVP {
+	c_avps := []d.AVP{d.AVP_Unsigned32(d.AVP_CODE_Subsession_Id, id, d.MAND, d.VENDOR_3GPP)}
+	if result != 0 {
+		c_avps = append(c_avps, d.AVP_Unsigned32(d.AVP_CODE_Result_Code, result, d.MAND, 0))
+	}
+	return d.AVP_Group(d.AVP_CODE_Subsession_Decision_Info, append(c_avps, avps...), d.MAND, d.VENDOR_3GPP)
+}
+
+// EnforcementOf maps a Gx CCR to the Subsession-Enforcement-Info of the
+// subsession id: the CC-Request-Type gives the Subsession-Operation.
+func EnforcementOf(id uint32, ccr *d.Message) d.AVP {
+	c_op := int32(d.ENUM_SUBSESSION_OPERATION_MODIFICATION)
+	if c_type := ccr.FindAVP(0, d.AVP_CODE_CC_Request_Type); c_type != nil {
+		c_op = Operation(int32(c_type.GetIntValue()))
+	}
+	return EnforcementInfo(id, c_op, pick(ccr.GetAVPs(), enforcement_avps))
+}
+
+// DecisionOf maps a Gx CCA or RAR to the Subsession-Decision-Info of the
+// subsession id, with the result of the CCA.
+func DecisionOf(id uint32, msg *d.Message) d.AVP {
+	return DecisionInfo(id, 0, pick(msg.GetAVPs(), decision_avps))
+}
+
+// Operation is the Subsession-Operation of a Gx CC-Request-Type.
+func Operation(cc_request_type int32) int32 {
+	switch cc_request_type {
+	case d.ENUM_CC_REQUEST_INITIAL:
+		return d.ENUM_SUBSESSION_OPERATION_ESTABLISHMENT
+	case d.ENUM_CC_REQUEST_TERMINATION:
+		return d.ENUM_SUBSESSION_OPERATION_TERMINATION
+	}
+	return d.ENUM_SUBSESSION_OPERATION_MODIFICATION
+}
+
+// RequestType is the Gx CC-Request-Type of a Subsession-Operation.
+func RequestType(op int32) int32 {
+	switch op {
+	case d.ENUM_SUBSESSION_OPERATION_ESTABLISHMENT:
+		return d.ENUM_CC_REQUEST_INITIAL
+	case d.ENUM_SUBSESSION_OPERATION_TERMINATION:
+		return d.ENUM_CC_REQUEST_TERMINATION
+	}
+	return d.ENUM_CC_REQUEST_UPDATE
+}
+
+// ParseSubsession parses a Subsession-Enforcement-Info or a
+// Subsession-Decision-Info.
+func ParseSubsession(avp *d.AVP) Subsession {
+	ret := Subsession{Operation: -1}
+	for _, v := range avp.GetGroupAVPs() {
+		switch {
+		case v.GetAVPCode() == d.AVP_CODE_Subsession_Id && v.GetVendorId() == d.VENDOR_3GPP:
+			ret.Id = uint32(v.GetIntValue())
+		case v.GetAVPCode() == d.AVP_CODE_Subsession_Operation && v.GetVendorId() == d.VENDOR_3GPP:
+			ret.Operation = int32(v.GetIntValue())
+		case v.GetAVPCode() == d.AVP_CODE_Result_Code && v.GetVendorId() == 0:
+			ret.ResultCode = uint32(v.GetIntValue())
+		case v.GetAVPCode() == d.AVP_CODE_Experimental_Result && v.GetVendorId() == 0:
+			if c_code := v.FindAVP(0, d.AVP_CODE_Experimental_Result_Code); c_code != nil {
+				ret.ResultCode = uint32(c_code.GetIntValue())
+			}
+		default:
+			ret.AVPs = append(ret.AVPs, v)
+		}
+	}
+	return ret
+}
+
+// Enforcements returns the Subsession-Enforcement-Infos of a CCR or a RAA.
+func Enforcements(msg *d.Message) []Subsession {
+	return parseAll(msg.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Subsession_Enforcement_Info))
+}
+
+// Decisions returns the Subsession-Decision-Infos of a CCA or a RAR.
+func Decisions(msg *d.Message) []Subsession {
+	return parseAll(msg.FindAVPs(d.VENDOR_3GPP, d.AVP_CODE_Subsession_Decision_Info))
+}
+
+// RulesOf returns the rules installed and removed by the
+// Charging-Rule-Install and Charging-Rule-Remove AVPs of avps, the Gx rules
+// of a subsession decision.
+func RulesOf(avps []d.AVP) (installed []gx.Rule, removed []gx.Rule) {
+	for _, c_group := range avps {
+		if c_group.GetVendorId() != d.VENDOR_3GPP {
+			continue
+		}
+		c_install := c_group.GetAVPCode() == d.AVP_CODE_Charging_Rule_Install
+		if !c_install && c_group.GetAVPCode() != d.AVP_CODE_Charging_Rule_Remove {
+			continue
+		}
+		for _, v := range c_group.GetGroupAVPs() {
+			var c_rule gx.Rule
+			switch {
+			case v.GetVendorId() != d.VENDOR_3GPP:
+				continue
+			case v.GetAVPCode() == d.AVP_CODE_Charging_Rule_Definition && c_install:
+				c_def := v
+				c_name := c_def.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_Charging_Rule_Name)
+				if c_name == nil {
+					continue
+				}
+				c_rule = gx.Rule{Name: nameOf(c_name), Definition: &c_def}
+			case v.GetAVPCode() == d.AVP_CODE_Charging_Rule_Name:
+				c_rule = gx.Rule{Name: nameOf(&v)}
+			case v.GetAVPCode() == d.AVP_CODE_Charging_Rule_Base_Name:
+				c_rule = gx.Rule{Name: v.GetStringValue(), Base: true}
+			default:
+				continue
+			}
+			if c_install {
+				installed = append(installed, c_rule)
+			} else {
+				removed = append(removed, c_rule)
+			}
+		}
+	}
+	return installed, removed
+}
+
+func parseAll(avps []*d.AVP) []Subsession {
+	var ret []Subsession
+	for _, v := range avps {
+		ret = append(ret, ParseSubsession(v))
+	}
+	return ret
+}
+
+// pick returns the AVPs of avps that are in keys.
+func pick(avps []d.AVP, keys []avpKey) []d.AVP {
+	var ret []d.AVP
+	for _, v := range avps {
+		for _, k := range keys {
+			if v.GetAVPCode() == k.code && v.GetVendorId() == k.vendor {
+				ret = append(ret, v)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// nameOf is the text of a Charging-Rule-Name, an OctetString.
+func nameOf(avp *d.AVP) string {
+	if c_val, ok := avp.GetValue().([]byte); ok {
+		return string(c_val)
+	}
+	return avp.GetStringValue()
+}
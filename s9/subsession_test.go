@@ -0,0 +1,119 @@
+package s9
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if err := d.InitWith("../dict", d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// decode reads back msg from its encoding.
+func decode(t *testing.T, msg d.Message) d.Message {
+	t.Helper()
+	ret, err := d.DecodeMessage(msg.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestOperation(t *testing.T) {
+	for _, c := range []struct {
+		cc_request_type int32
+		op              int32
+	}{
+		{d.ENUM_CC_REQUEST_INITIAL, d.ENUM_SUBSESSION_OPERATION_ESTABLISHMENT},
+		{d.ENUM_CC_REQUEST_UPDATE, d.ENUM_SUBSESSION_OPERATION_MODIFICATION},
+		{d.ENUM_CC_REQUEST_TERMINATION, d.ENUM_SUBSESSION_OPERATION_TERMINATION},
+	} {
+		if got := Operation(c.cc_request_type); got != c.op {
+			t.Errorf("CC-Request-Type %d: Subsession-Operation %d, want %d", c.cc_request_type, got, c.op)
+		}
+		if got := RequestType(c.op); got != c.cc_request_type {
+			t.Errorf("Subsession-Operation %d: CC-Request-Type %d, want %d", c.op, got, c.cc_request_type)
+		}
+	}
+}
+
+// TestEnforcementOf maps a Gx CCR to a subsession of an S9 CCR and back,
+// only the AVPs of the subsession are kept.
+func TestEnforcementOf(t *testing.T) {
+	c_gx := d.GenMess(d.CC_CREDIT_CONTROL, true, true, d.APPID_GX, 1, 1, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "pcef.test;1", d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, "pcef.test", d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_CC_Request_Type, d.ENUM_CC_REQUEST_INITIAL, d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_RAT_Type, d.ENUM_RAT_TYPE_EUTRAN, d.MAND, d.VENDOR_3GPP),
+		d.AVP_UTF8String(d.AVP_CODE_Called_Station_Id, "internet", d.MAND, 0),
+	})
+	c_s9 := decode(t, d.GenMess(d.CC_CREDIT_CONTROL, true, true, d.APPID_S9, 1, 1, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "vpcrf.test;1", d.MAND, 0),
+		EnforcementOf(3, &c_gx),
+	}))
+
+	c_subs := Enforcements(&c_s9)
+	if len(c_subs) != 1 {
+		t.Fatalf("%d subsessions", len(c_subs))
+	}
+	got := c_subs[0]
+	if got.Id != 3 || got.Operation != d.ENUM_SUBSESSION_OPERATION_ESTABLISHMENT || got.ResultCode != 0 || !got.Success() {
+		t.Errorf("subsession %+v", got)
+	}
+	if RequestType(got.Operation) != d.ENUM_CC_REQUEST_INITIAL {
+		t.Errorf("CC-Request-Type %d", RequestType(got.Operation))
+	}
+	if len(got.AVPs) != 2 || !got.AVPs[0].IsTheSameAVP(d.VENDOR_3GPP, d.AVP_CODE_RAT_Type) || got.AVPs[0].GetIntValue() != d.ENUM_RAT_TYPE_EUTRAN ||
+		!got.AVPs[1].IsTheSameAVP(0, d.AVP_CODE_Called_Station_Id) || got.AVPs[1].GetStringValue() != "internet" {
+		t.Errorf("AVPs of the subsession %v", got.AVPs)
+	}
+}
+
+// TestDecisionOf maps the Gx answers to subsessions of an S9 CCA with
+// their results and rules.
+func TestDecisionOf(t *testing.T) {
+	c_rule := d.AVP_Group(d.AVP_CODE_Charging_Rule_Install, []d.AVP{
+		d.AVP_OctetString(d.AVP_CODE_Charging_Rule_Name, []byte("web"), d.MAND, d.VENDOR_3GPP),
+		d.AVP_UTF8String(d.AVP_CODE_Charging_Rule_Base_Name, "base", d.MAND, d.VENDOR_3GPP),
+	}, d.MAND, d.VENDOR_3GPP)
+	c_success := d.GenMess(d.CC_CREDIT_CONTROL, false, true, d.APPID_GX, 1, 1, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "pcef.test;1", d.MAND, 0),
+		d.AVP_UTF8String(d.AVP_CODE_Origin_Host, "pcrf.test", d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_Result_Code, d.SUCCESS, d.MAND, 0),
+		c_rule,
+	})
+	c_rejected := d.GenMess(d.CC_CREDIT_CONTROL, false, true, d.APPID_GX, 2, 2, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "pcef.test;2", d.MAND, 0),
+		d.AVP_Group(d.AVP_CODE_Experimental_Result, []d.AVP{
+			d.AVP_Unsigned32(d.AVP_CODE_Vendor_Id, d.VENDOR_3GPP, d.MAND, 0),
+			d.AVP_Unsigned32(d.AVP_CODE_Experimental_Result_Code, d.USER_UNKNOWN, d.MAND, 0),
+		}, d.MAND, 0),
+	})
+	c_s9 := decode(t, d.GenMess(d.CC_CREDIT_CONTROL, false, true, d.APPID_S9, 1, 1, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "vpcrf.test;1", d.MAND, 0),
+		DecisionOf(1, &c_success),
+		DecisionOf(2, &c_rejected),
+	}))
+
+	c_subs := Decisions(&c_s9)
+	if len(c_subs) != 2 {
+		t.Fatalf("%d subsessions", len(c_subs))
+	}
+	if got := c_subs[0]; got.Id != 1 || got.Operation != -1 || got.ResultCode != d.SUCCESS || !got.Success() {
+		t.Errorf("subsession %+v", got)
+	}
+	c_installed, c_removed := RulesOf(c_subs[0].AVPs)
+	if got := fmt.Sprintf("%v %v", c_installed, c_removed); len(c_installed) != 2 || len(c_removed) != 0 ||
+		c_installed[0].Name != "web" || c_installed[0].Base || c_installed[1].Name != "base" || !c_installed[1].Base {
+		t.Errorf("rules %s", got)
+	}
+	if got := c_subs[1]; got.Id != 2 || got.ResultCode != d.USER_UNKNOWN || got.Success() || len(got.AVPs) != 0 {
+		t.Errorf("subsession %+v", got)
+	}
+}
@@ -0,0 +1,229 @@
+// Package sh is the Sh interface (3GPP TS 29.328/29.329) between an
+// application server and the HSS: the AS side requests and the User-Data
+// XML document they carry.
+//
+// Sh keeps no session state, the requests of a Client block until their
+// answer arrives through Handle (or Run), so Run has to go on in another
+// goroutine. The Push-Notification requests of the HSS are answered and
+// reported to ClientConfig.OnNotification.
+//
+//	cl := sh.NewClient(&diam_conn, send_ch, sh.ClientConfig{OnNotification: f})
+//	cl.Register(&diam_conn)
+//	go cl.Run(rcv_ch, nil)
+//	c_id := sh.Identity{PublicIdentity: "sip:alice@ims.test"}
+//	c_data, _, err := cl.Pull(c_id, []int32{d.ENUM_DATA_REFERENCE_REPOSITORY_DATA}, []string{"svc"}, nil)
+package sh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lehotomi/diam/app"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	"sync"
+	"time"
+)
+
+const (
+	default_tx = 10 * time.Second
+)
+
+var ErrTxExpired = errors.New("no answer within Tx")
+
+// ClientConfig sets up a Client.
+type ClientConfig struct {
+	// Tx is the answer timeout, 10s if zero.
+	Tx time.Duration
+	// OnNotification gets the User-Data of a Push-Notification, it may be
+	// nil. It is called before the answer is sent.
+	OnNotification func(id Identity, data *ShData, pnr d.Message)
+}
+
+// Client sends the Sh requests of an AS on one connection.
+type Client struct {
+	base    app.Base
+	conf    ClientConfig
+	mtx     sync.Mutex
+	pending map[uint32]chan d.Message
+}
+
+// NewClient creates a client sending on send_ch, the send channel of c.
+func NewClient(c app.Conn, send_ch chan d.Message, conf ClientConfig) *Client {
+	if conf.Tx <= 0 {
+		conf.Tx = default_tx
+	}
+	return &Client{
+		base:    app.NewBase("sh client", c, send_ch, AppAVPs()...),
+		conf:    conf,
+		pending: make(map[uint32]chan d.Message),
+	}
+}
+
+// Run handles the messages of rcv_ch until it is closed. The messages that
+// are not for the client go to rest, or are dropped if rest is nil.
+func (cl *Client) Run(rcv_ch chan d.Message, rest chan d.Message) {
+	cl.base.Run(rcv_ch, rest, cl.Handle)
+}
+
+// Handle processes a received message: the answers of the requests and the
+// Push-Notifications. It returns false for other messages.
+func (cl *Client) Handle(msg d.Message) bool {
+	if msg.GetAppId() != d.APPID_SH {
+		return false
+	}
+	if msg.IsRequest() {
+		if c_ans, ok := cl.HandleRequest(msg); ok {
+			cl.base.Send(c_ans)
+		}
+		return true
+	}
+	cl.mtx.Lock()
+	c_ch, ok := cl.pending[msg.Get_hop_by_hop()]
+	delete(cl.pending, msg.Get_hop_by_hop())
+	cl.mtx.Unlock()
+	if !ok {
+		l.Warn.Printf("sh client: answer without request, hop-by-hop 0x%08x", msg.Get_hop_by_hop())
+		return true
+	}
+	c_ch <- msg
+	return true
+}
+
+// Register makes r answer the Push-Notifications with the client.
+func (cl *Client) Register(r app.Registry) {
+	r.Handle(d.CC_PUSH_NOTIFICATION, d.APPID_SH, cl.HandleRequest)
+}
+
+// HandleRequest answers a Push-Notification, it is a conn.RequestHandler.
+// Other requests get 3001 with the E flag.
+func (cl *Client) HandleRequest(req d.Message) (d.Message, bool) {
+	if req.GetCmdCode() != d.CC_PUSH_NOTIFICATION {
+		return cl.base.AnswerTo(req, d.COMMAND_UNSUPPORTED), true
+	}
+	c_data, err := UserDataOf(&req)
+	if err != nil || c_data == nil {
+		l.Warn.Println("sh client: Push-Notification without User-Data:", err)
+		return cl.base.AnswerTo(req, d.MISSING_AVP), true
+	}
+	if cb := cl.conf.OnNotification; cb != nil {
+		cb(IdentityOf(&req), c_data, req)
+	}
+	return cl.base.AnswerTo(req, d.SUCCESS), true
+}
+
+// Pull sends a User-Data-Request for the data references refs, the
+// service indications select the repository data.
+func (cl *Client) Pull(id Identity, refs []int32, service_indications []string, avps []d.AVP) (*ShData, d.Message, error) {
+	c_avps, err := cl.userAVPs(id, refs, service_indications)
+	if err != nil {
+		return nil, d.Message{}, err
+	}
+	c_ans, err := cl.Request(d.CC_USER_DATA, append(c_avps, avps...))
+	if err != nil {
+		return nil, c_ans, err
+	}
+	c_data, err := UserDataOf(&c_ans)
+	return c_data, c_ans, err
+}
+
+// Update sends a Profile-Update-Request with the repository data of data,
+// the sequence numbers have to follow the ones of the HSS.
+func (cl *Client) Update(id Identity, data *ShData, avps []d.AVP) (d.Message, error) {
+	c_avps, err := cl.userAVPs(id, []int32{d.ENUM_DATA_REFERENCE_REPOSITORY_DATA}, nil)
+	if err != nil {
+		return d.Message{}, err
+	}
+	c_data, err := data.AVP()
+	if err != nil {
+		return d.Message{}, err
+	}
+	c_avps = append(c_avps, c_data)
+	return cl.Request(d.CC_PROFILE_UPDATE, append(c_avps, avps...))
+}
+
+// Subscribe sends a Subscribe-Notifications-Request for the changes of the
+// data references, with send_data the current data is returned.
+func (cl *Client) Subscribe(id Identity, refs []int32, service_indications []string, send_data bool, avps []d.AVP) (*ShData, d.Message, error) {
+	c_avps, err := cl.userAVPs(id, refs, service_indications)
+	if err != nil {
+		return nil, d.Message{}, err
+	}
+	c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Subs_Req_Type, d.ENUM_SUBS_REQ_TYPE_SUBSCRIBE, d.MAND, d.VENDOR_3GPP))
+	if send_data {
+		c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Send_Data_Indication, d.ENUM_SEND_DATA_INDICATION_REQUESTED, d.MAND, d.VENDOR_3GPP))
+	}
+	c_ans, err := cl.Request(d.CC_SUBSCRIBE_NOTIFICATIONS, append(c_avps, avps...))
+	if err != nil {
+		return nil, c_ans, err
+	}
+	c_data, err := UserDataOf(&c_ans)
+	return c_data, c_ans, err
+}
+
+// Unsubscribe ends a subscription of Subscribe.
+func (cl *Client) Unsubscribe(id Identity, refs []int32, service_indications []string, avps []d.AVP) (d.Message, error) {
+	c_avps, err := cl.userAVPs(id, refs, service_indications)
+	if err != nil {
+		return d.Message{}, err
+	}
+	c_avps = append(c_avps, d.AVP_Enumerated(d.AVP_CODE_Subs_Req_Type, d.ENUM_SUBS_REQ_TYPE_UNSUBSCRIBE, d.MAND, d.VENDOR_3GPP))
+	return cl.Request(d.CC_SUBSCRIBE_NOTIFICATIONS, append(c_avps, avps...))
+}
+
+// Request sends an Sh request with avps after the common AVPs and waits for
+// the answer. A not successful answer is returned with an
+// app.ResultError.
+func (cl *Client) Request(cmd_code uint32, avps []d.AVP) (d.Message, error) {
+	c_avps := []d.AVP{d.AVP_UTF8String(d.AVP_CODE_Session_Id, cl.base.Conn().Gen_Session_Id(), d.MAND, 0)}
+	c_avps = append(c_avps, AppAVPs()...)
+	c_avps = append(c_avps, cl.base.Origin()...)
+	c_avps = append(c_avps, cl.base.Destination()...)
+	c_avps = append(c_avps, avps...)
+	c_req := d.GenMess(cmd_code, true, true, d.APPID_SH, cl.base.Conn().NextHopByHop(), 0, c_avps)
+
+	c_ch := make(chan d.Message, 1)
+	cl.mtx.Lock()
+	cl.pending[c_req.Get_hop_by_hop()] = c_ch
+	cl.mtx.Unlock()
+	cl.base.Send(c_req)
+
+	select {
+	case c_ans := <-c_ch:
+		if c_result := app.ResultCode(&c_ans); c_result < 2000 || c_result >= 3000 {
+			return c_ans, &app.ResultError{ResultCode: c_result}
+		}
+		return c_ans, nil
+	case <-time.After(cl.conf.Tx):
+		cl.mtx.Lock()
+		delete(cl.pending, c_req.Get_hop_by_hop())
+		cl.mtx.Unlock()
+		return d.Message{}, fmt.Errorf("sh request %d: %w", cmd_code, ErrTxExpired)
+	}
+}
+
+func (cl *Client) userAVPs(id Identity, refs []int32, service_indications []string) ([]d.AVP, error) {
+	c_id, err := id.AVP()
+	if err != nil {
+		return nil, err
+	}
+	ret := []d.AVP{c_id}
+	for _, v := range refs {
+		ret = append(ret, d.AVP_Enumerated(d.AVP_CODE_Data_Reference, v, d.MAND, d.VENDOR_3GPP))
+	}
+	for _, v := range service_indications {
+		ret = append(ret, d.AVP_OctetString(d.AVP_CODE_Service_Indication, []byte(v), d.MAND, d.VENDOR_3GPP))
+	}
+	return ret, nil
+}
+
+// AppAVPs are the Vendor-Specific-Application-Id and the
+// Auth-Session-State of every Sh message.
+func AppAVPs() []d.AVP {
+	return []d.AVP{
+		d.AVP_Group(d.AVP_CODE_Vendor_Specific_Application_Id, []d.AVP{
+			d.AVP_Unsigned32(d.AVP_CODE_Vendor_Id, d.VENDOR_3GPP, d.MAND, 0),
+			d.AVP_Unsigned32(d.AVP_CODE_Auth_Application_Id, d.APPID_SH, d.MAND, 0),
+		}, d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_Auth_Session_State, d.ENUM_AUTH_SESSION_NO_STATE_MAINTAINED, d.MAND, 0),
+	}
+}
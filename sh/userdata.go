@@ -0,0 +1,166 @@
+package sh
+
+import (
+	"encoding/xml"
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+)
+
+// IMSUserState values of Sh-IMS-Data.
+const (
+	IMS_USER_STATE_NOT_REGISTERED            = 0
+	IMS_USER_STATE_REGISTERED                = 1
+	IMS_USER_STATE_REGISTERED_UNREG_SERVICES = 2
+	IMS_USER_STATE_AUTHENTICATION_PENDING    = 3
+)
+
+// ShData is the User-Data of Sh, the Sh-Data XML document of 3GPP TS
+// 29.328 annex D. Only the parts used by the HSS stub are typed, the
+// service data and the filter criteria are kept as raw XML.
+type ShData struct {
+	XMLName           xml.Name           `xml:"Sh-Data"`
+	PublicIdentifiers *PublicIdentifiers `xml:"PublicIdentifiers,omitempty"`
+	RepositoryData    []RepositoryData   `xml:"RepositoryData,omitempty"`
+	IMSData           *IMSData           `xml:"Sh-IMS-Data,omitempty"`
+}
+
+type PublicIdentifiers struct {
+	IMSPublicIdentity []string `xml:"IMSPublicIdentity,omitempty"`
+	MSISDN            []string `xml:"MSISDN,omitempty"`
+}
+
+// RepositoryData is the transparent data of an AS, a ServiceData without
+// content deletes it in a Profile-Update.
+type RepositoryData struct {
+	ServiceIndication string  `xml:"ServiceIndication"`
+	SequenceNumber    uint32  `xml:"SequenceNumber"`
+	ServiceData       *RawXML `xml:"ServiceData,omitempty"`
+}
+
+type IMSData struct {
+	SCSCFName string `xml:"S-CSCFName,omitempty"`
+	// IFCs is the content of the IFCs element, InitialFilterCriteria
+	// elements.
+	IFCs         *RawXML `xml:"IFCs,omitempty"`
+	IMSUserState *int    `xml:"IMSUserState,omitempty"`
+}
+
+// RawXML is the content of an element as it is.
+type RawXML struct {
+	Inner string `xml:",innerxml"`
+}
+
+// ParseUserData decodes an Sh-Data document.
+func ParseUserData(data []byte) (*ShData, error) {
+	var ret ShData
+	if err := xml.Unmarshal(data, &ret); err != nil {
+		return nil, fmt.Errorf("Sh-Data: %w", err)
+	}
+	return &ret, nil
+}
+
+// UserDataOf decodes the User-Data of msg, it is nil if msg has none.
+func UserDataOf(msg *d.Message) (*ShData, error) {
+	c_avp := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_User_Data)
+	if c_avp == nil {
+		return nil, nil
+	}
+	c_val, ok := c_avp.GetValue().([]byte)
+	if !ok {
+		c_val = []byte(c_avp.GetStringValue())
+	}
+	return ParseUserData(c_val)
+}
+
+// Marshal encodes the Sh-Data document with an XML declaration.
+func (sd *ShData) Marshal() ([]byte, error) {
+	c_data, err := xml.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), c_data...), nil
+}
+
+// AVP is the User-Data AVP of the document.
+func (sd *ShData) AVP() (d.AVP, error) {
+	c_data, err := sd.Marshal()
+	if err != nil {
+		return d.AVP{}, err
+	}
+	return d.AVP_OctetString(d.AVP_CODE_User_Data, c_data, d.MAND, d.VENDOR_3GPP), nil
+}
+
+// Repository returns the repository data of the service indication, nil
+// if the document has none.
+func (sd *ShData) Repository(service_indication string) *RepositoryData {
+	for i := range sd.RepositoryData {
+		if sd.RepositoryData[i].ServiceIndication == service_indication {
+			return &sd.RepositoryData[i]
+		}
+	}
+	return nil
+}
+
+// Data is the service data, empty if none.
+func (rd *RepositoryData) Data() string {
+	if rd.ServiceData == nil {
+		return ""
+	}
+	return rd.ServiceData.Inner
+}
+
+// Identity is the User-Identity of a request, a public identity (SIP or
+// tel URI) or an MSISDN.
+type Identity struct {
+	PublicIdentity string
+	MSISDN         string
+}
+
+func (id Identity) String() string {
+	if id.PublicIdentity != "" {
+		return id.PublicIdentity
+	}
+	return id.MSISDN
+}
+
+// AVP is the User-Identity AVP, the MSISDN is encoded in TBCD.
+func (id Identity) AVP() (d.AVP, error) {
+	var c_avps []d.AVP
+	if id.PublicIdentity != "" {
+		c_avps = append(c_avps, d.AVP_UTF8String(d.AVP_CODE_Public_Identity, id.PublicIdentity, d.MAND, d.VENDOR_3GPP))
+	}
+	if id.MSISDN != "" {
+		c_msisdn, err := d.TBCDEncode(id.MSISDN)
+		if err != nil {
+			return d.AVP{}, fmt.Errorf("MSISDN: %w", err)
+		}
+		c_avps = append(c_avps, d.AVP_OctetString(d.AVP_CODE_MSISDN, c_msisdn, d.MAND, d.VENDOR_3GPP))
+	}
+	if len(c_avps) == 0 {
+		return d.AVP{}, fmt.Errorf("empty User-Identity")
+	}
+	return d.AVP_Group(d.AVP_CODE_User_Identity, c_avps, d.MAND, d.VENDOR_3GPP), nil
+}
+
+// IdentityOf reads the User-Identity of msg.
+func IdentityOf(msg *d.Message) Identity {
+	var ret Identity
+	c_avp := msg.FindAVP(d.VENDOR_3GPP, d.AVP_CODE_User_Identity)
+	if c_avp == nil {
+		return ret
+	}
+	for _, v := range c_avp.GetGroupAVPs() {
+		if v.GetVendorId() != d.VENDOR_3GPP {
+			continue
+		}
+		switch v.GetAVPCode() {
+		case d.AVP_CODE_Public_Identity:
+			ret.PublicIdentity = v.GetStringValue()
+		case d.AVP_CODE_MSISDN:
+			if c_val, ok := v.GetValue().([]byte); ok {
+				ret.MSISDN = d.TBCDDecode(c_val)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,333 @@
+package templates
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	l "github.com/lehotomi/diam/mlog"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ActionFunc computes the value of a template action. inp is the value of
+// the parameter, or the result of the previous action of a chain, args are
+// the ':' separated arguments of the action.
+//
+//	{{msisdn!tbcd}}            inp: msisdn, no args
+//	{{!random:1000:9999}}      inp: "", args: 1000, 9999
+//	{{x!upper!hex}}            hex gets the result of upper
+type ActionFunc func(inp string, args []string) (string, error)
+
+var actions_mtx sync.RWMutex
+var actions map[string]ActionFunc = map[string]ActionFunc{
+	"now":                actionNow,
+	"add_time":           actionAddTime,
+	"counter":            actionCounter,
+	"uuid":               actionUUID,
+	"session_id":         actionSessionId,
+	"tbcd":               actionTBCD,
+	"mccnmc_to_user_loc": actionUserLocCGI,
+	"tai":                actionUserLocTAI,
+	"ecgi":               actionUserLocECGI,
+	"tai_ecgi":           actionUserLocTAIECGI,
+	"upper":              actionUpper,
+	"lower":              actionLower,
+	"hex":                actionHex,
+	"random":             actionRandom,
+}
+
+// RegisterAction makes f available in templates as {{!name}} or
+// {{param!name}}. A nil f removes the action.
+func RegisterAction(name string, f ActionFunc) {
+	actions_mtx.Lock()
+	defer actions_mtx.Unlock()
+	if f == nil {
+		delete(actions, name)
+		return
+	}
+	actions[name] = f
+}
+
+func lookUpAction(name string) (ActionFunc, bool) {
+	actions_mtx.RLock()
+	defer actions_mtx.RUnlock()
+	f, ok := actions[name]
+	return f, ok
+}
+
+// runAction runs the '!' separated chain of actions on inp.
+func runAction(inp string, action string) (string, error) {
+	c_val := inp
+	for _, c_step := range strings.Split(action, "!") {
+		c_parts := strings.Split(c_step, ":")
+		f, ok := lookUpAction(c_parts[0])
+		if !ok {
+			return "", fmt.Errorf("unknown action %s", c_parts[0])
+		}
+		res, err := f(c_val, c_parts[1:])
+		if err != nil {
+			return "", fmt.Errorf("action %s on '%s': %v", c_step, c_val, err)
+		}
+		c_val = res
+	}
+	return c_val, nil
+}
+
+// parseOffset parses a signed time.Duration, a d suffix is accepted for
+// days (+1d, -2d).
+func parseOffset(in string) (time.Duration, error) {
+	if strings.HasSuffix(in, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(in, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(in)
+}
+
+// now[:offset] current time, e.g. {{!now:+30s}}
+func actionNow(inp string, args []string) (string, error) {
+	t := time.Now()
+	if len(args) > 0 {
+		c_off, err := parseOffset(args[0])
+		if err != nil {
+			return "", err
+		}
+		t = t.Add(c_off)
+	}
+	return t.Format(const_date_format), nil
+}
+
+// add_time:offset moves the input time, e.g. {{start!add_time:-1h}}
+func actionAddTime(inp string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("add_time needs an offset")
+	}
+	t, err := time.Parse(const_date_format, inp)
+	if err != nil {
+		return "", err
+	}
+	c_off, err := parseOffset(args[0])
+	if err != nil {
+		return "", err
+	}
+	return t.Add(c_off).Format(const_date_format), nil
+}
+
+var counters_mtx sync.Mutex
+var counters map[string]uint64 = make(map[string]uint64)
+
+// counter[:name[:start]] returns start (default 1), then start+1, ... for
+// every use of the same counter name.
+func actionCounter(inp string, args []string) (string, error) {
+	c_name := ""
+	var c_start uint64 = 1
+	if len(args) > 0 {
+		c_name = args[0]
+	}
+	if len(args) > 1 {
+		v, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return "", err
+		}
+		c_start = v
+	}
+	counters_mtx.Lock()
+	defer counters_mtx.Unlock()
+	c_val, ok := counters[c_name]
+	if !ok {
+		c_val = c_start
+	}
+	counters[c_name] = c_val + 1
+	return strconv.FormatUint(c_val, 10), nil
+}
+
+// uuid returns a random (version 4) UUID.
+func actionUUID(inp string, args []string) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+var session_start string = strconv.FormatInt(time.Now().Unix(), 10)
+
+// session_id[:origin_host] generates <origin_host>;<start>;<counter>, like
+// DiamConn.Gen_Session_Id. The host is the argument or the input.
+func actionSessionId(inp string, args []string) (string, error) {
+	c_host := inp
+	if len(args) > 0 {
+		c_host = args[0]
+	}
+	if c_host == "" {
+		return "", errors.New("session_id needs an origin host")
+	}
+	c_run, _ := actionCounter("", []string{"!session_id"})
+	return c_host + ";" + session_start + ";" + c_run, nil
+}
+
+// tbcd returns the TBCD encoding of the input as hex, for OctetString AVPs.
+func actionTBCD(inp string, args []string) (string, error) {
+	c_val, err := d.TBCDEncode(inp)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(c_val), nil
+}
+
+// plmnHex encodes a 5 or 6 digit mcc+mnc as the 3 octet PLMN identity.
+func plmnHex(mccmnc string) (string, error) {
+	if len(mccmnc) != 5 && len(mccmnc) != 6 {
+		return "", fmt.Errorf("mccmnc '%s' should have 5 or 6 digits", mccmnc)
+	}
+	c_plmn, err := d.PLMNId(mccmnc[:3], mccmnc[3:])
+	if err != nil {
+		return "", fmt.Errorf("mccmnc '%s' should have 5 or 6 digits", mccmnc)
+	}
+	return hex.EncodeToString(c_plmn), nil
+}
+
+// parseLocId parses a TAC or ECI given in decimal or with 0x prefix.
+func parseLocId(in string, bits int) (uint64, error) {
+	return strconv.ParseUint(in, 0, bits)
+}
+
+// mccnmc_to_user_loc: CGI type 3GPP-User-Location-Info with unknown LAC/CI
+func actionUserLocCGI(inp string, args []string) (string, error) {
+	c_plmn, err := plmnHex(inp)
+	if err != nil {
+		l.Warn.Println("mccnmc is invalid:", inp)
+		return "0012f607ffffffff", nil
+	}
+	return "00" + c_plmn + "ffffffff", nil
+}
+
+// tai:tac TAI type 3GPP-User-Location-Info, the input is the mccmnc
+func actionUserLocTAI(inp string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("tai needs the tac")
+	}
+	c_tai, err := taiHex(inp, args[0])
+	if err != nil {
+		return "", err
+	}
+	return "80" + c_tai, nil
+}
+
+// ecgi:eci ECGI type 3GPP-User-Location-Info, the input is the mccmnc
+func actionUserLocECGI(inp string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("ecgi needs the eci")
+	}
+	c_ecgi, err := ecgiHex(inp, args[0])
+	if err != nil {
+		return "", err
+	}
+	return "81" + c_ecgi, nil
+}
+
+// tai_ecgi:tac:eci TAI and ECGI type 3GPP-User-Location-Info
+func actionUserLocTAIECGI(inp string, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("tai_ecgi needs the tac and the eci")
+	}
+	c_tai, err := taiHex(inp, args[0])
+	if err != nil {
+		return "", err
+	}
+	c_ecgi, err := ecgiHex(inp, args[1])
+	if err != nil {
+		return "", err
+	}
+	return "82" + c_tai + c_ecgi, nil
+}
+
+func taiHex(mccmnc string, tac string) (string, error) {
+	c_plmn, err := plmnHex(mccmnc)
+	if err != nil {
+		return "", err
+	}
+	c_tac, err := parseLocId(tac, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid tac '%s'", tac)
+	}
+	return fmt.Sprintf("%s%04x", c_plmn, c_tac), nil
+}
+
+func ecgiHex(mccmnc string, eci string) (string, error) {
+	c_plmn, err := plmnHex(mccmnc)
+	if err != nil {
+		return "", err
+	}
+	c_eci, err := parseLocId(eci, 28)
+	if err != nil {
+		return "", fmt.Errorf("invalid eci '%s'", eci)
+	}
+	return fmt.Sprintf("%s%08x", c_plmn, c_eci), nil
+}
+
+func actionUpper(inp string, args []string) (string, error) {
+	return strings.ToUpper(inp), nil
+}
+
+func actionLower(inp string, args []string) (string, error) {
+	return strings.ToLower(inp), nil
+}
+
+// hex encodes the input bytes, so text can be used in OctetString AVPs.
+func actionHex(inp string, args []string) (string, error) {
+	return hex.EncodeToString([]byte(inp)), nil
+}
+
+var random_mtx sync.Mutex
+var random_src *mrand.Rand = mrand.New(mrand.NewSource(time.Now().UnixNano()))
+
+// random[:min:max] a random integer between min and max (inclusive),
+// default 0 and 999999999.
+func actionRandom(inp string, args []string) (string, error) {
+	var c_min, c_max int64 = 0, 999999999
+	if len(args) == 2 {
+		var err error
+		if c_min, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+			return "", err
+		}
+		if c_max, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return "", err
+		}
+	} else if len(args) != 0 {
+		return "", errors.New("random needs min and max")
+	}
+	if c_max < c_min {
+		return "", errors.New("random max is less than min")
+	}
+	// the span is computed unsigned, max-min overflows int64 for wide ranges
+	c_span := uint64(c_max) - uint64(c_min)
+	random_mtx.Lock()
+	defer random_mtx.Unlock()
+	return strconv.FormatInt(int64(uint64(c_min)+randomUpTo(c_span)), 10), nil
+}
+
+// randomUpTo returns a uniform random number between 0 and n (inclusive).
+func randomUpTo(n uint64) uint64 {
+	if n < 1<<63-1 {
+		return uint64(random_src.Int63n(int64(n) + 1))
+	}
+	if n == 1<<64-1 {
+		return random_src.Uint64()
+	}
+	// at least half of the values are accepted
+	for {
+		if c_val := random_src.Uint64(); c_val <= n {
+			return c_val
+		}
+	}
+}
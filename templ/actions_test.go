@@ -0,0 +1,34 @@
+package templates
+
+import "testing"
+
+func TestUserLocationActions(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		f    func(string, []string) (string, error)
+		inp  string
+		args []string
+		want string
+	}{
+		{"cgi", actionUserLocCGI, "21630", nil, "0012f603ffffffff"},
+		{"cgi 3 digit mnc", actionUserLocCGI, "310410", nil, "00130014ffffffff"},
+		{"tai", actionUserLocTAI, "21630", []string{"0x1234"}, "8012f6031234"},
+		{"ecgi", actionUserLocECGI, "21630", []string{"257"}, "8112f60300000101"},
+		{"tai_ecgi", actionUserLocTAIECGI, "21630", []string{"1", "2"}, "8212f603000112f60300000002"},
+	} {
+		got, err := c.f(c.inp, c.args)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: %s, want %s", c.name, got, c.want)
+		}
+	}
+
+	for _, v := range []string{"2163", "2163a", "216300a", "-1630"} {
+		if got, err := actionUserLocTAI(v, []string{"1"}); err == nil {
+			t.Errorf("tai of %q: %s, want an error", v, got)
+		}
+	}
+}
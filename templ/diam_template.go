@@ -2,15 +2,19 @@ package templates
 
 import (
 	"bufio"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	d "github.com/lehotomi/diam/diam"
 	l "github.com/lehotomi/diam/mlog"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,8 +38,23 @@ const (
 	const_date_format = "2006-01-02 15:04:05 MST"
 )
 
+const (
+	ROW_AVP     = 0
+	ROW_IF      = 1
+	ROW_ELSE    = 2
+	ROW_END     = 3
+	ROW_FOREACH = 4
+	ROW_INCLUDE = 5
+	ROW_EXTENDS = 6
+	// an !include after resolution, the included rows follow it up to an
+	// ROW_END
+	ROW_SCOPE = 7
+)
+
 type TemplRow struct {
+	kind           int
 	level          int
+	optional       bool
 	vendor_id      uint32
 	avp_code       uint32
 	mandatory_flag bool
@@ -44,35 +63,121 @@ type TemplRow struct {
 	value          string
 	defValue       string
 	action         string
+	cond_param     string
+	cond_op        string
+	cond_value     string
+	loop_var       string
+	loop_list      string
+	type_name      string
+	encoding       string
+	include_name   string
+	include_args   map[string]string
+	file           string
+	dir            string
+	line           int
+	col            int
 }
 
 type header_info map[string]string
 
-var templates map[string][]TemplRow = make(map[string][]TemplRow)
+// templateSet is the result of loading a template directory. A loaded set is
+// never modified, Load swaps in a new one.
+type templateSet struct {
+	rows    map[string][]TemplRow
+	headers map[string]header_info
+	// files are the template files, by template name
+	files map[string]string
+}
+
+func newTemplateSet() *templateSet {
+	return &templateSet{
+		rows:    make(map[string][]TemplRow),
+		headers: make(map[string]header_info),
+		files:   make(map[string]string),
+	}
+}
+
+var set_mtx sync.RWMutex
+var current_set *templateSet = newTemplateSet()
+
+func currentSet() *templateSet {
+	set_mtx.RLock()
+	defer set_mtx.RUnlock()
+	return current_set
+}
+
+// dictionary used to resolve enum names, nil means the default one. It is
+// guarded by set_mtx like current_set.
+var dict *d.Dictionary
 
-var template_headers map[string]header_info = make(map[string]header_info)
+// SetDictionary sets the dictionary used to resolve enum names in values,
+// e.g. Enumerated 'END_USER_IMSI'. By default d.Default() is used.
+func SetDictionary(dc *d.Dictionary) {
+	set_mtx.Lock()
+	dict = dc
+	set_mtx.Unlock()
+}
+
+func dictionary() *d.Dictionary {
+	set_mtx.RLock()
+	defer set_mtx.RUnlock()
+	if dict != nil {
+		return dict
+	}
+	return d.Default()
+}
 
 func IsTemplateExists(c_template string) bool {
-	_, ok := templates[c_template]
+	_, ok := currentSet().rows[c_template]
 	if ok {
 		return true
 	}
 	return false
 }
 
+// FillTemplate builds the message of the template from pars. A missing
+// parameter, or a value that cannot be converted to the AVP type is an
+// error, mostly *TemplError.
 func FillTemplate(c_template string, pars map[string]string) (d.Message, error) {
+	return FillTemplateWith(c_template, pars, FillOptions{})
+}
 
-	c_templ, ok := templates[c_template]
+// FillTemplateWith is FillTemplate with options.
+func FillTemplateWith(c_template string, pars map[string]string, opts FillOptions) (d.Message, error) {
+
+	c_set := currentSet()
+	c_templ, ok := c_set.rows[c_template]
 	if !ok {
 		err_str := fmt.Sprintf("template %s does not exist", c_template)
 		l.Error.Println(err_str)
 		return d.Message{}, errors.New(err_str)
 	}
 
-	avps := collectRow(0, c_templ, pars)
-	c_header := template_headers[c_template]
-	c_cmd_code := stringToAvp_Unsigned32(c_header["command_code"])
-	c_app_id := stringToAvp_Unsigned32(c_header["application_id"])
+	if opts.Strict {
+		if err := checkUnknownParams(c_template, c_templ, pars); err != nil {
+			return d.Message{}, err
+		}
+	}
+
+	avps, err := collectRow(0, c_templ, pars)
+	if err != nil {
+		return d.Message{}, err
+	}
+	c_header := c_set.headers[c_template]
+	c_cmd_code, err := stringToAvp_Unsigned32(c_header["command_code"])
+	if err != nil {
+		return d.Message{}, fmt.Errorf("template %s, command_code: %v", c_template, err)
+	}
+	c_app_id, err := stringToAvp_Unsigned32(c_header["application_id"])
+	if err != nil {
+		return d.Message{}, fmt.Errorf("template %s, application_id: %v", c_template, err)
+	}
+
+	c_head_avps, err := headerAvps(c_template, c_header, opts.Conn)
+	if err != nil {
+		return d.Message{}, err
+	}
+	avps = append(c_head_avps, avps...)
 
 	c_request := false
 	if c_header["request"] == "1" {
@@ -88,44 +193,75 @@ func FillTemplate(c_template string, pars map[string]string) (d.Message, error)
 	return ret, nil
 }
 
-func computeValue(row TemplRow, pars map[string]string) (interface{}, int) {
+// header_avps are the header fields adding an AVP before the rows, in this
+// order:
+//
+//	!header command_code:272 application_id:4 session_id:auto destination_realm:auto
+//
+// auto takes the value from FillOptions.Conn (the session id, or the
+// connection config with the same key), other values are used as they are.
+var header_avps = []struct {
+	key  string
+	code uint32
+}{
+	{"session_id", d.AVP_CODE_Session_Id},
+	{"origin_host", d.AVP_CODE_Origin_Host},
+	{"origin_realm", d.AVP_CODE_Origin_Realm},
+	{"destination_realm", d.AVP_CODE_Destination_Realm},
+	{"destination_host", d.AVP_CODE_Destination_Host},
+}
+
+func headerAvps(c_template string, c_header header_info, conn HeaderSource) ([]d.AVP, error) {
+	var ret []d.AVP
+	for _, h := range header_avps {
+		c_val, ok := c_header[h.key]
+		if !ok {
+			continue
+		}
+		if c_val == "auto" {
+			if conn == nil {
+				return nil, fmt.Errorf("template %s, %s:auto needs a connection in FillOptions.Conn", c_template, h.key)
+			}
+			if h.key == "session_id" {
+				c_val = conn.Gen_Session_Id()
+			} else if c_val, ok = conn.ConfValue(h.key); !ok || c_val == "" {
+				return nil, fmt.Errorf("template %s, %s is not configured for the connection", c_template, h.key)
+			}
+		}
+		ret = append(ret, d.AVP_UTF8String(h.code, c_val, d.MAND, 0))
+	}
+	return ret, nil
+}
+
+// computeValue returns the value of the row before it is converted to the
+// AVP type.
+func computeValue(row TemplRow, pars map[string]string) (string, error) {
 
 	switch row.valueType {
 	case VAL_FIX:
-		return row.value, RET_STRING
+		return row.value, nil
 	case VAL_PARAM:
 		val, ok := pars[row.value]
-		if ok {
-			return val, RET_STRING
+		if !ok {
+			return "", fmt.Errorf("missing parameter %s", row.value)
 		}
-		l.Warn.Println("unable to find value for parameter ", row.value)
-		//TODO
-		return val, RET_STRING
+		return val, nil
 	case VAL_PARAM_WITH_DEFAULT:
 		val, ok := pars[row.value]
 		if ok {
-			return val, RET_STRING
+			return val, nil
 		} else {
-			return row.defValue, RET_STRING
+			return row.defValue, nil
 		}
 	case VAL_ACTION:
-		//if (row.action == "now" ) {
-		//t := time.Now()
-		//l.Info.Println("action!!!",row,row.action)
-		ret_val := runAction("", row.action)
-		return ret_val, RET_STRING
-		//return t.Format(const_date_format),RET_STRING
-		//}
+		return runAction("", row.action)
 
 	case VAL_PARAM_WITH_ACTION:
 		val, ok := pars[row.value]
-		if ok {
-			//l.Info.Println("running action on:", val, row.action)
-			mod_val := runAction(val, row.action)
-			return mod_val, RET_STRING
-		} else {
-			return row.defValue, RET_STRING
+		if !ok {
+			return "", fmt.Errorf("missing parameter %s", row.value)
 		}
+		return runAction(val, row.action)
 	case VAL_PARAM_WITH_DEFAULT_AND_ACTION:
 
 		val, ok := pars[row.value]
@@ -134,422 +270,768 @@ func computeValue(row TemplRow, pars map[string]string) (interface{}, int) {
 			val = row.defValue
 		}
 
-		//l.Info.Println("running action on 2:", val, row.action)
-		mod_val := runAction(val, row.action)
-		return mod_val, RET_STRING
+		return runAction(val, row.action)
 	default:
-		l.Warn.Println("unknown valueType:", row.valueType)
-		return string('0'), RET_STRING
+		return "", fmt.Errorf("unknown valueType: %d", row.valueType)
 	}
 
 }
 
-func runAction(inp string, action string) string {
-
-	switch action {
-	case "mccnmc_to_user_loc":
-		if len(inp) < 5 {
-			l.Warn.Println("mccnmc is invalid:", inp)
-			return "0012f607ffffffff"
+// rowError locates err at the row, with the parameter name if the value
+// comes from one.
+func rowError(row TemplRow, err error) error {
+	switch row.valueType {
+	case VAL_PARAM, VAL_PARAM_WITH_DEFAULT, VAL_PARAM_WITH_ACTION, VAL_PARAM_WITH_DEFAULT_AND_ACTION:
+		if !strings.HasPrefix(err.Error(), "missing parameter") {
+			err = fmt.Errorf("parameter %s: %v", row.value, err)
 		}
-		return "00" + string(inp[1]) + string(inp[0]) + "f" + string(inp[2]) + string(inp[4]) + string(inp[3]) + "ffffffff"
-
-	case "now":
-		t := time.Now()
-		//l.Info.Println("action!!!",row)
-		return t.Format(const_date_format)
 	}
-	l.Warn.Println("unknown action in template:", action)
-	return "0"
+	return newTemplError(row.file, row.line, row.col, "%v", err)
 }
 
-func collectRow(level int, rows []TemplRow, pars map[string]string) []d.AVP {
+func collectRow(level int, rows []TemplRow, pars map[string]string) ([]d.AVP, error) {
 	var ret []d.AVP
 
 	for j := 0; j < len(rows); j++ {
-		if rows[j].level == level {
-			res_value, ret_type := computeValue(rows[j], pars)
-			var computed_value string
-			if ret_type == RET_STRING {
-				computed_value = res_value.(string)
+		if rows[j].level == level && rows[j].kind != ROW_AVP {
+			c_avps, c_end, err := collectBlock(level, rows, j, pars)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, c_avps...)
+			j = c_end
+			continue
+		}
+		if rows[j].optional && paramMissing(rows[j], pars) {
+			continue
+		}
+		if rows[j].level != level {
+			continue
+		}
+
+		if rows[j].avp_type == d.Avp_Grouped {
+			var s int
+			for s = j + 1; s < len(rows); s++ {
+				if rows[s].level <= level {
+					break
+				}
+			}
+			group_row := rows[j+1 : s]
+			c_group, err := collectRow(level+1, group_row, pars)
+			if err != nil {
+				return nil, err
 			}
+			if rows[j].optional && len(c_group) == 0 {
+				continue
+			}
+			ret = append(ret,
+				d.AVP_Group(
+					rows[j].avp_code,
+					c_group,
+					rows[j].mandatory_flag,
+					rows[j].vendor_id),
+			)
+			continue
+		}
+
+		computed_value, err := computeValue(rows[j], pars)
+		if err != nil {
+			return nil, rowError(rows[j], err)
+		}
+		c_avp, err := valueToAvp(rows[j], computed_value)
+		if err != nil {
+			return nil, rowError(rows[j], err)
+		}
+		ret = append(ret, c_avp)
+	}
+
+	return ret, nil
+}
+
+// valueToAvp converts the computed value of a not grouped row.
+func valueToAvp(row TemplRow, computed_value string) (d.AVP, error) {
+	switch row.avp_type {
+	case d.Avp_Unsigned32:
+		c_val, err := stringToAvp_Unsigned32(computed_value)
+		return d.AVP_Unsigned32(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_Unsigned64:
+		c_val, err := stringToAvp_Unsigned64(computed_value)
+		return d.AVP_Unsigned64(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_Integer32:
+		c_val, err := stringToAvp_Integer32(computed_value)
+		return d.AVP_Integer32(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_Enumerated:
+		c_val, err := stringToAvp_Enumerated(row, computed_value)
+		return d.AVP_Enumerated(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_Integer64:
+		c_val, err := stringToAvp_Integer64(computed_value)
+		return d.AVP_Integer64(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_Float32:
+		c_val, err := stringToAvp_Float32(computed_value)
+		return d.AVP_Float32(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_Float64:
+		c_val, err := stringToAvp_Float64(computed_value)
+		return d.AVP_Float64(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_UTF8String:
+		return d.AVP_UTF8String(row.avp_code, computed_value, row.mandatory_flag, row.vendor_id), nil
+	case d.Avp_OctetString:
+		c_val, err := octetStringValue(row, computed_value)
+		return d.AVP_OctetString(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_Time:
+		c_val, err := stringToAvp_Time(computed_value)
+		return d.AVP_Time(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_Address:
+		c_val, err := stringToAvp_Address(computed_value)
+		return d.AVP_Address(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	case d.Avp_IPAddress:
+		c_val, err := IPToAvp_Octetstring(computed_value)
+		return d.AVP_OctetString(row.avp_code, c_val, row.mandatory_flag, row.vendor_id), err
+	}
+	return d.AVP{}, fmt.Errorf("unknown AVP type: %d", row.avp_type)
+}
 
-			switch rows[j].avp_type {
-			case d.Avp_Unsigned32:
-				ret = append(ret,
-					d.AVP_Unsigned32(
-						rows[j].avp_code,
-						stringToAvp_Unsigned32(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_Unsigned64:
-				ret = append(ret,
-					d.AVP_Unsigned64(
-						rows[j].avp_code,
-						stringToAvp_Unsigned64(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_Integer32:
-				ret = append(ret,
-					d.AVP_Integer32(
-						rows[j].avp_code,
-						stringToAvp_Integer32(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_Enumerated:
-				ret = append(ret,
-					d.AVP_Enumerated(
-						rows[j].avp_code,
-						stringToAvp_Integer32(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_Integer64:
-				ret = append(ret,
-					d.AVP_Integer64(
-						rows[j].avp_code,
-						stringToAvp_Integer64(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_Float32:
-				ret = append(ret,
-					d.AVP_Float32(
-						rows[j].avp_code,
-						stringToAvp_Float32(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_Float64:
-				ret = append(ret,
-					d.AVP_Float64(
-						rows[j].avp_code,
-						stringToAvp_Float64(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_UTF8String:
-				ret = append(ret,
-					d.AVP_UTF8String(
-						rows[j].avp_code,
-						computed_value,
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_OctetString:
-				ret = append(ret,
-					d.AVP_OctetString(
-						rows[j].avp_code,
-						stringToAvp_Octetstring(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_Time:
-				ret = append(ret,
-					d.AVP_Time(
-						rows[j].avp_code,
-						stringToAvp_Time(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_Address:
-				ret = append(ret,
-					d.AVP_Address(
-						rows[j].avp_code,
-						stringToAvp_Address(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_IPAddress:
-				ret = append(ret,
-					d.AVP_OctetString(
-						rows[j].avp_code,
-						IPToAvp_Octetstring(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
-			case d.Avp_Grouped:
-				var s int
-				for s = j + 1; s < len(rows); s++ {
-					if rows[s].level == level {
-						break
-					}
+// collectBlock evaluates the !if, !foreach or included block starting at
+// rows[j] and returns its AVPs and the index of its !end row.
+func collectBlock(level int, rows []TemplRow, j int, pars map[string]string) ([]d.AVP, int, error) {
+	c_else, c_end := findBlockEnd(rows, j)
+
+	switch rows[j].kind {
+	case ROW_IF:
+		if evalCondition(rows[j], pars) {
+			c_then_end := c_end
+			if c_else != -1 {
+				c_then_end = c_else
+			}
+			ret, err := collectRow(level, rows[j+1:c_then_end], pars)
+			return ret, c_end, err
+		}
+		if c_else != -1 {
+			ret, err := collectRow(level, rows[c_else+1:c_end], pars)
+			return ret, c_end, err
+		}
+		return nil, c_end, nil
+	case ROW_SCOPE:
+		c_pars := make(map[string]string, len(pars)+len(rows[j].include_args))
+		for k, v := range pars {
+			c_pars[k] = v
+		}
+		// arguments referring to missing parameters, by the argument name
+		c_missing := make(map[string]string)
+		for k, v := range rows[j].include_args {
+			c_val, ok, err := argValue(v, pars)
+			if err != nil {
+				return nil, c_end, newTemplError(rows[j].file, rows[j].line, rows[j].col, "argument %s: %v", k, err)
+			}
+			if ok {
+				c_pars[k] = c_val
+			} else {
+				delete(c_pars, k)
+				c_missing[k] = makeTmplRow(0, 0, 0, false, 0, v).value
+			}
+		}
+		ret, err := collectRow(level, rows[j+1:c_end], c_pars)
+		if c_err, ok := err.(*TemplError); ok {
+			for k, c_outer := range c_missing {
+				if c_err.Err.Error() == "missing parameter "+k {
+					return nil, c_end, newTemplError(rows[j].file, rows[j].line, rows[j].col, "missing parameter %s (argument %s of %s)", c_outer, k, rows[j].include_name)
 				}
-				group_row := rows[j+1 : s]
-				ret = append(ret,
-					d.AVP_Group(
-						rows[j].avp_code,
-						collectRow(level+1, group_row, pars),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id),
-				)
-			default:
-				l.Error.Printf("Unknown AVP type: %d", rows[j].avp_type)
-				ret = append(ret,
-					d.AVP_Unsigned32(
-						rows[j].avp_code,
-						stringToAvp_Unsigned32(computed_value),
-						rows[j].mandatory_flag,
-						rows[j].vendor_id))
 			}
 		}
+		return ret, c_end, err
+	case ROW_FOREACH:
+		var ret []d.AVP
+		for i, item := range listParam(pars[rows[j].loop_list]) {
+			c_pars := make(map[string]string, len(pars)+2)
+			for k, v := range pars {
+				c_pars[k] = v
+			}
+			c_pars[rows[j].loop_var] = item
+			c_pars[rows[j].loop_var+"_index"] = strconv.Itoa(i)
+			c_avps, err := collectRow(level, rows[j+1:c_end], c_pars)
+			if err != nil {
+				return nil, c_end, err
+			}
+			ret = append(ret, c_avps...)
+		}
+		return ret, c_end, nil
+	}
+	// a stray !else or !end, the parser does not let these through
+	return nil, j, nil
+}
+
+// findBlockEnd returns the index of the !else (-1 if there is none) and of
+// the !end row that belong to the block starting at rows[j].
+func findBlockEnd(rows []TemplRow, j int) (int, int) {
+	c_else := -1
+	depth := 0
+	for k := j + 1; k < len(rows); k++ {
+		switch rows[k].kind {
+		case ROW_IF, ROW_FOREACH, ROW_SCOPE:
+			depth++
+		case ROW_ELSE:
+			if depth == 0 {
+				c_else = k
+			}
+		case ROW_END:
+			if depth == 0 {
+				return c_else, k
+			}
+			depth--
+		}
 	}
+	return c_else, len(rows)
+}
 
+func evalCondition(row TemplRow, pars map[string]string) bool {
+	val, ok := pars[row.cond_param]
+	switch row.cond_op {
+	case "==":
+		return ok && val == row.cond_value
+	case "!=":
+		return !ok || val != row.cond_value
+	}
+	return ok && val != ""
+}
+
+// listParam splits the value of a list parameter, items are separated by
+// commas.
+func listParam(in string) []string {
+	var ret []string
+	for _, v := range strings.Split(in, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			ret = append(ret, v)
+		}
+	}
 	return ret
 }
 
-func stringToAvp_Unsigned32(in string) uint32 {
+// paramMissing tells if the row refers to a parameter that is not given and
+// has no default.
+func paramMissing(row TemplRow, pars map[string]string) bool {
+	switch row.valueType {
+	case VAL_PARAM, VAL_PARAM_WITH_ACTION:
+		_, ok := pars[row.value]
+		return !ok
+	}
+	return false
+}
+
+func stringToAvp_Unsigned32(in string) (uint32, error) {
 	res, err := strconv.ParseUint(in, 10, 32)
 	if err != nil {
-		l.Warn.Printf("cannot convert %s to uint32", in)
-		return 9999
+		return 0, fmt.Errorf("'%s' is not a valid Unsigned32", in)
 	}
-	return uint32(res)
+	return uint32(res), nil
 }
 
-func stringToAvp_Integer32(in string) int32 {
+func stringToAvp_Integer32(in string) (int32, error) {
 	res, err := strconv.ParseInt(in, 10, 32)
 	if err != nil {
-		l.Warn.Printf("cannot convert %s to int32", in)
-		return 9999
+		return 0, fmt.Errorf("'%s' is not a valid Integer32", in)
 	}
-	return int32(res)
+	return int32(res), nil
 }
 
-func stringToAvp_Float32(in string) float32 {
+// stringToAvp_Enumerated accepts the value or the enum name defined in the
+// dictionary.
+func stringToAvp_Enumerated(row TemplRow, in string) (int32, error) {
+	res, err := strconv.ParseInt(in, 10, 32)
+	if err == nil {
+		return int32(res), nil
+	}
+	c_val, ok := dictionary().LookUpAvp_EnumValue(row.avp_code, row.vendor_id, in)
+	if !ok {
+		return 0, fmt.Errorf("'%s' is not a valid Enumerated value of %d.%d", in, row.vendor_id, row.avp_code)
+	}
+	return c_val, nil
+}
+
+func stringToAvp_Float32(in string) (float32, error) {
 	res, err := strconv.ParseFloat(in, 32)
 	if err != nil {
-		l.Warn.Printf("cannot convert %s to float32", in)
-		return 9999
+		return 0, fmt.Errorf("'%s' is not a valid Float32", in)
 	}
-	return float32(res)
+	return float32(res), nil
 }
 
-func stringToAvp_Unsigned64(in string) uint64 {
+func stringToAvp_Unsigned64(in string) (uint64, error) {
 	res, err := strconv.ParseUint(in, 10, 64)
 	if err != nil {
-		l.Warn.Printf("cannot convert %s to uint64", in)
-		return 9999
+		return 0, fmt.Errorf("'%s' is not a valid Unsigned64", in)
 	}
-	return res
+	return res, nil
 }
 
-func stringToAvp_Integer64(in string) int64 {
+func stringToAvp_Integer64(in string) (int64, error) {
 	res, err := strconv.ParseInt(in, 10, 64)
 	if err != nil {
-		l.Warn.Printf("cannot convert %s to int64", in)
-		return 9999
+		return 0, fmt.Errorf("'%s' is not a valid Integer64", in)
 	}
-	return int64(res)
+	return int64(res), nil
 }
 
-func stringToAvp_Float64(in string) float64 {
+func stringToAvp_Float64(in string) (float64, error) {
 	res, err := strconv.ParseFloat(in, 64)
 	if err != nil {
-		l.Warn.Printf("cannot convert %s to float64", in)
-		return 9999
+		return 0, fmt.Errorf("'%s' is not a valid Float64", in)
 	}
-	return res
+	return res, nil
 }
 
-func stringToAvp_Time(in string) time.Time {
-
-	//format := "2006-01-02 15:04:05 MST"
+func stringToAvp_Time(in string) (time.Time, error) {
 	res, err := time.Parse(const_date_format, in)
 	if err != nil {
-		l.Warn.Printf("cannot convert %s to Time", in)
-		return time.Now()
+		return time.Time{}, fmt.Errorf("'%s' is not a valid Time, the format is %s", in, const_date_format)
 	}
-	return res
+	return res, nil
 }
 
-func IPToAvp_Octetstring(in string) []byte {
-
-	// todo check if ipv6, and convert that
-	return d.IPv4ToByte(in)
+// IPToAvp_Octetstring converts an IPv4 or IPv6 address.
+func IPToAvp_Octetstring(in string) ([]byte, error) {
+	c_ip := net.ParseIP(in)
+	if c_ip == nil {
+		return nil, fmt.Errorf("'%s' is not a valid IP address", in)
+	}
+	if c_ip4 := c_ip.To4(); c_ip4 != nil {
+		return c_ip4, nil
+	}
+	return c_ip, nil
 }
-func stringToAvp_Octetstring(in string) []byte {
 
+func stringToAvp_Octetstring(in string) ([]byte, error) {
 	res, err := hex.DecodeString(in)
 	if err != nil {
-		l.Warn.Printf("cannot convert %s to OctetString", in)
-		return []byte{0x00}
+		return nil, fmt.Errorf("'%s' is not a valid hex OctetString", in)
+	}
+	return res, nil
+}
+
+// octet_encodings are the ways an OctetString value can be written:
+//
+//	OctetString 'a1b2'             hex, the default
+//	OctetString:hex 'a1b2'
+//	OctetString:ascii '21670'      the bytes of the text
+//	OctetString:base64 'obI='
+//	OctetString:tbcd '21670123'    digits in TBCD, filled with F
+//	OctetString:file 'cert.der'    the content of the file, relative to the
+//	                               template directory
+var octet_encodings map[string]bool = map[string]bool{
+	"hex":    true,
+	"ascii":  true,
+	"base64": true,
+	"tbcd":   true,
+	"file":   true,
+}
+
+func octetStringValue(row TemplRow, in string) ([]byte, error) {
+	switch row.encoding {
+	case "ascii":
+		return []byte(in), nil
+	case "base64":
+		res, err := base64.StdEncoding.DecodeString(in)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not valid base64", in)
+		}
+		return res, nil
+	case "tbcd":
+		return d.TBCDEncode(in)
+	case "file":
+		c_path := in
+		if !filepath.IsAbs(c_path) {
+			c_path = filepath.Join(row.dir, c_path)
+		}
+		return ioutil.ReadFile(c_path)
 	}
-	return res
+	return stringToAvp_Octetstring(in)
 }
 
-func stringToAvp_Address(in string) d.Address {
-	//TODO check ip
-	res := d.NewAddress(d.ENUM_ADDR_FAMILY, d.IPv4ToByte(in))
-	return res
+func stringToAvp_Address(in string) (d.Address, error) {
+	c_ip := net.ParseIP(in).To4()
+	if c_ip == nil {
+		return d.Address{}, fmt.Errorf("'%s' is not a valid IPv4 Address", in)
+	}
+	return d.NewAddress(d.ENUM_ADDR_FAMILY, c_ip), nil
 }
 
+// Init loads the templates of templ_dir, it exits the program if they cannot
+// be loaded. Load returns the error instead.
 func Init(templ_dir string) {
-	//l.init()
+	if err := Load(templ_dir); err != nil {
+		l.Error.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Load parses every .template file of templ_dir and replaces the loaded
+// templates with them. On error the loaded templates are kept, syntax errors
+// are *TemplError. Rows not matching the dictionary are only logged, see
+// Lint.
+func Load(templ_dir string) error {
+	c_set, err := parseDir(templ_dir)
+	if err != nil {
+		return err
+	}
+	set_mtx.Lock()
+	current_set = c_set
+	set_mtx.Unlock()
+	return nil
+}
+
+// templateFiles returns the names of the .template and .fragment files of
+// templ_dir.
+func templateFiles(templ_dir string) ([]string, error) {
 	var files []string
-	var file_cont [][]string
-	fileInfo, err := ioutil.ReadDir(templ_dir) //TODO
+	fileInfo, err := ioutil.ReadDir(templ_dir)
 	if err != nil {
-		fmt.Println("cannot find template dir ...", templ_dir)
-		os.Exit(1)
-		return
+		return nil, fmt.Errorf("cannot find template dir %s: %v", templ_dir, err)
 	}
 
 	for _, file := range fileInfo {
 		c_file := file.Name()
-		if strings.HasSuffix(c_file, ".template") {
+		if strings.HasSuffix(c_file, ".template") || strings.HasSuffix(c_file, ".fragment") {
 			files = append(files, c_file)
 		}
-		//files = append(files, file.Name())
 	}
-	l.Trace.Println("template files:", files)
-	for _, c_file := range files {
-		var c_temps []TemplRow
-		c_tempfile, err := os.Open(templ_dir + "/" + c_file)
-		c_file_parts := strings.Split(c_file, ".")
-		c_file_basename := strings.Join(c_file_parts[:len(c_file_parts)-1], ".")
+	return files, nil
+}
+
+func parseDir(templ_dir string) (*templateSet, error) {
+	c_resolver, errs := parseAll(templ_dir)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	c_dict := dictionary()
+	c_set := newTemplateSet()
+	for c_name, c_parsed := range c_resolver.templates {
+		c_temps, header_params, err := c_resolver.resolve(c_parsed)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		defer c_tempfile.Close()
-		//byte_temp, _ := ioutil.ReadAll(c_tempfile)
-		var lines []string
-		var c_has_header bool = false
-		scanner := bufio.NewScanner(c_tempfile)
-		header_params := make(map[string]string)
-
-		for scanner.Scan() {
-			c_line := scanner.Text()
-			c_line = adjustLine(c_line)
-			if c_line == "" {
-				continue
+			return nil, err
+		}
+		for _, c_warn := range checkTemplate(c_parsed.file, c_temps, header_params, c_dict) {
+			l.Warn.Println(c_warn)
+		}
+		c_set.rows[c_name] = c_temps
+		c_set.headers[c_name] = header_params
+		c_set.files[c_name] = c_parsed.file
+	}
+	return c_set, nil
+}
+
+func parseFile(c_path string) ([]TemplRow, header_info, error) {
+	var c_temps []TemplRow
+	c_file := filepath.Base(c_path)
+	c_fragment := strings.HasSuffix(c_file, ".fragment")
+	c_tempfile, err := os.Open(c_path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c_tempfile.Close()
+
+	var c_has_header bool = false
+	scanner := bufio.NewScanner(c_tempfile)
+	header_params := make(header_info)
+	c_line_no := 0
+
+	for scanner.Scan() {
+		c_line_no++
+		c_line := scanner.Text()
+		c_line = adjustLine(c_line)
+		if c_line == "" {
+			continue
+		}
+		tab_index := strings.Index(c_line, "\t")
+		if tab_index != -1 {
+			return nil, nil, newTemplError(c_file, c_line_no, tab_index+1, "tab is not allowed")
+		}
+		num_of_leading_sp := countLeadingSpaces(c_line)
+
+		if num_of_leading_sp%4 != 0 {
+			return nil, nil, newTemplError(c_file, c_line_no, 1, "should have 0, 4, 8, 12, ... leading spaces")
+		}
+
+		if strings.HasPrefix(c_line, "!header ") {
+			if c_fragment {
+				return nil, nil, newTemplError(c_file, c_line_no, 1, "fragment should not have a header")
 			}
-			tab_index := strings.Index(c_line, "\t")
-			if tab_index != -1 {
-				l.Error.Printf("%s contains tab, at position %d, line:'%s'", c_file, tab_index, c_line)
-				os.Exit(1)
+			c_has_header = true
+
+			if ind_spaces := strings.Index(c_line, "  "); ind_spaces != -1 {
+				return nil, nil, newTemplError(c_file, c_line_no, ind_spaces+1, "header should only contain one space as separator")
 			}
-			num_of_leading_sp := countLeadingSpaces(c_line)
+			c_line := strings.TrimPrefix(c_line, "!header ")
+			c_head_parts := strings.Split(c_line, " ")
+			for _, v := range c_head_parts {
+				c_name_value := strings.Split(v, ":")
+				if len(c_name_value) != 2 {
+					return nil, nil, newTemplError(c_file, c_line_no, 1, "header is not valid: %s", v)
+				}
+				header_params[c_name_value[0]] = c_name_value[1]
+			}
+			continue
+		}
 
-			if num_of_leading_sp%4 != 0 {
-				l.Error.Printf("%s should have 0, 4, 8, 12, ... leading spaces, line:'%s'", c_file, c_line)
-				os.Exit(1)
+		level := num_of_leading_sp / 4
+		c_line = c_line[num_of_leading_sp:]
+		c_col := num_of_leading_sp + 1
+
+		if strings.HasPrefix(c_line, "!") {
+			c_row, err := parseDirective(level, c_line)
+			if err != nil {
+				return nil, nil, newTemplError(c_file, c_line_no, c_col, "%v", err)
 			}
+			if c_row.kind == ROW_EXTENDS && (len(c_temps) != 0 || level != 0) {
+				return nil, nil, newTemplError(c_file, c_line_no, c_col, "!extends should be the first row")
+			}
+			c_row.file = c_file
+			c_row.line = c_line_no
+			c_row.col = c_col
+			c_temps = append(c_temps, c_row)
+			continue
+		}
 
-			if strings.HasPrefix(c_line, "!header ") {
-				c_has_header = true
+		c_optional := false
+		if strings.HasPrefix(c_line, "?") {
+			c_optional = true
+			c_line = c_line[1:]
+		}
+		c_row_col := c_col
+		if c_optional {
+			c_row_col++
+		}
 
-				if ind_spaces := strings.Index(c_line, "  "); ind_spaces != -1 {
-					l.Error.Printf("%s header should only contain one space as separator, at postition %d, line:'%s'", c_file, ind_spaces, c_line)
-					os.Exit(1)
-				}
-				c_line := strings.TrimPrefix(c_line, "!header ")
-				c_head_parts := strings.Split(c_line, " ")
-				for _, v := range c_head_parts {
-					//fmt.Println("_"+v+"_")
-					c_name_value := strings.Split(v, ":")
-					if len(c_name_value) != 2 {
-						l.Error.Printf("%s header is not valid: %s", c_file, c_line)
-						os.Exit(1)
-					}
-					header_params[c_name_value[0]] = c_name_value[1]
-				}
+		more_than_one_space_index := strings.Index(c_line, "  ")
+		first_i := strings.Index(c_line, "'")
 
-				template_headers[c_file_basename] = header_params
-				continue
+		if more_than_one_space_index != -1 && more_than_one_space_index < first_i {
+			return nil, nil, newTemplError(c_file, c_line_no, c_row_col+more_than_one_space_index, "should only contain one space as separator")
+		}
+		c_line = fmt.Sprintf("%d.%s", level, c_line)
+
+		c_line_parts := strings.Split(c_line, " ")
+		if len(c_line_parts) < 2 {
+			return nil, nil, newTemplError(c_file, c_line_no, c_row_col, "avp type missing")
+		}
+		c_type_name := c_line_parts[1]
+
+		// OctetString:ascii '...', see octet_encodings
+		c_encoding := ""
+		if c_colon := strings.Index(c_line_parts[1], ":"); c_colon != -1 {
+			c_encoding = c_line_parts[1][c_colon+1:]
+			c_line_parts[1] = c_line_parts[1][:c_colon]
+			if c_line_parts[1] != "OctetString" || !octet_encodings[c_encoding] {
+				return nil, nil, newTemplError(c_file, c_line_no, c_row_col+strings.Index(c_line, " ")-len(fmt.Sprint(level)), "unknown value encoding %s", c_type_name)
 			}
+		}
 
-			level := num_of_leading_sp / 4
-			c_line = c_line[num_of_leading_sp:]
-			c_line = fmt.Sprintf("%d.%s", level, c_line)
+		c_avp_type := d.AvpStringToConst(c_line_parts[1])
 
-			more_than_one_space_index := strings.Index(c_line, "  ")
+		if c_avp_type == -1 {
+			return nil, nil, newTemplError(c_file, c_line_no, c_row_col+strings.Index(c_line, " ")-len(fmt.Sprint(level)), "avp type not known: '%s'", c_line_parts[1])
+		}
+
+		if c_line_parts[1] != "Grouped" {
 			first_i := strings.Index(c_line, "'")
+			last_i := strings.LastIndex(c_line, "'")
 
-			if more_than_one_space_index != -1 && more_than_one_space_index < first_i {
-				l.Error.Printf("%s should only contain one space as separator, at postition %d, line:'%s'", c_file, more_than_one_space_index, c_line)
-				os.Exit(1)
+			if first_i == -1 || last_i == -1 || first_i == last_i {
+				return nil, nil, newTemplError(c_file, c_line_no, c_row_col, "avp value should be between '")
 			}
+			c_line_parts[2] = c_line[first_i+1 : last_i]
+			c_line_parts = c_line_parts[0:3]
+		}
 
-			c_line_parts := strings.Split(c_line, " ")
+		c_line_parts[1] = fmt.Sprintf("%d", c_avp_type)
+		c_line = strings.Join(c_line_parts, ".")
 
-			c_avp_type := d.AvpStringToConst(c_line_parts[1])
+		c_line_split := strings.Split(c_line, ".")
+		if len(c_line_split) < 5 {
+			return nil, nil, newTemplError(c_file, c_line_no, c_row_col, "row should start with vendor.code.mflag")
+		}
 
-			if c_avp_type == -1 {
-				l.Error.Printf("%s, avp type not known:'%s'", c_file, c_line_parts[1])
-				os.Exit(1)
-			}
+		c_level, err := strconv.ParseInt(c_line_split[0], 10, 32)
+		if err != nil {
+			return nil, nil, newTemplError(c_file, c_line_no, c_row_col, "cannot parse %s as integer", c_line_split[0])
+		}
 
-			if c_line_parts[1] != "Grouped" {
-				first_i := strings.Index(c_line, "'")
-				last_i := strings.LastIndex(c_line, "'")
+		c_vendor_id, err := strconv.ParseUint(c_line_split[1], 10, 32)
+		if err != nil {
+			return nil, nil, newTemplError(c_file, c_line_no, c_row_col, "cannot parse vendor %s as integer", c_line_split[1])
+		}
+		c_avp_code, err := strconv.ParseUint(c_line_split[2], 10, 32)
+		if err != nil {
+			return nil, nil, newTemplError(c_file, c_line_no, c_row_col, "cannot parse avp code %s as integer", c_line_split[2])
+		}
+		c_mand_flag := true
+		if c_line_split[3] == "0" {
+			c_mand_flag = false
+		}
 
-				if first_i == -1 || last_i == -1 || first_i == last_i {
-					l.Error.Printf("%s, avp value should be between ', line:\"%s\"", c_file, c_line)
-					os.Exit(1)
-				}
-				c_line_parts[2] = c_line[first_i+1 : last_i]
-				c_line_parts = c_line_parts[0:3]
+		c_value := "NA"
+		if c_avp_type != d.Avp_Grouped {
+			if len(c_line_split) < 6 {
+				return nil, nil, newTemplError(c_file, c_line_no, c_row_col, "avp value missing")
 			}
+			c_value = strings.Join(c_line_split[5:], ".")
+		} else {
+			c_value = "_grouped_"
+		}
 
-			c_line_parts[1] = fmt.Sprintf("%d", c_avp_type)
-			c_line = strings.Join(c_line_parts, ".")
-			lines = append(lines, c_line)
-
-			c_line_split := strings.Split(c_line, ".")
+		c_new_trow := makeTmplRow(int(c_level), uint32(c_vendor_id), uint32(c_avp_code), c_mand_flag, c_avp_type, c_value)
+		c_new_trow.optional = c_optional
+		c_new_trow.type_name = c_type_name
+		c_new_trow.encoding = c_encoding
+		c_new_trow.file = c_file
+		c_new_trow.dir = filepath.Dir(c_path)
+		c_new_trow.line = c_line_no
+		c_new_trow.col = c_row_col
+		c_temps = append(c_temps, c_new_trow)
+
+	} // every line
+	if err := scanner.Err(); err != nil {
+		return nil, nil, &TemplError{File: c_file, Err: err}
+	}
 
-			c_level, err := strconv.ParseInt(c_line_split[0], 10, 32)
-			if err != nil {
-				l.Error.Printf("cannot parse %s as integer, line: %s", c_line_split[0], c_line)
-				os.Exit(1)
-			}
+	for j, b := range c_temps {
+		if j == 0 && b.level != 0 {
+			return nil, nil, newTemplError(c_file, b.line, 1, "first template avp sohuld not have space prefix")
+		}
+		if j == 0 {
+			continue
+		}
+		c_prev := c_temps[j-1]
+		if b.level > c_prev.level && (b.level != c_prev.level+1 || c_prev.kind != ROW_AVP || c_prev.avp_type != d.Avp_Grouped) {
+			return nil, nil, newTemplError(c_file, b.line, 1, "misaligned row")
+		}
+	}
+	if err := checkBlocks(c_temps); err != nil {
+		err.File = c_file
+		return nil, nil, err
+	}
+	c_extends := len(c_temps) > 0 && c_temps[0].kind == ROW_EXTENDS
+	if c_has_header == false && !c_fragment && !c_extends {
+		return nil, nil, newTemplError(c_file, 0, 0, "header is not defined")
+	}
+	return c_temps, header_params, nil
+}
 
-			c_vendor_id, err := strconv.ParseUint(c_line_split[1], 10, 32)
-			if err != nil {
-				l.Error.Printf("cannot parse %s as integer, line: %s", c_line_split[1], c_line)
-				os.Exit(1)
+// parseDirective parses the control rows of a template:
+//
+//	!if param                  param is given and not empty
+//	!if param == value         (or !=) value may be quoted with '
+//	!else
+//	!foreach item in list      list is a comma separated parameter, the rows
+//	                           up to !end are repeated with {{item}} and
+//	                           {{item_index}} set
+//	!end
+//	!include name [arg=value ...]
+//	                           the rows of name.fragment (or name.template)
+//	                           at the indentation of the !include, the args
+//	                           are parameters of the included rows, value
+//	                           may refer to parameters: data={{msisdn_a}}
+//	!extends name              the rows of name.template come first, the
+//	                           header is inherited
+//
+// The directive is indented like the rows it controls.
+func parseDirective(level int, c_line string) (TemplRow, error) {
+	c_parts := strings.Fields(c_line)
+	ret := TemplRow{level: level}
+
+	switch c_parts[0] {
+	case "!if":
+		ret.kind = ROW_IF
+		switch len(c_parts) {
+		case 2:
+			ret.cond_param = c_parts[1]
+		case 4:
+			if c_parts[2] != "==" && c_parts[2] != "!=" {
+				return ret, fmt.Errorf("unknown operator %s", c_parts[2])
 			}
-			c_avp_code, err := strconv.ParseUint(c_line_split[2], 10, 32)
-			if err != nil {
-				l.Error.Printf("cannot parse %s as integer, line: %s", c_line_split[2], c_line)
-				os.Exit(1)
-			}
-			c_mand_flag := true
-			if c_line_split[3] == "0" {
-				c_mand_flag = false
+			ret.cond_param = c_parts[1]
+			ret.cond_op = c_parts[2]
+			ret.cond_value = strings.Trim(c_parts[3], "'")
+		default:
+			return ret, errors.New("!if should be '!if param' or '!if param == value'")
+		}
+	case "!else":
+		ret.kind = ROW_ELSE
+	case "!end":
+		ret.kind = ROW_END
+	case "!foreach":
+		ret.kind = ROW_FOREACH
+		if len(c_parts) != 4 || c_parts[2] != "in" {
+			return ret, errors.New("!foreach should be '!foreach item in list'")
+		}
+		ret.loop_var = c_parts[1]
+		ret.loop_list = c_parts[3]
+	case "!include":
+		ret.kind = ROW_INCLUDE
+		if len(c_parts) < 2 {
+			return ret, errors.New("!include should be '!include name [arg=value ...]'")
+		}
+		ret.include_name = c_parts[1]
+		ret.include_args = make(map[string]string)
+		for _, v := range c_parts[2:] {
+			c_eq := strings.Index(v, "=")
+			if c_eq < 1 {
+				return ret, fmt.Errorf("include argument %s should be name=value", v)
 			}
+			ret.include_args[v[:c_eq]] = strings.Trim(v[c_eq+1:], "'")
+		}
+	case "!extends":
+		ret.kind = ROW_EXTENDS
+		if len(c_parts) != 2 {
+			return ret, errors.New("!extends should be '!extends name'")
+		}
+		ret.include_name = c_parts[1]
+	default:
+		return ret, fmt.Errorf("unknown directive %s", c_parts[0])
+	}
+	if (ret.kind == ROW_ELSE || ret.kind == ROW_END) && len(c_parts) != 1 {
+		return ret, fmt.Errorf("%s has no arguments", c_parts[0])
+	}
+	return ret, nil
+}
 
-			c_value := "NA"
-			if c_avp_type != d.Avp_Grouped {
-				if len(c_line_split) < 6 {
-					l.Error.Printf("avp value missing, line: %s", c_line)
-					os.Exit(1)
-				}
-				c_value = strings.Join(c_line_split[5:], ".")
-			} else {
-				c_value = "_grouped_"
+// checkBlocks verifies that every !if and !foreach is closed by an !end on
+// the same level and that the rows between are not less indented.
+func checkBlocks(rows []TemplRow) *TemplError {
+	var open []TemplRow
+	has_else := make(map[int]bool)
+	for _, b := range rows {
+		if len(open) > 0 && b.level < open[len(open)-1].level {
+			c_open := open[len(open)-1]
+			return newTemplError("", b.line, b.col, "row is less indented than the open block of line %d, !end missing", c_open.line)
+		}
+		switch b.kind {
+		case ROW_IF, ROW_FOREACH:
+			open = append(open, b)
+			has_else[len(open)] = false
+			if b.kind == ROW_FOREACH {
+				// an !else is not allowed in loops
+				has_else[len(open)] = true
 			}
-
-			c_new_trow := makeTmplRow(int(c_level), uint32(c_vendor_id), uint32(c_avp_code), c_mand_flag, c_avp_type, c_value)
-			c_temps = append(c_temps, c_new_trow)
-
-		} // every line
-
-		for j, b := range c_temps {
-			if j == 0 && b.level != 0 {
-				l.Error.Printf("first template avp sohuld not have space prefix")
-				os.Exit(1)
+		case ROW_ELSE:
+			if len(open) == 0 || open[len(open)-1].level != b.level {
+				return newTemplError("", b.line, b.col, "!else without !if")
 			}
-			if j == 0 {
-				continue
+			if has_else[len(open)] {
+				return newTemplError("", b.line, b.col, "unexpected !else")
 			}
-			if (b.level == c_temps[j-1].level+1) && c_temps[j-1].avp_type != d.Avp_Grouped {
-				l.Error.Printf("misaligned row: %s", c_file)
-				os.Exit(1)
+			has_else[len(open)] = true
+		case ROW_END:
+			if len(open) == 0 || open[len(open)-1].level != b.level {
+				return newTemplError("", b.line, b.col, "!end without !if/!foreach")
 			}
-
-		}
-		templates[c_file_basename] = c_temps
-		if c_has_header == false {
-			l.Error.Printf("%s, header is not defined", c_file)
-			os.Exit(1)
+			open = open[:len(open)-1]
 		}
-
-		file_cont = append(file_cont, lines)
-	} //every file
-
+	}
+	if len(open) > 0 {
+		c_open := open[len(open)-1]
+		return newTemplError("", c_open.line, c_open.col, "!end missing")
+	}
+	return nil
 }
 
 func makeTmplRow(c_level int, c_vendor_id uint32, c_avp_code uint32, c_mand_flag bool, c_avp_type int, c_value string) TemplRow {
@@ -576,8 +1058,14 @@ func makeTmplRow(c_level int, c_vendor_id uint32, c_avp_code uint32, c_mand_flag
 			ret.action = c_str_value[3 : len(c_str_value)-2]
 		} else {
 			c_stripped_value := c_str_value[2 : len(c_str_value)-2]
-			c_colon_pos := strings.Index(c_stripped_value, ":")
+			// actions may have ':' separated arguments, the default is
+			// only looked for before the first '!'
 			c_excl_pos := strings.Index(c_stripped_value, "!")
+			c_head := c_stripped_value
+			if c_excl_pos != -1 {
+				c_head = c_stripped_value[:c_excl_pos]
+			}
+			c_colon_pos := strings.Index(c_head, ":")
 			if (c_colon_pos == -1) && (c_excl_pos == -1) {
 				ret.value = c_stripped_value
 				ret.valueType = VAL_PARAM
@@ -616,9 +1104,18 @@ func adjustLine(line string) string {
 	return line
 }
 
+// stripComment cuts the line at the first # that is not between quotes.
 func stripComment(source string) string {
-	if cut := strings.Index(source, "#"); cut >= 0 {
-		return source[:cut]
+	in_quote := false
+	for i := 0; i < len(source); i++ {
+		switch source[i] {
+		case '\'':
+			in_quote = !in_quote
+		case '#':
+			if !in_quote {
+				return source[:i]
+			}
+		}
 	}
 	return source
 }
@@ -0,0 +1,126 @@
+package templates
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if err := d.InitWith("../dict", d.LoadOptions{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// writeTemplates writes files to a new directory and returns it.
+func writeTemplates(t *testing.T, files map[string]string) string {
+	t.Helper()
+	c_dir := t.TempDir()
+	for c_name, c_cont := range files {
+		if err := ioutil.WriteFile(filepath.Join(c_dir, c_name), []byte(c_cont), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c_dir
+}
+
+func loadTemplates(t *testing.T, files map[string]string) {
+	t.Helper()
+	if err := Load(writeTemplates(t, files)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// avpsString writes the AVPs as code=value, the grouped ones as
+// code{children}.
+func avpsString(avps []d.AVP) string {
+	var ret []string
+	for _, v := range avps {
+		if v.IsGrouped() {
+			ret = append(ret, fmt.Sprintf("%d{%s}", v.GetAVPCode(), avpsString(v.GetGroupAVPs())))
+		} else {
+			ret = append(ret, fmt.Sprintf("%d=%v", v.GetAVPCode(), v.GetValue()))
+		}
+	}
+	return strings.Join(ret, " ")
+}
+
+func fill(t *testing.T, c_template string, pars map[string]string) string {
+	t.Helper()
+	c_msg, err := FillTemplate(c_template, pars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return avpsString(c_msg.GetAVPs())
+}
+
+func TestDirectives(t *testing.T) {
+	loadTemplates(t, map[string]string{"ccr.template": `!header command_code:272 application_id:4 request:1 proxiable:1
+0.416.1 Enumerated '1'
+!if imsi
+0.1.1 UTF8String '{{imsi}}'
+!else
+0.1.1 UTF8String 'anonymous'
+!end
+!if type == 'event'
+0.436.1 Enumerated '0'
+!end
+!foreach id in ids
+0.443.1 Grouped
+    0.450.1 Enumerated '{{id_index}}'
+    0.444.1 UTF8String '{{id}}'
+!end
+?0.415.1 Unsigned32 '{{number}}'
+?10415.873.1 Grouped
+    ?10415.874.1 Grouped
+        ?10415.1032.1 Enumerated '{{access}}'
+`})
+	for _, c := range []struct {
+		pars map[string]string
+		want string
+	}{
+		{nil, "416=1 1=anonymous"},
+		{map[string]string{"imsi": ""}, "416=1 1=anonymous"},
+		{map[string]string{"imsi": "216701234567", "type": "event"}, "416=1 1=216701234567 436=0"},
+		{map[string]string{"type": "session"}, "416=1 1=anonymous"},
+		{map[string]string{"ids": "a, b,"}, "416=1 1=anonymous 443{450=0 444=a} 443{450=1 444=b}"},
+		{map[string]string{"number": "3", "access": "1"}, "416=1 1=anonymous 415=3 873{874{1032=1}}"},
+	} {
+		if got := fill(t, "ccr", c.pars); got != c.want {
+			t.Errorf("%v: %s, want %s", c.pars, got, c.want)
+		}
+	}
+}
+
+func TestDirectiveErrors(t *testing.T) {
+	const c_header = "!header command_code:272 application_id:4\n"
+	for _, c := range []struct {
+		name string
+		cont string
+		line int
+	}{
+		{"unknown directive", "0.416.1 Enumerated '1'\n!while x\n", 3},
+		{"if without end", "!if x\n0.416.1 Enumerated '1'\n", 2},
+		{"stray end", "0.416.1 Enumerated '1'\n!end\n", 3},
+		{"else with argument", "!if x\n!else y\n!end\n", 3},
+		{"foreach syntax", "!foreach x of y\n!end\n", 2},
+		{"if operator", "!if x < 3\n!end\n", 2},
+	} {
+		c_dir := writeTemplates(t, map[string]string{"bad.template": c_header + c.cont})
+		err := Load(c_dir)
+		c_err, ok := err.(*TemplError)
+		if !ok {
+			t.Errorf("%s: %v, want a TemplError", c.name, err)
+			continue
+		}
+		if c_err.File != "bad.template" || c_err.Line != c.line {
+			t.Errorf("%s: error at %s:%d, want bad.template:%d (%v)", c.name, c_err.File, c_err.Line, c.line, err)
+		}
+	}
+}
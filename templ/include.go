@@ -0,0 +1,180 @@
+package templates
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// parsedFile is a .template or .fragment file before its !include and
+// !extends rows are resolved.
+type parsedFile struct {
+	file   string
+	rows   []TemplRow
+	header header_info
+}
+
+type resolvedFile struct {
+	rows   []TemplRow
+	header header_info
+}
+
+// resolver expands the !include and !extends rows of the files of a
+// template directory.
+type resolver struct {
+	templates map[string]*parsedFile
+	fragments map[string]*parsedFile
+	done      map[string]resolvedFile
+	stack     []string
+}
+
+// parseAll parses every file of templ_dir, the syntax errors of all files
+// are returned.
+func parseAll(templ_dir string) (*resolver, []error) {
+	c_resolver := &resolver{
+		templates: make(map[string]*parsedFile),
+		fragments: make(map[string]*parsedFile),
+		done:      make(map[string]resolvedFile),
+	}
+	files, err := templateFiles(templ_dir)
+	if err != nil {
+		return c_resolver, []error{err}
+	}
+	sort.Strings(files)
+
+	var errs []error
+	for _, c_file := range files {
+		c_temps, header_params, err := parseFile(filepath.Join(templ_dir, c_file))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c_ext := filepath.Ext(c_file)
+		c_parsed := &parsedFile{file: c_file, rows: c_temps, header: header_params}
+		if c_ext == ".fragment" {
+			c_resolver.fragments[strings.TrimSuffix(c_file, c_ext)] = c_parsed
+		} else {
+			c_resolver.templates[strings.TrimSuffix(c_file, c_ext)] = c_parsed
+		}
+	}
+	return c_resolver, errs
+}
+
+// names returns the sorted names of the templates.
+func (r *resolver) names() []string {
+	var ret []string
+	for c_name := range r.templates {
+		ret = append(ret, c_name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// lookUp finds the target of an !include, a name without extension means a
+// fragment, or a template if there is no such fragment.
+func (r *resolver) lookUp(name string) (*parsedFile, bool) {
+	switch filepath.Ext(name) {
+	case ".fragment":
+		c_parsed, ok := r.fragments[strings.TrimSuffix(name, ".fragment")]
+		return c_parsed, ok
+	case ".template":
+		c_parsed, ok := r.templates[strings.TrimSuffix(name, ".template")]
+		return c_parsed, ok
+	}
+	if c_parsed, ok := r.fragments[name]; ok {
+		return c_parsed, true
+	}
+	c_parsed, ok := r.templates[name]
+	return c_parsed, ok
+}
+
+// resolve returns the rows of c_parsed with the included and inherited rows
+// in place, and the header merged with the header of the base template.
+func (r *resolver) resolve(c_parsed *parsedFile) ([]TemplRow, header_info, error) {
+	if c_done, ok := r.done[c_parsed.file]; ok {
+		return c_done.rows, c_done.header, nil
+	}
+	for j, c_file := range r.stack {
+		if c_file == c_parsed.file {
+			c_cycle := append(append([]string{}, r.stack[j:]...), c_parsed.file)
+			return nil, nil, fmt.Errorf("include cycle %s", strings.Join(c_cycle, " -> "))
+		}
+	}
+	r.stack = append(r.stack, c_parsed.file)
+	defer func() {
+		r.stack = r.stack[:len(r.stack)-1]
+	}()
+
+	var ret []TemplRow
+	header_params := make(header_info)
+	for _, row := range c_parsed.rows {
+		switch row.kind {
+		case ROW_EXTENDS:
+			c_base, ok := r.templates[strings.TrimSuffix(row.include_name, ".template")]
+			if !ok {
+				return nil, nil, newTemplError(c_parsed.file, row.line, row.col, "template %s to extend does not exist", row.include_name)
+			}
+			c_rows, c_header, err := r.resolve(c_base)
+			if err != nil {
+				return nil, nil, wrapIncludeError(row, err)
+			}
+			ret = append(ret, c_rows...)
+			for k, v := range c_header {
+				header_params[k] = v
+			}
+		case ROW_INCLUDE:
+			c_target, ok := r.lookUp(row.include_name)
+			if !ok {
+				return nil, nil, newTemplError(c_parsed.file, row.line, row.col, "%s to include does not exist", row.include_name)
+			}
+			c_rows, _, err := r.resolve(c_target)
+			if err != nil {
+				return nil, nil, wrapIncludeError(row, err)
+			}
+			c_scope := row
+			c_scope.kind = ROW_SCOPE
+			ret = append(ret, c_scope)
+			for _, c_row := range c_rows {
+				c_row.level += row.level
+				ret = append(ret, c_row)
+			}
+			ret = append(ret, TemplRow{kind: ROW_END, level: row.level, file: row.file, line: row.line, col: row.col})
+		default:
+			ret = append(ret, row)
+		}
+	}
+	for k, v := range c_parsed.header {
+		header_params[k] = v
+	}
+
+	r.done[c_parsed.file] = resolvedFile{rows: ret, header: header_params}
+	return ret, header_params, nil
+}
+
+// wrapIncludeError adds the location of the !include or !extends row to the
+// errors that have none.
+func wrapIncludeError(row TemplRow, err error) error {
+	if _, ok := err.(*TemplError); ok {
+		return err
+	}
+	return newTemplError(row.file, row.line, row.col, "%v", err)
+}
+
+// argValue computes an !include argument, {{param}} forms are evaluated
+// like row values. false means the argument refers to a missing parameter.
+func argValue(in string, pars map[string]string) (string, bool, error) {
+	if !strings.HasPrefix(in, "{{") || !strings.HasSuffix(in, "}}") {
+		return in, true, nil
+	}
+	c_row := makeTmplRow(0, 0, 0, false, d.Avp_UTF8String, in)
+	if paramMissing(c_row, pars) {
+		return "", false, nil
+	}
+	c_val, err := computeValue(c_row, pars)
+	if err != nil {
+		return "", false, err
+	}
+	return c_val, true, nil
+}
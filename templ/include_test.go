@@ -0,0 +1,69 @@
+package templates
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInclude(t *testing.T) {
+	loadTemplates(t, map[string]string{
+		"subscription_id.fragment": `0.443.1 Grouped
+    0.450.1 Enumerated '{{type:0}}'
+    0.444.1 UTF8String '{{data}}'
+`,
+		"base.template": `!header command_code:272 application_id:4 request:1 proxiable:1
+0.416.1 Enumerated '{{request_type:1}}'
+!include subscription_id data={{msisdn}}
+`,
+		"child.template": `!extends base
+10415.873.1 Grouped
+    !include subscription_id type=1 data='216701234567'
+`,
+	})
+	for _, c := range []struct {
+		template string
+		pars     map[string]string
+		want     string
+	}{
+		{"base", map[string]string{"msisdn": "36301234567"}, "416=1 443{450=0 444=36301234567}"},
+		// the parameters reach the included rows, the arguments override them
+		{"base", map[string]string{"msisdn": "36301234567", "data": "x", "type": "1"}, "416=1 443{450=1 444=36301234567}"},
+		{"child", map[string]string{"msisdn": "36301234567", "request_type": "3"}, "416=3 443{450=0 444=36301234567} 873{443{450=1 444=216701234567}}"},
+	} {
+		if got := fill(t, c.template, c.pars); got != c.want {
+			t.Errorf("%s %v: %s, want %s", c.template, c.pars, got, c.want)
+		}
+	}
+
+	c_msg, err := FillTemplate("child", map[string]string{"msisdn": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c_msg.GetCmdCode() != 272 || c_msg.GetAppId() != 4 || !c_msg.IsRequest() {
+		t.Errorf("header of child: command %d application %d", c_msg.GetCmdCode(), c_msg.GetAppId())
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	const c_header = "!header command_code:272 application_id:4\n"
+	for _, c := range []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"missing fragment", map[string]string{"a.template": c_header + "!include nothing\n"}, "a.template:2:1: nothing to include does not exist"},
+		{"missing base", map[string]string{"a.template": "!extends nothing\n"}, "a.template:1:1: template nothing to extend does not exist"},
+		{"cycle", map[string]string{
+			"a.template": c_header + "!include b\n",
+			"b.fragment": "!include c\n",
+			"c.fragment": "!include b\n",
+		}, "include cycle b.fragment -> c.fragment -> b.fragment"},
+		{"extends not first", map[string]string{"a.template": c_header + "0.416.1 Enumerated '1'\n!extends b\n"}, "a.template:3:1: !extends should be the first row"},
+		{"fragment header", map[string]string{"a.fragment": c_header}, "a.fragment:1:1: fragment should not have a header"},
+	} {
+		err := Load(writeTemplates(t, c.files))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: %v, want %s", c.name, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package templates
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TemplError is a problem found in a template file. Line and Col are 1
+// based, 0 if not known.
+type TemplError struct {
+	File string
+	Line int
+	Col  int
+	Err  error
+}
+
+func (e *TemplError) Error() string {
+	c_loc := e.File
+	if e.Line > 0 {
+		c_loc += ":" + strconv.Itoa(e.Line)
+		if e.Col > 0 {
+			c_loc += ":" + strconv.Itoa(e.Col)
+		}
+	}
+	return c_loc + ": " + e.Err.Error()
+}
+
+func (e *TemplError) Unwrap() error {
+	return e.Err
+}
+
+func newTemplError(file string, line int, col int, format string, a ...interface{}) *TemplError {
+	return &TemplError{File: file, Line: line, Col: col, Err: fmt.Errorf(format, a...)}
+}
+
+// Lint checks every template of templ_dir without loading them. Besides the
+// syntax it checks the rows against dc (nil means the dictionary set by
+// SetDictionary): the AVP is known, the type matches, a grouped AVP has
+// children and fixed enum values are valid. Unknown actions are reported
+// too. All problems are returned,
+// mostly as *TemplError.
+func Lint(templ_dir string, dc *d.Dictionary) []error {
+	if dc == nil {
+		dc = dictionary()
+	}
+	c_resolver, ret := parseAll(templ_dir)
+	for _, c_name := range c_resolver.names() {
+		c_parsed := c_resolver.templates[c_name]
+		c_temps, header_params, err := c_resolver.resolve(c_parsed)
+		if err != nil {
+			ret = append(ret, err)
+			continue
+		}
+		ret = append(ret, checkTemplate(c_parsed.file, c_temps, header_params, dc)...)
+	}
+	return ret
+}
+
+// LintLoaded checks the loaded templates against dc like Lint, e.g. before
+// dc replaces the dictionary the templates were loaded with.
+func LintLoaded(dc *d.Dictionary) []error {
+	c_set := currentSet()
+	var c_names []string
+	for c_name := range c_set.rows {
+		c_names = append(c_names, c_name)
+	}
+	sort.Strings(c_names)
+
+	var ret []error
+	for _, c_name := range c_names {
+		ret = append(ret, checkTemplate(c_set.files[c_name], c_set.rows[c_name], c_set.headers[c_name], dc)...)
+	}
+	return ret
+}
+
+// checkTemplate checks a parsed template against the dictionary.
+func checkTemplate(c_file string, rows []TemplRow, header_params header_info, dc *d.Dictionary) []error {
+	var ret []error
+
+	for _, c_name := range []string{"command_code", "application_id"} {
+		c_val, ok := header_params[c_name]
+		if !ok {
+			ret = append(ret, newTemplError(c_file, 0, 0, "header %s is missing", c_name))
+			continue
+		}
+		if _, err := strconv.ParseUint(c_val, 10, 32); err != nil {
+			ret = append(ret, newTemplError(c_file, 0, 0, "header %s '%s' is not a number", c_name, c_val))
+		}
+	}
+
+	for j, row := range rows {
+		if row.kind != ROW_AVP {
+			continue
+		}
+		if row.action != "" {
+			for _, c_step := range strings.Split(row.action, "!") {
+				c_name := strings.Split(c_step, ":")[0]
+				if _, ok := lookUpAction(c_name); !ok {
+					ret = append(ret, newTemplError(rowFile(row, c_file), row.line, row.col, "unknown action %s", c_name))
+				}
+			}
+		}
+		c_entry := dc.LookUpAvp(row.avp_code, row.vendor_id)
+		if c_entry.GetType() == d.Avp_code_unknown {
+			ret = append(ret, newTemplError(rowFile(row, c_file), row.line, row.col, "avp %d.%d is not in the dictionary", row.vendor_id, row.avp_code))
+			continue
+		}
+		if !typeMatches(row.avp_type, c_entry.GetType()) {
+			ret = append(ret, newTemplError(rowFile(row, c_file), row.line, row.col, "type %s does not match %s of %s in the dictionary", row.type_name, c_entry.GetTypeName(), c_entry.GetName()))
+			continue
+		}
+		if row.avp_type == d.Avp_Grouped && (j+1 >= len(rows) || rows[j+1].level <= row.level) {
+			ret = append(ret, newTemplError(rowFile(row, c_file), row.line, row.col, "grouped avp %s has no children", c_entry.GetName()))
+		}
+		if row.avp_type == d.Avp_Enumerated {
+			if err := checkEnum(row, c_entry, dc); err != nil {
+				ret = append(ret, newTemplError(rowFile(row, c_file), row.line, row.col, "%v", err))
+			}
+		}
+	}
+	return ret
+}
+
+// rowFile is the file the row comes from, it differs from c_file for
+// included and inherited rows.
+func rowFile(row TemplRow, c_file string) string {
+	if row.file != "" {
+		return row.file
+	}
+	return c_file
+}
+
+// typeMatches compares the type of a template row with the dictionary type.
+// The dictionary stores IPAddress as OctetString.
+func typeMatches(row_type int, dict_type int) bool {
+	if row_type == d.Avp_IPAddress {
+		return dict_type == d.Avp_OctetString || dict_type == d.Avp_Address
+	}
+	return row_type == dict_type
+}
+
+// checkEnum checks the fixed value, or the default of an Enumerated row.
+func checkEnum(row TemplRow, c_entry d.AVPDictEntry, dc *d.Dictionary) error {
+	var c_val string
+	switch row.valueType {
+	case VAL_FIX:
+		c_val = row.value
+	case VAL_PARAM_WITH_DEFAULT:
+		c_val = row.defValue
+	default:
+		return nil
+	}
+	c_num, err := strconv.ParseInt(strings.TrimSpace(c_val), 10, 32)
+	if err != nil {
+		if _, ok := dc.LookUpAvp_EnumValue(row.avp_code, row.vendor_id, c_val); !ok {
+			return fmt.Errorf("'%s' is not a value of %s", c_val, c_entry.GetName())
+		}
+		return nil
+	}
+	if !dc.HasEnum(row.avp_code, row.vendor_id) {
+		return nil
+	}
+	if _, ok := dc.LookUpAvp_Enum(row.avp_code, row.vendor_id, int32(c_num)); !ok {
+		return fmt.Errorf("%d is not a value of %s", c_num, c_entry.GetName())
+	}
+	return nil
+}
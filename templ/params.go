@@ -0,0 +1,207 @@
+package templates
+
+import (
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"sort"
+	"strings"
+)
+
+const (
+	PARAM_LIST   = "list"
+	PARAM_STRING = "string"
+)
+
+// Param describes a parameter of a template. Type is the AVP type of the
+// row using it (Unsigned32, UTF8String, ...), PARAM_LIST for !foreach lists
+// and PARAM_STRING for conditions and values passed to actions.
+type Param struct {
+	Name       string
+	Type       string
+	Default    string
+	HasDefault bool
+	// Required is set if the message cannot be built without the parameter,
+	// parameters of optional rows, conditions and blocks are not required.
+	Required bool
+}
+
+// FillOptions control FillTemplateWith.
+type FillOptions struct {
+	// Strict makes parameters not used by the template an error, a mistyped
+	// name would fall back to the default silently.
+	Strict bool
+	// Conn gives the values of the header fields set to auto, e.g.
+	// session_id:auto. *conn.DiamConn implements it.
+	Conn HeaderSource
+}
+
+// HeaderSource supplies the session id and the configuration of a
+// connection.
+type HeaderSource interface {
+	Gen_Session_Id() string
+	ConfValue(key string) (string, bool)
+}
+
+// Params returns the parameters of the template in the order of their first
+// use.
+func Params(c_template string) ([]Param, error) {
+	c_templ, ok := currentSet().rows[c_template]
+	if !ok {
+		return nil, fmt.Errorf("template %s does not exist", c_template)
+	}
+	return templateParams(c_templ), nil
+}
+
+// paramScope is the context of a row: the arguments of the includes and the
+// loop variables around it.
+type paramScope struct {
+	parent      *paramScope
+	args        map[string]string
+	locals      map[string]bool
+	conditional bool
+}
+
+type paramCollector struct {
+	params []Param
+	index  map[string]int
+}
+
+func templateParams(rows []TemplRow) []Param {
+	c_coll := &paramCollector{index: make(map[string]int)}
+	c_coll.walk(0, rows, &paramScope{})
+	return c_coll.params
+}
+
+// walk visits rows like collectRow does.
+func (c *paramCollector) walk(level int, rows []TemplRow, scope *paramScope) {
+	for j := 0; j < len(rows); j++ {
+		row := rows[j]
+		if row.level != level {
+			continue
+		}
+		if row.kind != ROW_AVP {
+			c_else, c_end := findBlockEnd(rows, j)
+			switch row.kind {
+			case ROW_IF:
+				c.add(scope, Param{Name: row.cond_param, Type: PARAM_STRING})
+				c_inner := &paramScope{parent: scope, conditional: true}
+				if c_else != -1 {
+					c.walk(level, rows[j+1:c_else], c_inner)
+					c.walk(level, rows[c_else+1:c_end], c_inner)
+				} else {
+					c.walk(level, rows[j+1:c_end], c_inner)
+				}
+			case ROW_FOREACH:
+				c.add(scope, Param{Name: row.loop_list, Type: PARAM_LIST})
+				c_inner := &paramScope{parent: scope, conditional: true, locals: map[string]bool{
+					row.loop_var:            true,
+					row.loop_var + "_index": true,
+				}}
+				c.walk(level, rows[j+1:c_end], c_inner)
+			case ROW_SCOPE:
+				c.walk(level, rows[j+1:c_end], &paramScope{parent: scope, args: row.include_args, conditional: scope.conditional})
+			}
+			j = c_end
+			continue
+		}
+		if row.avp_type == d.Avp_Grouped {
+			var s int
+			for s = j + 1; s < len(rows); s++ {
+				if rows[s].level <= level {
+					break
+				}
+			}
+			c.walk(level+1, rows[j+1:s], scope)
+			j = s - 1
+			continue
+		}
+		if c_param, ok := rowParam(row); ok {
+			c_param.Required = c_param.Required && !row.optional && !scope.conditional
+			c.add(scope, c_param)
+		}
+	}
+}
+
+// rowParam returns the parameter a row value refers to.
+func rowParam(row TemplRow) (Param, bool) {
+	ret := Param{Name: row.value, Type: row.type_name}
+	switch row.valueType {
+	case VAL_PARAM:
+		ret.Required = true
+	case VAL_PARAM_WITH_DEFAULT:
+		ret.Default, ret.HasDefault = row.defValue, true
+	case VAL_PARAM_WITH_ACTION:
+		ret.Type = PARAM_STRING
+		ret.Required = true
+	case VAL_PARAM_WITH_DEFAULT_AND_ACTION:
+		ret.Type = PARAM_STRING
+		ret.Default, ret.HasDefault = row.defValue, true
+	default:
+		return ret, false
+	}
+	return ret, true
+}
+
+// add records p after mapping it through the include arguments and loop
+// variables of the scopes.
+func (c *paramCollector) add(scope *paramScope, p Param) {
+	for ; scope != nil; scope = scope.parent {
+		if scope.locals[p.Name] {
+			return
+		}
+		c_arg, ok := scope.args[p.Name]
+		if !ok {
+			continue
+		}
+		c_row := makeTmplRow(0, 0, 0, false, 0, c_arg)
+		c_outer, ok := rowParam(c_row)
+		if !ok {
+			// a fixed value or an action
+			return
+		}
+		// a missing argument leaves the default of the included row
+		if !c_outer.HasDefault {
+			c_outer.Default, c_outer.HasDefault = p.Default, p.HasDefault
+		}
+		c_outer.Required = p.Required && !c_outer.HasDefault
+		if c_outer.Type != PARAM_STRING {
+			c_outer.Type = p.Type
+		}
+		p = c_outer
+	}
+
+	i, ok := c.index[p.Name]
+	if !ok {
+		c.index[p.Name] = len(c.params)
+		c.params = append(c.params, p)
+		return
+	}
+	c_prev := &c.params[i]
+	c_prev.Required = c_prev.Required || p.Required
+	if c_prev.Type == PARAM_STRING && p.Type != PARAM_STRING {
+		c_prev.Type = p.Type
+	}
+	if !c_prev.HasDefault && p.HasDefault {
+		c_prev.Default, c_prev.HasDefault = p.Default, true
+	}
+}
+
+// checkUnknownParams reports the parameters of pars the template does not
+// use.
+func checkUnknownParams(c_template string, rows []TemplRow, pars map[string]string) error {
+	c_known := make(map[string]bool)
+	for _, p := range templateParams(rows) {
+		c_known[p.Name] = true
+	}
+	var c_unknown []string
+	for k := range pars {
+		if !c_known[k] {
+			c_unknown = append(c_unknown, k)
+		}
+	}
+	if len(c_unknown) == 0 {
+		return nil
+	}
+	sort.Strings(c_unknown)
+	return fmt.Errorf("template %s does not use the parameters %s", c_template, strings.Join(c_unknown, ", "))
+}
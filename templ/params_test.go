@@ -0,0 +1,78 @@
+package templates
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var params_templates = map[string]string{
+	"subscription_id.fragment": `0.443.1 Grouped
+    0.450.1 Enumerated '{{type:0}}'
+    0.444.1 UTF8String '{{data}}'
+`,
+	"ccr.template": `!header command_code:272 application_id:4 request:1 proxiable:1
+0.416.1 Enumerated '{{request_type:1}}'
+0.415.1 Unsigned32 '{{number}}'
+?0.1.1 UTF8String '{{user}}'
+10415.873.1 Grouped
+    !include subscription_id data={{msisdn}}
+`,
+}
+
+func TestFillMissingParams(t *testing.T) {
+	loadTemplates(t, params_templates)
+	for _, c := range []struct {
+		name string
+		pars map[string]string
+		// want is the error, "" if the fill succeeds
+		want string
+	}{
+		{"all", map[string]string{"number": "0", "msisdn": "36301234567"}, ""},
+		{"missing", map[string]string{"msisdn": "36301234567"}, "ccr.template:3:1: missing parameter number"},
+		{"missing argument", map[string]string{"number": "0"}, "ccr.template:6:5: missing parameter msisdn (argument data of subscription_id)"},
+		{"invalid", map[string]string{"number": "x", "msisdn": "36301234567"}, "ccr.template:3:1: parameter number:"},
+		{"invalid enum", map[string]string{"number": "0", "msisdn": "1", "request_type": "FIRST"}, "ccr.template:2:1: parameter request_type:"},
+	} {
+		for _, c_strict := range []bool{false, true} {
+			_, err := FillTemplateWith("ccr", c.pars, FillOptions{Strict: c_strict})
+			switch {
+			case c.want == "" && err != nil:
+				t.Errorf("%s, strict %v: %v", c.name, c_strict, err)
+			case c.want != "" && (err == nil || !strings.HasPrefix(err.Error(), c.want)):
+				t.Errorf("%s, strict %v: %v, want %s", c.name, c_strict, err, c.want)
+			}
+		}
+	}
+
+	// only strict mode checks for parameters the template does not use
+	c_pars := map[string]string{"number": "0", "msisdn": "36301234567", "msidsn": "1"}
+	if _, err := FillTemplate("ccr", c_pars); err != nil {
+		t.Error(err)
+	}
+	if _, err := FillTemplateWith("ccr", c_pars, FillOptions{Strict: true}); err == nil || !strings.Contains(err.Error(), "msidsn") {
+		t.Errorf("strict with an unknown parameter: %v", err)
+	}
+}
+
+func TestParams(t *testing.T) {
+	loadTemplates(t, params_templates)
+	got, err := Params("ccr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Param{
+		{Name: "request_type", Type: "Enumerated", Default: "1", HasDefault: true},
+		{Name: "number", Type: "Unsigned32", Required: true},
+		{Name: "user", Type: "UTF8String"},
+		// not set by the !include, it comes from the parameters too
+		{Name: "type", Type: "Enumerated", Default: "0", HasDefault: true},
+		{Name: "msisdn", Type: "UTF8String", Required: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%+v, want %+v", got, want)
+	}
+	if _, err := Params("nothing"); err == nil {
+		t.Error("parameters of a missing template")
+	}
+}
@@ -0,0 +1,153 @@
+package templates
+
+import (
+	"encoding/hex"
+	"fmt"
+	d "github.com/lehotomi/diam/diam"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	const_comment_col = 60
+)
+
+// ToTemplate writes msg in the .template format, the AVP names of the
+// dictionary set by SetDictionary are added as comments. Filling the result
+// without parameters gives back the same AVPs.
+func ToTemplate(msg d.Message) string {
+	return ToTemplateDict(msg, dictionary())
+}
+
+// ToTemplateDict is ToTemplate with the names taken from dc.
+func ToTemplateDict(msg d.Message, dc *d.Dictionary) string {
+	var res []string
+
+	c_flags := msg.GetCmdFlags()
+	c_header := fmt.Sprintf("!header command_code:%d application_id:%d request:%d proxiable:%d",
+		msg.GetCmdCode(), msg.GetAppId(), (c_flags>>7)&1, (c_flags>>6)&1)
+	if c_name, ok := dc.LookUpAvp_command(msg.GetCmdCode()); ok {
+		c_header = withComment(c_header, c_name)
+	}
+	res = append(res, c_header, "")
+	res = append(res, avpsToTemplate(dc, msg.GetAVPs(), 0)...)
+	return strings.Join(res, "\n") + "\n"
+}
+
+func avpsToTemplate(dc *d.Dictionary, avps []d.AVP, level int) []string {
+	var ret []string
+	c_pref := strings.Repeat(" ", 4*level)
+
+	for _, v := range avps {
+		c_entry := dc.LookUpAvp(v.GetAVPCode(), v.GetVendorId())
+		c_mflag := 0
+		if v.IsMandatory() {
+			c_mflag = 1
+		}
+		c_row := fmt.Sprintf("%s%d.%d.%d ", c_pref, v.GetVendorId(), v.GetAVPCode(), c_mflag)
+
+		c_comment := c_entry.GetName()
+		if c_entry.GetType() == d.Avp_code_unknown {
+			c_comment = "not in the dictionary"
+		}
+
+		if v.IsGrouped() {
+			ret = append(ret, withComment(c_row+"Grouped", c_comment))
+			ret = append(ret, avpsToTemplate(dc, v.GetGroupAVPs(), level+1)...)
+			continue
+		}
+
+		c_type, c_val, c_note := avpToTemplateValue(dc, c_entry, v)
+		if c_note != "" {
+			c_comment += ", " + c_note
+		}
+		ret = append(ret, withComment(c_row+c_type+" '"+c_val+"'", c_comment))
+	}
+	return ret
+}
+
+// avpToTemplateValue returns the template type and value of a not grouped
+// AVP, and an optional note for the comment.
+func avpToTemplateValue(dc *d.Dictionary, c_entry d.AVPDictEntry, avp d.AVP) (string, string, string) {
+	switch c_val := avp.GetValue().(type) {
+	case int32:
+		if avp.GetFormat() == d.Avp_Enumerated {
+			c_name, _ := dc.LookUpAvp_Enum(avp.GetAVPCode(), avp.GetVendorId(), c_val)
+			return "Enumerated", strconv.FormatInt(int64(c_val), 10), c_name
+		}
+		return "Integer32", strconv.FormatInt(int64(c_val), 10), ""
+	case int64:
+		return "Integer64", strconv.FormatInt(c_val, 10), ""
+	case uint32:
+		return "Unsigned32", strconv.FormatUint(uint64(c_val), 10), ""
+	case uint64:
+		return "Unsigned64", strconv.FormatUint(c_val, 10), ""
+	case float32:
+		return "Float32", strconv.FormatFloat(float64(c_val), 'g', -1, 32), ""
+	case float64:
+		return "Float64", strconv.FormatFloat(c_val, 'g', -1, 64), ""
+	case string:
+		if !representable(c_val) {
+			return "OctetString", hex.EncodeToString([]byte(c_val)), "UTF8String written as hex"
+		}
+		return "UTF8String", c_val, ""
+	case time.Time:
+		return "Time", c_val.Format(const_date_format), ""
+	case d.Address:
+		if c_val.GetFamily() == d.ENUM_ADDR_FAMILY && len(c_val.GetAddr()) == 4 {
+			return "Address", net.IP(c_val.GetAddr()).String(), ""
+		}
+		c_raw := append(uint16ToBytes(c_val.GetFamily()), c_val.GetAddr()...)
+		return "OctetString", hex.EncodeToString(c_raw), "Address written as hex"
+	case []byte:
+		if c_entry.GetTypeName() == "IPAddress" && len(c_val) == 4 {
+			return "IPAddress", net.IP(c_val).String(), ""
+		}
+		if len(c_val) > 0 && isPrintable(c_val) && representable(string(c_val)) {
+			return "OctetString:ascii", string(c_val), ""
+		}
+		return "OctetString", hex.EncodeToString(c_val), ""
+	}
+	return "OctetString", "", fmt.Sprintf("unsupported value %T", avp.GetValue())
+}
+
+// representable tells if the string can be written between quotes in a
+// template row.
+func representable(in string) bool {
+	if !utf8.ValidString(in) || strings.Contains(in, "{{") {
+		return false
+	}
+	for _, c := range in {
+		if c < 0x20 || c == 0x7f || c == '\'' {
+			return false
+		}
+	}
+	return true
+}
+
+func isPrintable(in []byte) bool {
+	for _, c := range in {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func uint16ToBytes(in uint16) []byte {
+	return []byte{byte(in >> 8), byte(in)}
+}
+
+func withComment(row string, comment string) string {
+	if comment == "" {
+		return row
+	}
+	c_pad := const_comment_col - len(row)
+	if c_pad < 1 {
+		c_pad = 1
+	}
+	return row + strings.Repeat(" ", c_pad) + "#" + comment
+}
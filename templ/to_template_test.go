@@ -0,0 +1,41 @@
+package templates
+
+import (
+	"bytes"
+	d "github.com/lehotomi/diam/diam"
+	"testing"
+	"time"
+)
+
+// TestToTemplate fills the template written from a message, the result
+// must encode to the same bytes.
+func TestToTemplate(t *testing.T) {
+	c_msg := d.GenMess(d.CC_CREDIT_CONTROL, true, true, d.APPID_CC, 0, 0, []d.AVP{
+		d.AVP_UTF8String(d.AVP_CODE_Session_Id, "client.test;1;2", d.MAND, 0),
+		d.AVP_Enumerated(d.AVP_CODE_CC_Request_Type, 1, d.MAND, 0),
+		d.AVP_Unsigned32(d.AVP_CODE_CC_Request_Number, 7, d.MAND, 0),
+		d.AVP_Time(d.AVP_CODE_Event_Timestamp, time.Date(2021, 11, 13, 15, 4, 5, 0, time.UTC), d.MAND, 0),
+		d.AVP_Group(d.AVP_CODE_Subscription_Id, []d.AVP{
+			d.AVP_Enumerated(d.AVP_CODE_Subscription_Id_Type, 1, d.MAND, 0),
+			d.AVP_UTF8String(d.AVP_CODE_Subscription_Id_Data, "216701234567", d.MAND, 0),
+		}, d.MAND, 0),
+		// a quote cannot be written in a row, it goes as hex
+		d.AVP_UTF8String(d.AVP_CODE_User_Name, "o'brien", d.MAND, 0),
+		d.AVP_OctetString(99999, []byte{0x82, 0x12, 0xf6, 0x10}, false, 0),
+		d.AVP_OctetString(99998, []byte("ascii"), false, 10415),
+	})
+	c_encoded := c_msg.Encode()
+	c_decoded, err := d.DecodeMessage(c_encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadTemplates(t, map[string]string{"decoded.template": ToTemplate(c_decoded)})
+	c_filled, err := FillTemplate("decoded", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c_filled.Encode(); !bytes.Equal(got, c_encoded) {
+		t.Errorf("filled template\n%x, want\n%x\ntemplate:\n%s", got, c_encoded, ToTemplate(c_decoded))
+	}
+}